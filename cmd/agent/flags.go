@@ -3,8 +3,13 @@ package main
 import (
 	"errors"
 	"flag"
-	"log"
+	"fmt"
 	"logger/conf"
+	"logger/internal/compress"
+	"logger/internal/keyring"
+	"logger/internal/logging"
+	"logger/internal/tracing"
+	"logger/internal/wire"
 	"net"
 	"net/url"
 	"os"
@@ -29,7 +34,34 @@ func initConfig(conf *conf.AgentConfig) error {
 		AddressFlag        string
 		LogFileFlag        string
 		key                string
+		keys               string
+		token              string
+		CompressionFlag    = compress.Gzip
+		WireFormatFlag     = "json"
+		TLSFlag            bool
+		TLSCAFlag          string
+		TLSCertFlag        string
+		TLSKeyFlag         string
 		RateLimitFlag      string
+		// Значения по умолчанию заданы и здесь, так как в режиме тестирования флаги не парсятся
+		BreakerFailuresFlag    = "5"
+		BreakerTimeoutFlag     = "30"
+		BreakerHalfOpenFlag    = "1"
+		CollectorsDisableFlag  string
+		CollectorsIntervalFlag string
+		CollectorsTimeoutFlag  string
+		ProcessListFlag        string
+		StatsdAddressFlag      string
+		StatsdPercentilesFlag  string
+		PushAddressFlag        string
+		SelfMetricsHTTPFlag    bool
+		LogLevelFlag           = "info"
+		LogFormatFlag          = "console"
+		LogMaxSizeFlag         = strconv.Itoa(logging.DefaultMaxSizeMB)
+		LogMaxAgeFlag          = strconv.Itoa(logging.DefaultMaxAgeDays)
+		LogMaxBackupsFlag      = strconv.Itoa(logging.DefaultMaxBackups)
+		TraceExporterFlag      = tracing.ExporterNone
+		TraceEndpointFlag      string
 	)
 
 	// Парсинг параметров командной строки
@@ -41,50 +73,85 @@ func initConfig(conf *conf.AgentConfig) error {
 		// Для логирования агента в лог файл необходимо определить флаг -l
 		flag.StringVar(&LogFileFlag, "f", "", "agent log file")
 		flag.StringVar(&key, "k", "", "key")
+		flag.StringVar(&keys, "keys", "", "Signing key ring id:secret[@RFC3339],... from newest to oldest. Newest key signs requests, all keys are accepted.")
 		//flag.StringVar(&key, "k", "superkey", "key")
+		flag.StringVar(&token, "token", "", "Bearer token with writer role for server requests.")
+		flag.StringVar(&CompressionFlag, "compression", CompressionFlag, "Request body codec: gzip, zstd, deflate, identity or compress for servers of previous versions.")
+		flag.StringVar(&WireFormatFlag, "wire-format", WireFormatFlag, "Batch encoding: json, protobuf or msgpack.")
+		flag.BoolVar(&TLSFlag, "tls", false, "Send metrics over https. Enabled also by https:// address or -tls-ca.")
+		flag.StringVar(&TLSCAFlag, "tls-ca", "", "CA bundle to verify server certificate. Default is system CAs.")
+		flag.StringVar(&TLSCertFlag, "tls-cert", "", "Client certificate file for mutual TLS.")
+		flag.StringVar(&TLSKeyFlag, "tls-key", "", "Client certificate key file for mutual TLS.")
 		flag.StringVar(&RateLimitFlag, "l", "10", "Rate limit for agent connections to server.")
 		flag.BoolVar(&conf.PProfHTTPEnabled, "t", false, "Flag for enabling pprof web server. Default false.")
+		flag.StringVar(&BreakerFailuresFlag, "breaker-failures", BreakerFailuresFlag, "Number of consecutive retriable errors to open circuit breaker.")
+		flag.StringVar(&BreakerTimeoutFlag, "breaker-timeout", BreakerTimeoutFlag, "Seconds to wait in open state before probing the server.")
+		flag.StringVar(&BreakerHalfOpenFlag, "breaker-halfopen", BreakerHalfOpenFlag, "Number of successful probe requests to close circuit breaker.")
+
+		flag.StringVar(&CollectorsDisableFlag, "collectors-disable", "", "Comma separated list of disabled collectors, e.g. gops,breaker.")
+		flag.StringVar(&CollectorsIntervalFlag, "collectors-interval", "", "Per collector poll interval in seconds, e.g. gops=5,runtime=2. Default is poll interval.")
+		flag.StringVar(&CollectorsTimeoutFlag, "collectors-timeout", "", "Per collector timeout in seconds, e.g. gops=1. Default is collector interval.")
+
+		flag.StringVar(&ProcessListFlag, "processes", "", "Comma separated list of process names for process collector, e.g. postgres,nginx.")
+		flag.StringVar(&StatsdAddressFlag, "statsd", "", "UDP address for StatsD listener, e.g. 127.0.0.1:8125. Disabled by default.")
+		flag.StringVar(&StatsdPercentilesFlag, "statsd-percentiles", "50,90,99", "Comma separated list of StatsD timer percentiles.")
+		flag.StringVar(&PushAddressFlag, "push", "", "Address of local push API for applications: host:port or unix:/path/to/socket. Disabled by default.")
+
+		flag.StringVar(&LogLevelFlag, "log-level", LogLevelFlag, "Log level: debug, info, warn, error.")
+		flag.StringVar(&LogFormatFlag, "log-format", LogFormatFlag, "Log format: json or console.")
+		flag.StringVar(&LogMaxSizeFlag, "log-max-size", LogMaxSizeFlag, "Log file size in megabytes before rotation.")
+		flag.StringVar(&LogMaxAgeFlag, "log-max-age", LogMaxAgeFlag, "Days to keep rotated log files. 0 -- keep forever.")
+		flag.StringVar(&LogMaxBackupsFlag, "log-max-backups", LogMaxBackupsFlag, "Number of rotated log files to keep. 0 -- keep all.")
+		flag.BoolVar(&SelfMetricsHTTPFlag, "self-metrics-http", false, "Serve agent self metrics on pprof web server (-t). Default false.")
+		flag.StringVar(&TraceExporterFlag, "trace-exporter", TraceExporterFlag, "OpenTelemetry span exporter: none, stdout or otlp.")
+		flag.StringVar(&TraceEndpointFlag, "trace-endpoint", "", "OTLP/HTTP collector URL, e.g. http://localhost:4318. Default is OTLP default endpoint.")
 
 		flag.Parse()
 	}
 	// address processing
 	if envAddressFlag := os.Getenv("ADDRESS"); envAddressFlag != "" {
-		log.Println("env var ADDRESS was specified, use ADDRESS =", envAddressFlag)
+		logging.L().Infow("env var specified", "name", "ADDRESS", "value", envAddressFlag)
 		AddressFlag = envAddressFlag
 	}
+	// Адрес может быть задан со схемой: https:// включает TLS
+	if rest, ok := strings.CutPrefix(AddressFlag, "https://"); ok {
+		AddressFlag, TLSFlag = rest, true
+	} else {
+		AddressFlag = strings.TrimPrefix(AddressFlag, "http://")
+	}
 
 	// Проверка на то, что заданный адрес является валидным IP или URI
 	if IsValidIP(strings.Split(AddressFlag, ":")[0]) {
-		log.Println("AddressFlag is IP address, Using IP:", AddressFlag)
+		logging.L().Debugw("address is IP address", "address", AddressFlag)
 	} else if _, err := url.ParseRequestURI(AddressFlag); err != nil {
-		log.Println("initConfig: Error parsing AddressFlag: ", AddressFlag)
+		logging.L().Errorw("initConfig: parse failed", "flag", "AddressFlag", "value", AddressFlag)
 		return err
 	}
 	conf.Address = AddressFlag
 
 	// reportInterval processing
 	if envReportInterval := os.Getenv("REPORT_INTERVAL"); envReportInterval != "" {
-		log.Println("env var REPORT_INTERVAL was specified, use REPORT_INTERVAL =", envReportInterval)
+		logging.L().Infow("env var specified", "name", "REPORT_INTERVAL", "value", envReportInterval)
 		ReportIntervalFlag = envReportInterval
 	}
 
 	if c, err := strconv.Atoi(ReportIntervalFlag); err == nil {
 		conf.ReportInterval = c
 	} else {
-		log.Println("initConfig: Error parsing ReportIntervalFlag: ", ReportIntervalFlag)
+		logging.L().Errorw("initConfig: parse failed", "flag", "ReportIntervalFlag", "value", ReportIntervalFlag)
 		return err
 	}
 
 	// PollInterval processing
 	if envPollInterval := os.Getenv("POLL_INTERVAL"); envPollInterval != "" {
-		log.Println("env var POLL_INTERVAL was specified, use POLL_INTERVAL =", envPollInterval)
+		logging.L().Infow("env var specified", "name", "POLL_INTERVAL", "value", envPollInterval)
 		PollIntervalFlag = envPollInterval
 	}
 
 	if c, err := strconv.Atoi(PollIntervalFlag); err == nil {
 		conf.PollInterval = c
 	} else {
-		log.Println("initConfig: Error parsing PollIntervalFlag: ", PollIntervalFlag)
+		logging.L().Errorw("initConfig: parse failed", "flag", "PollIntervalFlag", "value", PollIntervalFlag)
 		return err
 	}
 
@@ -97,28 +164,292 @@ func initConfig(conf *conf.AgentConfig) error {
 	// Для логирования агента в лог файл необходимо определить переменную окружения AGENT_LOG
 	// Настройка переменных окружения имеют приоритет перед параметрами командной строки
 	if envLogFileFlag := os.Getenv("AGENT_LOG"); envLogFileFlag != "" {
-		log.Println("env var AGENT_LOG was specified, use AGENT_LOG =", envLogFileFlag)
+		logging.L().Infow("env var specified", "name", "AGENT_LOG", "value", envLogFileFlag)
 		LogFileFlag = envLogFileFlag
 	}
 	conf.Logfile = LogFileFlag
 
+	if envLogLevel := os.Getenv("LOG_LEVEL"); envLogLevel != "" {
+		logging.L().Infow("env var specified", "name", "LOG_LEVEL", "value", envLogLevel)
+		LogLevelFlag = envLogLevel
+	}
+	conf.LogLevel = LogLevelFlag
+
+	if envLogFormat := os.Getenv("LOG_FORMAT"); envLogFormat != "" {
+		logging.L().Infow("env var specified", "name", "LOG_FORMAT", "value", envLogFormat)
+		LogFormatFlag = envLogFormat
+	}
+	conf.LogFormat = LogFormatFlag
+
+	if envLogMaxSize := os.Getenv("LOG_MAX_SIZE"); envLogMaxSize != "" {
+		logging.L().Infow("env var specified", "name", "LOG_MAX_SIZE", "value", envLogMaxSize)
+		LogMaxSizeFlag = envLogMaxSize
+	}
+	if c, err := strconv.Atoi(LogMaxSizeFlag); err == nil && c > 0 {
+		conf.LogMaxSize = c
+	} else {
+		return fmt.Errorf("initConfig: LOG_MAX_SIZE must be a positive integer, got %q", LogMaxSizeFlag)
+	}
+
+	if envLogMaxAge := os.Getenv("LOG_MAX_AGE"); envLogMaxAge != "" {
+		logging.L().Infow("env var specified", "name", "LOG_MAX_AGE", "value", envLogMaxAge)
+		LogMaxAgeFlag = envLogMaxAge
+	}
+	if c, err := strconv.Atoi(LogMaxAgeFlag); err == nil && c >= 0 {
+		conf.LogMaxAge = c
+	} else {
+		return fmt.Errorf("initConfig: LOG_MAX_AGE must be a non-negative integer, got %q", LogMaxAgeFlag)
+	}
+
+	if envLogMaxBackups := os.Getenv("LOG_MAX_BACKUPS"); envLogMaxBackups != "" {
+		logging.L().Infow("env var specified", "name", "LOG_MAX_BACKUPS", "value", envLogMaxBackups)
+		LogMaxBackupsFlag = envLogMaxBackups
+	}
+	if c, err := strconv.Atoi(LogMaxBackupsFlag); err == nil && c >= 0 {
+		conf.LogMaxBackups = c
+	} else {
+		return fmt.Errorf("initConfig: LOG_MAX_BACKUPS must be a non-negative integer, got %q", LogMaxBackupsFlag)
+	}
+
+	// Значение ключа в лог не пишется
 	if envKey := os.Getenv("KEY"); envKey != "" {
-		log.Println("KEY env var specified")
+		logging.L().Infow("env var specified", "name", "KEY")
 		key = envKey
 	}
 	conf.Key = key
 
+	// Значения ключей в лог не пишутся
+	if envKeys := os.Getenv("KEYS"); envKeys != "" {
+		logging.L().Infow("env var specified", "name", "KEYS")
+		keys = envKeys
+	}
+	conf.Keys = keys
+	ring, err := keyring.New(conf.Key, conf.Keys)
+	if err != nil {
+		return fmt.Errorf("initConfig: %w", err)
+	}
+	conf.KeyRing = ring
+
+	// Значение токена в лог не пишется
+	if envToken := os.Getenv("TOKEN"); envToken != "" {
+		logging.L().Infow("env var specified", "name", "TOKEN")
+		token = envToken
+	}
+	conf.Token = token
+
+	if envCompression := os.Getenv("COMPRESSION"); envCompression != "" {
+		logging.L().Infow("env var specified", "name", "COMPRESSION", "value", envCompression)
+		CompressionFlag = envCompression
+	}
+	if _, err := compress.Normalize(CompressionFlag); err != nil {
+		return fmt.Errorf("initConfig: COMPRESSION: %w", err)
+	}
+	conf.Compression = strings.ToLower(strings.TrimSpace(CompressionFlag))
+
+	if envWireFormat := os.Getenv("WIRE_FORMAT"); envWireFormat != "" {
+		logging.L().Infow("env var specified", "name", "WIRE_FORMAT", "value", envWireFormat)
+		WireFormatFlag = envWireFormat
+	}
+	format, err := wire.ByName(WireFormatFlag)
+	if err != nil {
+		return fmt.Errorf("initConfig: WIRE_FORMAT: %w", err)
+	}
+	conf.WireFormat = format
+
+	if envTLS := os.Getenv("TLS"); envTLS != "" {
+		logging.L().Infow("env var specified", "name", "TLS", "value", envTLS)
+		tmp, err := strconv.ParseBool(envTLS)
+		if err != nil {
+			return fmt.Errorf("initConfig: invalid TLS variable %q", envTLS)
+		}
+		TLSFlag = TLSFlag || tmp
+	}
+	if envTLSCA := os.Getenv("TLS_CA"); envTLSCA != "" {
+		logging.L().Infow("env var specified", "name", "TLS_CA", "value", envTLSCA)
+		TLSCAFlag = envTLSCA
+	}
+	if envTLSCert := os.Getenv("TLS_CERT"); envTLSCert != "" {
+		logging.L().Infow("env var specified", "name", "TLS_CERT", "value", envTLSCert)
+		TLSCertFlag = envTLSCert
+	}
+	if envTLSKey := os.Getenv("TLS_KEY"); envTLSKey != "" {
+		logging.L().Infow("env var specified", "name", "TLS_KEY", "value", envTLSKey)
+		TLSKeyFlag = envTLSKey
+	}
+	if (TLSCertFlag == "") != (TLSKeyFlag == "") {
+		return errors.New("initConfig: both TLS_CERT and TLS_KEY must be set")
+	}
+	// CA bundle и клиентский сертификат имеют смысл только для https
+	conf.TLS = TLSFlag || TLSCAFlag != "" || TLSCertFlag != ""
+	conf.TLSCAFile, conf.TLSCertFile, conf.TLSKeyFile = TLSCAFlag, TLSCertFlag, TLSKeyFlag
+
 	if envRateLimit := os.Getenv("RATE_LIMIT"); envRateLimit != "" {
-		log.Println("RATE_LIMIT env var specified, ", envRateLimit)
+		logging.L().Infow("env var specified", "name", "RATE_LIMIT", "value", envRateLimit)
 		RateLimitFlag = envRateLimit
 	}
 	if c, err := strconv.Atoi(RateLimitFlag); err == nil {
 		conf.RateLimit = c
 	} else {
-		log.Println("initConfig: Error parsing RateLimitFlag: ", RateLimitFlag)
+		logging.L().Errorw("initConfig: parse failed", "flag", "RateLimitFlag", "value", RateLimitFlag)
+		return err
+	}
+
+	// Circuit breaker processing
+	if envBreakerFailureThreshold := os.Getenv("BREAKER_FAILURE_THRESHOLD"); envBreakerFailureThreshold != "" {
+		logging.L().Infow("env var specified", "name", "BREAKER_FAILURE_THRESHOLD", "value", envBreakerFailureThreshold)
+		BreakerFailuresFlag = envBreakerFailureThreshold
+	}
+	if c, err := strconv.Atoi(BreakerFailuresFlag); err == nil && c > 0 {
+		conf.BreakerFailureThreshold = c
+	} else {
+		logging.L().Errorw("initConfig: parse failed", "flag", "BreakerFailuresFlag", "value", BreakerFailuresFlag)
+		return fmt.Errorf("initConfig: BREAKER_FAILURE_THRESHOLD must be a positive integer, got %q", BreakerFailuresFlag)
+	}
+
+	if envBreakerOpenTimeout := os.Getenv("BREAKER_OPEN_TIMEOUT"); envBreakerOpenTimeout != "" {
+		logging.L().Infow("env var specified", "name", "BREAKER_OPEN_TIMEOUT", "value", envBreakerOpenTimeout)
+		BreakerTimeoutFlag = envBreakerOpenTimeout
+	}
+	if c, err := strconv.Atoi(BreakerTimeoutFlag); err == nil && c > 0 {
+		conf.BreakerOpenTimeout = c
+	} else {
+		logging.L().Errorw("initConfig: parse failed", "flag", "BreakerTimeoutFlag", "value", BreakerTimeoutFlag)
+		return fmt.Errorf("initConfig: BREAKER_OPEN_TIMEOUT must be a positive integer, got %q", BreakerTimeoutFlag)
+	}
+
+	if envBreakerHalfOpenMaxCalls := os.Getenv("BREAKER_HALF_OPEN_MAX_CALLS"); envBreakerHalfOpenMaxCalls != "" {
+		logging.L().Infow("env var specified", "name", "BREAKER_HALF_OPEN_MAX_CALLS", "value", envBreakerHalfOpenMaxCalls)
+		BreakerHalfOpenFlag = envBreakerHalfOpenMaxCalls
+	}
+	if c, err := strconv.Atoi(BreakerHalfOpenFlag); err == nil && c > 0 {
+		conf.BreakerHalfOpenMaxCalls = c
+	} else {
+		logging.L().Errorw("initConfig: parse failed", "flag", "BreakerHalfOpenFlag", "value", BreakerHalfOpenFlag)
+		return fmt.Errorf("initConfig: BREAKER_HALF_OPEN_MAX_CALLS must be a positive integer, got %q", BreakerHalfOpenFlag)
+	}
+
+	// Collectors processing
+	if envCollectorsDisable := os.Getenv("COLLECTORS_DISABLE"); envCollectorsDisable != "" {
+		logging.L().Infow("env var specified", "name", "COLLECTORS_DISABLE", "value", envCollectorsDisable)
+		CollectorsDisableFlag = envCollectorsDisable
+	}
+	conf.CollectorsDisabled = splitList(CollectorsDisableFlag)
+
+	if envCollectorsInterval := os.Getenv("COLLECTORS_INTERVAL"); envCollectorsInterval != "" {
+		logging.L().Infow("env var specified", "name", "COLLECTORS_INTERVAL", "value", envCollectorsInterval)
+		CollectorsIntervalFlag = envCollectorsInterval
+	}
+	intervals, err := parseCollectorSettings(CollectorsIntervalFlag)
+	if err != nil {
+		logging.L().Errorw("initConfig: parse failed", "flag", "CollectorsIntervalFlag", "value", CollectorsIntervalFlag)
+		return err
+	}
+	conf.CollectorIntervals = intervals
+
+	if envCollectorsTimeout := os.Getenv("COLLECTORS_TIMEOUT"); envCollectorsTimeout != "" {
+		logging.L().Infow("env var specified", "name", "COLLECTORS_TIMEOUT", "value", envCollectorsTimeout)
+		CollectorsTimeoutFlag = envCollectorsTimeout
+	}
+	timeouts, err := parseCollectorSettings(CollectorsTimeoutFlag)
+	if err != nil {
+		logging.L().Errorw("initConfig: parse failed", "flag", "CollectorsTimeoutFlag", "value", CollectorsTimeoutFlag)
 		return err
 	}
+	conf.CollectorTimeouts = timeouts
+
+	if envProcessList := os.Getenv("PROCESSES"); envProcessList != "" {
+		logging.L().Infow("env var specified", "name", "PROCESSES", "value", envProcessList)
+		ProcessListFlag = envProcessList
+	}
+	conf.ProcessList = splitList(ProcessListFlag)
+
+	// StatsD processing
+	if envStatsdAddress := os.Getenv("STATSD_ADDRESS"); envStatsdAddress != "" {
+		logging.L().Infow("env var specified", "name", "STATSD_ADDRESS", "value", envStatsdAddress)
+		StatsdAddressFlag = envStatsdAddress
+	}
+	conf.StatsdAddress = StatsdAddressFlag
+
+	if envStatsdPercentiles := os.Getenv("STATSD_PERCENTILES"); envStatsdPercentiles != "" {
+		logging.L().Infow("env var specified", "name", "STATSD_PERCENTILES", "value", envStatsdPercentiles)
+		StatsdPercentilesFlag = envStatsdPercentiles
+	}
+	conf.StatsdPercentiles = nil
+	for _, item := range splitList(StatsdPercentilesFlag) {
+		p, err := strconv.ParseFloat(item, 64)
+		if err != nil || p <= 0 || p > 100 {
+			logging.L().Errorw("initConfig: parse failed", "flag", "StatsdPercentilesFlag", "value", StatsdPercentilesFlag)
+			return fmt.Errorf("initConfig: STATSD_PERCENTILES must contain numbers in (0, 100], got %q", item)
+		}
+		conf.StatsdPercentiles = append(conf.StatsdPercentiles, p)
+	}
+
+	// Push API processing
+	if envPushAddress := os.Getenv("PUSH_ADDRESS"); envPushAddress != "" {
+		logging.L().Infow("env var specified", "name", "PUSH_ADDRESS", "value", envPushAddress)
+		PushAddressFlag = envPushAddress
+	}
+	conf.PushAddress = PushAddressFlag
+
+	// Self metrics processing
+	if envSelfMetricsHTTP := os.Getenv("SELF_METRICS_HTTP"); envSelfMetricsHTTP != "" {
+		logging.L().Infow("env var specified", "name", "SELF_METRICS_HTTP", "value", envSelfMetricsHTTP)
+		b, err := strconv.ParseBool(envSelfMetricsHTTP)
+		if err != nil {
+			logging.L().Errorw("initConfig: parse failed", "flag", "SELF_METRICS_HTTP", "value", envSelfMetricsHTTP)
+			return fmt.Errorf("initConfig: SELF_METRICS_HTTP must be a boolean, got %q", envSelfMetricsHTTP)
+		}
+		SelfMetricsHTTPFlag = b
+	}
+	conf.SelfMetricsHTTP = SelfMetricsHTTPFlag
+	if conf.SelfMetricsHTTP && !conf.PProfHTTPEnabled {
+		logging.L().Warnw("initConfig: self metrics HTTP requires pprof web server (-t), self metrics are not served")
+	}
+
+	// Tracing processing
+	if envTraceExporter := os.Getenv("TRACE_EXPORTER"); envTraceExporter != "" {
+		logging.L().Infow("env var specified", "name", "TRACE_EXPORTER", "value", envTraceExporter)
+		TraceExporterFlag = envTraceExporter
+	}
+	conf.TraceExporter = TraceExporterFlag
+
+	if envTraceEndpoint := os.Getenv("TRACE_ENDPOINT"); envTraceEndpoint != "" {
+		logging.L().Infow("env var specified", "name", "TRACE_ENDPOINT", "value", envTraceEndpoint)
+		TraceEndpointFlag = envTraceEndpoint
+	}
+	conf.TraceEndpoint = TraceEndpointFlag
 
-	log.Printf("Address is %s, PollInterval is %d, ReportInterval is %d, LogFile is %s, RateLimit id %d \n", conf.Address, conf.PollInterval, conf.ReportInterval, conf.Logfile, conf.RateLimit)
 	return nil
 }
+
+// splitList разбор списка вида "a,b,c" с пропуском пустых элементов
+func splitList(s string) []string {
+	var res []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			res = append(res, item)
+		}
+	}
+	return res
+}
+
+// parseCollectorSettings разбор параметров коллекторов вида "name=seconds,name=seconds"
+func parseCollectorSettings(s string) (map[string]int, error) {
+	res := make(map[string]int)
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(item, "=")
+		if !ok || strings.TrimSpace(name) == "" {
+			return nil, fmt.Errorf("collector setting %q must be in form name=seconds", item)
+		}
+		c, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil || c <= 0 {
+			return nil, fmt.Errorf("collector setting %q: seconds must be a positive integer", item)
+		}
+		res[strings.TrimSpace(name)] = c
+	}
+	return res, nil
+}
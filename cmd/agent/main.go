@@ -4,14 +4,21 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"log"
 	"logger/conf"
 	"logger/internal"
+	"logger/internal/apperr"
+	"logger/internal/breaker"
+	"logger/internal/collector"
+	"logger/internal/logging"
+	"logger/internal/pushapi"
+	"logger/internal/selfmetrics"
+	"logger/internal/statsd"
+	"logger/internal/tracing"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
 	"os/signal"
-	"strings"
+	"slices"
 	"sync"
 	"syscall"
 	"time"
@@ -21,94 +28,125 @@ import (
 var FlagTest = false
 
 const (
-	clientDoErrors int = 3       // Максимально допустимое количество ошибок подключения к серверу client.Do error
-	addr               = ":6060" // For pprof HTTP server
+	addr                = ":6060"  // For pprof HTTP server
+	statsdCollectorName = "statsd" // Имя коллектора метрик StatsD
 )
 
 var srv *http.Server
 
-// metricsPolling функция сбора метрик
-func metricsPolling(ctx context.Context, m *sync.RWMutex, myMetrics *internal.MetricsStorage, config *conf.AgentConfig) error {
-	log.Println("start metricsPolling goroutine")
-	counter := 1
-	for {
-		select {
-		case <-ctx.Done():
-			log.Println("STOP metricsPolling goroutine")
-			return nil
-		default:
-			if counter == config.PollInterval {
-				//log.Println("metricsPolling goroutine polling")
-				m.Lock()
-				if err := internal.MetricsPolling(myMetrics); err != nil {
-					log.Println("error in metricsPolling :", err)
-					return err
-				}
-				m.Unlock()
-				counter = 0
-			}
-			time.Sleep(1 * time.Second)
-			counter++
+// shutdown выгрузка span-ов трассировки при остановке агента
+var shutdown = func(context.Context) error { return nil }
+
+// collectorsInit регистрация коллекторов метрик агента согласно конфигурации.
+// Коллекторы пишут метрики в myMetrics под блокировкой m. extra -- коллекторы, создаваемые в run, например statsd
+func collectorsInit(m *sync.RWMutex, myMetrics *internal.MetricsStorage, config *conf.AgentConfig, extra ...collector.Collector) (*collector.Registry, error) {
+	registry := collector.NewRegistry(myMetrics, m)
+	registry.Observe(internal.ObserveCollector)
+	for _, c := range append(internal.DefaultCollectors(config), extra...) {
+		if err := registry.Register(c, collectorOptions(c.Name(), config)); err != nil {
+			return nil, err
+		}
+	}
+	// Предупреждение о настройках для незарегистрированных коллекторов, скорее всего это опечатка
+	names := registry.Names()
+	for _, name := range config.CollectorsDisabled {
+		if !slices.Contains(names, name) {
+			logging.L().Warnw("collectorsInit: unknown collector in disabled list", "collector", name)
+		}
+	}
+	for name := range config.CollectorIntervals {
+		if !slices.Contains(names, name) {
+			logging.L().Warnw("collectorsInit: unknown collector in intervals", "collector", name)
+		}
+	}
+	for name := range config.CollectorTimeouts {
+		if !slices.Contains(names, name) {
+			logging.L().Warnw("collectorsInit: unknown collector in timeouts", "collector", name)
 		}
 	}
+	return registry, nil
 }
 
-// gopsMetricsPolling функция сбора метрик, собранных через gopsutil
-func gopsMetricsPolling(ctx context.Context, m *sync.RWMutex, myMetrics *internal.MetricsStorage, config *conf.AgentConfig) error {
-	log.Println("start gopsMetricsPolling goroutine")
-	counter := 1
-	for {
-		select {
-		case <-ctx.Done():
-			log.Println("STOP gopsMetricsPolling goroutine")
-			return nil
-		default:
-			if counter == config.PollInterval {
-				//log.Println("gopsMetricsPolling goroutine polling")
-				m.Lock()
-				if err := internal.GopsMetricPolling(myMetrics); err != nil {
-					log.Println("error in metricsPolling :", err)
-					return err
-				}
-				m.Unlock()
-				counter = 0
-			}
-			time.Sleep(1 * time.Second)
-			counter++
+// collectorOptions параметры запуска коллектора name. По умолчанию коллектор включен и собирает метрики раз в PollInterval,
+// метрики StatsD сбрасываются раз в ReportInterval
+func collectorOptions(name string, config *conf.AgentConfig) collector.Options {
+	opts := collector.Options{
+		Enabled:  !slices.Contains(config.CollectorsDisabled, name),
+		Interval: time.Duration(config.PollInterval) * time.Second,
+	}
+	if name == statsdCollectorName {
+		opts.Interval = time.Duration(config.ReportInterval) * time.Second
+	}
+	if interval, ok := config.CollectorIntervals[name]; ok {
+		opts.Interval = time.Duration(interval) * time.Second
+	}
+	if timeout, ok := config.CollectorTimeouts[name]; ok {
+		opts.Timeout = time.Duration(timeout) * time.Second
+	}
+	return opts
+}
+
+// statsdInit запуск listener-а StatsD. Возвращает коллектор, сбрасывающий агрегированные метрики в MetricsStorage
+func statsdInit(ctx context.Context, wg *sync.WaitGroup, config *conf.AgentConfig) (collector.Collector, error) {
+	agg := statsd.NewAggregator(config.StatsdPercentiles)
+	server, err := statsd.Listen(config.StatsdAddress, agg)
+	if err != nil {
+		return nil, err
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := server.Serve(ctx); err != nil {
+			logging.FromContext(ctx).Errorw("statsd listener failed", "error", err)
 		}
+	}()
+	return collector.New(statsdCollectorName, func(_ context.Context, s collector.Sink) error {
+		agg.Flush(s)
+		return nil
+	}), nil
+}
+
+// pushInit запуск локального push API. Принятые метрики пишутся в myMetrics под блокировкой m
+func pushInit(ctx context.Context, wg *sync.WaitGroup, m *sync.RWMutex, myMetrics *internal.MetricsStorage, config *conf.AgentConfig) error {
+	ln, err := pushapi.Listen(config.PushAddress)
+	if err != nil {
+		return err
 	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := pushapi.Serve(ctx, ln, pushapi.NewHandler(myMetrics, m)); err != nil {
+			logging.FromContext(ctx).Errorw("push API server failed", "error", err)
+		}
+	}()
+	return nil
 }
 
 // metricReport функция отсылки метрик на сервер
 func metricsReport(ctx context.Context, m *sync.RWMutex, myMetrics *internal.MetricsStorage, config *conf.AgentConfig) error {
-	log.Println("start metricsReport goroutine")
+	logger := logging.FromContext(ctx)
+	logger.Infow("start metricsReport")
 	counter := 1
-	errorCount := 0
 	for {
 		select {
 		case <-ctx.Done():
-			log.Println("STOP metricsReport goroutine")
+			logger.Infow("stop metricsReport")
 			return nil
 		default:
 			if counter == config.ReportInterval {
-				m.RLock()
-				log.Println("run. SendMetricsJSONBatch start. myMetrics is:", myMetrics)
-				if err := internal.SendMetricsJSONBatch(myMetrics, "http://"+config.Address+"/updates", config); err != nil {
-					// Если это ошибка подключения к серверу client.Do error -- игнорируем clientDoErrors ошибок, после возвращаем err
-					// Если количество ошибок подключения к серверу >= clientDoErrors -- увеличиваем счетчик ошибок errorCount
-					// Если это не client.Do ошибка -- сразу возвращаем error
-					if strings.Contains(err.Error(), "client.Do error") && errorCount >= clientDoErrors {
-						log.Println("main: client.Do error from SendMetricsJSONBatch:", err, "errorCount > 3, raise panic")
-						return err
+				logger.Debugw("send metrics batch")
+				if err := internal.SendMetricsJSONBatch(ctx, m, myMetrics, internal.ServerURL(config, "/updates"), config); err != nil {
+					// Ошибки отсылки не останавливают агента: метрики продолжают собираться и будут отосланы в следующем цикле.
+					// При недоступности сервера circuit breaker отклоняет запросы без обращения к серверу
+					switch {
+					case errors.Is(err, breaker.ErrOpen):
+						logger.Warnw("metricsReport: circuit breaker is open, skip sending metrics", "error", err)
+					case errors.Is(err, apperr.ErrRetriable):
+						logger.Warnw("metricsReport: send metrics failed, will retry in next report", "error", err)
+					default:
+						logger.Errorw("metricsReport: send metrics failed", "error", err)
 					}
-					if !strings.Contains(err.Error(), "client.Do error") {
-						log.Println("metricsReport, error from SendMetricsJSONBatch:", err)
-						return err
-					}
-					log.Println("metricsReport, client.Do error from SendMetricsJSONBatch:", err, "errorCount is", errorCount, " ignore this error")
-					errorCount++
 				}
-				m.RUnlock()
 				counter = 0
 			}
 			time.Sleep(1 * time.Second)
@@ -117,8 +155,11 @@ func metricsReport(ctx context.Context, m *sync.RWMutex, myMetrics *internal.Met
 	}
 }
 
-// startHTTPServer -- start HTTP server for pprof
-func startHTTPServer(wg *sync.WaitGroup) *http.Server {
+// startHTTPServer -- start HTTP server for pprof. При selfMetrics на нем же отдаются метрики агента
+func startHTTPServer(wg *sync.WaitGroup, selfMetrics bool) *http.Server {
+	if selfMetrics {
+		http.Handle(selfmetrics.Path, selfmetrics.Default.Handler())
+	}
 	srv := &http.Server{Addr: addr}
 
 	go func() {
@@ -127,7 +168,7 @@ func startHTTPServer(wg *sync.WaitGroup) *http.Server {
 		// always returns error. ErrServerClosed on graceful close
 		if err := srv.ListenAndServe(); err != http.ErrServerClosed {
 			// unexpected error. port in use?
-			log.Fatalf("startHTTPServer ListenAndServe(): %v", err)
+			logging.L().Fatalw("startHTTPServer: ListenAndServe failed", "error", err)
 		}
 	}()
 	// returning reference so caller can call Shutdown()
@@ -136,43 +177,49 @@ func startHTTPServer(wg *sync.WaitGroup) *http.Server {
 
 // Run функция запуска горутин polling-а метрик и их отсылки на сервер
 func run(myMetrics internal.MetricsStorage, config *conf.AgentConfig) {
-	ctx, cancel := context.WithCancel(context.Background())
+	ctx, cancel := context.WithCancel(logging.WithLogger(context.Background(), logging.L()))
 	var m sync.RWMutex
 	var wg sync.WaitGroup
 
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		err := metricsPolling(ctx, &m, &myMetrics, config)
+	var extra []collector.Collector
+	if config.StatsdAddress != "" {
+		c, err := statsdInit(ctx, &wg, config)
 		if err != nil {
-			log.Panicf("metricsPolling error %s", errors.Unwrap(err))
+			logging.L().Fatalw("statsdInit failed", "error", err)
 		}
-	}()
+		extra = append(extra, c)
+	}
 
+	if config.PushAddress != "" {
+		if err := pushInit(ctx, &wg, &m, &myMetrics, config); err != nil {
+			logging.L().Fatalw("pushInit failed", "error", err)
+		}
+	}
+
+	registry, err := collectorsInit(&m, &myMetrics, config, extra...)
+	if err != nil {
+		logging.L().Fatalw("collectorsInit failed", "error", err)
+	}
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		err := gopsMetricsPolling(ctx, &m, &myMetrics, config)
-		if err != nil {
-			log.Panicf("gopsMetricsPolling error %s", errors.Unwrap(err))
-		}
+		registry.Run(ctx)
 	}()
 
-	log.Println("start metricsReport")
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
 		err := metricsReport(ctx, &m, &myMetrics, config)
 		if err != nil {
-			log.Panicf("metricsReport error %s", errors.Unwrap(err))
+			logging.L().Panicw("metricsReport failed", "error", errors.Unwrap(err))
 		}
 	}()
 
 	//starting pprof http.server
 	if config.PProfHTTPEnabled {
-		log.Println("start pprof web server")
+		logging.L().Infow("start pprof web server", "address", addr)
 		wg.Add(1)
-		srv = startHTTPServer(&wg)
+		srv = startHTTPServer(&wg, config.SelfMetricsHTTP)
 	}
 
 	exit := make(chan os.Signal, 1)
@@ -181,48 +228,74 @@ func run(myMetrics internal.MetricsStorage, config *conf.AgentConfig) {
 	// Graceful shutdown pprof http server if option -t enabled
 	if config.PProfHTTPEnabled {
 		if err := srv.Shutdown(ctx); err != nil {
-			log.Println("run, failure/timeout shutting down the server gracefully, error is:", err)
+			logging.L().Warnw("run: pprof web server shutdown failed", "error", err)
 		} else {
-			log.Println("run, pprof http.server shutdown gracefully")
+			logging.L().Infow("run: pprof web server shutdown gracefully")
 		}
 	}
 	cancel()
 	wg.Wait()
-	log.Println("Main done")
-	log.Println("AGENT STOPPED.")
+	// Выгрузка накопленных span-ов, т.к. defer при os.Exit не выполняется
+	if err := shutdown(context.Background()); err != nil {
+		logging.L().Warnw("run: tracing shutdown failed", "error", err)
+	}
+	logging.L().Infow("AGENT STOPPED")
+	_ = logging.L().Sync()
 	os.Exit(1)
 }
 
 func main() {
 
 	if err := initConfig(&config); err != nil {
-		log.Println("AGENT Panic from initConfig", err)
+		logging.L().Errorw("AGENT panic from initConfig", "error", err)
 		panic(err)
 	}
 
-	if config.Logfile != "" {
-		file, err := os.OpenFile(config.Logfile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
-		if err != nil {
-			log.Fatal("Failed to open log file:", err)
-		}
-		log.SetOutput(file)
-		defer file.Close()
+	logger, err := logging.New(logging.Config{
+		Level:      config.LogLevel,
+		Format:     config.LogFormat,
+		File:       config.Logfile,
+		MaxSizeMB:  config.LogMaxSize,
+		MaxAgeDays: config.LogMaxAge,
+		MaxBackups: config.LogMaxBackups,
+	})
+	if err != nil {
+		logging.L().Errorw("AGENT panic from logging.New", "error", err)
+		panic(err)
+	}
+	defer logger.Sync()
+	logging.SetDefault(logger)
+
+	shutdown, err = tracing.Init(context.Background(), tracing.Config{
+		Exporter:    config.TraceExporter,
+		Endpoint:    config.TraceEndpoint,
+		ServiceName: "agent",
+	})
+	if err != nil {
+		logging.L().Errorw("AGENT panic from tracing.Init", "error", err)
+		panic(err)
+	}
+
+	internal.InitBreaker(&config)
+	if err := internal.InitClient(&config); err != nil {
+		logging.L().Errorw("AGENT panic from InitClient", "error", err)
+		panic(err)
 	}
 
-	fmt.Printf("\nAddress is %s, PollInterval is %d, ReportInterval is %d, LogFile is %s \n", config.Address, config.PollInterval, config.ReportInterval, config.Logfile)
+	logging.L().Infow("AGENT STARTED", "address", config.Address, "tls", config.TLS, "poll_interval", config.PollInterval,
+		"report_interval", config.ReportInterval, "log_file", config.Logfile)
 
 	myMetrics := internal.NewMetricsStorageObj()
 
 	defer func() {
 		if p := recover(); p != nil {
 			err := fmt.Errorf("%v", p)
-			log.Println("Panic recovering -> main:", err)
-			log.Println("recovered from panic in main")
+			logging.L().Errorw("recovered from panic in main", "error", err)
 		}
-		log.Println("Start run after recovering")
+		logging.L().Infow("start run after recovering")
 		run(myMetrics, &config)
 	}()
 
-	log.Println("Start run")
+	logging.L().Infow("start run")
 	run(myMetrics, &config)
 }
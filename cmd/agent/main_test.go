@@ -1,9 +1,12 @@
 package main
 
 import (
+	"github.com/stretchr/testify/assert"
 	"logger/conf"
+	"logger/internal/collector"
 	"os"
 	"testing"
+	"time"
 )
 
 // setEnv вспомогательная функция для установки переменных среды как параметров тестирования
@@ -105,3 +108,102 @@ func Test_initConfig(t *testing.T) {
 		})
 	}
 }
+
+func Test_initConfig_TLS(t *testing.T) {
+	FlagTest = true
+	t.Setenv("POLL_INTERVAL", "2")
+	t.Setenv("REPORT_INTERVAL", "10")
+
+	t.Setenv("ADDRESS", "https://localhost:8443")
+	var c conf.AgentConfig
+	assert.NoError(t, initConfig(&c))
+	assert.True(t, c.TLS)
+	assert.Equal(t, "localhost:8443", c.Address)
+
+	t.Setenv("ADDRESS", "localhost:8443")
+	t.Setenv("TLS_CERT", "agent.crt")
+	c = conf.AgentConfig{}
+	assert.Error(t, initConfig(&c), "client certificate without key")
+	t.Setenv("TLS_KEY", "agent.key")
+	c = conf.AgentConfig{}
+	assert.NoError(t, initConfig(&c))
+	assert.True(t, c.TLS)
+}
+
+func Test_initConfig_Compression(t *testing.T) {
+	FlagTest = true
+	t.Setenv("POLL_INTERVAL", "2")
+	t.Setenv("REPORT_INTERVAL", "10")
+
+	var c conf.AgentConfig
+	assert.NoError(t, initConfig(&c))
+	assert.Equal(t, "gzip", c.Compression)
+
+	t.Setenv("COMPRESSION", "ZSTD")
+	c = conf.AgentConfig{}
+	assert.NoError(t, initConfig(&c))
+	assert.Equal(t, "zstd", c.Compression)
+
+	t.Setenv("COMPRESSION", "br")
+	c = conf.AgentConfig{}
+	assert.Error(t, initConfig(&c))
+}
+
+func Test_initConfig_WireFormat(t *testing.T) {
+	FlagTest = true
+	t.Setenv("POLL_INTERVAL", "2")
+	t.Setenv("REPORT_INTERVAL", "10")
+
+	var c conf.AgentConfig
+	assert.NoError(t, initConfig(&c))
+	assert.Equal(t, "application/json", c.WireFormat)
+
+	t.Setenv("WIRE_FORMAT", "protobuf")
+	c = conf.AgentConfig{}
+	assert.NoError(t, initConfig(&c))
+	assert.Equal(t, "application/x-protobuf", c.WireFormat)
+
+	t.Setenv("WIRE_FORMAT", "xml")
+	c = conf.AgentConfig{}
+	assert.Error(t, initConfig(&c))
+}
+
+func Test_parseCollectorSettings(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    map[string]int
+		wantErr bool
+	}{
+		{name: "empty", value: "", want: map[string]int{}},
+		{name: "several collectors", value: "gops=5, runtime=2", want: map[string]int{"gops": 5, "runtime": 2}},
+		{name: "no value", value: "gops", wantErr: true},
+		{name: "not a number", value: "gops=five", wantErr: true},
+		{name: "zero", value: "gops=0", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseCollectorSettings(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseCollectorSettings() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr {
+				assert.Equal(t, tt.want, got)
+			}
+		})
+	}
+}
+
+func Test_collectorOptions(t *testing.T) {
+	config := conf.AgentConfig{
+		PollInterval:       2,
+		ReportInterval:     10,
+		CollectorsDisabled: []string{"breaker"},
+		CollectorIntervals: map[string]int{"gops": 10},
+		CollectorTimeouts:  map[string]int{"gops": 1},
+	}
+	assert.Equal(t, collector.Options{Enabled: true, Interval: 2 * time.Second}, collectorOptions("runtime", &config))
+	assert.Equal(t, collector.Options{Enabled: true, Interval: 10 * time.Second, Timeout: time.Second}, collectorOptions("gops", &config))
+	assert.False(t, collectorOptions("breaker", &config).Enabled)
+	assert.Equal(t, 10*time.Second, collectorOptions(statsdCollectorName, &config).Interval)
+}
@@ -4,28 +4,136 @@ package main
 import (
 	"context"
 	"fmt"
-	"github.com/gin-contrib/gzip"
 	"github.com/gin-contrib/pprof"
 	"github.com/gin-gonic/gin"
-	"go.uber.org/zap"
-	"log"
 	"logger/cmd/server/initconf"
 	"logger/internal"
+	"logger/internal/auth"
 	"logger/internal/compress"
+	"logger/internal/events"
 	"logger/internal/handlers"
+	"logger/internal/idempotency"
+	"logger/internal/limits"
 	"logger/internal/logging"
+	"logger/internal/servermetrics"
+	"logger/internal/storage/boltstorage"
 	"logger/internal/storage/memstorage"
 	"logger/internal/storage/pgstorage"
+	"logger/internal/tlsconf"
+	"logger/internal/tokens"
+	"logger/internal/tracing"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 )
 
-// Для возможности использования Zap
-var sugar zap.SugaredLogger
+// Route-ы изменения метрик, запросы к которым проверяются auth.Middleware
+const (
+	updateURLRoute = "/update/:metricType/:metricName/:metricValue"
+	updateRoute    = "/update/"
+	updatesRoute   = "/updates"
+)
+
+// updatesStreamRoute route приема метрик потоком NDJSON. Тело потока не буферизуется, поэтому HMAC-подпись
+// для него не проверяется: доступ ограничивается bearer-токеном с ролью writer
+const updatesStreamRoute = "/updates/stream"
+
+// Route-ы чтения метрик
+const (
+	allMetricsRoute = "/"
+	valueURLRoute   = "/value/:metricType/:metricName"
+	valueRoute      = "/value/"
+	eventsRoute     = "/stream"
+)
+
+// pingRoute route проверки соединения с БД
+const pingRoute = "/ping"
+
+// pprofPrefix префикс route-ов pprof
+const pprofPrefix = "/debug/pprof"
+
+// rateLimitClients максимальное количество клиентов, для которых хранится состояние ограничения частоты запросов
+const rateLimitClients = 100000
+
+// Поток событий изменения метрик: размер буфера событий подписчика и максимальное количество подписчиков
+const (
+	eventBuffer      = 256
+	eventSubscribers = 1000
+)
+
+// tokenRoutes роли, необходимые для запросов к route-ам при включенной проверке токенов. Служебные route-ы
+// добавляет protectOperationalRoutes
+var tokenRoutes = map[string]tokens.Role{
+	updateURLRoute:     tokens.RoleWriter,
+	updateRoute:        tokens.RoleWriter,
+	updatesRoute:       tokens.RoleWriter,
+	updatesStreamRoute: tokens.RoleWriter,
+	allMetricsRoute:    tokens.RoleReader,
+	valueURLRoute:      tokens.RoleReader,
+	valueRoute:         tokens.RoleReader,
+	eventsRoute:        tokens.RoleReader,
+}
+
+// protectOperationalRoutes требование роли admin для служебных route-ов router-а: метрик сервера, проверки БД
+// и pprof. Вызывается после регистрации всех route-ов и до запуска сервера
+func protectOperationalRoutes(router *gin.Engine, routes map[string]tokens.Role) {
+	routes[servermetrics.Path] = tokens.RoleAdmin
+	routes[pingRoute] = tokens.RoleAdmin
+	for _, r := range router.Routes() {
+		if strings.HasPrefix(r.Path, pprofPrefix) {
+			routes[r.Path] = tokens.RoleAdmin
+		}
+	}
+}
+
+// tokensInit инициализация хранилища токенов: файл TokensFile, если задан, иначе таблица БД.
+// Если проверка токенов отключена, возвращается nil
+func tokensInit(ctx context.Context, store handlers.Storager, conf *initconf.Config) (tokens.Store, error) {
+	if !conf.RequireToken {
+		return nil, nil
+	}
+	if conf.TokensFile != "" {
+		return tokens.NewFileStore(conf.TokensFile)
+	}
+	if pg, ok := store.(pgstorage.PgStorage); ok {
+		return tokens.NewPgStore(ctx, pg.DB())
+	}
+	return nil, fmt.Errorf("tokens storage is not configured: set TOKENS_FILE or DATABASE_DSN")
+}
+
+// idempotencyInit инициализация хранилища идентификаторов batch-ей: таблица БД, если метрики хранятся в PostgreSQL,
+// иначе память. При нулевом окне дедупликация отключена и возвращается nil
+func idempotencyInit(ctx context.Context, store handlers.Storager, conf *initconf.Config) (idempotency.Store, error) {
+	if conf.IdempotencyWindow == 0 {
+		return nil, nil
+	}
+	window := time.Duration(conf.IdempotencyWindow) * time.Second
+	if pg, ok := store.(pgstorage.PgStorage); ok {
+		return idempotency.NewPgStore(ctx, pg.DB(), window)
+	}
+	return idempotency.NewMemoryStore(conf.IdempotencySize, window), nil
+}
+
+// storageBackend имя типа хранилища метрик для метрик сервера
+func storageBackend(conf *initconf.Config) string {
+	switch {
+	case conf.DatabaseDSN != "":
+		return "pgstorage"
+	case conf.BoltStoragePath != "":
+		return "boltstorage"
+	default:
+		return "memstorage"
+	}
+}
+
+// useDump функция определения необходимости дампа метрик на диск -- нужен только для memstorage
+func useDump(conf *initconf.Config) bool {
+	return conf.DatabaseDSN == "" && conf.BoltStoragePath == ""
+}
 
 // task функция для старта дампа метрик на диск раз в interval секунд
 func task(ctx context.Context, interval int, store handlers.Storager, conf *initconf.Config) {
@@ -37,7 +145,7 @@ func task(ctx context.Context, interval int, store handlers.Storager, conf *init
 			return
 		// выполняем нужный нам код
 		default:
-			println("Save metrics dump to file", conf.FileStoragePath, "with interval", interval, "s")
+			logging.FromContext(ctx).Debugw("save metrics dump", "file", conf.FileStoragePath, "interval", interval)
 			err := internal.Save(ctx, store, conf.FileStoragePath)
 			if err != nil {
 				return
@@ -52,40 +160,68 @@ func task(ctx context.Context, interval int, store handlers.Storager, conf *init
 // 1. создан memstorage восстановлением из dump-а
 // 2. при ошибке в п.1 -- создан новый memstorage
 // 3. если определена переменная DatabaseDSN -- создан store типа pgstorage
+// 4. если DatabaseDSN не определена, но определена BoltStoragePath -- создан store типа boltstorage
 func storeInit(ctx context.Context, store handlers.Storager, conf *initconf.Config) (handlers.Storager, error) {
 	var err error
+	logger := logging.FromContext(ctx)
+	if conf.DatabaseDSN == "" && conf.BoltStoragePath != "" {
+		logger.Infow("initialize storage", "backend", "boltstorage", "path", conf.BoltStoragePath)
+		store, err = boltstorage.New(ctx, conf)
+		if err != nil {
+			return nil, err
+		}
+		return store, nil
+	}
 	if conf.DatabaseDSN == "" {
 		// если определена опция восстановления store из дампа
 		if conf.Restore {
-			log.Println("DatabaseDSN is not configured, Load metric dump from file")
+			logger.Infow("load metrics dump", "file", conf.FileStoragePath)
 			store, err := internal.Load(conf.FileStoragePath)
-			log.Println("Metric after dump load :", store)
 			if err == nil {
 				return store, nil
 			} else {
-				log.Println("storeInit error in initial dump load:", err, " Trying to initialize new memstorage.")
+				logger.Warnw("load metrics dump failed, initialize new memstorage", "error", err)
 			}
 		}
 		// Store Инициализация хранилища метрик типа memstorage
+		logger.Infow("initialize storage", "backend", "memstorage")
 		store, err = memstorage.New(ctx)
 		if err != nil {
-			log.Println("storeInit error memstorage initialization.")
 			return nil, err
 		}
 		return store, nil
 	}
 	// Инициализация хранилища метрик типа pgstorage
 	if conf.DatabaseDSN != "" {
-		log.Println("storeInit DatabaseDSN is configured, start to initialize pgstorage.")
+		logger.Infow("initialize storage", "backend", "pgstorage")
 		store, err = pgstorage.New(ctx, conf)
 		if err != nil {
-			log.Println("storeInit error pgstorage initialization.")
 			return nil, err
 		}
 	}
 	return store, nil
 }
 
+// serve запуск HTTP сервера, либо HTTPS, если заданы сертификат и ключ
+func serve(router *gin.Engine, conf *initconf.Config) error {
+	if conf.TLSCertFile == "" {
+		logging.L().Infow("server started", "address", conf.RunAddr)
+		return router.Run(conf.RunAddr)
+	}
+	tlsConfig, err := tlsconf.Server(conf.TLSCertFile, conf.TLSKeyFile, conf.TLSClientCAFile)
+	if err != nil {
+		return err
+	}
+	srv := &http.Server{
+		Addr:      conf.RunAddr,
+		Handler:   router.Handler(),
+		TLSConfig: tlsConfig,
+	}
+	logging.L().Infow("server started", "address", conf.RunAddr, "tls", true, "mtls", conf.TLSClientCAFile != "")
+	// Сертификат и ключ берутся из TLSConfig.GetCertificate
+	return srv.ListenAndServeTLS("", "")
+}
+
 var err error
 
 func main() {
@@ -101,108 +237,180 @@ func main() {
 	ctx, cancel = context.WithCancel(context.Background())
 	defer cancel()
 
+	// Управление токенами: server token create|revoke|list
+	if len(os.Args) > 1 && os.Args[1] == tokenCommandName {
+		if err := tokenCommand(ctx, os.Args[2:], os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	// Config initialization
 	if err := initconf.InitConfig(&conf); err != nil {
-		log.Println("Panic in initConfig")
-		panic(err)
+		logging.L().Fatalw("config initialization failed", "error", err)
+	}
+
+	// Logger initialization. Если определена опция Logfile -- логи сервера пишутся в этот файл с ротацией
+	logger, err := logging.New(logging.Config{
+		Level:      conf.LogLevel,
+		Format:     conf.LogFormat,
+		File:       conf.Logfile,
+		MaxSizeMB:  conf.LogMaxSize,
+		MaxAgeDays: conf.LogMaxAge,
+		MaxBackups: conf.LogMaxBackups,
+	})
+	if err != nil {
+		logging.L().Fatalw("logger initialization failed", "error", err)
 	}
-	log.Println("initconf is:", conf)
+	defer logger.Sync()
+	logging.SetDefault(logger)
+	ctx = logging.WithLogger(ctx, logging.L())
+
+	// Tracing initialization
+	shutdownTracing, err := tracing.Init(ctx, tracing.Config{
+		Exporter:    conf.TraceExporter,
+		Endpoint:    conf.TraceEndpoint,
+		ServiceName: "server",
+	})
+	if err != nil {
+		logging.L().Fatalw("tracing initialization failed", "error", err)
+	}
+	defer shutdownTracing(context.Background())
 
 	// store initialization
 	if store, err = storeInit(ctx, store, &conf); err != nil {
-		log.Println("Storage initialization error :", err)
-		panic(err)
+		logging.L().Fatalw("storage initialization failed", "error", err)
 	}
 	defer store.Close()
 
+	batchIDs, err := idempotencyInit(ctx, store, &conf)
+	if err != nil {
+		logging.L().Fatalw("idempotency storage initialization failed", "error", err)
+	}
+	apiTokens, err := tokensInit(ctx, store, &conf)
+	if err != nil {
+		logging.L().Fatalw("tokens storage initialization failed", "error", err)
+	}
+	// Учет длительности операций хранилища. Обертка устанавливается после idempotencyInit и tokensInit,
+	// которым нужен исходный тип хранилища
+	store = servermetrics.InstrumentStorage(store, storageBackend(&conf), servermetrics.Default)
+	store = tracing.InstrumentStorage(store, storageBackend(&conf))
+	// Успешные изменения метрик публикуются подписчикам потока событий
+	broker := events.NewBroker(eventBuffer, eventSubscribers)
+	store = events.PublishStorage(store, broker)
+
 	// Остановка сервера и сохранение дампа memstorage при остановке, если используется memstorage
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		<-c
 		// Если для хранения метрик не используется БД -- делаем DUMP метрик на диск
-		if conf.DatabaseDSN == "" {
+		if useDump(&conf) {
 			err := internal.Save(ctx, store, conf.FileStoragePath)
 			if err != nil {
-				log.Println("Save metric DUMP error:", err)
+				logging.L().Errorw("save metrics dump failed", "error", err)
 			}
 		}
-		log.Println("SERVER STOPPED.")
+		// Закрываем store для корректного закрытия файла БД, т.к. defer при os.Exit не выполняется
+		if err := store.Close(); err != nil {
+			logging.L().Errorw("store close failed", "error", err)
+		}
+		if err := shutdownTracing(context.Background()); err != nil {
+			logging.L().Warnw("tracing shutdown failed", "error", err)
+		}
+		logging.L().Infow("SERVER STOPPED")
+		_ = logger.Sync()
 		os.Exit(1)
 	}()
 
-	// создаём предустановленный регистратор zap
-	logger, err := zap.NewDevelopment()
-	if err != nil {
-		// вызываем панику, если ошибка
-		panic(err)
-	}
-	defer logger.Sync()
-	// создаем регистратор SugaredLogger
-	sugar = *logger.Sugar()
-
-	// Если не определен DatabaseDSN и StoreMetricInterval не равен нулю -- запускается автодамп memstorage
-	if conf.DatabaseDSN == "" && conf.StoreMetricInterval != 0 {
+	// Если используется memstorage и StoreMetricInterval не равен нулю -- запускается автодамп memstorage
+	if useDump(&conf) && conf.StoreMetricInterval != 0 {
 		// создаём контекст с функцией завершения
-		log.Println("Init context fo goroutine (Conf.StoreMetricInterval is not 0):", conf.StoreMetricInterval)
 		// Создаем дочерний контекст для процесса дампа метрик в случае, если StoreMetricInterval != 0
 		ctxDUMP, cancelDUMP = context.WithCancel(ctx)
 		// запускаем горутину
 		go task(ctxDUMP, conf.StoreMetricInterval, store, &conf)
 	}
 
-	sugar.Infow("initConfig sugar logging", "conf.RunAddr", conf.RunAddr)
-
-	// Если определена опция Logfile -- логи сервера перенаправляются в этот файл
-	if conf.Logfile != "" {
-		file, err := os.OpenFile("server.log", os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
-		if err != nil {
-			log.Fatal("Failed to open log file:", err)
-		}
-		log.SetOutput(file)
-		defer file.Close()
+	// GIN init. Вместо gin.Default: запросы пишет в лог WithLogging
+	router := gin.New()
+	// IP клиента для ограничения частоты запросов берется из X-Forwarded-For только от доверенных прокси,
+	// иначе клиент обходил бы ограничение подменой заголовка
+	if err := router.SetTrustedProxies(conf.TrustedProxyList()); err != nil {
+		logging.L().Fatalw("trusted proxies configuration failed", "error", err)
 	}
-
-	// GIN init
-	router := gin.Default()
-	router.Use(logging.WithLogging(&sugar))
-	router.Use(gzip.Gzip(gzip.DefaultCompression)) //-- standard GIN compress "github.com/gin-contrib/compress"
-	router.Use(compress.GzipRequestHandle(ctx, &conf))
-	//router.Use(gin.Recovery())
-	if conf.DatabaseDSN == "" {
+	router.Use(gin.Recovery())
+	router.Use(tracing.Middleware())
+	// Идентификатор агента из клиентского сертификата при mTLS
+	router.Use(tlsconf.Middleware())
+	router.Use(servermetrics.Middleware(servermetrics.Default))
+	router.Use(logging.WithLogging(logging.L()))
+	// Кодек ответа выбирается по Accept-Encoding: zstd, gzip или deflate
+	router.Use(compress.ResponseHandle(compress.DefaultCompression))
+	// Размер тела ограничивается до его чтения проверкой подписи и распаковкой
+	// Поток NDJSON ограничен собственным лимитом и до, и после распаковки
+	streamLimits := map[string]int64{updatesStreamRoute: conf.MaxStreamSize}
+	router.Use(limits.BodySize(conf.MaxBodySize, streamLimits))
+	// Токен проверяется до подписи: запрос без прав отклоняется без чтения тела
+	if apiTokens != nil {
+		router.Use(tokens.Middleware(apiTokens, tokenRoutes))
+	}
+	if conf.RateLimit > 0 {
+		router.Use(limits.RateLimit(limits.NewLimiter(conf.RateLimit, conf.RateBurst, rateLimitClients)))
+	}
+	// Подпись проверяется до распаковки тела
+	router.Use(auth.Middleware(&conf, updateURLRoute, updateRoute, updatesRoute))
+	router.Use(compress.RequestHandle(ctx, conf.MaxDecompressedSize, streamLimits))
+	if useDump(&conf) {
 		router.Use(internal.SyncDumpUpdate(ctx, store, &conf))
 	}
 	// для обработки всех запросов, не обрабатываемых handler-ами ниже -- из-за gzip handler проблемы
 	router.NoRoute(func(c *gin.Context) {
-		fmt.Println("Handling Any request for", c.Request.URL.Path)
 		c.Status(http.StatusNotFound)
 		// Flush -- убираем возможность изменения статуса gzip handler-ом:
 		c.Writer.Flush()
 	})
-	router.GET("/", handlers.GetAllMetrics(ctx, store))
-	router.POST("/update/:metricType/:metricName/:metricValue", handlers.MetricsHandler(ctx, store))
-	router.POST("/update/", handlers.MetricHandlerJSON(ctx, store, &conf))
-	router.POST("/updates", handlers.MetricHandlerBatchUpdate(ctx, store, &conf))
-	router.GET("/value/:metricType/:metricName", handlers.GetMetric(ctx, store))
-	router.POST("/value/", handlers.GetMetricJSON(ctx, store, &conf))
-	router.GET("/ping", handlers.DBPing(conf.DatabaseDSN))
+	router.GET(allMetricsRoute, tracing.Handler("handlers.GetAllMetrics", handlers.GetAllMetrics(ctx, store)))
+	router.POST(updateURLRoute, tracing.Handler("handlers.MetricsHandler", handlers.MetricsHandler(ctx, store)))
+	// Повторно отосланные агентом batch-и не применяются, если включена дедупликация
+	updateHandlers := []gin.HandlerFunc{tracing.Handler("handlers.MetricHandlerJSON", handlers.MetricHandlerJSON(ctx, store, &conf))}
+	batchHandlers := []gin.HandlerFunc{tracing.Handler("handlers.MetricHandlerBatchUpdate", handlers.MetricHandlerBatchUpdate(ctx, store, &conf))}
+	if batchIDs != nil {
+		updateHandlers = append([]gin.HandlerFunc{idempotency.Middleware(batchIDs, conf.KeyRing.SignHeader)}, updateHandlers...)
+		batchHandlers = append([]gin.HandlerFunc{idempotency.Middleware(batchIDs, conf.KeyRing.SignHeader)}, batchHandlers...)
+	}
+	router.POST(updateRoute, updateHandlers...)
+	router.POST(updatesRoute, batchHandlers...)
+	// Без проверки токенов поток принимается только если подпись запросов отключена: иначе он позволял бы
+	// изменять метрики в обход подписи
+	if apiTokens != nil || !conf.KeyRing.Enabled() {
+		router.POST(updatesStreamRoute, tracing.Handler("handlers.MetricHandlerStream", handlers.MetricHandlerStream(ctx, store, &conf)))
+	} else {
+		logging.L().Warnw("NDJSON stream endpoint disabled: it cannot be signed, enable bearer tokens to use it", "route", updatesStreamRoute)
+	}
+	router.GET(valueURLRoute, tracing.Handler("handlers.GetMetric", handlers.GetMetric(ctx, store)))
+	router.POST(valueRoute, tracing.Handler("handlers.GetMetricJSON", handlers.GetMetricJSON(ctx, store, &conf)))
+	router.GET(eventsRoute, tracing.Handler("events.Handler", events.Handler(ctx, broker)))
+	router.GET(pingRoute, tracing.Handler("handlers.DBPing", handlers.DBPing(conf.DatabaseDSN)))
+	// Метрики работы самого сервера
+	router.GET(servermetrics.Path, servermetrics.Handler(servermetrics.Default))
 
 	// Start PProf HTTP if option -t enabled
 	if conf.PProfHTTPEnabled {
-		pprof.Register(router)
+		pprof.Register(router, pprofPrefix)
 	}
+	protectOperationalRoutes(router, tokenRoutes)
 
-	err = router.Run(conf.RunAddr)
+	err = serve(router, &conf)
 	if err != nil {
-		panic(err)
+		logging.L().Errorw("server stopped with error", "error", err)
 	}
 
-	sugar.Infow("\nServer started on runAddr %s \n", conf.RunAddr)
-
 	// завершаем дочерний контекст дампа, чтобы завершить горутину дампа метрик в файл
-	if conf.DatabaseDSN == "" && conf.StoreMetricInterval != 0 {
+	if useDump(&conf) && conf.StoreMetricInterval != 0 {
 		cancelDUMP()
 	}
 
-	log.Println("SERVER STOPPED.")
+	logging.L().Infow("SERVER STOPPED")
 }
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"github.com/gin-contrib/pprof"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"logger/internal/servermetrics"
+	"logger/internal/tokens"
+	"strings"
+	"testing"
+)
+
+func Test_protectOperationalRoutes(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET(pingRoute, func(c *gin.Context) {})
+	router.GET(servermetrics.Path, func(c *gin.Context) {})
+	pprof.Register(router, pprofPrefix)
+
+	routes := map[string]tokens.Role{valueRoute: tokens.RoleReader}
+	protectOperationalRoutes(router, routes)
+
+	assert.Equal(t, tokens.RoleReader, routes[valueRoute])
+	assert.Equal(t, tokens.RoleAdmin, routes[pingRoute])
+	assert.Equal(t, tokens.RoleAdmin, routes[servermetrics.Path])
+	// Все route-ы pprof, в том числе зарегистрированные библиотекой, требуют роль admin
+	for _, r := range router.Routes() {
+		if strings.HasPrefix(r.Path, pprofPrefix) {
+			assert.Equal(t, tokens.RoleAdmin, routes[r.Path], r.Path)
+		}
+	}
+	assert.Contains(t, routes, pprofPrefix+"/heap")
+}
@@ -1,5 +1,7 @@
 package conf
 
+import "logger/internal/keyring"
+
 type Config struct {
 	Database struct {
 		Host     string `mapstructure:"host"`
@@ -14,8 +16,43 @@ type AgentConfig struct {
 	PollInterval     int
 	ReportInterval   int
 	Address          string
-	Logfile          string
+	Logfile          string // Файл лога. Пустая строка -- stderr
 	Key              string
+	Keys             string        // Набор ключей подписи "id:secret[@RFC3339],..." от нового к старому
+	KeyRing          *keyring.Ring // Набор ключей из Keys и Key. nil -- подпись отключена
+	Token            string        // Bearer-токен агента с ролью writer. Пустая строка -- токен не передается
+	WireFormat       string        // Content-Type batch-ей: application/json, application/x-protobuf или application/msgpack
+	Compression      string        // Кодек тела запросов: gzip, zstd, deflate, identity или compress для серверов прежних версий
 	RateLimit        int
 	PProfHTTPEnabled bool
+	// Параметры TLS соединения с сервером
+	TLS         bool   // Отсылка метрик по https
+	TLSCAFile   string // CA bundle для проверки сертификата сервера. Пустая строка -- системные CA
+	TLSCertFile string // Клиентский сертификат для mTLS. Пустая строка -- без сертификата
+	TLSKeyFile  string // Ключ клиентского сертификата
+	// Параметры circuit breaker-а отсылки метрик на сервер
+	BreakerFailureThreshold int // Количество retriable ошибок подряд для открытия breaker-а
+	BreakerOpenTimeout      int // Время в секундах до пробного запроса после открытия breaker-а
+	BreakerHalfOpenMaxCalls int // Количество успешных пробных запросов для закрытия breaker-а
+	// Параметры коллекторов метрик
+	CollectorsDisabled []string       // Имена отключенных коллекторов
+	CollectorIntervals map[string]int // Интервал сбора в секундах по имени коллектора. По умолчанию PollInterval
+	CollectorTimeouts  map[string]int // Таймаут сбора в секундах по имени коллектора. По умолчанию равен интервалу
+	ProcessList        []string       // Имена процессов для сбора потребления памяти и CPU коллектором process
+	// Параметры приема метрик StatsD
+	StatsdAddress     string    // UDP адрес listener-а StatsD. Пустая строка -- прием отключен
+	StatsdPercentiles []float64 // Перцентили timer-ов StatsD
+	// Адрес локального push API для приложений: host:port или unix:/path/to/socket. Пустая строка -- API отключен
+	PushAddress string
+	// Отдача метрик агента на HTTP сервере pprof по пути /debug/agent/metrics
+	SelfMetricsHTTP bool
+	// Параметры логирования
+	LogLevel      string // debug, info, warn, error
+	LogFormat     string // json или console
+	LogMaxSize    int    // Размер файла лога в мегабайтах, после которого файл ротируется
+	LogMaxAge     int    // Количество дней хранения ротированных файлов лога
+	LogMaxBackups int    // Количество хранимых ротированных файлов лога
+	// Параметры трассировки OpenTelemetry
+	TraceExporter string // none, stdout или otlp
+	TraceEndpoint string // URL OTLP/HTTP collector-а
 }
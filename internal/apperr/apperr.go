@@ -0,0 +1,286 @@
+// Package apperr набор sentinel-ошибок и типизированная ошибка Error, общие для хранилищ, handler-ов и агента,
+// а также единое отображение ошибок в HTTP коды и JSON problem body (RFC 7807).
+package apperr
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Sentinel-ошибки -- классы ошибок для проверки через errors.Is
+var (
+	ErrNotFound     = errors.New("not found")
+	ErrWrongType    = errors.New("wrong metric type")
+	ErrInvalidValue = errors.New("invalid value")
+	ErrRetriable    = errors.New("retriable backend error")
+	ErrUnauthorized = errors.New("authentication failed")
+	ErrForbidden    = errors.New("access denied")
+	ErrTooLarge     = errors.New("request is too large")
+	ErrRateLimited  = errors.New("rate limit exceeded")
+	ErrUnsupported  = errors.New("unsupported media type")
+)
+
+// ProblemContentType Content-Type ответа с описанием ошибки
+const ProblemContentType = "application/problem+json"
+
+// Error типизированная ошибка: класс ошибки Kind (одна из sentinel-ошибок), операция Op и исходная ошибка Err.
+// errors.Is(err, ErrNotFound) срабатывает по Kind, errors.As(err, &*Error) позволяет получить Op
+type Error struct {
+	Kind error
+	Op   string
+	Err  error
+}
+
+func (e *Error) Error() string {
+	if e.Err == nil {
+		return fmt.Sprintf("%s: %v", e.Op, e.Kind)
+	}
+	return fmt.Sprintf("%s: %v: %v", e.Op, e.Kind, e.Err)
+}
+
+// Unwrap возвращает и класс ошибки, и исходную ошибку, чтобы errors.Is/As работали для обеих цепочек
+func (e *Error) Unwrap() []error {
+	if e.Err == nil {
+		return []error{e.Kind}
+	}
+	return []error{e.Kind, e.Err}
+}
+
+// New создание типизированной ошибки класса kind для операции op
+func New(kind error, op string, err error) *Error {
+	return &Error{Kind: kind, Op: op, Err: err}
+}
+
+// NotFound ошибка отсутствия метрики key
+func NotFound(op string, key string) *Error {
+	return New(ErrNotFound, op, errors.New("no value for key "+key))
+}
+
+// WrongType ошибка неизвестного типа метрики
+func WrongType(op string, mType string) *Error {
+	return New(ErrWrongType, op, errors.New("unknown metric type "+mType))
+}
+
+// InvalidValue ошибка некорректного значения метрики или тела запроса
+func InvalidValue(op string, err error) *Error {
+	return New(ErrInvalidValue, op, err)
+}
+
+// Retriable ошибка backend-а, после которой операцию имеет смысл повторить
+func Retriable(op string, err error) *Error {
+	return New(ErrRetriable, op, err)
+}
+
+// Unauthorized ошибка проверки подписи или аутентификации
+func Unauthorized(op string, err error) *Error {
+	return New(ErrUnauthorized, op, err)
+}
+
+// Forbidden ошибка недостаточных прав аутентифицированного клиента
+func Forbidden(op string, err error) *Error {
+	return New(ErrForbidden, op, err)
+}
+
+// TooLarge ошибка превышения размера тела запроса или количества метрик в batch-е
+func TooLarge(op string, err error) *Error {
+	return New(ErrTooLarge, op, err)
+}
+
+// RateLimited ошибка превышения лимита запросов клиента
+func RateLimited(op string, err error) *Error {
+	return New(ErrRateLimited, op, err)
+}
+
+// Unsupported ошибка неподдерживаемого кодирования или формата тела запроса
+func Unsupported(op string, err error) *Error {
+	return New(ErrUnsupported, op, err)
+}
+
+// retryAfterError ошибка с рекомендованной сервером задержкой перед повтором
+type retryAfterError struct {
+	err   error
+	after time.Duration
+}
+
+func (e *retryAfterError) Error() string {
+	return e.err.Error()
+}
+
+func (e *retryAfterError) Unwrap() error {
+	return e.err
+}
+
+// WithRetryAfter ошибка err с задержкой перед повтором d из заголовка Retry-After ответа сервера
+func WithRetryAfter(err error, d time.Duration) error {
+	return &retryAfterError{err: err, after: d}
+}
+
+// RetryAfter задержка перед повтором, рекомендованная сервером. ok == false, если сервер ее не указал
+func RetryAfter(err error) (time.Duration, bool) {
+	var e *retryAfterError
+	if errors.As(err, &e) {
+		return e.after, true
+	}
+	return 0, false
+}
+
+// parseRetryAfter разбор заголовка Retry-After: количество секунд или HTTP дата
+func parseRetryAfter(v string) (time.Duration, bool) {
+	if v == "" {
+		return 0, false
+	}
+	if sec, err := strconv.Atoi(v); err == nil && sec >= 0 {
+		return time.Duration(sec) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return max(time.Until(t), 0), true
+	}
+	return 0, false
+}
+
+// HTTPStatus отображение ошибки в HTTP код ответа
+func HTTPStatus(err error) int {
+	switch {
+	case err == nil:
+		return http.StatusOK
+	case errors.Is(err, ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrWrongType), errors.Is(err, ErrInvalidValue):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrUnauthorized):
+		return http.StatusUnauthorized
+	case errors.Is(err, ErrForbidden):
+		return http.StatusForbidden
+	case errors.Is(err, ErrTooLarge), isMaxBytes(err):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, ErrRateLimited):
+		return http.StatusTooManyRequests
+	case errors.Is(err, ErrUnsupported):
+		return http.StatusUnsupportedMediaType
+	case errors.Is(err, ErrRetriable):
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// isMaxBytes true, если err -- превышение лимита http.MaxBytesReader при чтении тела запроса
+func isMaxBytes(err error) bool {
+	var e *http.MaxBytesError
+	return errors.As(err, &e)
+}
+
+// code машиночитаемый код класса ошибки для поля Problem.Code
+func code(err error) string {
+	switch {
+	case errors.Is(err, ErrNotFound):
+		return "not_found"
+	case errors.Is(err, ErrWrongType):
+		return "wrong_type"
+	case errors.Is(err, ErrInvalidValue):
+		return "invalid_value"
+	case errors.Is(err, ErrUnauthorized):
+		return "unauthorized"
+	case errors.Is(err, ErrForbidden):
+		return "forbidden"
+	case errors.Is(err, ErrTooLarge), isMaxBytes(err):
+		return "too_large"
+	case errors.Is(err, ErrRateLimited):
+		return "rate_limited"
+	case errors.Is(err, ErrUnsupported):
+		return "unsupported"
+	case errors.Is(err, ErrRetriable):
+		return "retriable"
+	default:
+		return "internal"
+	}
+}
+
+// Problem JSON тело ответа с описанием ошибки (RFC 7807) с дополнительным машиночитаемым полем Code
+type Problem struct {
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	Code   string `json:"code"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// NewProblem формирование Problem по ошибке. Для внутренних ошибок детали не раскрываются клиенту
+func NewProblem(err error) Problem {
+	status := HTTPStatus(err)
+	p := Problem{
+		Type:   "about:blank",
+		Title:  http.StatusText(status),
+		Status: status,
+		Code:   code(err),
+	}
+	if status != http.StatusInternalServerError {
+		p.Detail = err.Error()
+	}
+	return p
+}
+
+// WriteProblem запись ответа с HTTP кодом и problem body, соответствующими ошибке, и прерывание цепочки handler-ов
+func WriteProblem(c *gin.Context, err error) {
+	p := NewProblem(err)
+	body, mErr := json.Marshal(p)
+	if mErr != nil {
+		c.AbortWithStatus(p.Status)
+		return
+	}
+	c.Header("Content-Type", ProblemContentType)
+	c.AbortWithStatus(p.Status)
+	_, _ = c.Writer.Write(body)
+}
+
+// WriteHTTPProblem аналог WriteProblem для handler-ов net/http
+func WriteHTTPProblem(w http.ResponseWriter, err error) {
+	p := NewProblem(err)
+	body, mErr := json.Marshal(p)
+	if mErr != nil {
+		w.WriteHeader(p.Status)
+		return
+	}
+	w.Header().Set("Content-Type", ProblemContentType)
+	w.WriteHeader(p.Status)
+	_, _ = w.Write(body)
+}
+
+// FromResponse формирование ошибки по ответу сервера с кодом не 2xx. Используется агентом.
+// Если тело ответа содержит Problem -- его Detail включается в текст ошибки
+func FromResponse(op string, resp *http.Response) error {
+	if resp.StatusCode < http.StatusBadRequest {
+		return nil
+	}
+	cause := errors.New("server responded with status " + resp.Status)
+	if resp.Body != nil {
+		var p Problem
+		if body, err := io.ReadAll(io.LimitReader(resp.Body, 4096)); err == nil && json.Unmarshal(body, &p) == nil && p.Detail != "" {
+			cause = fmt.Errorf("server responded with status %s: %s", resp.Status, p.Detail)
+		}
+	}
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return New(ErrNotFound, op, cause)
+	case resp.StatusCode == http.StatusUnauthorized, resp.StatusCode == http.StatusForbidden:
+		return New(ErrUnauthorized, op, cause)
+	case resp.StatusCode == http.StatusTooManyRequests, resp.StatusCode >= http.StatusInternalServerError:
+		// Retry-After ответов 429 и 503 задает задержку перед повтором
+		if d, ok := parseRetryAfter(resp.Header.Get("Retry-After")); ok {
+			return WithRetryAfter(New(ErrRetriable, op, cause), d)
+		}
+		return New(ErrRetriable, op, cause)
+	case resp.StatusCode == http.StatusRequestEntityTooLarge:
+		return New(ErrTooLarge, op, cause)
+	case resp.StatusCode == http.StatusUnsupportedMediaType:
+		return New(ErrUnsupported, op, cause)
+	default:
+		return New(ErrInvalidValue, op, cause)
+	}
+}
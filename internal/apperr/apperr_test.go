@@ -0,0 +1,141 @@
+package apperr
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHTTPStatus(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{name: "not found", err: NotFound("op", "key"), want: http.StatusNotFound},
+		{name: "wrapped not found", err: fmt.Errorf("wrap: %w", NotFound("op", "key")), want: http.StatusNotFound},
+		{name: "wrong type", err: WrongType("op", "bool"), want: http.StatusBadRequest},
+		{name: "invalid value", err: InvalidValue("op", errors.New("bad")), want: http.StatusBadRequest},
+		{name: "unauthorized", err: Unauthorized("op", nil), want: http.StatusUnauthorized},
+		{name: "forbidden", err: Forbidden("op", nil), want: http.StatusForbidden},
+		{name: "too large", err: TooLarge("op", nil), want: http.StatusRequestEntityTooLarge},
+		{name: "body limit", err: fmt.Errorf("read: %w", &http.MaxBytesError{Limit: 1}), want: http.StatusRequestEntityTooLarge},
+		{name: "rate limited", err: RateLimited("op", nil), want: http.StatusTooManyRequests},
+		{name: "unsupported", err: Unsupported("op", nil), want: http.StatusUnsupportedMediaType},
+		{name: "retriable", err: Retriable("op", errors.New("conn refused")), want: http.StatusServiceUnavailable},
+		{name: "untyped", err: errors.New("boom"), want: http.StatusInternalServerError},
+		{name: "nil", err: nil, want: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, HTTPStatus(tt.err))
+		})
+	}
+}
+
+func TestError_IsAs(t *testing.T) {
+	cause := errors.New("connection refused")
+	err := fmt.Errorf("outer: %w", Retriable("SendRequest", cause))
+
+	assert.True(t, errors.Is(err, ErrRetriable))
+	assert.True(t, errors.Is(err, cause))
+	assert.False(t, errors.Is(err, ErrNotFound))
+
+	var typed *Error
+	if assert.True(t, errors.As(err, &typed)) {
+		assert.Equal(t, "SendRequest", typed.Op)
+	}
+}
+
+func TestWriteProblem(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	tests := []struct {
+		name       string
+		err        error
+		wantStatus int
+		wantCode   string
+		wantDetail bool
+	}{
+		{name: "not found", err: NotFound("GetValue", "m1"), wantStatus: http.StatusNotFound, wantCode: "not_found", wantDetail: true},
+		{name: "internal error hides detail", err: errors.New("sql: secret"), wantStatus: http.StatusInternalServerError, wantCode: "internal", wantDetail: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			WriteProblem(c, tt.err)
+
+			assert.Equal(t, tt.wantStatus, w.Code)
+			assert.Equal(t, ProblemContentType, w.Header().Get("Content-Type"))
+			assert.True(t, c.IsAborted())
+			var p Problem
+			if assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &p)) {
+				assert.Equal(t, tt.wantStatus, p.Status)
+				assert.Equal(t, tt.wantCode, p.Code)
+				assert.Equal(t, tt.wantDetail, p.Detail != "")
+			}
+		})
+	}
+}
+
+func TestFromResponse(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		body   string
+		want   error
+	}{
+		{name: "ok", status: http.StatusOK, want: nil},
+		{name: "bad request", status: http.StatusBadRequest, want: ErrInvalidValue},
+		{name: "unauthorized", status: http.StatusUnauthorized, want: ErrUnauthorized},
+		{name: "not found", status: http.StatusNotFound, want: ErrNotFound},
+		{name: "too many requests", status: http.StatusTooManyRequests, want: ErrRetriable},
+		{name: "too large", status: http.StatusRequestEntityTooLarge, want: ErrTooLarge},
+		{name: "unsupported", status: http.StatusUnsupportedMediaType, want: ErrUnsupported},
+		{name: "server error with problem", status: http.StatusServiceUnavailable, body: `{"status":503,"detail":"db down"}`, want: ErrRetriable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := &http.Response{
+				StatusCode: tt.status,
+				Status:     http.StatusText(tt.status),
+				Body:       io.NopCloser(strings.NewReader(tt.body)),
+			}
+			err := FromResponse("test", resp)
+			if tt.want == nil {
+				assert.NoError(t, err)
+				return
+			}
+			assert.ErrorIs(t, err, tt.want)
+			if tt.body != "" {
+				assert.Contains(t, err.Error(), "db down")
+			}
+		})
+	}
+}
+
+func TestFromResponse_RetryAfter(t *testing.T) {
+	resp := &http.Response{
+		StatusCode: http.StatusTooManyRequests,
+		Status:     http.StatusText(http.StatusTooManyRequests),
+		Header:     http.Header{"Retry-After": []string{"3"}},
+		Body:       io.NopCloser(strings.NewReader("")),
+	}
+	err := FromResponse("test", resp)
+	assert.ErrorIs(t, err, ErrRetriable)
+	d, ok := RetryAfter(err)
+	assert.True(t, ok)
+	assert.Equal(t, 3*time.Second, d)
+
+	resp.Header = nil
+	_, ok = RetryAfter(FromResponse("test", resp))
+	assert.False(t, ok)
+}
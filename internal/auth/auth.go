@@ -0,0 +1,160 @@
+// Package auth проверка HMAC-подписи запросов на изменение метрик. Подпись проверяется до распаковки тела,
+// независимо от Content-Encoding, и покрывает метод, путь, время подписи, nonce и тело запроса
+// (keyring.RequestPayload). Запрос с временем подписи вне допустимого расхождения часов или с уже
+// использованным nonce отклоняется, чтобы перехваченный запрос нельзя было отправить повторно.
+// Запросы без заголовка HashKeyID считаются подписанными по старой схеме -- только тело -- и принимаются
+// только вне режима обязательной подписи
+package auth
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"io"
+	"logger/cmd/server/initconf"
+	"logger/internal/apperr"
+	"logger/internal/keyring"
+	"logger/internal/logging"
+	"logger/internal/servermetrics"
+	"logger/internal/tracing"
+	"math"
+	"strconv"
+	"time"
+)
+
+// Значения по умолчанию защиты от повтора запросов
+const (
+	DefaultSkew           = 5 * time.Minute
+	DefaultNonceCacheSize = 100000
+)
+
+var (
+	ErrClockSkew    = errors.New("request timestamp is outside allowed clock skew")
+	ErrReplay       = errors.New("request nonce has already been used")
+	ErrNoTimestamp  = errors.New("request timestamp or nonce is missing")
+	ErrBadTimestamp = errors.New("request timestamp is invalid")
+	// ErrNonceCacheFull кэш nonce заполнен значениями в пределах окна, запрос следует повторить позже
+	ErrNonceCacheFull = errors.New("request nonce cache is full")
+)
+
+// Middleware проверка подписи запросов к route-ам routes (шаблоны gin, например "/updates").
+// Запросы к остальным route-ам пропускаются без проверки. Если config.RequireSignature, запрос без подписи
+// или с подписью по старой схеме отклоняется, иначе неподписанный запрос принимается, а подпись,
+// если она есть, проверяется
+func Middleware(config *initconf.Config, routes ...string) gin.HandlerFunc {
+	protected := make(map[string]bool, len(routes))
+	for _, r := range routes {
+		protected[r] = true
+	}
+	skew := time.Duration(config.SignatureSkew) * time.Second
+	if skew <= 0 {
+		skew = DefaultSkew
+	}
+	size := config.NonceCacheSize
+	if size <= 0 {
+		size = DefaultNonceCacheSize
+	}
+	// Запросы с временем подписи в пределах ±skew принимаются, поэтому nonce хранится 2*skew
+	g := &guard{skew: skew, nonces: NewNonceCache(size, 2*skew)}
+	return func(c *gin.Context) {
+		if !protected[c.FullPath()] || !config.KeyRing.Enabled() {
+			c.Next()
+			return
+		}
+		ctx, span := tracing.Start(c.Request.Context(), "auth.Middleware")
+		defer span.End()
+		c.Request = c.Request.WithContext(ctx)
+		logger := logging.FromContext(ctx)
+
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			err = fmt.Errorf("auth.Middleware: body read error: %w", err)
+			tracing.RecordError(span, err)
+			apperr.WriteProblem(c, err)
+			return
+		}
+		// Тело вычитано для проверки подписи -- передаем дальше его копию
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+		keyID := c.GetHeader(keyring.KeyIDHeader)
+		err = g.verify(c, config, keyID, body)
+		if errors.Is(err, ErrNonceCacheFull) {
+			// Подпись верна, но nonce негде запомнить: запрос отклоняется как временно невыполнимый
+			wait, _ := apperr.RetryAfter(err)
+			retryAfter := max(1, int(math.Ceil(wait.Seconds())))
+			logger.Warnw("auth.Middleware: nonce cache is full", "remote", c.ClientIP(), "route", c.FullPath(),
+				"key_id", keyID, "retry_after", retryAfter)
+			err = apperr.Retriable("auth.Middleware", err)
+			tracing.RecordError(span, err)
+			c.Header("Retry-After", strconv.Itoa(retryAfter))
+			apperr.WriteProblem(c, err)
+			return
+		}
+		if err != nil {
+			servermetrics.Default.HMACFailure()
+			// Подпись и ключ в лог не пишутся. reason позволяет отличить расхождение часов от повтора запроса
+			logger.Warnw("auth.Middleware: signature check failed", "remote", c.ClientIP(), "route", c.FullPath(),
+				"key_id", keyID, "reason", reason(err), "error", err)
+			err = apperr.Unauthorized("auth.Middleware", err)
+			tracing.RecordError(span, err)
+			apperr.WriteProblem(c, err)
+			return
+		}
+		c.Next()
+	}
+}
+
+// reason краткая причина отказа для лога
+func reason(err error) string {
+	switch {
+	case errors.Is(err, ErrClockSkew), errors.Is(err, ErrBadTimestamp):
+		return "clock_skew"
+	case errors.Is(err, ErrReplay):
+		return "replay"
+	case errors.Is(err, ErrNoTimestamp), errors.Is(err, keyring.ErrNoSignature):
+		return "unsigned"
+	default:
+		return "signature"
+	}
+}
+
+// guard защита от повтора подписанных запросов
+type guard struct {
+	skew   time.Duration
+	nonces *NonceCache
+}
+
+// verify проверка подписи запроса c с телом body. Nonce запоминается только после проверки подписи,
+// чтобы неподписанные запросы не могли заполнить кэш
+func (g *guard) verify(c *gin.Context, config *initconf.Config, keyID string, body []byte) error {
+	sig := c.GetHeader(keyring.SignatureHeader)
+	switch {
+	case sig == "" && !config.RequireSignature:
+		return nil
+	case sig == "":
+		return keyring.ErrNoSignature
+	case keyID == "" && config.RequireSignature:
+		return fmt.Errorf("%w: key id is required", keyring.ErrUnknownKey)
+	case keyID == "":
+		// Старая схема: подписано только тело
+		return config.KeyRing.Verify("", body, sig)
+	}
+
+	timestamp, nonce := c.GetHeader(keyring.TimestampHeader), c.GetHeader(keyring.NonceHeader)
+	if timestamp == "" || nonce == "" {
+		return ErrNoTimestamp
+	}
+	payload := keyring.RequestPayload(c.Request.Method, c.Request.URL.RequestURI(), timestamp, nonce, body)
+	if err := config.KeyRing.Verify(keyID, payload, sig); err != nil {
+		return err
+	}
+	sec, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("%w: %q", ErrBadTimestamp, timestamp)
+	}
+	if d := time.Since(time.Unix(sec, 0)); d > g.skew || d < -g.skew {
+		return fmt.Errorf("%w: request signed %s ago, allowed ±%s", ErrClockSkew, d.Round(time.Second), g.skew)
+	}
+	return g.nonces.Add(keyID + ":" + nonce)
+}
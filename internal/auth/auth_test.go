@@ -0,0 +1,213 @@
+package auth
+
+import (
+	"bytes"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"logger/cmd/server/initconf"
+	"logger/internal/apperr"
+	"logger/internal/keyring"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestMiddleware(t *testing.T) {
+	ring, err := keyring.New("", "a:s1")
+	require.NoError(t, err)
+	legacy, err := keyring.New("s1", "")
+	require.NoError(t, err)
+	body := []byte(`[{"id":"Alloc","type":"gauge","value":1}]`)
+
+	// sign подпись запроса как агентом: метод, путь и тело
+	sign := func(method, target string) func(r *http.Request) {
+		return func(r *http.Request) {
+			signed := httptest.NewRequest(method, target, nil)
+			ring.SignRequest(signed, body)
+			r.Header = signed.Header
+		}
+	}
+	// signBodyOnly подпись только тела без идентификатора ключа, как агентом без поддержки набора ключей
+	signBodyOnly := func(r *http.Request) {
+		_, sig, _ := legacy.Sign(body)
+		r.Header.Set(keyring.SignatureHeader, sig)
+	}
+
+	tests := []struct {
+		name     string
+		ring     *keyring.Ring
+		require  bool
+		method   string
+		target   string
+		sign     func(r *http.Request)
+		wantCode int
+	}{
+		{name: "signing disabled", method: http.MethodPost, target: "/updates", wantCode: http.StatusOK},
+		{name: "unsigned accepted", ring: ring, method: http.MethodPost, target: "/updates", wantCode: http.StatusOK},
+		{name: "unsigned rejected", ring: ring, require: true, method: http.MethodPost, target: "/updates", wantCode: http.StatusUnauthorized},
+		{name: "signed", ring: ring, require: true, method: http.MethodPost, target: "/updates", sign: sign(http.MethodPost, "/updates"), wantCode: http.StatusOK},
+		{name: "signed for other path", ring: ring, require: true, method: http.MethodPost, target: "/updates", sign: sign(http.MethodPost, "/update/"), wantCode: http.StatusUnauthorized},
+		{name: "signed for other method", ring: ring, require: true, method: http.MethodPost, target: "/updates", sign: sign(http.MethodPut, "/updates"), wantCode: http.StatusUnauthorized},
+		{name: "URL update signed", ring: ring, require: true, method: http.MethodPost, target: "/update/gauge/Alloc/1", sign: sign(http.MethodPost, "/update/gauge/Alloc/1"), wantCode: http.StatusOK},
+		{name: "URL update with other value", ring: ring, require: true, method: http.MethodPost, target: "/update/gauge/Alloc/2", sign: sign(http.MethodPost, "/update/gauge/Alloc/1"), wantCode: http.StatusUnauthorized},
+		{name: "body only signature accepted", ring: legacy, method: http.MethodPost, target: "/updates", sign: signBodyOnly, wantCode: http.StatusOK},
+		{name: "body only signature rejected", ring: legacy, require: true, method: http.MethodPost, target: "/updates", sign: signBodyOnly, wantCode: http.StatusUnauthorized},
+		{name: "read route not checked", ring: ring, require: true, method: http.MethodPost, target: "/value/", wantCode: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gin.SetMode(gin.TestMode)
+			config := &initconf.Config{KeyRing: tt.ring, RequireSignature: tt.require}
+			var got []byte
+			handler := func(c *gin.Context) {
+				got, _ = io.ReadAll(c.Request.Body)
+				c.Status(http.StatusOK)
+			}
+			router := gin.New()
+			router.Use(Middleware(config, "/update/:metricType/:metricName/:metricValue", "/updates"))
+			router.POST("/update/:metricType/:metricName/:metricValue", handler)
+			router.POST("/updates", handler)
+			router.POST("/value/", handler)
+
+			req := httptest.NewRequest(tt.method, tt.target, bytes.NewReader(body))
+			if tt.sign != nil {
+				tt.sign(req)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			assert.Equal(t, tt.wantCode, w.Code)
+			if tt.wantCode == http.StatusOK {
+				// Тело, вычитанное для проверки подписи, передается handler-у
+				assert.Equal(t, body, got)
+			}
+		})
+	}
+}
+
+func TestMiddleware_Replay(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	ring, err := keyring.New("", "a:s1")
+	require.NoError(t, err)
+	config := &initconf.Config{KeyRing: ring, RequireSignature: true, SignatureSkew: 60}
+	router := gin.New()
+	router.Use(Middleware(config, "/updates"))
+	router.POST("/updates", func(c *gin.Context) { c.Status(http.StatusOK) })
+	body := []byte(`[]`)
+
+	// signed запрос, подписанный в момент at с nonce
+	signed := func(at time.Time, nonce string) *http.Request {
+		req := httptest.NewRequest(http.MethodPost, "/updates", bytes.NewReader(body))
+		ts := strconv.FormatInt(at.Unix(), 10)
+		req.Header.Set(keyring.TimestampHeader, ts)
+		req.Header.Set(keyring.NonceHeader, nonce)
+		ring.SignHeader(req.Header, keyring.RequestPayload(http.MethodPost, "/updates", ts, nonce, body))
+		return req
+	}
+	do := func(req *http.Request) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	tests := []struct {
+		name       string
+		req        *http.Request
+		wantCode   int
+		wantDetail string
+	}{
+		{name: "fresh", req: signed(time.Now(), "n1"), wantCode: http.StatusOK},
+		{name: "replay", req: signed(time.Now(), "n1"), wantCode: http.StatusUnauthorized, wantDetail: ErrReplay.Error()},
+		{name: "new nonce", req: signed(time.Now(), "n2"), wantCode: http.StatusOK},
+		{name: "within skew", req: signed(time.Now().Add(-50*time.Second), "n3"), wantCode: http.StatusOK},
+		{name: "too old", req: signed(time.Now().Add(-2*time.Minute), "n4"), wantCode: http.StatusUnauthorized, wantDetail: ErrClockSkew.Error()},
+		{name: "from future", req: signed(time.Now().Add(2*time.Minute), "n5"), wantCode: http.StatusUnauthorized, wantDetail: ErrClockSkew.Error()},
+		{name: "too old is not remembered", req: signed(time.Now(), "n4"), wantCode: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := do(tt.req)
+			assert.Equal(t, tt.wantCode, w.Code)
+			assert.Contains(t, w.Body.String(), tt.wantDetail)
+		})
+	}
+
+	// Замена времени подписи без пересчета подписи
+	req := signed(time.Now().Add(-time.Hour), "n6")
+	req.Header.Set(keyring.TimestampHeader, strconv.FormatInt(time.Now().Unix(), 10))
+	assert.Equal(t, http.StatusUnauthorized, do(req).Code)
+	// Запрос без времени подписи и nonce
+	req = signed(time.Now(), "n7")
+	req.Header.Del(keyring.NonceHeader)
+	assert.Contains(t, do(req).Body.String(), ErrNoTimestamp.Error())
+}
+
+func TestNonceCache(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	n := NewNonceCache(2, time.Minute)
+	n.now = func() time.Time { return now }
+
+	assert.NoError(t, n.Add("a"))
+	assert.ErrorIs(t, n.Add("a"), ErrReplay)
+	now = now.Add(10 * time.Second)
+	assert.NoError(t, n.Add("b"))
+
+	// Nonce в пределах окна не вытесняются: при заполненном кэше новый nonce отклоняется до истечения
+	// окна самого старого, а повтор вытесняемого nonce по-прежнему обнаруживается
+	now = now.Add(50 * time.Second)
+	err := n.Add("c")
+	assert.ErrorIs(t, err, ErrNonceCacheFull)
+	wait, ok := apperr.RetryAfter(err)
+	assert.True(t, ok)
+	assert.Equal(t, time.Duration(0), wait)
+	assert.ErrorIs(t, n.Add("a"), ErrReplay)
+	assert.Equal(t, 2, n.Len())
+
+	// Окно самого старого nonce истекло -- место освобождается
+	now = now.Add(time.Nanosecond)
+	assert.NoError(t, n.Add("c"))
+	assert.Equal(t, 2, n.Len())
+	err = n.Add("d")
+	assert.ErrorIs(t, err, ErrNonceCacheFull)
+	wait, _ = apperr.RetryAfter(err)
+	assert.Equal(t, 10*time.Second-time.Nanosecond, wait)
+
+	// Nonce старше окна забываются
+	now = now.Add(2 * time.Minute)
+	assert.NoError(t, n.Add("a"))
+	assert.Equal(t, 1, n.Len())
+}
+
+func TestMiddleware_NonceCacheFull(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	ring, err := keyring.New("", "a:s1")
+	require.NoError(t, err)
+	config := &initconf.Config{KeyRing: ring, RequireSignature: true, SignatureSkew: 60, NonceCacheSize: 1}
+	router := gin.New()
+	router.Use(Middleware(config, "/updates"))
+	router.POST("/updates", func(c *gin.Context) { c.Status(http.StatusOK) })
+	body := []byte(`[]`)
+	do := func(nonce string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/updates", bytes.NewReader(body))
+		ts := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set(keyring.TimestampHeader, ts)
+		req.Header.Set(keyring.NonceHeader, nonce)
+		ring.SignHeader(req.Header, keyring.RequestPayload(http.MethodPost, "/updates", ts, nonce, body))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	assert.Equal(t, http.StatusOK, do("n1").Code)
+	// Кэш заполнен nonce в пределах окна: новый запрос отклоняется временно, n1 не вытесняется
+	w := do("n2")
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Contains(t, w.Body.String(), ErrNonceCacheFull.Error())
+	retryAfter, err := strconv.Atoi(w.Header().Get("Retry-After"))
+	require.NoError(t, err)
+	assert.InDelta(t, 120, retryAfter, 1)
+	assert.Equal(t, http.StatusUnauthorized, do("n1").Code)
+}
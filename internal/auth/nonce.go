@@ -0,0 +1,70 @@
+package auth
+
+import (
+	"container/list"
+	"logger/internal/apperr"
+	"sync"
+	"time"
+)
+
+// NonceCache использованные nonce подписанных запросов: не более size значений не старше window.
+// Запрос старше window отклоняется по времени подписи, поэтому более старые nonce хранить не нужно.
+// Nonce в пределах окна не вытесняются: иначе вытесненный запрос можно было бы повторить, поэтому
+// при заполненном кэше новые запросы отклоняются до истечения окна самого старого nonce
+type NonceCache struct {
+	mu     sync.Mutex
+	size   int
+	window time.Duration
+	ll     *list.List               // Элементы *nonceEntry, в начале -- последние добавленные
+	items  map[string]*list.Element // Nonce -> элемент ll
+	now    func() time.Time
+}
+
+type nonceEntry struct {
+	nonce string
+	added time.Time
+}
+
+// NewNonceCache создание NonceCache на size значений с окном window
+func NewNonceCache(size int, window time.Duration) *NonceCache {
+	return &NonceCache{
+		size:   size,
+		window: window,
+		ll:     list.New(),
+		items:  make(map[string]*list.Element),
+		now:    time.Now,
+	}
+}
+
+// Add запоминание nonce. ErrReplay, если nonce уже встречался в пределах окна, ErrNonceCacheFull с задержкой
+// до освобождения места (apperr.RetryAfter), если кэш заполнен nonce в пределах окна
+func (n *NonceCache) Add(nonce string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	now := n.now()
+	// Удаление устаревших значений с конца списка
+	for el := n.ll.Back(); el != nil && now.Sub(el.Value.(*nonceEntry).added) > n.window; el = n.ll.Back() {
+		n.remove(el)
+	}
+	if _, ok := n.items[nonce]; ok {
+		return ErrReplay
+	}
+	if n.ll.Len() >= n.size {
+		wait := n.window - now.Sub(n.ll.Back().Value.(*nonceEntry).added)
+		return apperr.WithRetryAfter(ErrNonceCacheFull, wait)
+	}
+	n.items[nonce] = n.ll.PushFront(&nonceEntry{nonce: nonce, added: now})
+	return nil
+}
+
+// Len количество сохраненных nonce
+func (n *NonceCache) Len() int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.ll.Len()
+}
+
+func (n *NonceCache) remove(el *list.Element) {
+	n.ll.Remove(el)
+	delete(n.items, el.Value.(*nonceEntry).nonce)
+}
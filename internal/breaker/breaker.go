@@ -0,0 +1,194 @@
+// Package breaker автоматический выключатель (circuit breaker) для вызовов внешнего сервиса.
+// В состоянии closed вызовы проходят, после FailureThreshold ошибок подряд breaker переходит в open
+// и отклоняет вызовы без обращения к сервису. Через OpenTimeout breaker переходит в half-open
+// и пропускает не более HalfOpenMaxCalls пробных вызовов: их успех закрывает breaker, ошибка снова открывает.
+package breaker
+
+import (
+	"errors"
+	"logger/internal/apperr"
+	"sync"
+	"time"
+)
+
+// State состояние breaker-а
+type State int
+
+const (
+	StateClosed State = iota
+	StateOpen
+	StateHalfOpen
+)
+
+func (s State) String() string {
+	switch s {
+	case StateClosed:
+		return "closed"
+	case StateOpen:
+		return "open"
+	case StateHalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+// ErrOpen вызов отклонен, так как breaker открыт или лимит пробных вызовов в half-open исчерпан.
+// Execute возвращает ErrOpen обернутой в apperr.ErrRetriable
+var ErrOpen = errors.New("circuit breaker is open")
+
+// Settings параметры breaker-а
+type Settings struct {
+	Name             string        // Имя breaker-а для логов и метрик
+	FailureThreshold int           // Количество ошибок подряд для перехода в open
+	OpenTimeout      time.Duration // Время в состоянии open до перехода в half-open
+	HalfOpenMaxCalls int           // Количество пробных вызовов в half-open, успех которых закрывает breaker
+	// IsFailure определение, считается ли ошибка отказом сервиса. По умолчанию -- любая ошибка
+	IsFailure func(err error) bool
+	// OnStateChange вызывается при каждой смене состояния под блокировкой breaker-а, поэтому не должна вызывать его методы
+	OnStateChange func(name string, from, to State)
+}
+
+// Counts снимок состояния breaker-а
+type Counts struct {
+	State               State
+	ConsecutiveFailures int
+	Transitions         int64 // Всего смен состояния
+	Opens               int64 // Всего переходов в open
+	Rejected            int64 // Всего отклоненных вызовов
+}
+
+// Breaker circuit breaker
+type Breaker struct {
+	mu        sync.Mutex
+	settings  Settings
+	state     State
+	failures  int       // Ошибок подряд в состоянии closed
+	successes int       // Успешных пробных вызовов в состоянии half-open
+	inFlight  int       // Выполняющихся пробных вызовов в состоянии half-open
+	openedAt  time.Time // Время перехода в open
+	counts    Counts
+	now       func() time.Time
+}
+
+// New создание breaker-а в состоянии closed. Нулевые параметры заменяются значениями по умолчанию
+func New(s Settings) *Breaker {
+	if s.FailureThreshold <= 0 {
+		s.FailureThreshold = 5
+	}
+	if s.OpenTimeout <= 0 {
+		s.OpenTimeout = 30 * time.Second
+	}
+	if s.HalfOpenMaxCalls <= 0 {
+		s.HalfOpenMaxCalls = 1
+	}
+	if s.IsFailure == nil {
+		s.IsFailure = func(err error) bool { return err != nil }
+	}
+	return &Breaker{settings: s, now: time.Now}
+}
+
+// State текущее состояние breaker-а с учетом истечения OpenTimeout
+func (b *Breaker) State() State {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.checkTimeout()
+	return b.state
+}
+
+// Counts снимок состояния и счетчиков breaker-а
+func (b *Breaker) Counts() Counts {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.checkTimeout()
+	c := b.counts
+	c.State = b.state
+	c.ConsecutiveFailures = b.failures
+	return c
+}
+
+// Execute выполнение fn, если breaker пропускает вызов. Результат fn учитывается в состоянии breaker-а
+func (b *Breaker) Execute(fn func() error) error {
+	if err := b.before(); err != nil {
+		return err
+	}
+	err := fn()
+	b.after(err)
+	return err
+}
+
+// before проверка возможности вызова
+func (b *Breaker) before() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.checkTimeout()
+	switch b.state {
+	case StateOpen:
+		b.counts.Rejected++
+		return apperr.Retriable("breaker."+b.settings.Name, ErrOpen)
+	case StateHalfOpen:
+		if b.inFlight >= b.settings.HalfOpenMaxCalls {
+			b.counts.Rejected++
+			return apperr.Retriable("breaker."+b.settings.Name, ErrOpen)
+		}
+		b.inFlight++
+	}
+	return nil
+}
+
+// after учет результата вызова
+func (b *Breaker) after(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	failure := err != nil && b.settings.IsFailure(err)
+	switch b.state {
+	case StateClosed:
+		if !failure {
+			b.failures = 0
+			return
+		}
+		b.failures++
+		if b.failures >= b.settings.FailureThreshold {
+			b.setState(StateOpen)
+		}
+	case StateHalfOpen:
+		b.inFlight--
+		if failure {
+			b.setState(StateOpen)
+			return
+		}
+		b.successes++
+		if b.successes >= b.settings.HalfOpenMaxCalls {
+			b.setState(StateClosed)
+		}
+	case StateOpen:
+		// Вызов начался до открытия breaker-а другим вызовом -- результат не влияет на состояние
+	}
+}
+
+// checkTimeout переход из open в half-open по истечении OpenTimeout. Вызывается под mu
+func (b *Breaker) checkTimeout() {
+	if b.state == StateOpen && b.now().Sub(b.openedAt) >= b.settings.OpenTimeout {
+		b.setState(StateHalfOpen)
+	}
+}
+
+// setState смена состояния со сбросом счетчиков. Вызывается под mu
+func (b *Breaker) setState(to State) {
+	from := b.state
+	if from == to {
+		return
+	}
+	b.state = to
+	b.failures = 0
+	b.successes = 0
+	b.inFlight = 0
+	b.counts.Transitions++
+	if to == StateOpen {
+		b.openedAt = b.now()
+		b.counts.Opens++
+	}
+	if b.settings.OnStateChange != nil {
+		b.settings.OnStateChange(b.settings.Name, from, to)
+	}
+}
@@ -0,0 +1,104 @@
+package breaker
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"logger/internal/apperr"
+	"testing"
+	"time"
+)
+
+var errFail = errors.New("server is down")
+
+func fail() error    { return errFail }
+func success() error { return nil }
+
+// newTestBreaker breaker с управляемым временем
+func newTestBreaker(s Settings) (*Breaker, *time.Time) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	b := New(s)
+	b.now = func() time.Time { return now }
+	return b, &now
+}
+
+func TestBreaker_OpensAfterThreshold(t *testing.T) {
+	var transitions []string
+	b, _ := newTestBreaker(Settings{
+		Name:             "test",
+		FailureThreshold: 3,
+		OpenTimeout:      time.Minute,
+		OnStateChange: func(name string, from, to State) {
+			transitions = append(transitions, from.String()+"->"+to.String())
+		},
+	})
+
+	for i := 0; i < 2; i++ {
+		assert.ErrorIs(t, b.Execute(fail), errFail)
+	}
+	// Успешный вызов сбрасывает счетчик ошибок подряд
+	assert.NoError(t, b.Execute(success))
+	for i := 0; i < 3; i++ {
+		assert.ErrorIs(t, b.Execute(fail), errFail)
+	}
+	assert.Equal(t, StateOpen, b.State())
+
+	called := false
+	err := b.Execute(func() error { called = true; return nil })
+	assert.False(t, called)
+	assert.ErrorIs(t, err, ErrOpen)
+	assert.ErrorIs(t, err, apperr.ErrRetriable)
+	assert.Equal(t, []string{"closed->open"}, transitions)
+	assert.Equal(t, int64(1), b.Counts().Rejected)
+}
+
+func TestBreaker_HalfOpen(t *testing.T) {
+	tests := []struct {
+		name      string
+		probes    []func() error
+		wantState State
+	}{
+		{name: "probes succeed", probes: []func() error{success, success}, wantState: StateClosed},
+		{name: "probe fails", probes: []func() error{fail}, wantState: StateOpen},
+		{name: "one probe of two", probes: []func() error{success}, wantState: StateHalfOpen},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, now := newTestBreaker(Settings{FailureThreshold: 1, OpenTimeout: time.Minute, HalfOpenMaxCalls: 2})
+			_ = b.Execute(fail)
+			assert.Equal(t, StateOpen, b.State())
+
+			*now = now.Add(time.Minute)
+			assert.Equal(t, StateHalfOpen, b.State())
+			for _, probe := range tt.probes {
+				_ = b.Execute(probe)
+			}
+			assert.Equal(t, tt.wantState, b.State())
+		})
+	}
+}
+
+func TestBreaker_HalfOpenLimitsProbes(t *testing.T) {
+	b, now := newTestBreaker(Settings{FailureThreshold: 1, OpenTimeout: time.Second, HalfOpenMaxCalls: 1})
+	_ = b.Execute(fail)
+	*now = now.Add(time.Second)
+
+	// Пока пробный вызов выполняется, следующие вызовы отклоняются
+	var inner error
+	err := b.Execute(func() error {
+		inner = b.Execute(success)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.ErrorIs(t, inner, ErrOpen)
+	assert.Equal(t, StateClosed, b.State())
+}
+
+func TestBreaker_IsFailure(t *testing.T) {
+	errBadRequest := errors.New("bad request")
+	b, _ := newTestBreaker(Settings{
+		FailureThreshold: 1,
+		IsFailure:        func(err error) bool { return !errors.Is(err, errBadRequest) },
+	})
+	assert.ErrorIs(t, b.Execute(func() error { return errBadRequest }), errBadRequest)
+	assert.Equal(t, StateClosed, b.State())
+}
@@ -0,0 +1,244 @@
+// Package collector сбор метрик агента набором независимых коллекторов.
+// Каждый коллектор регистрируется в Registry со своими интервалом, таймаутом и признаком включения.
+// Результат сбора накапливается в Batch и переносится в общий Sink под блокировкой одним куском,
+// поэтому ошибка, паника или зависание одного коллектора не затрагивает остальные.
+package collector
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"logger/internal/logging"
+	"sync"
+	"time"
+)
+
+// Sink приемник собранных значений метрик
+type Sink interface {
+	SetGauge(name string, value float64)
+	SetCounter(name string, value int64)
+	AddCounter(name string, delta int64)
+}
+
+// Collector источник метрик
+type Collector interface {
+	Name() string
+	Collect(ctx context.Context, s Sink) error
+}
+
+type funcCollector struct {
+	name string
+	fn   func(ctx context.Context, s Sink) error
+}
+
+func (f funcCollector) Name() string { return f.name }
+
+func (f funcCollector) Collect(ctx context.Context, s Sink) error { return f.fn(ctx, s) }
+
+// New коллектор из функции fn
+func New(name string, fn func(ctx context.Context, s Sink) error) Collector {
+	return funcCollector{name: name, fn: fn}
+}
+
+// Options параметры запуска коллектора
+type Options struct {
+	Enabled  bool
+	Interval time.Duration // Период сбора
+	Timeout  time.Duration // Максимальное время одного сбора. 0 -- равен Interval
+}
+
+// ErrTimeout сбор не завершился за Options.Timeout, собранные значения отброшены
+var ErrTimeout = errors.New("collector timeout")
+
+type entry struct {
+	c    Collector
+	opts Options
+}
+
+// Registry набор коллекторов, собирающих метрики в общий Sink
+type Registry struct {
+	sink     Sink
+	locker   sync.Locker // Блокировка, под которой пишется sink
+	entries  []entry
+	observer Observer
+}
+
+// Observer получает результат каждого сбора: имя коллектора, длительность и ошибку.
+// Вызывается из горутины коллектора
+type Observer func(name string, d time.Duration, err error)
+
+// NewRegistry создание Registry. Значения коллекторов переносятся в sink под блокировкой locker
+func NewRegistry(sink Sink, locker sync.Locker) *Registry {
+	return &Registry{sink: sink, locker: locker}
+}
+
+// Register регистрация коллектора. Имена коллекторов должны быть уникальны
+func (r *Registry) Register(c Collector, opts Options) error {
+	for _, e := range r.entries {
+		if e.c.Name() == c.Name() {
+			return fmt.Errorf("collector %s already registered", c.Name())
+		}
+	}
+	if opts.Enabled && opts.Interval <= 0 {
+		return fmt.Errorf("collector %s: interval must be positive", c.Name())
+	}
+	r.entries = append(r.entries, entry{c: c, opts: opts})
+	return nil
+}
+
+// Observe установка observer-а сборов. Вызывается до Run
+func (r *Registry) Observe(o Observer) {
+	r.observer = o
+}
+
+// Names имена зарегистрированных коллекторов
+func (r *Registry) Names() []string {
+	names := make([]string, 0, len(r.entries))
+	for _, e := range r.entries {
+		names = append(names, e.c.Name())
+	}
+	return names
+}
+
+// Run запуск сбора всеми включенными коллекторами. Каждый коллектор работает в своей горутине,
+// первый сбор выполняется сразу. Run возвращает управление после отмены ctx и остановки всех коллекторов
+func (r *Registry) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, e := range r.entries {
+		if !e.opts.Enabled {
+			logging.FromContext(ctx).Infow("collector is disabled", "collector", e.c.Name())
+			continue
+		}
+		wg.Add(1)
+		go func(e entry) {
+			defer wg.Done()
+			r.loop(ctx, e)
+		}(e)
+	}
+	wg.Wait()
+}
+
+// loop периодический сбор одним коллектором
+func (r *Registry) loop(ctx context.Context, e entry) {
+	logger := logging.FromContext(ctx).With("collector", e.c.Name())
+	logger.Infow("start collector", "interval", e.opts.Interval)
+	ticker := time.NewTicker(e.opts.Interval)
+	defer ticker.Stop()
+	for {
+		start := time.Now()
+		err := r.collect(ctx, e)
+		// Сбор, прерванный остановкой агента, не является ошибкой коллектора
+		if ctx.Err() != nil && errors.Is(err, ctx.Err()) {
+			logger.Infow("stop collector")
+			return
+		}
+		if err != nil {
+			logger.Warnw("collect failed", "error", err)
+		}
+		if r.observer != nil {
+			r.observer(e.c.Name(), time.Since(start), err)
+		}
+		select {
+		case <-ctx.Done():
+			logger.Infow("stop collector")
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// collect однократный сбор коллектором e с таймаутом и перехватом паники.
+// Значения переносятся в sink только при успешном завершении сбора. При отмене parent возвращается parent.Err(),
+// ErrTimeout -- только по истечении таймаута коллектора
+func (r *Registry) collect(parent context.Context, e entry) error {
+	timeout := e.opts.Timeout
+	if timeout <= 0 {
+		timeout = e.opts.Interval
+	}
+	ctx, cancel := context.WithTimeout(parent, timeout)
+	defer cancel()
+
+	batch := NewBatch()
+	done := make(chan error, 1)
+	// Коллектор, не проверяющий ctx, продолжит работу в своей горутине после таймаута,
+	// но его значения в sink не попадут
+	go func() {
+		defer func() {
+			if p := recover(); p != nil {
+				done <- fmt.Errorf("panic in collector %s: %v", e.c.Name(), p)
+			}
+		}()
+		done <- e.c.Collect(ctx, batch)
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			return err
+		}
+	case <-ctx.Done():
+		if err := parent.Err(); err != nil {
+			return err
+		}
+		return fmt.Errorf("%w: %s after %v", ErrTimeout, e.c.Name(), timeout)
+	}
+
+	r.locker.Lock()
+	batch.MergeInto(r.sink)
+	r.locker.Unlock()
+	return nil
+}
+
+// Batch буфер значений одного сбора, реализует Sink
+type Batch struct {
+	mu       sync.Mutex
+	gauges   map[string]float64
+	counters map[string]int64 // Значения, заданные SetCounter
+	deltas   map[string]int64 // Приращения, заданные AddCounter
+}
+
+func NewBatch() *Batch {
+	return &Batch{
+		gauges:   make(map[string]float64),
+		counters: make(map[string]int64),
+		deltas:   make(map[string]int64),
+	}
+}
+
+func (b *Batch) SetGauge(name string, value float64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.gauges[name] = value
+}
+
+func (b *Batch) SetCounter(name string, value int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.counters[name] = value
+	delete(b.deltas, name)
+}
+
+func (b *Batch) AddCounter(name string, delta int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.counters[name]; ok {
+		b.counters[name] += delta
+		return
+	}
+	b.deltas[name] += delta
+}
+
+// MergeInto перенос значений в s
+func (b *Batch) MergeInto(s Sink) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for k, v := range b.gauges {
+		s.SetGauge(k, v)
+	}
+	for k, v := range b.counters {
+		s.SetCounter(k, v)
+	}
+	for k, v := range b.deltas {
+		s.AddCounter(k, v)
+	}
+}
@@ -0,0 +1,180 @@
+package collector
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testSink Sink для проверки перенесенных значений
+type testSink struct {
+	gauges   map[string]float64
+	counters map[string]int64
+}
+
+func newTestSink() *testSink {
+	return &testSink{gauges: make(map[string]float64), counters: make(map[string]int64)}
+}
+
+func (s *testSink) SetGauge(name string, value float64) { s.gauges[name] = value }
+func (s *testSink) SetCounter(name string, value int64) { s.counters[name] = value }
+func (s *testSink) AddCounter(name string, delta int64) { s.counters[name] += delta }
+
+func TestBatch_MergeInto(t *testing.T) {
+	sink := newTestSink()
+	sink.counters["Existing"] = 10
+	sink.counters["Reset"] = 10
+
+	b := NewBatch()
+	b.SetGauge("Gauge", 1.5)
+	b.AddCounter("Existing", 2)
+	b.AddCounter("Existing", 3)
+	b.SetCounter("Reset", 1)
+	b.AddCounter("Reset", 1)
+	b.MergeInto(sink)
+
+	assert.Equal(t, 1.5, sink.gauges["Gauge"])
+	assert.Equal(t, int64(15), sink.counters["Existing"])
+	assert.Equal(t, int64(2), sink.counters["Reset"])
+}
+
+func TestRegistry_Register(t *testing.T) {
+	r := NewRegistry(newTestSink(), &sync.Mutex{})
+	noop := func(ctx context.Context, s Sink) error { return nil }
+
+	assert.NoError(t, r.Register(New("a", noop), Options{Enabled: true, Interval: time.Second}))
+	assert.Error(t, r.Register(New("a", noop), Options{Enabled: true, Interval: time.Second}), "duplicate name")
+	assert.Error(t, r.Register(New("b", noop), Options{Enabled: true}), "zero interval")
+	assert.NoError(t, r.Register(New("c", noop), Options{Enabled: false}), "disabled collector needs no interval")
+	assert.Equal(t, []string{"a", "c"}, r.Names())
+}
+
+func TestRegistry_collect(t *testing.T) {
+	tests := []struct {
+		name      string
+		fn        func(ctx context.Context, s Sink) error
+		wantErr   bool
+		wantMerge bool
+	}{
+		{
+			name: "success",
+			fn: func(ctx context.Context, s Sink) error {
+				s.SetGauge("Value", 1)
+				return nil
+			},
+			wantMerge: true,
+		},
+		{
+			name: "error discards batch",
+			fn: func(ctx context.Context, s Sink) error {
+				s.SetGauge("Value", 1)
+				return errors.New("read /proc failed")
+			},
+			wantErr: true,
+		},
+		{
+			name: "panic is recovered",
+			fn: func(ctx context.Context, s Sink) error {
+				s.SetGauge("Value", 1)
+				panic("index out of range")
+			},
+			wantErr: true,
+		},
+		{
+			name: "timeout discards batch",
+			fn: func(ctx context.Context, s Sink) error {
+				s.SetGauge("Value", 1)
+				time.Sleep(time.Second)
+				return nil
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sink := newTestSink()
+			r := NewRegistry(sink, &sync.Mutex{})
+			e := entry{c: New(tt.name, tt.fn), opts: Options{Enabled: true, Interval: time.Second, Timeout: 20 * time.Millisecond}}
+
+			err := r.collect(context.Background(), e)
+			assert.Equal(t, tt.wantErr, err != nil, "error: %v", err)
+			_, merged := sink.gauges["Value"]
+			assert.Equal(t, tt.wantMerge, merged)
+		})
+	}
+}
+
+func TestRegistry_Run(t *testing.T) {
+	var mu sync.Mutex
+	sink := newTestSink()
+	r := NewRegistry(sink, &mu)
+
+	var fastCalls, disabledCalls atomic.Int32
+	_ = r.Register(New("fast", func(ctx context.Context, s Sink) error {
+		fastCalls.Add(1)
+		s.AddCounter("Calls", 1)
+		return nil
+	}), Options{Enabled: true, Interval: 5 * time.Millisecond})
+	_ = r.Register(New("failing", func(ctx context.Context, s Sink) error {
+		panic("collector bug")
+	}), Options{Enabled: true, Interval: 5 * time.Millisecond})
+	_ = r.Register(New("disabled", func(ctx context.Context, s Sink) error {
+		disabledCalls.Add(1)
+		return nil
+	}), Options{Enabled: false})
+
+	// Observer получает результат каждого сбора, кроме прерванного остановкой
+	var observed sync.Map // имя коллектора -> *atomic.Int32 ошибок
+	var fastMerged atomic.Int32
+	r.Observe(func(name string, d time.Duration, err error) {
+		v, _ := observed.LoadOrStore(name, &atomic.Int32{})
+		if err != nil {
+			v.(*atomic.Int32).Add(1)
+		} else if name == "fast" {
+			fastMerged.Add(1)
+		}
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	r.Run(ctx)
+
+	// Паника одного коллектора не останавливает остальные
+	assert.Greater(t, fastCalls.Load(), int32(2))
+	assert.Equal(t, int32(0), disabledCalls.Load())
+	failing, ok := observed.Load("failing")
+	assert.True(t, ok)
+	assert.Greater(t, failing.(*atomic.Int32).Load(), int32(0))
+	fast, ok := observed.Load("fast")
+	assert.True(t, ok)
+	assert.Equal(t, int32(0), fast.(*atomic.Int32).Load())
+	_, ok = observed.Load("disabled")
+	assert.False(t, ok)
+	// В sink попадают только сборы, завершившиеся до остановки
+	mu.Lock()
+	assert.Equal(t, int64(fastMerged.Load()), sink.counters["Calls"])
+	mu.Unlock()
+}
+
+func TestRegistry_collect_ParentCanceled(t *testing.T) {
+	sink := newTestSink()
+	r := NewRegistry(sink, &sync.Mutex{})
+	release := make(chan struct{})
+	defer close(release)
+	e := entry{c: New("slow", func(ctx context.Context, s Sink) error {
+		<-release
+		s.SetGauge("Value", 1)
+		return nil
+	}), opts: Options{Enabled: true, Interval: time.Second}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := r.collect(ctx, e)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.NotErrorIs(t, err, ErrTimeout)
+	assert.NotContains(t, sink.gauges, "Value")
+}
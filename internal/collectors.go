@@ -0,0 +1,45 @@
+package internal
+
+import (
+	"context"
+	"logger/conf"
+	"logger/internal/collector"
+	"logger/internal/selfmetrics"
+	"time"
+)
+
+// DefaultCollectors коллекторы метрик агента. Имя коллектора используется в настройках агента
+// для отключения коллектора и задания его интервала и таймаута.
+// Коллектор процессов добавляется, только если в конфигурации задан список процессов
+func DefaultCollectors(config *conf.AgentConfig) []collector.Collector {
+	collectors := []collector.Collector{
+		collector.New("runtime", func(_ context.Context, s collector.Sink) error {
+			return MetricsPolling(s)
+		}),
+		collector.New("gops", func(_ context.Context, s collector.Sink) error {
+			return GopsMetricPolling(s)
+		}),
+		collector.New("breaker", func(_ context.Context, s collector.Sink) error {
+			BreakerMetricsPolling(s)
+			return nil
+		}),
+		collector.New("self", selfmetrics.Default.Collect),
+		collector.New("load", LoadMetricPolling),
+		collector.New("swap", SwapMetricPolling),
+		collector.New("disk", DiskMetricPolling),
+		collector.New("net", NetMetricPolling),
+		collector.New("fd", FDMetricPolling),
+	}
+	if len(config.ProcessList) > 0 {
+		collectors = append(collectors, newProcessCollector(config.ProcessList))
+	}
+	return collectors
+}
+
+// ObserveCollector запись длительности и ошибок сбора коллектором в метрики агента
+func ObserveCollector(name string, d time.Duration, err error) {
+	selfmetrics.Default.ObserveDuration(selfmetrics.CollectDuration(name), d)
+	if err != nil {
+		selfmetrics.Default.AddCounter(selfmetrics.CollectErrors(name), 1)
+	}
+}
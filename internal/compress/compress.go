@@ -1,18 +1,25 @@
+// Package compress кодирование тел запросов и ответов: gzip, deflate и zstd. Кодек тела запроса задается
+// заголовком Content-Encoding, кодек ответа выбирается по Accept-Encoding клиента. Content-Encoding: compress,
+// который отсылали агенты прежних версий, принимается как gzip.
 package compress
 
 import (
+	"bufio"
 	"bytes"
+	"compress/flate"
 	"compress/gzip"
+	"compress/zlib"
 	"context"
-	"crypto/hmac"
-	"crypto/sha256"
-	"encoding/hex"
+	"errors"
 	"fmt"
 	"github.com/gin-gonic/gin"
+	"github.com/klauspost/compress/zstd"
 	"io"
-	"log"
-	"logger/cmd/server/initconf"
+	"logger/internal/apperr"
+	"logger/internal/logging"
+	"logger/internal/tracing"
 	"net/http"
+	"strconv"
 	"strings"
 )
 
@@ -23,144 +30,289 @@ const (
 	NoCompression      = gzip.NoCompression
 )
 
-var contentTypeToCompressMap = map[string]bool{
-	"text/html":                true,
-	"text/html; charset=utf-8": true,
-	"application/json":         true,
+// Имена кодеков в заголовках Content-Encoding и Accept-Encoding
+const (
+	Gzip     = "gzip"
+	Deflate  = "deflate"
+	Zstd     = "zstd"
+	Identity = "identity"
+	// Legacy имя gzip, которое отсылали агенты прежних версий
+	Legacy = "compress"
+)
+
+// zstdMaxWindow максимальное окно zstd при распаковке. Окно, заявленное в заголовке кадра, выделяется
+// в памяти до распаковки данных, поэтому оно ограничивается независимо от размера тела
+const zstdMaxWindow = 8 << 20
+
+// ErrUnsupportedEncoding неизвестный кодек тела запроса
+var ErrUnsupportedEncoding = errors.New("unsupported content encoding")
+
+// preference порядок выбора кодека ответа при одинаковом q-value в Accept-Encoding
+var preference = []string{Zstd, Gzip, Deflate}
+
+// Normalize каноническое имя кодека name: регистр не учитывается, compress и x-gzip -- gzip,
+// пустая строка -- identity. Ошибка ErrUnsupportedEncoding для неизвестного кодека
+func Normalize(name string) (string, error) {
+	switch n := strings.ToLower(strings.TrimSpace(name)); n {
+	case Gzip, "x-gzip", Legacy:
+		return Gzip, nil
+	case Deflate, Zstd, Identity:
+		return n, nil
+	case "":
+		return Identity, nil
+	default:
+		return "", fmt.Errorf("%w %q", ErrUnsupportedEncoding, name)
+	}
 }
 
-type gzipWriter struct {
-	gin.ResponseWriter
-	writer *gzip.Writer
+// zstdLevel уровень сжатия zstd, соответствующий уровню gzip level
+func zstdLevel(level int) zstd.EncoderLevel {
+	switch {
+	case level == DefaultCompression:
+		return zstd.SpeedDefault
+	case level <= BestSpeed:
+		return zstd.SpeedFastest
+	case level >= BestCompression:
+		return zstd.SpeedBestCompression
+	default:
+		return zstd.SpeedBetterCompression
+	}
 }
 
-func (g gzipWriter) Write(data []byte) (int, error) {
-	g.Header().Del("Content-Length")
-	return g.writer.Write(data)
+// NewWriter кодирующий writer кодека encoding поверх w с уровнем сжатия level (BestSpeed..BestCompression).
+// Для deflate используется формат zlib (RFC 1950), как того требует HTTP
+func NewWriter(encoding string, w io.Writer, level int) (io.WriteCloser, error) {
+	name, err := Normalize(encoding)
+	if err != nil {
+		return nil, err
+	}
+	switch name {
+	case Gzip:
+		return gzip.NewWriterLevel(w, level)
+	case Deflate:
+		return zlib.NewWriterLevel(w, level)
+	case Zstd:
+		return zstd.NewWriter(w, zstd.WithEncoderLevel(zstdLevel(level)), zstd.WithEncoderConcurrency(1))
+	default:
+		return nopWriteCloser{w}, nil
+	}
 }
 
-func (g *gzipWriter) WriteString(s string) (int, error) {
-	g.Header().Del("Content-Length")
-	return g.writer.Write([]byte(s))
+// nopWriteCloser writer без кодирования для identity
+type nopWriteCloser struct {
+	io.Writer
 }
 
-//func GzipResponseHandle(level int) gin.HandlerFunc {
-//	return func(c *gin.Context) {
-//
-//		if !shouldCompress(c.Request) {
-//			c.Next()
-//			return
-//		}
-//		// создаём compress.Writer поверх текущего c.Writer
-//		gz, err := gzip.NewWriterLevel(c.Writer, level)
-//		if err != nil {
-//			io.WriteString(c.Writer, err.Error())
-//			return
-//		}
-//		c.Header("Content-Encoding", "compress")
-//		c.Header("Vary", "Accept-Encoding")
-//		c.Writer = &gzipWriter{c.Writer, gz}
-//		defer func() {
-//			c.Header("Content-Length", "0")
-//			gz.Close()
-//		}()
-//		c.Next()
-//	}
-//}
-
-func shouldCompress(req *http.Request) bool {
-	if !strings.Contains(req.Header.Get("Accept-Encoding"), "compress") {
-		log.Println("There is no Accept-Encoding.")
-		return false
-	}
-
-	// Если Content-Type запроса содержится в contentTypeToCompressMap -- включается сжатие
-	if contentTypeToCompressMap[req.Header.Get("content-type")] {
-		log.Println("compress compression for Content-Type", req.Header.Get("content-type"), "enabled")
-		return true
-	}
-
-	if contentTypeToCompressMap[req.Header.Get("Accept")] {
-		log.Println("compress compression for Content-Type", req.Header.Get("content-type"), "enabled")
-		return true
-	}
-
-	log.Println("Default - do not encode. Content-Type is", req.Header.Get("Content-Type"))
-	return false
+func (nopWriteCloser) Close() error { return nil }
+
+// NewReader декодирующий reader кодека encoding поверх r. Для deflate принимается и zlib, и raw deflate,
+// который отсылают некоторые клиенты
+func NewReader(encoding string, r io.Reader) (io.ReadCloser, error) {
+	name, err := Normalize(encoding)
+	if err != nil {
+		return nil, err
+	}
+	switch name {
+	case Gzip:
+		return gzip.NewReader(r)
+	case Deflate:
+		br := bufio.NewReader(r)
+		// Заголовок zlib: метод сжатия 8 и контрольная сумма первых двух байт, кратная 31
+		if h, err := br.Peek(2); err == nil && h[0]&0x0f == 8 && (uint16(h[0])<<8|uint16(h[1]))%31 == 0 {
+			return zlib.NewReader(br)
+		}
+		return flate.NewReader(br), nil
+	case Zstd:
+		d, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxWindow(zstdMaxWindow))
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	default:
+		return io.NopCloser(r), nil
+	}
 }
 
-func checkSign(body []byte, hash string, config *initconf.Config) (bool, error) {
-	if config.Key == "" {
-		return false, nil
+// Encode кодирование data кодеком encoding с уровнем сжатия по умолчанию
+func Encode(encoding string, data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := NewWriter(encoding, &buf, DefaultCompression)
+	if err != nil {
+		return nil, err
 	}
-	var (
-		data []byte // Декодированный hash с подписью
-		err  error
-		sign []byte // HMAC-подпись от идентификатора
-	)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
 
-	data, err = hex.DecodeString(hash)
+// Negotiate выбор кодека ответа по заголовку Accept-Encoding: кодек с наибольшим q-value,
+// при равных q-value -- в порядке preference. identity, если клиент не принимает ни один из кодеков
+func Negotiate(acceptEncoding string) string {
+	weights := make(map[string]float64)
+	wildcard := -1.0
+	for _, item := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(item, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			parsed, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+			if err != nil {
+				continue
+			}
+			q = parsed
+		}
+		switch name {
+		case "*":
+			wildcard = q
+		case "x-gzip":
+			weights[Gzip] = q
+		case "":
+		default:
+			weights[name] = q
+		}
+	}
+	best, bestQ := Identity, 0.0
+	for _, name := range preference {
+		q, ok := weights[name]
+		if !ok {
+			q = wildcard
+		}
+		if q > bestQ {
+			best, bestQ = name, q
+		}
+	}
+	return best
+}
+
+// encodeWriter gin.ResponseWriter, кодирующий тело ответа. Кодирование начинается с первой записи тела,
+// поэтому ответы без тела (204, 304, ошибки без problem body) передаются без Content-Encoding
+type encodeWriter struct {
+	gin.ResponseWriter
+	encoding string
+	level    int
+	enc      io.WriteCloser
+	bypass   bool // Handler сам закодировал тело и установил Content-Encoding
+}
+
+func (w *encodeWriter) start() error {
+	if w.enc != nil || w.bypass {
+		return nil
+	}
+	h := w.Header()
+	if h.Get("Content-Encoding") != "" {
+		w.bypass = true
+		return nil
+	}
+	enc, err := NewWriter(w.encoding, w.ResponseWriter, w.level)
 	if err != nil {
-		log.Println("checkSign: hex.DecodeString error", err)
-		return true, err
+		return err
+	}
+	h.Set("Content-Encoding", w.encoding)
+	h.Del("Content-Length")
+	w.enc = enc
+	return nil
+}
+
+func (w *encodeWriter) Write(data []byte) (int, error) {
+	if err := w.start(); err != nil {
+		return 0, err
+	}
+	if w.bypass {
+		return w.ResponseWriter.Write(data)
+	}
+	return w.enc.Write(data)
+}
+
+func (w *encodeWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+// Flush отправка клиенту уже закодированных данных, например, для потоковых ответов
+func (w *encodeWriter) Flush() {
+	if f, ok := w.enc.(interface{ Flush() error }); ok {
+		_ = f.Flush()
 	}
-	h := hmac.New(sha256.New, []byte(config.Key))
-	h.Write(body)
-	sign = h.Sum(nil)
+	w.ResponseWriter.Flush()
+}
 
-	if hmac.Equal(sign, data) {
-		fmt.Println("Подпись подлинна.")
-		return true, nil
-	} else {
-		log.Println("Подпись неверна.")
-		return true, fmt.Errorf("%s %v", "checkSign error: signature is incorrect ", err)
+// close завершение кодирования тела ответа
+func (w *encodeWriter) close() error {
+	if w.enc == nil {
+		return nil
 	}
+	return w.enc.Close()
 }
 
-func GzipRequestHandle(_ context.Context, config *initconf.Config) gin.HandlerFunc {
+// ResponseHandle кодирование тела ответа кодеком, выбранным по Accept-Encoding запроса, с уровнем сжатия level
+func ResponseHandle(level int) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		var body []byte
-		var newBody *bytes.Reader
-		var gz *gzip.Reader
-		var err error
-		if c.Request.Header.Get(`Content-Encoding`) == `compress` {
-			log.Println("c.Request.Header.Get(\"HashSHA256\") is :", c.Request.Header.Get("HashSHA256"))
-			if hash := c.Request.Header.Get("HashSHA256"); hash != "" {
-				body, err = io.ReadAll(c.Request.Body)
-				if err != nil {
-					log.Println("GzipRequestHandle: ioutil.ReadAll body error", err)
-					c.Status(http.StatusInternalServerError)
-					return
-				}
-				keyBool, err := checkSign(body, hash, config)
-				if keyBool {
-					if err != nil {
-						log.Println("GzipRequestHandle: checkSign error", err)
-						c.Status(http.StatusBadRequest)
-						return
-					}
-				}
-				// Ввиду того, что c.Request.Body был вычитан s body с помощью io.ReadAll -- делаем его копию для передачи в gz
-				newBody = bytes.NewReader(body)
-				gz, err = gzip.NewReader(newBody)
-				if err != nil {
-					log.Println("Error in GzipRequestHandle:", err)
-					c.Status(http.StatusInternalServerError)
-					return
-				}
-			} else {
-				gz, err = gzip.NewReader(c.Request.Body)
-				if err != nil {
-					log.Println("Error in GzipRequestHandle:", err)
-					c.Status(http.StatusInternalServerError)
-					return
-				}
+		c.Header("Vary", "Accept-Encoding")
+		encoding := Negotiate(c.GetHeader("Accept-Encoding"))
+		// Upgrade соединения и потоки событий не кодируются
+		if encoding == Identity || c.GetHeader("Upgrade") != "" || c.GetHeader("Accept") == "text/event-stream" {
+			c.Next()
+			return
+		}
+		w := &encodeWriter{ResponseWriter: c.Writer, encoding: encoding, level: level}
+		c.Writer = w
+		defer func() {
+			if err := w.close(); err != nil {
+				logging.FromContext(c.Request.Context()).Infow("compress.ResponseHandle: encoder close failed",
+					"encoding", encoding, "error", err)
 			}
-			log.Println("compress decompression")
+		}()
+		c.Next()
+	}
+}
 
-			defer gz.Close()
-			c.Request.Body = gz
+// RequestHandle распаковка тела запроса согласно Content-Encoding. Подпись запроса проверяется
+// до распаковки middleware auth.Middleware. Распакованное тело ограничено maxSize байтами, чтобы
+// небольшое сжатое тело с большим коэффициентом сжатия не исчерпало память. Для route-ов из routes (шаблоны gin)
+// действует собственный лимит. Лимит <= 0 -- без ограничения. Неизвестный кодек отклоняется с кодом 415
+func RequestHandle(ctx context.Context, maxSize int64, routes map[string]int64) gin.HandlerFunc {
+	logger := logging.FromContext(ctx)
+	return func(c *gin.Context) {
+		maxSize := maxSize
+		if v, ok := routes[c.FullPath()]; ok {
+			maxSize = v
+		}
+		header := c.Request.Header.Get("Content-Encoding")
+		if header == "" || c.Request.Body == nil {
 			c.Next()
+			return
+		}
+		encoding, err := Normalize(header)
+		if err != nil {
+			logger.Infow("RequestHandle: unsupported content encoding", "encoding", header)
+			apperr.WriteProblem(c, apperr.Unsupported("RequestHandle", err))
+			return
+		}
+		if encoding == Identity {
+			c.Next()
+			return
+		}
+		ctx, span := tracing.Start(c.Request.Context(), "compress.RequestHandle")
+		defer span.End()
+		c.Request = c.Request.WithContext(ctx)
+		dec, err := NewReader(encoding, c.Request.Body)
+		if err != nil {
+			logger.Infow("RequestHandle: invalid compressed body", "encoding", encoding, "error", err)
+			tracing.RecordError(span, err)
+			apperr.WriteProblem(c, apperr.InvalidValue("RequestHandle", err))
+			return
+		}
+		defer dec.Close()
+		c.Request.Body = dec
+		if maxSize > 0 {
+			c.Request.Body = http.MaxBytesReader(c.Writer, dec, maxSize)
 		}
+		// Тело после распаковки передается handler-ам без кодирования
+		c.Request.Header.Del("Content-Encoding")
+		c.Request.ContentLength = -1
+		c.Next()
 	}
 }
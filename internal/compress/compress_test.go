@@ -0,0 +1,147 @@
+package compress
+
+import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestEncodeDecode(t *testing.T) {
+	data := bytes.Repeat([]byte(`{"id":"Alloc","type":"gauge","value":1}`), 100)
+	for _, encoding := range []string{Gzip, Deflate, Zstd, Legacy, "X-GZIP", Identity} {
+		t.Run(encoding, func(t *testing.T) {
+			encoded, err := Encode(encoding, data)
+			require.NoError(t, err)
+			r, err := NewReader(encoding, bytes.NewReader(encoded))
+			require.NoError(t, err)
+			got, err := io.ReadAll(r)
+			require.NoError(t, err)
+			assert.Equal(t, data, got)
+			assert.NoError(t, r.Close())
+		})
+	}
+
+	// Raw deflate без заголовка zlib
+	var buf bytes.Buffer
+	fw, err := flate.NewWriter(&buf, BestSpeed)
+	require.NoError(t, err)
+	_, _ = fw.Write(data)
+	require.NoError(t, fw.Close())
+	r, err := NewReader(Deflate, &buf)
+	require.NoError(t, err)
+	got, err := io.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, data, got)
+
+	_, err = Encode("br", data)
+	assert.ErrorIs(t, err, ErrUnsupportedEncoding)
+}
+
+func TestNegotiate(t *testing.T) {
+	tests := []struct {
+		accept string
+		want   string
+	}{
+		{accept: "", want: Identity},
+		{accept: "gzip", want: Gzip},
+		{accept: "gzip, deflate, br, zstd", want: Zstd},
+		{accept: "gzip;q=1.0, zstd;q=0.5", want: Gzip},
+		{accept: "deflate, gzip;q=0", want: Deflate},
+		{accept: "br", want: Identity},
+		{accept: "*", want: Zstd},
+		{accept: "*;q=0.5, gzip", want: Gzip},
+		{accept: "X-Gzip", want: Gzip},
+		{accept: "zstd;q=0, *", want: Gzip},
+	}
+	for _, tt := range tests {
+		t.Run(tt.accept, func(t *testing.T) {
+			assert.Equal(t, tt.want, Negotiate(tt.accept))
+		})
+	}
+}
+
+func TestRequestHandle(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(RequestHandle(context.Background(), 0, nil))
+	router.POST("/", func(c *gin.Context) {
+		body, err := io.ReadAll(c.Request.Body)
+		require.NoError(t, err)
+		c.String(http.StatusOK, string(body))
+	})
+
+	tests := []struct {
+		name     string
+		encoding string
+		body     []byte
+		wantCode int
+	}{
+		{name: "plain", body: []byte("[]"), wantCode: http.StatusOK},
+		{name: "gzip", encoding: Gzip, wantCode: http.StatusOK},
+		{name: "legacy", encoding: Legacy, wantCode: http.StatusOK},
+		{name: "zstd", encoding: Zstd, wantCode: http.StatusOK},
+		{name: "deflate", encoding: Deflate, wantCode: http.StatusOK},
+		{name: "unknown", encoding: "br", body: []byte("[]"), wantCode: http.StatusUnsupportedMediaType},
+		{name: "broken", encoding: Gzip, body: []byte("[]"), wantCode: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := tt.body
+			if body == nil {
+				var err error
+				body, err = Encode(tt.encoding, []byte("[]"))
+				require.NoError(t, err)
+			}
+			req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body))
+			if tt.encoding != "" {
+				req.Header.Set("Content-Encoding", tt.encoding)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			assert.Equal(t, tt.wantCode, w.Code)
+			if tt.wantCode == http.StatusOK {
+				assert.Equal(t, "[]", w.Body.String())
+			}
+		})
+	}
+}
+
+func TestResponseHandle(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(ResponseHandle(DefaultCompression))
+	body := bytes.Repeat([]byte("metric "), 100)
+	router.GET("/", func(c *gin.Context) { c.Data(http.StatusOK, "text/plain", body) })
+	router.GET("/empty", func(c *gin.Context) { c.Status(http.StatusNoContent) })
+
+	for _, accept := range []string{"gzip", "zstd", "deflate", ""} {
+		t.Run(accept, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("Accept-Encoding", accept)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			require.Equal(t, http.StatusOK, w.Code)
+			assert.Equal(t, "Accept-Encoding", w.Header().Get("Vary"))
+			assert.Equal(t, accept, w.Header().Get("Content-Encoding"))
+			r, err := NewReader(w.Header().Get("Content-Encoding"), w.Body)
+			require.NoError(t, err)
+			got, err := io.ReadAll(r)
+			require.NoError(t, err)
+			assert.Equal(t, body, got)
+		})
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/empty", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Empty(t, w.Header().Get("Content-Encoding"), "response without body is not encoded")
+}
@@ -4,8 +4,8 @@ import (
 	"context"
 	"database/sql"
 	_ "github.com/jackc/pgx/v5/stdlib"
-	"log"
 	"logger/conf"
+	"logger/internal/logging"
 	"regexp"
 	"strings"
 )
@@ -21,21 +21,19 @@ func (p *Postgresql) Connect(connStr string) error {
 	zp := regexp.MustCompile(`(://)|/|@|:|\?`)
 	connStrMap := zp.Split(connStr, -1)
 	// Получаем map вида [postgres user password address port user sslmode=disable]
-	log.Println("connStrMap:", connStrMap)
 	p.Cfg.Database.User = connStrMap[1]
 	p.Cfg.Database.Password = connStrMap[2]
 	p.Cfg.Database.Host = connStrMap[3]
 	p.Cfg.Database.Dbname = connStrMap[5]
 	p.Cfg.Database.Sslmode = strings.Split(connStrMap[6], "=")[1]
 
-	log.Println("p.Cfg.Database is:", p.Cfg.Database)
-	log.Println("Connection string to database:", connStr)
+	// DSN содержит пароль и в лог не пишется
 	db, err := sql.Open("pgx", connStr)
 	if err != nil {
-		log.Println("Error connecting to database :", err)
+		logging.L().Errorw("open database failed", "host", p.Cfg.Database.Host, "dbname", p.Cfg.Database.Dbname, "error", err)
 		return err
 	}
-	log.Println("Connected to database with DSN :", connStr, "with db:", db)
+	logging.L().Infow("database opened", "host", p.Cfg.Database.Host, "dbname", p.Cfg.Database.Dbname)
 	p.db = db
 	return nil
 }
@@ -0,0 +1,173 @@
+// Package events рассылка изменений метрик подписчикам в реальном времени. Обертка хранилища PublishStorage
+// публикует метрики после успешных UpdateGauge, UpdateCounter и UpdateBatch, Handler отдает их клиенту
+// потоком server-sent events. Публикация не блокирует запись метрик: если подписчик не успевает читать
+// и его буфер заполнен, события для него отбрасываются, а их количество передается ему событием dropped.
+package events
+
+import (
+	"errors"
+	"fmt"
+	"logger/internal/storage"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrTooManySubscribers превышено максимальное количество подписчиков
+var ErrTooManySubscribers = errors.New("too many event stream subscribers")
+
+// Event изменение метрики: для gauge -- новое значение, для counter -- приращение
+type Event struct {
+	storage.Metrics
+	Time time.Time `json:"time"`
+}
+
+// Filter отбор событий подписчика. Пустые Types и Pattern -- без ограничения
+type Filter struct {
+	Types   map[string]bool   // Типы метрик
+	Pattern string            // Шаблон имени метрики в синтаксисе path.Match, например "app.*"
+	Allow   func(string) bool // Дополнительная проверка имени, например, префиксов токена. nil -- без ограничения
+}
+
+// ParseFilter фильтр из списка типов через запятую и шаблона имени
+func ParseFilter(types string, pattern string) (Filter, error) {
+	f := Filter{Pattern: pattern}
+	for _, t := range strings.Split(types, ",") {
+		switch t = strings.TrimSpace(t); t {
+		case "":
+		case "gauge", "counter":
+			if f.Types == nil {
+				f.Types = make(map[string]bool)
+			}
+			f.Types[t] = true
+		default:
+			return f, fmt.Errorf("unknown metric type %q", t)
+		}
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		return f, fmt.Errorf("invalid name pattern %q: %w", pattern, err)
+	}
+	return f, nil
+}
+
+// Match true, если метрика m проходит фильтр
+func (f Filter) Match(m storage.Metrics) bool {
+	if len(f.Types) > 0 && !f.Types[m.MType] {
+		return false
+	}
+	if f.Pattern != "" {
+		if ok, _ := path.Match(f.Pattern, m.ID); !ok {
+			return false
+		}
+	}
+	return f.Allow == nil || f.Allow(m.ID)
+}
+
+// Subscription подписка на события. События читаются из канала Events
+type Subscription struct {
+	broker  *Broker
+	filter  Filter
+	ch      chan Event
+	dropped atomic.Int64
+}
+
+// Events канал событий подписки. Закрывается при закрытии Broker-а
+func (s *Subscription) Events() <-chan Event {
+	return s.ch
+}
+
+// TakeDropped количество событий, отброшенных с прошлого вызова из-за заполненного буфера
+func (s *Subscription) TakeDropped() int64 {
+	return s.dropped.Swap(0)
+}
+
+// Close отмена подписки
+func (s *Subscription) Close() {
+	s.broker.unsubscribe(s)
+}
+
+// Broker рассылка событий подписчикам. Каждому подписчику выделяется буфер на buffer событий,
+// одновременно допускается не более maxSubscribers подписчиков
+type Broker struct {
+	mu             sync.RWMutex
+	subs           map[*Subscription]struct{}
+	buffer         int
+	maxSubscribers int
+	closed         bool
+	now            func() time.Time
+}
+
+// NewBroker создание Broker. maxSubscribers <= 0 -- без ограничения
+func NewBroker(buffer int, maxSubscribers int) *Broker {
+	return &Broker{
+		subs:           make(map[*Subscription]struct{}),
+		buffer:         buffer,
+		maxSubscribers: maxSubscribers,
+		now:            time.Now,
+	}
+}
+
+// Subscribe подписка на события, проходящие фильтр f
+func (b *Broker) Subscribe(f Filter) (*Subscription, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed || (b.maxSubscribers > 0 && len(b.subs) >= b.maxSubscribers) {
+		return nil, ErrTooManySubscribers
+	}
+	s := &Subscription{broker: b, filter: f, ch: make(chan Event, b.buffer)}
+	b.subs[s] = struct{}{}
+	return s, nil
+}
+
+func (b *Broker) unsubscribe(s *Subscription) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.subs, s)
+}
+
+// Subscribers текущее количество подписчиков
+func (b *Broker) Subscribers() int {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return len(b.subs)
+}
+
+// Publish рассылка изменений метрик подписчикам без ожидания: подписчику с заполненным буфером событие
+// не передается и учитывается как отброшенное
+func (b *Broker) Publish(metrics ...storage.Metrics) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if len(b.subs) == 0 {
+		return
+	}
+	now := b.now()
+	for _, m := range metrics {
+		ev := Event{Metrics: m, Time: now}
+		for s := range b.subs {
+			if !s.filter.Match(m) {
+				continue
+			}
+			select {
+			case s.ch <- ev:
+			default:
+				s.dropped.Add(1)
+			}
+		}
+	}
+}
+
+// Close закрытие каналов всех подписок. Новые подписки не принимаются
+func (b *Broker) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return
+	}
+	b.closed = true
+	for s := range b.subs {
+		close(s.ch)
+		delete(b.subs, s)
+	}
+}
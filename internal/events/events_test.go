@@ -0,0 +1,139 @@
+package events
+
+import (
+	"bufio"
+	"context"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"logger/internal/storage"
+	"logger/internal/storage/memstorage"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func gauge(id string, v float64) storage.Metrics {
+	return storage.Metrics{ID: id, MType: "gauge", Value: &v}
+}
+
+func counter(id string, d int64) storage.Metrics {
+	return storage.Metrics{ID: id, MType: "counter", Delta: &d}
+}
+
+func TestFilter(t *testing.T) {
+	tests := []struct {
+		name    string
+		types   string
+		pattern string
+		metric  storage.Metrics
+		want    bool
+	}{
+		{name: "empty", metric: gauge("Alloc", 1), want: true},
+		{name: "type", types: "counter", metric: gauge("Alloc", 1), want: false},
+		{name: "types", types: "gauge, counter", metric: counter("PollCount", 1), want: true},
+		{name: "pattern", pattern: "app.*", metric: gauge("app.rps", 1), want: true},
+		{name: "pattern mismatch", pattern: "app.*", metric: gauge("Alloc", 1), want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := ParseFilter(tt.types, tt.pattern)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, f.Match(tt.metric))
+		})
+	}
+
+	_, err := ParseFilter("histogram", "")
+	assert.Error(t, err)
+	_, err = ParseFilter("", "[")
+	assert.Error(t, err)
+}
+
+func TestBroker_Backpressure(t *testing.T) {
+	b := NewBroker(2, 1)
+	slow, err := b.Subscribe(Filter{})
+	require.NoError(t, err)
+	_, err = b.Subscribe(Filter{})
+	assert.ErrorIs(t, err, ErrTooManySubscribers)
+
+	// Публикация не блокируется заполненным буфером подписчика
+	done := make(chan struct{})
+	go func() {
+		b.Publish(gauge("a", 1), gauge("b", 2), gauge("c", 3), gauge("d", 4))
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Publish blocked on slow subscriber")
+	}
+	assert.Equal(t, "a", (<-slow.Events()).ID)
+	assert.Equal(t, "b", (<-slow.Events()).ID)
+	assert.Equal(t, int64(2), slow.TakeDropped())
+	assert.Equal(t, int64(0), slow.TakeDropped())
+
+	slow.Close()
+	assert.Equal(t, 0, b.Subscribers())
+	b.Close()
+	_, err = b.Subscribe(Filter{})
+	assert.ErrorIs(t, err, ErrTooManySubscribers)
+}
+
+func TestPublishStorage(t *testing.T) {
+	ctx := context.Background()
+	ms, err := memstorage.New(ctx)
+	require.NoError(t, err)
+	b := NewBroker(10, 0)
+	sub, err := b.Subscribe(Filter{})
+	require.NoError(t, err)
+	store := PublishStorage(ms, b)
+
+	require.NoError(t, store.UpdateGauge(ctx, "g", 1.5))
+	require.NoError(t, store.UpdateCounter(ctx, "c", 3))
+	require.NoError(t, store.UpdateBatch(ctx, []storage.Metrics{gauge("g", 2), counter("c", 1)}))
+	// Неуспешное изменение не публикуется
+	assert.Error(t, store.UpdateBatch(ctx, []storage.Metrics{{ID: "x", MType: "histogram"}}))
+
+	var got []string
+	for len(sub.Events()) > 0 {
+		ev := <-sub.Events()
+		got = append(got, ev.ID+":"+ev.MType)
+	}
+	assert.Equal(t, []string{"g:gauge", "c:counter", "g:gauge", "c:counter"}, got)
+}
+
+func TestHandler(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	b := NewBroker(10, 0)
+	router := gin.New()
+	router.GET("/stream", Handler(context.Background(), b))
+	srv := httptest.NewServer(router)
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/stream?name=[")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	resp, err = http.Get(srv.URL + "/stream?type=counter")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	// Заголовки ответа отправляются после подписки
+	b.Publish(gauge("Alloc", 1), counter("PollCount", 5))
+	r := bufio.NewReader(resp.Body)
+	var lines []string
+	for len(lines) < 2 {
+		line, err := r.ReadString('\n')
+		require.NoError(t, err)
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	assert.Equal(t, "event:metric", lines[0])
+	assert.True(t, strings.HasPrefix(lines[1], `data:{"id":"PollCount","type":"counter","delta":5,`), lines[1])
+}
@@ -0,0 +1,71 @@
+package events
+
+import (
+	"context"
+	"github.com/gin-gonic/gin"
+	"logger/internal/apperr"
+	"logger/internal/logging"
+	"logger/internal/tokens"
+	"net/http"
+	"time"
+)
+
+// heartbeatInterval период события ping, по которому клиент и прокси определяют, что соединение живо
+const heartbeatInterval = 15 * time.Second
+
+// Handler -- Gin handler потока событий изменения метрик в формате server-sent events. Параметры запроса:
+// type -- типы метрик через запятую, name -- шаблон имени метрики (path.Match). Метрики передаются событиями
+// metric, количество отброшенных из-за медленного чтения событий -- событием dropped. Токен с префиксами
+// ограничивает поток метриками этих префиксов
+func Handler(ctx context.Context, b *Broker) gin.HandlerFunc {
+	logger := logging.FromContext(ctx)
+	return func(c *gin.Context) {
+		f, err := ParseFilter(c.Query("type"), c.Query("name"))
+		if err != nil {
+			apperr.WriteProblem(c, apperr.InvalidValue("events.Handler", err))
+			return
+		}
+		if t, ok := tokens.FromContext(c); ok {
+			f.Allow = t.AllowsMetric
+		}
+		sub, err := b.Subscribe(f)
+		if err != nil {
+			logger.Warnw("events.Handler: subscribe failed", "subscribers", b.Subscribers(), "error", err)
+			apperr.WriteProblem(c, apperr.Retriable("events.Handler", err))
+			return
+		}
+		defer sub.Close()
+
+		c.Header("Content-Type", "text/event-stream")
+		c.Header("Cache-Control", "no-cache")
+		// Буферизация ответа прокси nginx задержала бы события
+		c.Header("X-Accel-Buffering", "no")
+		c.Status(http.StatusOK)
+		c.Writer.WriteHeaderNow()
+		c.Writer.Flush()
+
+		heartbeat := time.NewTicker(heartbeatInterval)
+		defer heartbeat.Stop()
+		done := c.Request.Context().Done()
+		for {
+			select {
+			case <-done:
+				return
+			case ev, ok := <-sub.Events():
+				if !ok {
+					return
+				}
+				if n := sub.TakeDropped(); n > 0 {
+					c.SSEvent("dropped", gin.H{"count": n})
+				}
+				c.SSEvent("metric", ev)
+			case now := <-heartbeat.C:
+				if n := sub.TakeDropped(); n > 0 {
+					c.SSEvent("dropped", gin.H{"count": n})
+				}
+				c.SSEvent("ping", now.Unix())
+			}
+			c.Writer.Flush()
+		}
+	}
+}
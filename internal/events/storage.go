@@ -0,0 +1,63 @@
+package events
+
+import (
+	"context"
+	"logger/internal/handlers"
+	"logger/internal/storage"
+)
+
+// publishingStorage handlers.Storager с публикацией успешно измененных метрик
+type publishingStorage struct {
+	store  handlers.Storager
+	broker *Broker
+}
+
+// PublishStorage обертка над хранилищем store для публикации в b метрик после успешных
+// UpdateGauge, UpdateCounter и UpdateBatch
+func PublishStorage(store handlers.Storager, b *Broker) handlers.Storager {
+	return publishingStorage{store: store, broker: b}
+}
+
+func (s publishingStorage) UpdateGauge(ctx context.Context, key string, value float64) error {
+	if err := s.store.UpdateGauge(ctx, key, value); err != nil {
+		return err
+	}
+	s.broker.Publish(storage.Metrics{ID: key, MType: "gauge", Value: &value})
+	return nil
+}
+
+func (s publishingStorage) UpdateCounter(ctx context.Context, key string, value int64) error {
+	if err := s.store.UpdateCounter(ctx, key, value); err != nil {
+		return err
+	}
+	s.broker.Publish(storage.Metrics{ID: key, MType: "counter", Delta: &value})
+	return nil
+}
+
+func (s publishingStorage) UpdateBatch(ctx context.Context, metrics []storage.Metrics) error {
+	if err := s.store.UpdateBatch(ctx, metrics); err != nil {
+		return err
+	}
+	s.broker.Publish(metrics...)
+	return nil
+}
+
+func (s publishingStorage) GetGauge(ctx context.Context, key string) (float64, error) {
+	return s.store.GetGauge(ctx, key)
+}
+
+func (s publishingStorage) GetCounter(ctx context.Context, key string) (int64, error) {
+	return s.store.GetCounter(ctx, key)
+}
+
+func (s publishingStorage) GetValue(ctx context.Context, t string, key string) (any, error) {
+	return s.store.GetValue(ctx, t, key)
+}
+
+func (s publishingStorage) GetAllMetrics(ctx context.Context) (any, error) {
+	return s.store.GetAllMetrics(ctx)
+}
+
+func (s publishingStorage) Close() error {
+	return s.store.Close()
+}
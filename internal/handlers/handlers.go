@@ -1,21 +1,21 @@
 package handlers
 
 import (
-	"bytes"
 	"context"
-	"crypto/hmac"
-	"crypto/sha256"
-	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/trace"
 	"io"
-	"log"
 	"logger/cmd/server/initconf"
+	"logger/internal/apperr"
 	"logger/internal/database"
+	"logger/internal/logging"
 	"logger/internal/storage"
 	"logger/internal/storage/memstorage"
+	"logger/internal/tokens"
+	"logger/internal/wire"
 	"net/http"
 	"strconv"
 	"strings"
@@ -49,7 +49,6 @@ func urlToMap(url string) ([]string, error) {
 	}
 	// Если длина разобранного URL больше 4 -- в URL что-то лишнее
 	if len(splittedURL) > 4 {
-		log.Println("Error in urlToMap: URL is too long")
 		return splittedURL, errors.New("URL is too long")
 	}
 	return splittedURL, nil
@@ -66,65 +65,112 @@ func MetricsToMemstorage(ctx context.Context, metrics []storage.Metrics) (memsto
 			_ = stor.UpdateCounter(ctx, m.ID, *m.Delta)
 		}
 	}
-	log.Println("MetricsToMemstorage: []Metrics :", metrics, " -> stor :", stor)
+	logging.FromContext(ctx).Debugw("metrics converted to memstorage", "count", len(metrics))
 	return stor, nil
 }
 
-// hashBody функция вычисления hash-а body сообщения и подписи сообщения в контексте gin.Context
+// hashBody функция подписи body сообщения самым новым ключом сервера в заголовках ответа gin.Context
 func hashBody(body []byte, config *initconf.Config, c *gin.Context) error {
-	if config.Key == "" {
-		log.Println("config.Key is empty")
-		return nil
-	}
-	h := hmac.New(sha256.New, []byte(config.Key))
-	h.Write(body)
-	hash := h.Sum(nil)
-	fmt.Printf("%x", hash)
-	log.Println("hash is:", hash)
-	log.Printf("HashSHA256 is : %x", hash)
-	c.Header("HashSHA256", hex.EncodeToString(hash))
+	config.KeyRing.SignHeader(c.Writer.Header(), body)
 	return nil
 }
 
+// forbiddenMetric ошибка доступа к метрике name вне префиксов токена запроса
+func forbiddenMetric(op string, name string) error {
+	return apperr.Forbidden(op, fmt.Errorf("%w: %s", tokens.ErrScope, name))
+}
+
+// scopedMetrics метрики из результата Storager.GetAllMetrics, разрешенные токеном запроса c
+func scopedMetrics(c *gin.Context, metrics any) (any, error) {
+	var data []byte
+	var err error
+	if ms, ok := metrics.(memstorage.MemStorage); ok {
+		data, err = memstorage.Marshal(ms)
+	} else {
+		data, err = json.Marshal(metrics)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var all struct {
+		GaugeMap   map[string]float64
+		CounterMap map[string]int64
+	}
+	if err := json.Unmarshal(data, &all); err != nil {
+		return nil, err
+	}
+	for name := range all.GaugeMap {
+		if !tokens.AllowsMetric(c, name) {
+			delete(all.GaugeMap, name)
+		}
+	}
+	for name := range all.CounterMap {
+		if !tokens.AllowsMetric(c, name) {
+			delete(all.CounterMap, name)
+		}
+	}
+	return all, nil
+}
+
+// bodyFormats форматы тела запроса и ответа. Content-Type, не относящийся к Protobuf и MessagePack, -- JSON:
+// клиенты прежних версий отсылали JSON с произвольным Content-Type
+func bodyFormats(c *gin.Context) (string, string) {
+	in, err := wire.Parse(c.GetHeader("Content-Type"))
+	if err != nil {
+		in = wire.JSON
+	}
+	return in, wire.Negotiate(c.GetHeader("Accept"), in)
+}
+
+// requestContext контекст обработчика ctx со span-ом трассировки запроса c, чтобы операции хранилища
+// попадали в трассировку запроса
+func requestContext(ctx context.Context, c *gin.Context) context.Context {
+	return trace.ContextWithSpan(ctx, trace.SpanFromContext(c.Request.Context()))
+}
+
 // MetricsHandler -- Gin handlers обработки запросов по изменениям метрик через URL
 func MetricsHandler(ctx context.Context, store Storager) gin.HandlerFunc {
+	logger := logging.FromContext(ctx)
 	return func(c *gin.Context) {
+		ctx := requestContext(ctx, c)
 		splittedURL, err := urlToMap(c.Request.URL.String())
 		if err != nil {
-			c.Status(http.StatusNotFound)
+			apperr.WriteProblem(c, apperr.New(apperr.ErrNotFound, "MetricsHandler", err))
 			return
 		}
 		// metricHandler Обработка gauge метрики
 		if splittedURL[metricType] == "gauge" {
 			if val, err := strconv.ParseFloat(splittedURL[metricValue], 64); err == nil {
 				if err := store.UpdateGauge(ctx, splittedURL[metricName], val); err != nil {
-					c.Status(http.StatusInternalServerError)
+					logger.Errorw("MetricsHandler: update gauge failed", "metric", splittedURL[metricName], "error", err)
+					apperr.WriteProblem(c, err)
 					return
 				}
 			} else {
-				log.Println("Error in MetricHandler: There is no metric or wrong metric value type -- must be float64")
-				c.Status(http.StatusBadRequest)
+				logger.Infow("MetricsHandler: wrong gauge value, must be float64", "metric", splittedURL[metricName])
+				apperr.WriteProblem(c, apperr.InvalidValue("MetricsHandler", err))
 				return
 			}
 			// metricHandler Обработка counter метрик
 		} else if splittedURL[metricType] == "counter" {
 			if val, err := strconv.ParseInt(splittedURL[metricValue], 10, 64); err == nil {
 				if err := store.UpdateCounter(ctx, splittedURL[metricName], val); err != nil {
-					c.Status(http.StatusInternalServerError)
+					logger.Errorw("MetricsHandler: update counter failed", "metric", splittedURL[metricName], "error", err)
+					apperr.WriteProblem(c, err)
 					return
 				}
 			} else {
-				log.Println("Error in MetricHandler: There is no metric or wrong metric value type -- must be int64")
-				c.Status(http.StatusBadRequest)
+				logger.Infow("MetricsHandler: wrong counter value, must be int64", "metric", splittedURL[metricName])
+				apperr.WriteProblem(c, apperr.InvalidValue("MetricsHandler", err))
 				return
 			}
 			// Неправильный тип метрики
 		} else {
-			log.Println("Error in MetricHandler: Wrong metric type")
-			c.Status(http.StatusBadRequest)
+			logger.Infow("MetricsHandler: wrong metric type", "type", splittedURL[metricType])
+			apperr.WriteProblem(c, apperr.WrongType("MetricsHandler", splittedURL[metricType]))
 			return
 		}
-		log.Println("Requested PLAIN metric UPDATE with next metric")
+		logger.Debugw("MetricsHandler: metric updated", "type", splittedURL[metricType], "metric", splittedURL[metricName])
 		// Формируем ответ
 		c.Header("content-type", "text/html; charset=utf-8")
 		c.Status(http.StatusOK)
@@ -133,11 +179,12 @@ func MetricsHandler(ctx context.Context, store Storager) gin.HandlerFunc {
 
 // MetricHandlerJSON -- Gin handlers обработки запросов по изменениям метрик через JSON в Body
 func MetricHandlerJSON(ctx context.Context, store Storager, conf *initconf.Config) gin.HandlerFunc {
+	logger := logging.FromContext(ctx)
 	return func(c *gin.Context) {
-		log.Println("MetricHandlerJSON START")
+		ctx := requestContext(ctx, c)
 		jsn, err := io.ReadAll(c.Request.Body)
 		if err != nil {
-			http.Error(c.Writer, "Error in json body read", http.StatusInternalServerError)
+			apperr.WriteProblem(c, fmt.Errorf("MetricHandlerJSON: error in json body read: %w", err))
 			return
 		}
 
@@ -146,124 +193,149 @@ func MetricHandlerJSON(ctx context.Context, store Storager, conf *initconf.Confi
 
 		err = json.Unmarshal(jsn, &tmpMetric)
 		if err != nil {
-			log.Println("Error in json body read 2", err, "jsn is:", string(jsn))
-			c.Status(http.StatusBadRequest)
+			logger.Infow("MetricHandlerJSON: invalid JSON body", "error", err)
+			apperr.WriteProblem(c, apperr.InvalidValue("MetricHandlerJSON", err))
 			return
 		}
 
-		log.Println("Requested JSON metric UPDATE with next metric", tmpMetric)
+		logger.Debugw("MetricHandlerJSON: metric update requested", "type", tmpMetric.MType, "metric", tmpMetric.ID)
+
+		// Проверка типа метрики и наличия значения до обращения к store
+		if err := tmpMetric.Validate(); err != nil {
+			logger.Infow("MetricHandlerJSON: invalid metric", "metric", tmpMetric.ID, "error", err)
+			apperr.WriteProblem(c, err)
+			return
+		}
+		if !tokens.AllowsMetric(c, tmpMetric.ID) {
+			apperr.WriteProblem(c, forbiddenMetric("MetricHandlerJSON", tmpMetric.ID))
+			return
+		}
 
 		if tmpMetric.MType == "gauge" {
 			if err := store.UpdateGauge(ctx, tmpMetric.ID, *tmpMetric.Value); err != nil {
-				log.Println("Error in UpdateGauge:", err)
-				c.Status(http.StatusInternalServerError)
+				logger.Errorw("MetricHandlerJSON: update gauge failed", "metric", tmpMetric.ID, "error", err)
+				apperr.WriteProblem(c, err)
 				return
 			}
-		} else if tmpMetric.MType == "counter" {
+		} else {
 			if err := store.UpdateCounter(ctx, tmpMetric.ID, *tmpMetric.Delta); err != nil {
-				log.Println("Error in UpdateCounter:", err)
-				c.Status(http.StatusInternalServerError)
+				logger.Errorw("MetricHandlerJSON: update counter failed", "metric", tmpMetric.ID, "error", err)
+				apperr.WriteProblem(c, err)
 				return
 			}
 			// обновляем во временном объекте метрики значение Counter-а для выдачи его в response
 			if *tmpMetric.Delta, err = store.GetCounter(ctx, tmpMetric.ID); err != nil {
-				log.Println("Error in GetCounter:", err)
-				c.Status(http.StatusInternalServerError)
+				logger.Errorw("MetricHandlerJSON: get counter failed", "metric", tmpMetric.ID, "error", err)
+				apperr.WriteProblem(c, err)
 				return
 			}
-		} else {
-			log.Println("Error in MetricHandlerJSON: Wrong metric type")
-			c.Status(http.StatusBadRequest)
-			return
 		}
 
-		j2 := io.NopCloser(bytes.NewBuffer(jsn))
-		log.Println("Request from j2:", j2)
-
 		resp, err := json.Marshal(tmpMetric)
 		if err != nil {
-			log.Println("Error in json.Marshal in handlers:", err)
-			c.Status(http.StatusInternalServerError)
+			logger.Errorw("MetricHandlerJSON: marshal response failed", "error", err)
+			apperr.WriteProblem(c, err)
 			return
 		}
 
 		if err := hashBody(resp, conf, c); err != nil {
-			log.Println("MetricHandlerBatchUpdate: Error in hashBody:", err)
+			logger.Errorw("MetricHandlerJSON: sign response failed", "error", err)
 		}
 
 		c.Header("content-type", "application/json")
 		c.Status(http.StatusOK)
 
 		if _, err := c.Writer.Write(resp); err != nil {
-			log.Println("GetMetric Writer.Write error:", err)
+			logger.Warnw("MetricHandlerJSON: write response failed", "error", err)
 		}
-
-		log.Println("Initconfig before Save is:", conf)
-		log.Println("start SAVE metrics dump to file: ", conf.FileStoragePath, "Store is:", store)
 	}
 }
 
 // MetricHandlerBatchUpdate -- Gin handlers обработки batch запроса по изменениям batch-а метрик через []Metrics в Body
 func MetricHandlerBatchUpdate(ctx context.Context, store Storager, conf *initconf.Config) gin.HandlerFunc {
+	logger := logging.FromContext(ctx)
 	return func(c *gin.Context) {
-		jsn, err := io.ReadAll(c.Request.Body)
+		ctx := requestContext(ctx, c)
+		body, err := io.ReadAll(c.Request.Body)
 		if err != nil {
-			http.Error(c.Writer, "MetricHandlerBatchUpdate: Error in json body read", http.StatusInternalServerError)
+			apperr.WriteProblem(c, fmt.Errorf("MetricHandlerBatchUpdate: error in body read: %w", err))
 			return
 		}
 
-		var tmpMetrics []storage.Metrics
-
-		err = json.Unmarshal(jsn, &tmpMetrics)
+		in, out := bodyFormats(c)
+		tmpMetrics, err := wire.UnmarshalMetrics(in, body)
 		if err != nil {
-			log.Println("MetricHandlerBatchUpdate: Error in json.Unmarshal", err, "jsn is:", string(jsn))
-			c.Status(http.StatusBadRequest)
+			logger.Infow("MetricHandlerBatchUpdate: invalid body", "format", in, "error", err)
+			apperr.WriteProblem(c, apperr.InvalidValue("MetricHandlerBatchUpdate", err))
 			return
 		}
 
-		log.Println("MetricHandlerBatchUpdate: Requested JSON batch metric UPDATES with next []metric", tmpMetrics)
-
-		log.Println("MetricHandlerBatchUpdate: tmpMetrics : ", tmpMetrics, " -> store :", store)
-
-		j2 := io.NopCloser(bytes.NewBuffer(jsn))
-		log.Println("MetricHandlerBatchUpdate: Request from j2:", j2)
+		if conf.MaxBatchSize > 0 && len(tmpMetrics) > conf.MaxBatchSize {
+			logger.Infow("MetricHandlerBatchUpdate: batch is too large", "count", len(tmpMetrics), "limit", conf.MaxBatchSize)
+			apperr.WriteProblem(c, apperr.TooLarge("MetricHandlerBatchUpdate",
+				fmt.Errorf("batch of %d metrics exceeds limit %d", len(tmpMetrics), conf.MaxBatchSize)))
+			return
+		}
+		// Batch применяется целиком, поэтому метрика вне префиксов токена отклоняет весь batch
+		for _, m := range tmpMetrics {
+			if !tokens.AllowsMetric(c, m.ID) {
+				apperr.WriteProblem(c, forbiddenMetric("MetricHandlerBatchUpdate", m.ID))
+				return
+			}
+		}
 
-		log.Println("MetricHandlerBatchUpdate. Starting storage batch update. Store before update is :", store)
+		logger.Debugw("MetricHandlerBatchUpdate: batch update requested", "count", len(tmpMetrics))
 		if err := store.UpdateBatch(ctx, tmpMetrics); err != nil {
-			log.Println("MetricHandlerBatchUpdate. Error in UpdateBatch:", err)
-			c.Status(http.StatusInternalServerError)
+			logger.Errorw("MetricHandlerBatchUpdate: update batch failed", "count", len(tmpMetrics), "error", err)
+			apperr.WriteProblem(c, err)
 			return
 		}
 
-		resp, err := json.Marshal(store)
+		// В JSON ответ прежний, в бинарных форматах ответ -- пустой список метрик
+		var resp []byte
+		if out == wire.JSON {
+			resp, err = json.Marshal(store)
+		} else {
+			resp, err = wire.MarshalMetrics(out, []storage.Metrics{})
+		}
 		if err != nil {
-			log.Println("MetricHandlerBatchUpdate: Error in json.Marshal in handlers:", err)
-			c.Status(http.StatusInternalServerError)
+			logger.Errorw("MetricHandlerBatchUpdate: marshal response failed", "error", err)
+			apperr.WriteProblem(c, err)
 			return
 		}
 
 		if err := hashBody(resp, conf, c); err != nil {
-			log.Println("MetricHandlerBatchUpdate: Error in hashBody:", err)
+			logger.Errorw("MetricHandlerBatchUpdate: sign response failed", "error", err)
 		}
 
-		c.Header("content-type", "application/json")
+		c.Header("content-type", out)
 		c.Status(http.StatusOK)
 
 		if _, err := c.Writer.Write(resp); err != nil {
-			log.Println("MetricHandlerBatchUpdate: Writer.Write error:", err)
+			logger.Warnw("MetricHandlerBatchUpdate: write response failed", "error", err)
 		}
 	}
 }
 
 // GetAllMetrics получить все метрики
 func GetAllMetrics(ctx context.Context, store Storager) gin.HandlerFunc {
+	logger := logging.FromContext(ctx)
 	return func(c *gin.Context) {
-
+		ctx := requestContext(ctx, c)
 		metrics, err := store.GetAllMetrics(ctx)
 		if err != nil {
-			c.Status(http.StatusInternalServerError)
+			logger.Errorw("GetAllMetrics: get metrics failed", "error", err)
+			apperr.WriteProblem(c, err)
 			return
 		}
+		// Токену с ограничением по префиксам отдаются только разрешенные метрики
+		if tokens.Scoped(c) {
+			if metrics, err = scopedMetrics(c, metrics); err != nil {
+				logger.Errorw("GetAllMetrics: filter metrics failed", "error", err)
+				apperr.WriteProblem(c, err)
+				return
+			}
+		}
 		c.Header("content-type", "text/html; charset=utf-8")
 		c.Status(http.StatusOK)
 		c.IndentedJSON(http.StatusOK, metrics)
@@ -272,15 +344,18 @@ func GetAllMetrics(ctx context.Context, store Storager) gin.HandlerFunc {
 
 // GetMetric получить значение метрики
 func GetMetric(ctx context.Context, store Storager) gin.HandlerFunc {
+	logger := logging.FromContext(ctx)
 	return func(c *gin.Context) {
-		splittedURL, err := urlToMap(c.Request.URL.String())
-		if err != nil {
-			c.Status(http.StatusInternalServerError)
+		ctx := requestContext(ctx, c)
+		splittedURL := strings.Split(strings.Trim(c.Request.URL.Path, "/"), "/")
+		if len(splittedURL) != 3 {
+			apperr.WriteProblem(c, apperr.New(apperr.ErrNotFound, "GetMetric", errors.New("wrong URL")))
+			return
 		}
 		val, err := store.GetValue(ctx, splittedURL[metricType], splittedURL[metricName])
 		if err != nil {
-			fmt.Println("Error in GetMetric:", err)
-			c.Status(http.StatusNotFound)
+			logger.Debugw("GetMetric: get value failed", "type", splittedURL[metricType], "metric", splittedURL[metricName], "error", err)
+			apperr.WriteProblem(c, err)
 		} else {
 			switch v := val.(type) {
 			case float64:
@@ -296,88 +371,90 @@ func GetMetric(ctx context.Context, store Storager) gin.HandlerFunc {
 
 // GetMetricJSON получить значение метрики через JSON
 func GetMetricJSON(ctx context.Context, store Storager, conf *initconf.Config) gin.HandlerFunc {
+	logger := logging.FromContext(ctx)
 	return func(c *gin.Context) {
-		jsn, err := io.ReadAll(c.Request.Body)
-		log.Println("GetMetricJSON, jsn after ReadAll:", string(jsn))
+		ctx := requestContext(ctx, c)
+		body, err := io.ReadAll(c.Request.Body)
 		if err != nil {
-			http.Error(c.Writer, "GetMetricJSON: Error in json body read", http.StatusInternalServerError)
+			apperr.WriteProblem(c, fmt.Errorf("GetMetricJSON: error in body read: %w", err))
 			return
 		}
 
-		var tmpMetric storage.Metrics
-
-		err = json.Unmarshal(jsn, &tmpMetric)
+		in, out := bodyFormats(c)
+		tmpMetric, err := wire.UnmarshalMetric(in, body)
 		if err != nil {
-			log.Println("GetMetricJSON: Error json.Unmarshal. Error is:", err)
-			c.Status(http.StatusBadRequest)
+			logger.Infow("GetMetricJSON: invalid body", "format", in, "error", err)
+			apperr.WriteProblem(c, apperr.InvalidValue("GetMetricJSON", err))
+			return
+		}
+		if !tokens.AllowsMetric(c, tmpMetric.ID) {
+			apperr.WriteProblem(c, forbiddenMetric("GetMetricJSON", tmpMetric.ID))
 			return
 		}
 
-		if tmpMetric.MType == "gauge" {
+		switch tmpMetric.MType {
+		case "gauge":
 			var val float64
 			val, err = store.GetGauge(ctx, tmpMetric.ID)
-			// Если получили ошибку -- в соответствии со спецификацией возвращаем json запроса
 			if err != nil {
-				log.Println("GetMetricJSON: Error store.GetGauge", tmpMetric, "Error is", err)
-				c.Header("content-type", "application/json")
-				c.IndentedJSON(http.StatusNotFound, jsn)
+				logger.Debugw("GetMetricJSON: get gauge failed", "metric", tmpMetric.ID, "error", err)
+				apperr.WriteProblem(c, err)
 				return
 			}
 			tmpMetric.Value = &val
-		}
-		if tmpMetric.MType == "counter" {
+		case "counter":
 			var delta int64
 			delta, err = store.GetCounter(ctx, tmpMetric.ID)
-			// Если получили ошибку -- в соответствии со спецификацией возвращаем json запроса
 			if err != nil {
-				log.Println("GetMetricJSON: Error store.GetCounter", tmpMetric, "Error is", err)
-				c.Header("content-type", "application/json")
-				c.IndentedJSON(http.StatusNotFound, jsn)
+				logger.Debugw("GetMetricJSON: get counter failed", "metric", tmpMetric.ID, "error", err)
+				apperr.WriteProblem(c, err)
 				return
 			}
 			tmpMetric.Delta = &delta
+		default:
+			logger.Infow("GetMetricJSON: wrong metric type", "type", tmpMetric.MType)
+			apperr.WriteProblem(c, apperr.WrongType("GetMetricJSON", tmpMetric.MType))
+			return
 		}
 
-		resp, err := json.Marshal(tmpMetric)
+		resp, err := wire.MarshalMetric(out, tmpMetric)
 		if err != nil {
-			log.Println("GetMetricJSON: Error in json.Marshal with Metric:", tmpMetric, "Error is", err)
-			c.Status(http.StatusInternalServerError)
+			logger.Errorw("GetMetricJSON: marshal response failed", "metric", tmpMetric.ID, "error", err)
+			apperr.WriteProblem(c, err)
 			return
 		}
 
 		if err := hashBody(resp, conf, c); err != nil {
-			log.Println("GetMetricJSON: Error in hashBody:", err)
+			logger.Errorw("GetMetricJSON: sign response failed", "error", err)
 		}
 
-		log.Println("GetMetricJSON: Requested metric value with status 200", tmpMetric)
-		j2 := io.NopCloser(bytes.NewBuffer(resp))
-		log.Println("GetMetricJSON: Request value from j2:", j2)
-
-		c.Header("content-type", "application/json")
+		c.Header("content-type", out)
 		c.Status(http.StatusOK)
 		if _, err := c.Writer.Write(resp); err != nil {
-			log.Println("GetMetricJSON: Error Writer.Write error:", err)
+			logger.Warnw("GetMetricJSON: write response failed", "error", err)
 		}
 	}
 }
 
 func DBPing(connStr string) gin.HandlerFunc {
 	return func(c *gin.Context) {
+		logger := logging.FromContext(c.Request.Context())
 		// Тест коннекта к базе
-		log.Println("TEST Connecting to base")
 		db := database.Postgresql{}
 		err := db.Connect(connStr)
 		if err != nil {
-			log.Println("Error connecting to database :", err)
+			logger.Warnw("DBPing: connect to database failed", "error", err)
+			apperr.WriteProblem(c, fmt.Errorf("DBPing: %w", err))
+			return
 		}
 		defer db.Close()
 		err = db.Ping()
 		if err != nil {
-			log.Println("database connect error")
-			c.Status(http.StatusInternalServerError)
-			panic(err)
+			logger.Warnw("DBPing: ping database failed", "error", err)
+			apperr.WriteProblem(c, fmt.Errorf("DBPing: %w", err))
+			return
 		}
-		log.Println("database connected")
+		logger.Debugw("DBPing: database connected")
 		c.Status(http.StatusOK)
 		c.Next()
 	}
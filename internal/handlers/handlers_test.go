@@ -1,15 +1,23 @@
 package handlers
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"github.com/gin-gonic/gin"
 	"github.com/stretchr/testify/assert"
 	"logger/cmd/server/initconf"
+	"logger/internal/apperr"
+	"logger/internal/keyring"
 	"logger/internal/storage"
 	"logger/internal/storage/memstorage"
+	"logger/internal/tokens"
+	"logger/internal/wire"
 	"net/http"
 	"net/http/httptest"
 	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -59,7 +67,8 @@ func TestMetricHandler(t *testing.T) {
 				r: httptest.NewRequest(http.MethodPost, "/update/gauge/metric1/1/fault/fault", nil),
 			},
 			want: want{
-				code: http.StatusNotFound,
+				code:        http.StatusNotFound,
+				contentType: apperr.ProblemContentType,
 			},
 		},
 		{
@@ -70,7 +79,8 @@ func TestMetricHandler(t *testing.T) {
 				r: httptest.NewRequest(http.MethodPost, "/update/gauge/metric1/1ewe", nil),
 			},
 			want: want{
-				code: http.StatusBadRequest,
+				code:        http.StatusBadRequest,
+				contentType: apperr.ProblemContentType,
 			},
 		},
 		{
@@ -80,7 +90,8 @@ func TestMetricHandler(t *testing.T) {
 				r: httptest.NewRequest(http.MethodPost, "/update/counter/metric1/1ewe", nil),
 			},
 			want: want{
-				code: http.StatusBadRequest,
+				code:        http.StatusBadRequest,
+				contentType: apperr.ProblemContentType,
 			},
 		},
 		{
@@ -90,7 +101,8 @@ func TestMetricHandler(t *testing.T) {
 				r: httptest.NewRequest(http.MethodPost, "/update/bool/metric1/1", nil),
 			},
 			want: want{
-				code: http.StatusBadRequest,
+				code:        http.StatusBadRequest,
+				contentType: apperr.ProblemContentType,
 			},
 		},
 	}
@@ -276,8 +288,12 @@ func TestGetAllMetrics(t *testing.T) {
 func Test_hashBody(t *testing.T) {
 	body := []byte("Test body")
 	var c *gin.Context
+	ring, err := keyring.New("superkey", "new:secret")
+	if err != nil {
+		t.Fatal(err)
+	}
 	config := initconf.Config{
-		Key: "superkey",
+		KeyRing: ring,
 	}
 	type args struct {
 		w *httptest.ResponseRecorder
@@ -287,13 +303,16 @@ func Test_hashBody(t *testing.T) {
 		w: httptest.NewRecorder(),
 		r: httptest.NewRequest(http.MethodGet, "/value/gauge/metric1", nil),
 	}
-	c, err := SetTestGinContext(httpArg.w, httpArg.r)
+	c, err = SetTestGinContext(httpArg.w, httpArg.r)
 	if err != nil {
 		t.Fatal(err)
 	}
 	if err := hashBody(body, &config, c); err != nil {
 		t.Errorf("hashBody() error = %v", err)
 	}
+	// Ответ подписывается самым новым ключом
+	assert.Equal(t, "new", httpArg.w.Header().Get(keyring.KeyIDHeader))
+	assert.NoError(t, ring.VerifyHeader(httpArg.w.Header(), body))
 }
 
 func Test_MetricsToMemstorage(t *testing.T) {
@@ -324,3 +343,256 @@ func Test_MetricsToMemstorage(t *testing.T) {
 	}
 	assert.Equal(t, w.stor, stor)
 }
+
+func TestMetricHandlerJSON_Errors(t *testing.T) {
+	type want struct {
+		code        int
+		problemCode string
+	}
+	var ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	var store, _ = memstorage.New(ctx)
+	config := initconf.Config{}
+	tests := []struct {
+		name string
+		body string
+		want want
+	}{
+		{
+			name: "Negative test, gauge without value",
+			body: `{"id":"metric1","type":"gauge"}`,
+			want: want{code: http.StatusBadRequest, problemCode: "invalid_value"},
+		},
+		{
+			name: "Negative test, wrong metric type",
+			body: `{"id":"metric1","type":"bool","value":1}`,
+			want: want{code: http.StatusBadRequest, problemCode: "wrong_type"},
+		},
+		{
+			name: "Negative test, broken json",
+			body: `{"id":`,
+			want: want{code: http.StatusBadRequest, problemCode: "invalid_value"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			c, err := SetTestGinContext(w, httptest.NewRequest(http.MethodPost, "/update/", strings.NewReader(tt.body)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			MetricHandlerJSON(ctx, &store, &config)(c)
+			assert.Equal(t, tt.want.code, w.Code)
+			assert.Equal(t, apperr.ProblemContentType, w.Header().Get("Content-Type"))
+			var p apperr.Problem
+			if assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &p)) {
+				assert.Equal(t, tt.want.problemCode, p.Code)
+			}
+		})
+	}
+}
+
+func TestGetMetricJSON_NotFound(t *testing.T) {
+	var ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	var store, _ = memstorage.New(ctx)
+	config := initconf.Config{}
+
+	w := httptest.NewRecorder()
+	c, err := SetTestGinContext(w, httptest.NewRequest(http.MethodPost, "/value/", strings.NewReader(`{"id":"absent","type":"counter"}`)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	GetMetricJSON(ctx, &store, &config)(c)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	var p apperr.Problem
+	if assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &p)) {
+		assert.Equal(t, "not_found", p.Code)
+	}
+}
+
+func TestHandlers_TokenScope(t *testing.T) {
+	var ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	var store, _ = memstorage.New(ctx)
+	config := initconf.Config{}
+	scoped := tokens.Token{Role: tokens.RoleAdmin, Prefixes: []string{"app."}}
+	if err := store.UpdateGauge(ctx, "Alloc", 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.UpdateGauge(ctx, "app.latency", 2); err != nil {
+		t.Fatal(err)
+	}
+
+	// run вызов handler-а h с токеном scoped в контексте запроса
+	run := func(h gin.HandlerFunc, method, target, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		c, _ := SetTestGinContext(w, httptest.NewRequest(method, target, strings.NewReader(body)))
+		tokens.SetContext(c, scoped)
+		h(c)
+		return w
+	}
+
+	w := run(MetricHandlerJSON(ctx, &store, &config), http.MethodPost, "/update/", `{"id":"Alloc","type":"gauge","value":5}`)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	w = run(MetricHandlerJSON(ctx, &store, &config), http.MethodPost, "/update/", `{"id":"app.latency","type":"gauge","value":5}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// Batch с метрикой вне префиксов не применяется целиком
+	w = run(MetricHandlerBatchUpdate(ctx, &store, &config), http.MethodPost, "/updates",
+		`[{"id":"app.rps","type":"gauge","value":1},{"id":"Alloc","type":"gauge","value":7}]`)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	_, err := store.GetGauge(ctx, "app.rps")
+	assert.ErrorIs(t, err, apperr.ErrNotFound)
+
+	w = run(GetMetricJSON(ctx, &store, &config), http.MethodPost, "/value/", `{"id":"Alloc","type":"gauge"}`)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	w = run(GetAllMetrics(ctx, &store), http.MethodGet, "/", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "app.latency")
+	assert.NotContains(t, w.Body.String(), "Alloc")
+}
+
+func TestMetricHandlerBatchUpdate_MaxBatchSize(t *testing.T) {
+	var ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	var store, _ = memstorage.New(ctx)
+	config := initconf.Config{MaxBatchSize: 1}
+
+	w := httptest.NewRecorder()
+	c, _ := SetTestGinContext(w, httptest.NewRequest(http.MethodPost, "/updates",
+		strings.NewReader(`[{"id":"g1","type":"gauge","value":1},{"id":"g2","type":"gauge","value":2}]`)))
+	MetricHandlerBatchUpdate(ctx, &store, &config)(c)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+	_, err := store.GetGauge(ctx, "g1")
+	assert.ErrorIs(t, err, apperr.ErrNotFound)
+}
+
+func TestHandlers_WireFormats(t *testing.T) {
+	var ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	var store, _ = memstorage.New(ctx)
+	ring, err := keyring.New("", "a:s1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := initconf.Config{KeyRing: ring}
+	value, delta := 1.5, int64(3)
+
+	for _, format := range []string{wire.Protobuf, wire.MsgPack} {
+		t.Run(format, func(t *testing.T) {
+			body, err := wire.MarshalMetrics(format, []storage.Metrics{
+				{ID: "g1", MType: "gauge", Value: &value},
+				{ID: "c1", MType: "counter", Delta: &delta},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			w := httptest.NewRecorder()
+			c, _ := SetTestGinContext(w, httptest.NewRequest(http.MethodPost, "/updates", bytes.NewReader(body)))
+			c.Request.Header.Set("Content-Type", format)
+			MetricHandlerBatchUpdate(ctx, &store, &config)(c)
+			assert.Equal(t, http.StatusOK, w.Code)
+			assert.Equal(t, format, w.Header().Get("Content-Type"))
+
+			// Запрос в формате format, ответ в JSON по Accept. Подпись покрывает тело ответа как есть
+			body, err = wire.MarshalMetric(format, storage.Metrics{ID: "g1", MType: "gauge"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			w = httptest.NewRecorder()
+			c, _ = SetTestGinContext(w, httptest.NewRequest(http.MethodPost, "/value/", bytes.NewReader(body)))
+			c.Request.Header.Set("Content-Type", format)
+			c.Request.Header.Set("Accept", wire.JSON)
+			GetMetricJSON(ctx, &store, &config)(c)
+			assert.Equal(t, http.StatusOK, w.Code)
+			assert.JSONEq(t, `{"id":"g1","type":"gauge","value":1.5}`, w.Body.String())
+			assert.NoError(t, ring.VerifyHeader(w.Header(), w.Body.Bytes()))
+
+			// Ответ в формате запроса
+			w = httptest.NewRecorder()
+			c, _ = SetTestGinContext(w, httptest.NewRequest(http.MethodPost, "/value/", bytes.NewReader(body)))
+			c.Request.Header.Set("Content-Type", format)
+			GetMetricJSON(ctx, &store, &config)(c)
+			assert.Equal(t, http.StatusOK, w.Code)
+			m, err := wire.UnmarshalMetric(format, w.Body.Bytes())
+			if assert.NoError(t, err) && assert.NotNil(t, m.Value) {
+				assert.Equal(t, value, *m.Value)
+			}
+			assert.NoError(t, ring.VerifyHeader(w.Header(), w.Body.Bytes()))
+		})
+	}
+}
+
+// chunkStore хранилище, запоминающее размеры batch-ей и отказывающее после fail успешных UpdateBatch
+type chunkStore struct {
+	memstorage.MemStorage
+	chunks []int
+	fail   int
+}
+
+func (s *chunkStore) UpdateBatch(ctx context.Context, metrics []storage.Metrics) error {
+	if s.fail > 0 && len(s.chunks) == s.fail {
+		return apperr.Retriable("chunkStore", errors.New("db down"))
+	}
+	s.chunks = append(s.chunks, len(metrics))
+	return s.MemStorage.UpdateBatch(ctx, metrics)
+}
+
+func TestMetricHandlerStream(t *testing.T) {
+	var ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	lines := strings.Join([]string{
+		`{"id":"g1","type":"gauge","value":1}`,
+		``,
+		`{"id":"c1","type":"counter","delta":2}`,
+		`not json`,
+		`{"id":"g2","type":"gauge"}`,
+		`{"id":"c1","type":"counter","delta":3}`,
+		`{"id":"long","type":"gauge","value":1,"pad":"` + strings.Repeat("x", maxStreamLineSize) + `"}`,
+		`{"id":"g3","type":"gauge","value":3}`,
+	}, "\n")
+
+	tests := []struct {
+		name     string
+		fail     int
+		limit    int64
+		wantCode int
+		want     StreamSummary
+		chunks   []int
+	}{
+		{name: "all lines", wantCode: http.StatusOK, chunks: []int{2, 2},
+			want: StreamSummary{Lines: 8, CommittedLines: 8, Applied: 4, Rejected: 3}},
+		// Подробности ошибки хранилища клиенту не передаются
+		{name: "storage failure", fail: 1, wantCode: http.StatusServiceUnavailable, chunks: []int{2},
+			want: StreamSummary{Lines: 8, CommittedLines: 3, Applied: 2, Rejected: 3, Error: "Service Unavailable"}},
+		{name: "body limit", limit: 100, wantCode: http.StatusRequestEntityTooLarge, chunks: []int{2},
+			want: StreamSummary{Lines: 4, CommittedLines: 4, Applied: 2, Rejected: 1, Error: "http: request body too large"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ms, _ := memstorage.New(ctx)
+			store := &chunkStore{MemStorage: ms, fail: tt.fail}
+			config := initconf.Config{StreamChunkSize: 2}
+			w := httptest.NewRecorder()
+			c, _ := SetTestGinContext(w, httptest.NewRequest(http.MethodPost, "/updates/stream", strings.NewReader(lines)))
+			if tt.limit > 0 {
+				c.Request.Body = http.MaxBytesReader(w, c.Request.Body, tt.limit)
+			}
+			MetricHandlerStream(ctx, store, &config)(c)
+			assert.Equal(t, tt.wantCode, w.Code)
+
+			var got StreamSummary
+			if assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &got)) {
+				assert.Equal(t, tt.want.Lines, got.Lines)
+				assert.Equal(t, tt.want.CommittedLines, got.CommittedLines)
+				assert.Equal(t, tt.want.Applied, got.Applied)
+				assert.Equal(t, tt.want.Rejected, got.Rejected)
+				assert.Equal(t, tt.want.Rejected, len(got.Errors))
+				assert.Equal(t, tt.want.Error, got.Error)
+			}
+			assert.Equal(t, tt.chunks, store.chunks)
+		})
+	}
+}
@@ -0,0 +1,169 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"io"
+	"logger/cmd/server/initconf"
+	"logger/internal/apperr"
+	"logger/internal/logging"
+	"logger/internal/storage"
+	"logger/internal/tokens"
+	"net/http"
+)
+
+const (
+	// DefaultStreamChunkSize количество метрик, применяемых одним UpdateBatch, если размер не задан конфигурацией
+	DefaultStreamChunkSize = 1000
+	// maxStreamLineSize максимальная длина строки NDJSON. Более длинная строка отклоняется целиком
+	maxStreamLineSize = 64 << 10
+	// maxStreamLineErrors количество ошибок строк, передаваемых в ответе. Остальные только учитываются в Rejected
+	maxStreamLineErrors = 100
+)
+
+var errLineTooLong = fmt.Errorf("line exceeds %d bytes", maxStreamLineSize)
+
+// LineError ошибка строки потока NDJSON. Строки нумеруются с 1
+type LineError struct {
+	Line  int    `json:"line"`
+	Error string `json:"error"`
+}
+
+// StreamSummary итог приема потока NDJSON. Если прием прерван (ошибка чтения тела или хранилища), Error содержит
+// причину (для ошибок сервера -- только текст статуса), а метрики первых CommittedLines строк уже применены -- клиент может продолжить со следующей строки
+type StreamSummary struct {
+	Lines           int         `json:"lines"`
+	CommittedLines  int         `json:"committed_lines"`
+	Applied         int         `json:"applied"`
+	Rejected        int         `json:"rejected"`
+	Errors          []LineError `json:"errors,omitempty"`
+	ErrorsTruncated bool        `json:"errors_truncated,omitempty"`
+	Error           string      `json:"error,omitempty"`
+}
+
+// streamError причина прерывания приема для ответа клиенту. Подробности ошибок сервера (5xx) только в журнале
+func streamError(status int, err error) string {
+	if status >= http.StatusInternalServerError {
+		return http.StatusText(status)
+	}
+	return err.Error()
+}
+
+func (s *StreamSummary) reject(line int, err error) {
+	s.Rejected++
+	if len(s.Errors) < maxStreamLineErrors {
+		s.Errors = append(s.Errors, LineError{Line: line, Error: err.Error()})
+	} else {
+		s.ErrorsTruncated = true
+	}
+}
+
+// readLine чтение строки r без буферизации строк длиннее maxStreamLineSize: остаток такой строки пропускается.
+// Возвращаемый срез действителен до следующего чтения из r
+func readLine(r *bufio.Reader) ([]byte, bool, error) {
+	line, err := r.ReadSlice('\n')
+	tooLong := false
+	for errors.Is(err, bufio.ErrBufferFull) {
+		tooLong = true
+		_, err = r.ReadSlice('\n')
+	}
+	return line, tooLong, err
+}
+
+// parseStreamLine разбор и проверка метрики строки line потока NDJSON
+func parseStreamLine(c *gin.Context, line []byte, tooLong bool) (storage.Metrics, error) {
+	var m storage.Metrics
+	if tooLong {
+		return m, apperr.TooLarge("MetricHandlerStream", errLineTooLong)
+	}
+	if err := json.Unmarshal(line, &m); err != nil {
+		return m, apperr.InvalidValue("MetricHandlerStream", err)
+	}
+	if !tokens.AllowsMetric(c, m.ID) {
+		return m, forbiddenMetric("MetricHandlerStream", m.ID)
+	}
+	return m, m.Validate()
+}
+
+// MetricHandlerStream -- Gin handler приема метрик потоком NDJSON: по одной метрике в формате JSON на строке.
+// Тело разбирается по мере чтения, корректные метрики применяются через UpdateBatch порциями по conf.StreamChunkSize,
+// некорректные строки пропускаются с ошибкой в StreamSummary. Тело целиком в памяти не хранится
+func MetricHandlerStream(ctx context.Context, store Storager, conf *initconf.Config) gin.HandlerFunc {
+	logger := logging.FromContext(ctx)
+	chunkSize := conf.StreamChunkSize
+	if chunkSize <= 0 {
+		chunkSize = DefaultStreamChunkSize
+	}
+	return func(c *gin.Context) {
+		ctx := requestContext(ctx, c)
+		var summary StreamSummary
+		status := http.StatusOK
+		chunk := make([]storage.Metrics, 0, chunkSize)
+		// flush применение накопленных метрик. Ошибка хранилища прерывает прием
+		flush := func() error {
+			if len(chunk) > 0 {
+				if err := store.UpdateBatch(ctx, chunk); err != nil {
+					return err
+				}
+				summary.Applied += len(chunk)
+				chunk = chunk[:0]
+			}
+			summary.CommittedLines = summary.Lines
+			return nil
+		}
+
+		r := bufio.NewReaderSize(c.Request.Body, maxStreamLineSize)
+		for {
+			line, tooLong, readErr := readLine(r)
+			// Строка, оборванная ошибкой чтения, не разбирается. Пустые строки учитываются в нумерации, но пропускаются
+			if (tooLong || len(line) > 0) && (readErr == nil || errors.Is(readErr, io.EOF)) {
+				summary.Lines++
+				if tooLong || len(bytes.TrimSpace(line)) > 0 {
+					if m, err := parseStreamLine(c, line, tooLong); err != nil {
+						summary.reject(summary.Lines, err)
+					} else {
+						chunk = append(chunk, m)
+					}
+				}
+			}
+			if len(chunk) == chunkSize || readErr != nil {
+				if err := flush(); err != nil {
+					logger.Errorw("MetricHandlerStream: update batch failed", "applied", summary.Applied, "error", err)
+					status = apperr.HTTPStatus(err)
+					summary.Error = streamError(status, err)
+					break
+				}
+			}
+			if readErr != nil {
+				if !errors.Is(readErr, io.EOF) {
+					logger.Infow("MetricHandlerStream: body read failed", "lines", summary.Lines, "error", readErr)
+					status = apperr.HTTPStatus(readErr)
+					summary.Error = streamError(status, readErr)
+				}
+				break
+			}
+		}
+		logger.Debugw("MetricHandlerStream: stream processed", "lines", summary.Lines, "applied", summary.Applied,
+			"rejected", summary.Rejected)
+
+		resp, err := json.Marshal(summary)
+		if err != nil {
+			logger.Errorw("MetricHandlerStream: marshal response failed", "error", err)
+			apperr.WriteProblem(c, err)
+			return
+		}
+		if err := hashBody(resp, conf, c); err != nil {
+			logger.Errorw("MetricHandlerStream: sign response failed", "error", err)
+		}
+		c.Header("content-type", "application/json")
+		c.Status(status)
+		if _, err := c.Writer.Write(resp); err != nil {
+			logger.Warnw("MetricHandlerStream: write response failed", "error", err)
+		}
+	}
+}
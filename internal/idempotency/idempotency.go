@@ -0,0 +1,154 @@
+// Package idempotency защита от повторного применения batch-ей метрик.
+// Агент помечает каждый batch уникальным идентификатором в заголовке X-Batch-ID и сохраняет его при повторной отсылке.
+// Сервер запоминает ответы на batch-и за ограниченное окно и на повторный batch с тем же идентификатором
+// возвращает сохраненный ответ, не применяя batch повторно.
+package idempotency
+
+import (
+	"bytes"
+	"context"
+	"github.com/gin-gonic/gin"
+	"logger/internal/logging"
+	"net/http"
+	"sync"
+)
+
+// Header заголовок с идентификатором batch-а
+const Header = "X-Batch-ID"
+
+// ReplayedHeader заголовок ответа, возвращенного из хранилища без повторного применения batch-а
+const ReplayedHeader = "X-Batch-Replayed"
+
+// maxIDLength максимальная длина идентификатора batch-а
+const maxIDLength = 128
+
+// Response сохраненный ответ на batch
+type Response struct {
+	Status      int
+	ContentType string
+	Body        []byte
+}
+
+// Signer подпись тела ответа body в заголовках h
+type Signer func(h http.Header, body []byte)
+
+// Store хранилище ответов на batch-и за ограниченное окно
+type Store interface {
+	// Get сохраненный ответ на batch id. ok == false, если batch не встречался в пределах окна
+	Get(ctx context.Context, id string) (resp Response, ok bool, err error)
+	Put(ctx context.Context, id string, resp Response) error
+}
+
+// captureWriter gin.ResponseWriter, сохраняющий копию тела ответа
+type captureWriter struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *captureWriter) Write(b []byte) (int, error) {
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *captureWriter) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
+
+// keyLock блокировка по идентификатору batch-а: одновременные запросы с одним идентификатором
+// (повтор агента по таймауту, пока первый запрос еще обрабатывается) выполняются последовательно
+type keyLock struct {
+	mu    sync.Mutex
+	locks map[string]*keyLockEntry
+}
+
+type keyLockEntry struct {
+	mu   sync.Mutex
+	refs int
+}
+
+func (k *keyLock) lock(id string) {
+	k.mu.Lock()
+	e, ok := k.locks[id]
+	if !ok {
+		e = &keyLockEntry{}
+		k.locks[id] = e
+	}
+	e.refs++
+	k.mu.Unlock()
+	e.mu.Lock()
+}
+
+func (k *keyLock) unlock(id string) {
+	k.mu.Lock()
+	e := k.locks[id]
+	e.refs--
+	if e.refs == 0 {
+		delete(k.locks, id)
+	}
+	k.mu.Unlock()
+	e.mu.Unlock()
+}
+
+// Middleware повторный batch с уже обработанным идентификатором получает сохраненный ответ без вызова handler-а.
+// Сохраняются ответы с кодом меньше 500: после ошибки сервера batch должен быть применен при повторе.
+// Запросы без заголовка X-Batch-ID обрабатываются как обычно.
+// Должен подключаться после проверки подписи, чтобы неподписанный запрос не мог занять идентификатор.
+// Заголовки подписи не сохраняются: если sign не nil, сохраненный ответ подписывается заново текущим ключом
+func Middleware(store Store, sign Signer) gin.HandlerFunc {
+	locks := &keyLock{locks: make(map[string]*keyLockEntry)}
+	return func(c *gin.Context) {
+		id := c.GetHeader(Header)
+		if id == "" {
+			c.Next()
+			return
+		}
+		if len(id) > maxIDLength {
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+
+		locks.lock(id)
+		defer locks.unlock(id)
+
+		ctx := c.Request.Context()
+		logger := logging.FromContext(ctx)
+		resp, ok, err := store.Get(ctx, id)
+		if err != nil {
+			// Недоступность хранилища идентификаторов не должна останавливать прием метрик
+			logger.Errorw("idempotency: store get failed", "error", err)
+		}
+		if ok {
+			logger.Infow("idempotency: batch already applied, replay saved response", "batch_id", id)
+			c.Header(ReplayedHeader, "true")
+			if resp.ContentType != "" {
+				c.Header("Content-Type", resp.ContentType)
+			}
+			if sign != nil && len(resp.Body) > 0 {
+				sign(c.Writer.Header(), resp.Body)
+			}
+			c.Status(resp.Status)
+			_, _ = c.Writer.Write(resp.Body)
+			c.Abort()
+			return
+		}
+
+		w := &captureWriter{ResponseWriter: c.Writer}
+		c.Writer = w
+		c.Next()
+		c.Writer = w.ResponseWriter
+
+		status := w.Status()
+		if status >= http.StatusInternalServerError {
+			return
+		}
+		err = store.Put(ctx, id, Response{
+			Status:      status,
+			ContentType: w.Header().Get("Content-Type"),
+			Body:        w.body.Bytes(),
+		})
+		if err != nil {
+			logger.Errorw("idempotency: store put failed", "error", err)
+		}
+	}
+}
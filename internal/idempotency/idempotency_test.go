@@ -0,0 +1,138 @@
+package idempotency
+
+import (
+	"context"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestRouter router с middleware и handler-ом, считающим применения batch-ей.
+// Handler отвечает кодом status и задерживается на delay
+func newTestRouter(store Store, status int, delay time.Duration, applied *atomic.Int32) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/updates", Middleware(store, nil), func(c *gin.Context) {
+		time.Sleep(delay)
+		n := applied.Add(1)
+		c.JSON(status, gin.H{"applied": n})
+	})
+	return router
+}
+
+func doRequest(router http.Handler, id string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/updates", strings.NewReader(`[]`))
+	if id != "" {
+		req.Header.Set(Header, id)
+	}
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestMiddleware(t *testing.T) {
+	tests := []struct {
+		name        string
+		status      int
+		ids         []string
+		wantApplied int32
+	}{
+		{name: "same id applied once", status: http.StatusOK, ids: []string{"a", "a", "a"}, wantApplied: 1},
+		{name: "different ids", status: http.StatusOK, ids: []string{"a", "b"}, wantApplied: 2},
+		{name: "no id", status: http.StatusOK, ids: []string{"", ""}, wantApplied: 2},
+		{name: "client error is cached", status: http.StatusBadRequest, ids: []string{"a", "a"}, wantApplied: 1},
+		{name: "server error is not cached", status: http.StatusServiceUnavailable, ids: []string{"a", "a"}, wantApplied: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var applied atomic.Int32
+			router := newTestRouter(NewMemoryStore(10, time.Minute), tt.status, 0, &applied)
+
+			first := doRequest(router, tt.ids[0])
+			for _, id := range tt.ids[1:] {
+				w := doRequest(router, id)
+				assert.Equal(t, tt.status, w.Code)
+				if tt.wantApplied == 1 {
+					// Повторный ответ совпадает с первым
+					assert.Equal(t, first.Body.String(), w.Body.String())
+					assert.Equal(t, first.Header().Get("Content-Type"), w.Header().Get("Content-Type"))
+					assert.Equal(t, "true", w.Header().Get(ReplayedHeader))
+				}
+			}
+			assert.Equal(t, tt.wantApplied, applied.Load())
+		})
+	}
+}
+
+func TestMiddleware_ConcurrentSameID(t *testing.T) {
+	var applied atomic.Int32
+	router := newTestRouter(NewMemoryStore(10, time.Minute), http.StatusOK, 20*time.Millisecond, &applied)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.Equal(t, http.StatusOK, doRequest(router, "same").Code)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), applied.Load())
+}
+
+func TestMiddleware_ReplaySigned(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	var signed []string
+	sign := func(h http.Header, body []byte) {
+		signed = append(signed, string(body))
+		h.Set("HashSHA256", "sign")
+	}
+	router := gin.New()
+	router.POST("/updates", Middleware(NewMemoryStore(10, time.Minute), sign), func(c *gin.Context) {
+		c.Header("HashSHA256", "sign")
+		c.JSON(http.StatusOK, gin.H{"applied": 1})
+	})
+
+	first := doRequest(router, "a")
+	replay := doRequest(router, "a")
+	assert.Equal(t, "true", replay.Header().Get(ReplayedHeader))
+	assert.Equal(t, "sign", replay.Header().Get("HashSHA256"))
+	// Подписывается только сохраненный ответ, ответ handler-а подписан им самим
+	assert.Equal(t, []string{first.Body.String()}, signed)
+}
+
+func TestMiddleware_TooLongID(t *testing.T) {
+	var applied atomic.Int32
+	router := newTestRouter(NewMemoryStore(10, time.Minute), http.StatusOK, 0, &applied)
+	assert.Equal(t, http.StatusBadRequest, doRequest(router, strings.Repeat("x", maxIDLength+1)).Code)
+	assert.Equal(t, int32(0), applied.Load())
+}
+
+func TestMemoryStore(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	s := NewMemoryStore(2, time.Minute)
+	s.now = func() time.Time { return now }
+
+	_ = s.Put(ctx, "a", Response{Status: 200})
+	_ = s.Put(ctx, "b", Response{Status: 200})
+	// Обращение к "a" делает "b" самым давним, он вытесняется при добавлении "c"
+	_, ok, _ := s.Get(ctx, "a")
+	assert.True(t, ok)
+	_ = s.Put(ctx, "c", Response{Status: 200})
+	assert.Equal(t, 2, s.Len())
+	_, ok, _ = s.Get(ctx, "b")
+	assert.False(t, ok)
+
+	// Идентификаторы старше окна забываются
+	now = now.Add(2 * time.Minute)
+	_, ok, _ = s.Get(ctx, "a")
+	assert.False(t, ok)
+	assert.Equal(t, 1, s.Len())
+}
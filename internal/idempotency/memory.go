@@ -0,0 +1,76 @@
+package idempotency
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+)
+
+// MemoryStore хранилище ответов в памяти: не более size идентификаторов (LRU) не старше window
+type MemoryStore struct {
+	mu     sync.Mutex
+	size   int
+	window time.Duration
+	ll     *list.List               // Элементы *memoryEntry, в начале -- последние добавленные
+	items  map[string]*list.Element // Идентификатор -> элемент ll
+	now    func() time.Time
+}
+
+type memoryEntry struct {
+	id      string
+	resp    Response
+	created time.Time
+}
+
+// NewMemoryStore создание MemoryStore на size идентификаторов с окном window
+func NewMemoryStore(size int, window time.Duration) *MemoryStore {
+	return &MemoryStore{
+		size:   size,
+		window: window,
+		ll:     list.New(),
+		items:  make(map[string]*list.Element),
+		now:    time.Now,
+	}
+}
+
+func (s *MemoryStore) Get(_ context.Context, id string) (Response, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	el, ok := s.items[id]
+	if !ok {
+		return Response{}, false, nil
+	}
+	e := el.Value.(*memoryEntry)
+	if s.now().Sub(e.created) > s.window {
+		s.remove(el)
+		return Response{}, false, nil
+	}
+	s.ll.MoveToFront(el)
+	return e.resp, true, nil
+}
+
+func (s *MemoryStore) Put(_ context.Context, id string, resp Response) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if el, ok := s.items[id]; ok {
+		s.remove(el)
+	}
+	s.items[id] = s.ll.PushFront(&memoryEntry{id: id, resp: resp, created: s.now()})
+	for s.ll.Len() > s.size {
+		s.remove(s.ll.Back())
+	}
+	return nil
+}
+
+// Len количество сохраненных идентификаторов
+func (s *MemoryStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.ll.Len()
+}
+
+func (s *MemoryStore) remove(el *list.Element) {
+	s.ll.Remove(el)
+	delete(s.items, el.Value.(*memoryEntry).id)
+}
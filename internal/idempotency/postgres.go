@@ -0,0 +1,58 @@
+package idempotency
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"logger/internal/database"
+	"time"
+)
+
+// PgStore хранилище ответов в таблице PostgreSQL batch_ids. Позволяет нескольким экземплярам сервера
+// с общей БД распознавать batch-и, уже примененные другим экземпляром
+type PgStore struct {
+	db     database.Database
+	window time.Duration
+}
+
+// NewPgStore создание таблицы batch_ids при необходимости
+func NewPgStore(ctx context.Context, db database.Database, window time.Duration) (*PgStore, error) {
+	sqlQuery := `CREATE TABLE IF NOT EXISTS batch_ids (
+		"batch_id" TEXT PRIMARY KEY,
+		"status" INTEGER NOT NULL,
+		"content_type" TEXT NOT NULL,
+		"body" BYTEA,
+		"created_at" TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`
+	if _, err := db.ExecContext(ctx, sqlQuery); err != nil {
+		return nil, fmt.Errorf("idempotency: create table batch_ids: %w", err)
+	}
+	return &PgStore{db: db, window: window}, nil
+}
+
+func (s *PgStore) Get(ctx context.Context, id string) (Response, bool, error) {
+	sqlQuery := "SELECT status, content_type, body FROM batch_ids WHERE batch_id = $1 AND created_at > now() - make_interval(secs => $2)"
+	var resp Response
+	err := s.db.QueryRowContext(ctx, sqlQuery, id, s.window.Seconds()).Scan(&resp.Status, &resp.ContentType, &resp.Body)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Response{}, false, nil
+	}
+	if err != nil {
+		return Response{}, false, fmt.Errorf("idempotency: get batch id: %w", err)
+	}
+	return resp, true, nil
+}
+
+// Put сохранение ответа с удалением идентификаторов старше окна
+func (s *PgStore) Put(ctx context.Context, id string, resp Response) error {
+	sqlQuery := "INSERT INTO batch_ids (batch_id, status, content_type, body, created_at) VALUES($1,$2,$3,$4,now())" +
+		" ON CONFLICT(batch_id) DO UPDATE SET status = $2, content_type = $3, body = $4, created_at = now()"
+	if _, err := s.db.ExecContext(ctx, sqlQuery, id, resp.Status, resp.ContentType, resp.Body); err != nil {
+		return fmt.Errorf("idempotency: put batch id: %w", err)
+	}
+	if _, err := s.db.ExecContext(ctx, "DELETE FROM batch_ids WHERE created_at < now() - make_interval(secs => $1)", s.window.Seconds()); err != nil {
+		return fmt.Errorf("idempotency: delete expired batch ids: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,228 @@
+// Package keyring набор ключей HMAC-подписи запросов агента и ответов сервера. Подпись передается в заголовке
+// HashSHA256, идентификатор ключа -- в заголовке HashKeyID. Подписывается всегда самым новым ключом,
+// а проверяются подписи всеми действующими ключами. Это позволяет сменить общий ключ без одновременного
+// перезапуска всех агентов и серверов:
+//  1. всем добавляется новый ключ вторым: "old:s1,new:s2" -- подпись старым, принимаются оба;
+//  2. всем новый ключ ставится первым: "new:s2,old:s1" -- подпись новым, принимаются оба;
+//  3. после обновления всех старый ключ удаляется, либо перестает приниматься по истечении срока "old:s1@<RFC3339>".
+package keyring
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// SignatureHeader заголовок с HMAC-SHA256 подписью тела в hex
+	SignatureHeader = "HashSHA256"
+	// KeyIDHeader заголовок с идентификатором ключа подписи
+	KeyIDHeader = "HashKeyID"
+	// DefaultKeyID идентификатор ключа, заданного одиночным параметром KEY
+	DefaultKeyID = "default"
+	// TimestampHeader заголовок с временем подписи запроса в секундах Unix
+	TimestampHeader = "HashTimestamp"
+	// NonceHeader заголовок с одноразовым случайным значением запроса
+	NonceHeader = "HashNonce"
+)
+
+var (
+	ErrUnknownKey   = errors.New("unknown signing key")
+	ErrExpiredKey   = errors.New("signing key expired")
+	ErrBadSignature = errors.New("signature is incorrect")
+	ErrNoSignature  = errors.New("signature is missing")
+)
+
+// now текущее время, подменяется в тестах
+var now = time.Now
+
+// Key ключ подписи
+type Key struct {
+	ID      string
+	Secret  []byte
+	Expires time.Time // После Expires ключ не принимается и не используется для подписи. Нулевое значение -- бессрочно
+}
+
+func (k Key) expired() bool {
+	return !k.Expires.IsZero() && now().After(k.Expires)
+}
+
+func (k Key) sign(body []byte) []byte {
+	h := hmac.New(sha256.New, k.Secret)
+	h.Write(body)
+	return h.Sum(nil)
+}
+
+// Ring набор ключей. Первый ключ -- самый новый, им подписываются сообщения.
+// Методы nil *Ring безопасны: nil означает, что подпись отключена
+type Ring struct {
+	keys []Key
+}
+
+// New набор ключей из списка keys вида "id:secret[@RFC3339],..." в порядке от нового к старому
+// и одиночного ключа key, добавляемого последним под идентификатором DefaultKeyID.
+// Если оба параметра пусты, возвращается nil -- подпись отключена
+func New(key string, keys string) (*Ring, error) {
+	r := &Ring{}
+	seen := make(map[string]bool)
+	for _, item := range strings.Split(keys, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		k, err := parseKey(item)
+		if err != nil {
+			return nil, err
+		}
+		if seen[k.ID] {
+			return nil, fmt.Errorf("keyring: duplicate key id %q", k.ID)
+		}
+		seen[k.ID] = true
+		r.keys = append(r.keys, k)
+	}
+	if key != "" && !seen[DefaultKeyID] {
+		r.keys = append(r.keys, Key{ID: DefaultKeyID, Secret: []byte(key)})
+	}
+	if len(r.keys) == 0 {
+		return nil, nil
+	}
+	return r, nil
+}
+
+// parseKey разбор ключа вида "id:secret" или "id:secret@2026-01-02T15:04:05Z"
+func parseKey(s string) (Key, error) {
+	id, secret, ok := strings.Cut(s, ":")
+	if !ok || id == "" || secret == "" {
+		return Key{}, fmt.Errorf("keyring: key must be id:secret[@RFC3339], got %q", id)
+	}
+	k := Key{ID: id}
+	if i := strings.LastIndex(secret, "@"); i >= 0 {
+		expires, err := time.Parse(time.RFC3339, secret[i+1:])
+		if err != nil {
+			return Key{}, fmt.Errorf("keyring: key %q: invalid expiration time: %w", id, err)
+		}
+		k.Expires = expires
+		secret = secret[:i]
+	}
+	k.Secret = []byte(secret)
+	return k, nil
+}
+
+// Enabled true, если подпись включена
+func (r *Ring) Enabled() bool {
+	return r != nil && len(r.keys) > 0
+}
+
+// IDs идентификаторы ключей от нового к старому
+func (r *Ring) IDs() []string {
+	if r == nil {
+		return nil
+	}
+	ids := make([]string, 0, len(r.keys))
+	for _, k := range r.keys {
+		ids = append(ids, k.ID)
+	}
+	return ids
+}
+
+// Sign подпись body самым новым действующим ключом. ok == false, если подпись отключена или все ключи истекли
+func (r *Ring) Sign(body []byte) (id string, sig string, ok bool) {
+	if r == nil {
+		return "", "", false
+	}
+	for _, k := range r.keys {
+		if !k.expired() {
+			return k.ID, hex.EncodeToString(k.sign(body)), true
+		}
+	}
+	return "", "", false
+}
+
+// Verify проверка подписи sig тела body ключом id. Если id пуст (отправитель без поддержки набора ключей),
+// подпись проверяется всеми действующими ключами
+func (r *Ring) Verify(id string, body []byte, sig string) error {
+	if !r.Enabled() {
+		return nil
+	}
+	if sig == "" {
+		return ErrNoSignature
+	}
+	data, err := hex.DecodeString(sig)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrBadSignature, err)
+	}
+	for _, k := range r.keys {
+		if id != "" && k.ID != id {
+			continue
+		}
+		if k.expired() {
+			if id != "" {
+				return fmt.Errorf("%w: %s", ErrExpiredKey, id)
+			}
+			continue
+		}
+		if hmac.Equal(k.sign(body), data) {
+			return nil
+		}
+		if id != "" {
+			return ErrBadSignature
+		}
+	}
+	if id != "" {
+		return fmt.Errorf("%w: %s", ErrUnknownKey, id)
+	}
+	return ErrBadSignature
+}
+
+// RequestPayload подписываемое содержимое запроса: метод, путь с query, время подписи, nonce и тело в том виде,
+// в котором оно передается (после сжатия). Подпись запроса покрывает метод и путь, чтобы подписанное тело
+// нельзя было отправить на другой endpoint, а обновления метрик через URL были защищены подписью.
+// Время и nonce позволяют серверу отклонять повторно отправленные перехваченные запросы
+func RequestPayload(method string, requestURI string, timestamp string, nonce string, body []byte) []byte {
+	payload := make([]byte, 0, len(method)+len(requestURI)+len(timestamp)+len(nonce)+len(body)+4)
+	for _, part := range []string{method, requestURI, timestamp, nonce} {
+		payload = append(payload, part...)
+		payload = append(payload, '\n')
+	}
+	return append(payload, body...)
+}
+
+// newNonce случайное одноразовое значение запроса
+func newNonce() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// SignRequest подпись запроса req с телом body в его заголовках. Каждый вызов, в том числе для повтора
+// того же запроса, использует текущее время и новый nonce
+func (r *Ring) SignRequest(req *http.Request, body []byte) {
+	if !r.Enabled() {
+		return
+	}
+	timestamp := strconv.FormatInt(now().Unix(), 10)
+	nonce := newNonce()
+	req.Header.Set(TimestampHeader, timestamp)
+	req.Header.Set(NonceHeader, nonce)
+	r.SignHeader(req.Header, RequestPayload(req.Method, req.URL.RequestURI(), timestamp, nonce, body))
+}
+
+// SignHeader запись подписи body и идентификатора ключа в заголовки h
+func (r *Ring) SignHeader(h http.Header, body []byte) {
+	if id, sig, ok := r.Sign(body); ok {
+		h.Set(SignatureHeader, sig)
+		h.Set(KeyIDHeader, id)
+	}
+}
+
+// VerifyHeader проверка подписи body по заголовкам h
+func (r *Ring) VerifyHeader(h http.Header, body []byte) error {
+	return r.Verify(h.Get(KeyIDHeader), body, h.Get(SignatureHeader))
+}
@@ -0,0 +1,148 @@
+package keyring
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		name    string
+		key     string
+		keys    string
+		wantIDs []string
+		wantErr bool
+	}{
+		{name: "disabled", wantIDs: nil},
+		{name: "single key", key: "superkey", wantIDs: []string{DefaultKeyID}},
+		{name: "ring", keys: "new:s2, old:s1@2030-01-01T00:00:00Z", wantIDs: []string{"new", "old"}},
+		{name: "ring and single key", key: "superkey", keys: "new:s2", wantIDs: []string{"new", DefaultKeyID}},
+		{name: "default id in ring wins", key: "superkey", keys: "default:s2", wantIDs: []string{DefaultKeyID}},
+		{name: "duplicate id", keys: "a:s1,a:s2", wantErr: true},
+		{name: "no secret", keys: "a", wantErr: true},
+		{name: "empty secret", keys: "a:", wantErr: true},
+		{name: "invalid expiration", keys: "a:s1@tomorrow", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := New(tt.key, tt.keys)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantIDs, r.IDs())
+			assert.Equal(t, tt.wantIDs != nil, r.Enabled())
+		})
+	}
+}
+
+func TestRing_Rotation(t *testing.T) {
+	defer func() { now = time.Now }()
+	now = func() time.Time { return time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC) }
+	body := []byte("body")
+
+	// Шаг 1: подпись старым ключом, шаг 2: подпись новым, старый принимается до истечения срока
+	step1, err := New("", "old:s1,new:s2")
+	require.NoError(t, err)
+	step2, err := New("", "new:s2,old:s1@2026-02-01T00:00:00Z")
+	require.NoError(t, err)
+	newOnly, err := New("", "new:s2")
+	require.NoError(t, err)
+
+	id, sig, ok := step1.Sign(body)
+	require.True(t, ok)
+	assert.Equal(t, "old", id)
+	assert.NoError(t, step2.Verify(id, body, sig))
+	assert.ErrorIs(t, newOnly.Verify(id, body, sig), ErrUnknownKey)
+
+	id, sig, ok = step2.Sign(body)
+	require.True(t, ok)
+	assert.Equal(t, "new", id)
+	assert.NoError(t, step1.Verify(id, body, sig))
+	assert.NoError(t, newOnly.Verify(id, body, sig))
+
+	// По истечении срока старый ключ не принимается
+	_, oldSig, _ := step1.Sign(body)
+	now = func() time.Time { return time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC) }
+	assert.ErrorIs(t, step2.Verify("old", body, oldSig), ErrExpiredKey)
+	assert.ErrorIs(t, step2.Verify("", body, oldSig), ErrBadSignature)
+}
+
+func TestRing_Verify(t *testing.T) {
+	r, err := New("superkey", "a:s1")
+	require.NoError(t, err)
+	body := []byte("body")
+	id, sig, _ := r.Sign(body)
+	_, legacySig, _ := (&Ring{keys: []Key{{ID: DefaultKeyID, Secret: []byte("superkey")}}}).Sign(body)
+
+	tests := []struct {
+		name    string
+		id      string
+		body    []byte
+		sig     string
+		wantErr error
+	}{
+		{name: "valid", id: id, body: body, sig: sig},
+		{name: "legacy sender without key id", body: body, sig: legacySig},
+		{name: "modified body", id: id, body: []byte("other"), sig: sig, wantErr: ErrBadSignature},
+		{name: "wrong key id", id: DefaultKeyID, body: body, sig: sig, wantErr: ErrBadSignature},
+		{name: "unknown key id", id: "b", body: body, sig: sig, wantErr: ErrUnknownKey},
+		{name: "not hex", id: id, body: body, sig: "zz", wantErr: ErrBadSignature},
+		{name: "missing", id: id, body: body, wantErr: ErrNoSignature},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := r.Verify(tt.id, tt.body, tt.sig)
+			if tt.wantErr == nil {
+				assert.NoError(t, err)
+				return
+			}
+			assert.ErrorIs(t, err, tt.wantErr)
+		})
+	}
+}
+
+func TestRing_Header(t *testing.T) {
+	var disabled *Ring
+	h := http.Header{}
+	disabled.SignHeader(h, []byte("body"))
+	assert.Empty(t, h)
+	assert.NoError(t, disabled.VerifyHeader(h, []byte("body")))
+
+	r, err := New("", "a:s1")
+	require.NoError(t, err)
+	r.SignHeader(h, []byte("body"))
+	assert.Equal(t, "a", h.Get(KeyIDHeader))
+	assert.NoError(t, r.VerifyHeader(h, []byte("body")))
+	assert.ErrorIs(t, r.VerifyHeader(h, []byte("other")), ErrBadSignature)
+}
+
+func TestRing_SignRequest(t *testing.T) {
+	r, err := New("", "a:s1")
+	require.NoError(t, err)
+	body := []byte("body")
+
+	// Каждая подпись, в том числе повтора того же запроса, использует новый nonce
+	var nonces []string
+	for i := 0; i < 2; i++ {
+		req, err := http.NewRequest(http.MethodPost, "http://localhost:8080/updates?x=1", nil)
+		require.NoError(t, err)
+		r.SignRequest(req, body)
+		ts, nonce := req.Header.Get(TimestampHeader), req.Header.Get(NonceHeader)
+		require.NotEmpty(t, ts)
+		require.NotEmpty(t, nonce)
+		assert.NoError(t, r.VerifyHeader(req.Header, RequestPayload(http.MethodPost, "/updates?x=1", ts, nonce, body)))
+		nonces = append(nonces, nonce)
+	}
+	assert.NotEqual(t, nonces[0], nonces[1])
+
+	var disabled *Ring
+	req, err := http.NewRequest(http.MethodPost, "http://localhost:8080/updates", nil)
+	require.NoError(t, err)
+	disabled.SignRequest(req, body)
+	assert.Empty(t, req.Header)
+}
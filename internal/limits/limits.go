@@ -0,0 +1,137 @@
+// Package limits ограничения нагрузки на сервер: размер тела запроса и частота запросов клиента.
+// Размер тела ограничивается до чтения: превышение возвращает *http.MaxBytesError, который apperr
+// отображает в 413. Частота запросов ограничивается token bucket-ом на клиента: при превышении
+// возвращается 429 с заголовком Retry-After, который агент учитывает при повторе.
+package limits
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"logger/internal/apperr"
+	"logger/internal/logging"
+	"logger/internal/tlsconf"
+	"logger/internal/tokens"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ErrRateLimited причина отказа по частоте запросов
+var ErrRateLimited = errors.New("too many requests from client")
+
+// BodySize ограничение размера тела запроса maxSize байтами в том виде, в котором оно передано (до распаковки).
+// Для route-ов из routes (шаблоны gin) действует собственный лимит. Лимит <= 0 -- без ограничения
+func BodySize(maxSize int64, routes map[string]int64) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		maxSize := maxSize
+		if v, ok := routes[c.FullPath()]; ok {
+			maxSize = v
+		}
+		if maxSize > 0 && c.Request.Body != nil {
+			if c.Request.ContentLength > maxSize {
+				apperr.WriteProblem(c, apperr.TooLarge("limits.BodySize",
+					fmt.Errorf("body size %d exceeds limit %d", c.Request.ContentLength, maxSize)))
+				return
+			}
+			c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxSize)
+		}
+		c.Next()
+	}
+}
+
+// bucket token bucket клиента
+type bucket struct {
+	key    string
+	tokens float64
+	last   time.Time
+}
+
+// Limiter token bucket-ы клиентов: rate запросов в секунду с накоплением до burst запросов.
+// Хранится не более size bucket-ов, bucket-ы давно не обращавшихся клиентов вытесняются (LRU)
+type Limiter struct {
+	mu    sync.Mutex
+	rate  float64
+	burst float64
+	size  int
+	ll    *list.List               // Элементы *bucket, в начале -- последние использованные
+	items map[string]*list.Element // Ключ клиента -> элемент ll
+	now   func() time.Time
+}
+
+// NewLimiter создание Limiter. burst < 1 -- burst равен rate, но не меньше 1
+func NewLimiter(rate float64, burst int, size int) *Limiter {
+	b := float64(burst)
+	if b < 1 {
+		b = math.Max(rate, 1)
+	}
+	return &Limiter{
+		rate:  rate,
+		burst: b,
+		size:  size,
+		ll:    list.New(),
+		items: make(map[string]*list.Element),
+		now:   time.Now,
+	}
+}
+
+// Allow списание запроса клиента key. Если запрос не разрешен, возвращается время до появления токена
+func (l *Limiter) Allow(key string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	var b *bucket
+	if el, ok := l.items[key]; ok {
+		b = el.Value.(*bucket)
+		l.ll.MoveToFront(el)
+		b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+		b.last = now
+	} else {
+		b = &bucket{key: key, tokens: l.burst, last: now}
+		l.items[key] = l.ll.PushFront(b)
+		for l.ll.Len() > l.size {
+			el := l.ll.Back()
+			l.ll.Remove(el)
+			delete(l.items, el.Value.(*bucket).key)
+		}
+	}
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+}
+
+// clientKey ключ клиента: CN клиентского сертификата при mTLS, идентификатор токена, если запрос прошел
+// проверку токена, иначе IP адрес
+func clientKey(c *gin.Context) string {
+	if id := tlsconf.Identity(c); id != "" {
+		return "cn:" + id
+	}
+	if t, ok := tokens.FromContext(c); ok {
+		return "token:" + t.ID
+	}
+	return "ip:" + c.ClientIP()
+}
+
+// RateLimit ограничение частоты запросов клиентов. Должен подключаться после tlsconf.Middleware и tokens.Middleware,
+// чтобы запросы агентов учитывались по сертификату или токену, а не по IP адресу
+func RateLimit(l *Limiter) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := clientKey(c)
+		ok, wait := l.Allow(key)
+		if ok {
+			c.Next()
+			return
+		}
+		// Retry-After в целых секундах, округление вверх
+		retryAfter := int(math.Ceil(wait.Seconds()))
+		logging.FromContext(c.Request.Context()).Infow("limits.RateLimit: request rejected", "client", key,
+			"route", c.FullPath(), "retry_after", retryAfter)
+		c.Header("Retry-After", strconv.Itoa(retryAfter))
+		apperr.WriteProblem(c, apperr.RateLimited("limits.RateLimit", ErrRateLimited))
+	}
+}
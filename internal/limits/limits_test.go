@@ -0,0 +1,181 @@
+package limits
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"logger/internal/apperr"
+	"logger/internal/compress"
+	"logger/internal/tlsconf"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestLimiter_Allow(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	l := NewLimiter(2, 3, 2)
+	l.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		ok, _ := l.Allow("a")
+		assert.True(t, ok, "burst request %d", i)
+	}
+	ok, wait := l.Allow("a")
+	assert.False(t, ok)
+	assert.Equal(t, 500*time.Millisecond, wait)
+	// Другой клиент ограничивается независимо
+	ok, _ = l.Allow("b")
+	assert.True(t, ok)
+
+	now = now.Add(500 * time.Millisecond)
+	ok, _ = l.Allow("a")
+	assert.True(t, ok)
+
+	// Клиент, вытесненный из памяти, начинает с полным bucket-ом
+	l.Allow("c")
+	assert.Equal(t, 2, l.ll.Len())
+	ok, _ = l.Allow("b")
+	assert.True(t, ok)
+}
+
+func TestRateLimit(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(RateLimit(NewLimiter(0.5, 1, 10)))
+	router.GET("/", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	do := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		return w
+	}
+	assert.Equal(t, http.StatusOK, do().Code)
+	w := do()
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "2", w.Header().Get("Retry-After"))
+}
+
+func TestRateLimit_SpoofedForwardedFor(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	require.NoError(t, router.SetTrustedProxies(nil))
+	router.Use(RateLimit(NewLimiter(0.5, 1, 10)))
+	router.GET("/", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	// Подмена X-Forwarded-For и X-Real-IP не создает новый bucket: IP клиента -- адрес соединения
+	for i, want := range []int{http.StatusOK, http.StatusTooManyRequests, http.StatusTooManyRequests} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		req.Header.Set("X-Forwarded-For", fmt.Sprintf("198.51.100.%d", i))
+		req.Header.Set("X-Real-IP", fmt.Sprintf("203.0.113.%d", i))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		assert.Equal(t, want, w.Code, "request %d", i)
+	}
+}
+
+func TestRateLimit_ClientCertificate(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(tlsconf.Middleware())
+	router.Use(RateLimit(NewLimiter(0.5, 1, 10)))
+	router.GET("/", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	do := func(cn string, remote string) int {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = remote
+		req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: cn}}}}}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+	// Запросы агента учитываются по CN сертификата независимо от IP адреса
+	assert.Equal(t, http.StatusOK, do("agent-01", "192.0.2.1:1234"))
+	assert.Equal(t, http.StatusTooManyRequests, do("agent-01", "192.0.2.2:1234"))
+	assert.Equal(t, http.StatusOK, do("agent-02", "192.0.2.1:1234"))
+}
+
+func TestBodySize(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(BodySize(4<<10, nil))
+	router.Use(compress.RequestHandle(context.Background(), 64<<10, nil))
+	router.POST("/", func(c *gin.Context) {
+		if _, err := io.ReadAll(c.Request.Body); err != nil {
+			apperr.WriteProblem(c, err)
+			return
+		}
+		c.Status(http.StatusOK)
+	})
+	gzipped := func(size int) []byte {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		_, err := gz.Write(bytes.Repeat([]byte("a"), size))
+		require.NoError(t, err)
+		require.NoError(t, gz.Close())
+		return buf.Bytes()
+	}
+
+	tests := []struct {
+		name     string
+		body     []byte
+		gzip     bool
+		chunked  bool
+		wantCode int
+	}{
+		{name: "small", body: []byte("[]"), wantCode: http.StatusOK},
+		{name: "too large", body: bytes.Repeat([]byte("a"), 4<<10+1), wantCode: http.StatusRequestEntityTooLarge},
+		{name: "too large without content length", body: bytes.Repeat([]byte("a"), 4<<10+1), chunked: true, wantCode: http.StatusRequestEntityTooLarge},
+		{name: "gzip within limits", body: gzipped(32 << 10), gzip: true, wantCode: http.StatusOK},
+		{name: "gzip bomb", body: gzipped(1 << 20), gzip: true, wantCode: http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.gzip {
+				// Сжатое тело укладывается в лимит до распаковки
+				require.LessOrEqual(t, len(tt.body), 4<<10)
+			}
+			req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(tt.body))
+			if tt.chunked {
+				req.ContentLength = -1
+			}
+			if tt.gzip {
+				req.Header.Set("Content-Encoding", "gzip")
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			assert.Equal(t, tt.wantCode, w.Code)
+		})
+	}
+}
+
+func TestBodySize_Routes(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(BodySize(4, map[string]int64{"/stream": 0}))
+	handler := func(c *gin.Context) {
+		if _, err := io.ReadAll(c.Request.Body); err != nil {
+			apperr.WriteProblem(c, err)
+			return
+		}
+		c.Status(http.StatusOK)
+	}
+	router.POST("/", handler)
+	router.POST("/stream", handler)
+
+	for target, want := range map[string]int{"/": http.StatusRequestEntityTooLarge, "/stream": http.StatusOK} {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, target, bytes.NewReader(make([]byte, 64))))
+		assert.Equal(t, want, w.Code, target)
+	}
+}
@@ -0,0 +1,101 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"gopkg.in/natefinch/lumberjack.v2"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+// Config параметры логгера
+type Config struct {
+	Level      string // debug, info, warn, error. По умолчанию info
+	Format     string // json или console. По умолчанию console
+	File       string // Файл лога. Пустая строка -- stderr
+	MaxSizeMB  int    // Размер файла лога в мегабайтах, после которого файл ротируется
+	MaxAgeDays int    // Количество дней хранения ротированных файлов. 0 -- без ограничения
+	MaxBackups int    // Количество хранимых ротированных файлов. 0 -- без ограничения
+}
+
+// Значения по умолчанию параметров ротации
+const (
+	DefaultMaxSizeMB  = 100
+	DefaultMaxAgeDays = 7
+	DefaultMaxBackups = 5
+)
+
+// New создание логгера согласно cfg.
+// Тела запросов, значения метрик и ключи подписи пишутся в лог только на уровне debug или не пишутся вовсе
+func New(cfg Config) (*zap.Logger, error) {
+	level := zapcore.InfoLevel
+	if cfg.Level != "" {
+		if err := level.UnmarshalText([]byte(strings.ToLower(cfg.Level))); err != nil {
+			return nil, fmt.Errorf("logging: unknown level %q", cfg.Level)
+		}
+	}
+
+	encCfg := zap.NewProductionEncoderConfig()
+	encCfg.EncodeTime = zapcore.ISO8601TimeEncoder
+	var enc zapcore.Encoder
+	switch strings.ToLower(cfg.Format) {
+	case "", "console":
+		encCfg.EncodeLevel = zapcore.CapitalLevelEncoder
+		enc = zapcore.NewConsoleEncoder(encCfg)
+	case "json":
+		enc = zapcore.NewJSONEncoder(encCfg)
+	default:
+		return nil, fmt.Errorf("logging: unknown format %q, must be json or console", cfg.Format)
+	}
+
+	var out zapcore.WriteSyncer = zapcore.Lock(os.Stderr)
+	if cfg.File != "" {
+		out = zapcore.AddSync(&lumberjack.Logger{
+			Filename:   cfg.File,
+			MaxSize:    cfg.MaxSizeMB,
+			MaxAge:     cfg.MaxAgeDays,
+			MaxBackups: cfg.MaxBackups,
+		})
+	}
+	return zap.New(zapcore.NewCore(enc, out, level), zap.AddCaller()), nil
+}
+
+// defaultLogger логгер процесса. До вызова SetDefault пишет в stderr на уровне info
+var defaultLogger atomic.Pointer[zap.SugaredLogger]
+
+func init() {
+	l, _ := New(Config{})
+	defaultLogger.Store(l.Sugar())
+}
+
+// SetDefault установка логгера процесса. Вывод стандартного пакета log, в том числе из сторонних библиотек,
+// перенаправляется в l на уровне info
+func SetDefault(l *zap.Logger) {
+	defaultLogger.Store(l.Sugar())
+	zap.RedirectStdLog(l)
+}
+
+// L логгер процесса
+func L() *zap.SugaredLogger {
+	return defaultLogger.Load()
+}
+
+type loggerKey struct{}
+
+// WithLogger контекст с логгером l. Сервер и агент передают логгер компонентам через корневой контекст
+func WithLogger(ctx context.Context, l *zap.SugaredLogger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, l)
+}
+
+// FromContext логгер из контекста ctx или логгер процесса, если в контексте логгера нет
+func FromContext(ctx context.Context) *zap.SugaredLogger {
+	if ctx != nil {
+		if l, ok := ctx.Value(loggerKey{}).(*zap.SugaredLogger); ok {
+			return l
+		}
+	}
+	return L()
+}
@@ -0,0 +1,97 @@
+package logging
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     Config
+		wantErr bool
+	}{
+		{name: "defaults", cfg: Config{}},
+		{name: "json debug", cfg: Config{Level: "debug", Format: "json"}},
+		{name: "upper case", cfg: Config{Level: "WARN", Format: "Console"}},
+		{name: "unknown level", cfg: Config{Level: "verbose"}, wantErr: true},
+		{name: "unknown format", cfg: Config{Format: "xml"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, err := New(tt.cfg)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.NotNil(t, l)
+		})
+	}
+}
+
+func TestNew_JSONFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "test.log")
+	l, err := New(Config{Level: "info", Format: "json", File: file, MaxSizeMB: DefaultMaxSizeMB})
+	require.NoError(t, err)
+
+	l.Sugar().Debugw("hidden", "key", "value")
+	l.Sugar().Infow("shown", "key", "value")
+	require.NoError(t, l.Sync())
+
+	data, err := os.ReadFile(file)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	require.Len(t, lines, 1)
+	var entry map[string]any
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &entry))
+	assert.Equal(t, "info", entry["level"])
+	assert.Equal(t, "shown", entry["msg"])
+	assert.Equal(t, "value", entry["key"])
+}
+
+func TestFromContext(t *testing.T) {
+	assert.Same(t, L(), FromContext(context.Background()))
+
+	l, err := New(Config{})
+	require.NoError(t, err)
+	sugar := l.Sugar()
+	assert.Same(t, sugar, FromContext(WithLogger(context.Background(), sugar)))
+}
+
+func TestWithLogging_RequestLogger(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	core, logs := observer.New(zap.InfoLevel)
+	base := zap.New(core).Sugar()
+
+	router := gin.New()
+	// Поле agent добавляет в логгер запроса предыдущий middleware, например, tlsconf.Middleware
+	router.Use(func(c *gin.Context) {
+		if agent := c.GetHeader("X-Test-Agent"); agent != "" {
+			c.Request = c.Request.WithContext(WithLogger(c.Request.Context(), base.With("agent", agent)))
+		}
+	})
+	router.Use(WithLogging(base))
+	router.GET("/", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-Test-Agent", "agent-01")
+	router.ServeHTTP(httptest.NewRecorder(), req)
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+	entries := logs.FilterMessage("request").All()
+	require.Len(t, entries, 2)
+	assert.Equal(t, "agent-01", entries[0].ContextMap()["agent"])
+	assert.NotContains(t, entries[1].ContextMap(), "agent")
+}
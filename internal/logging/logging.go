@@ -6,15 +6,25 @@ import (
 	"time"
 )
 
-// WithLogging обертка над gin.HandlerFunc для внедрения логирования
+// WithLogging обертка над gin.HandlerFunc для внедрения логирования. Если предыдущие middleware сохранили
+// в контексте запроса логгер с полями запроса (например, идентификатором агента при mTLS), запрос пишется им
 func WithLogging(sugar *zap.SugaredLogger) gin.HandlerFunc {
 	logFn := func(c *gin.Context) {
 		start := time.Now()
 		c.Next()
 		duration := time.Since(start)
 
-		sugar.Infoln(
-			"uri", c.Request.RequestURI,
+		// Запрос пишется по шаблону route-а: URL может содержать имена и значения метрик
+		route := c.FullPath()
+		if route == "" {
+			route = "NoRoute"
+		}
+		logger := sugar
+		if l, ok := c.Request.Context().Value(loggerKey{}).(*zap.SugaredLogger); ok {
+			logger = l
+		}
+		logger.Infow("request",
+			"route", route,
 			"method", c.Request.Method,
 			"status", c.Writer.Status(), // получаем перехваченный код статуса ответа
 			"duration", duration,
@@ -2,34 +2,85 @@ package internal
 
 import (
 	"bytes"
-	"compress/gzip"
-	"crypto/hmac"
-	"crypto/sha256"
+	"context"
+	"crypto/rand"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/shirou/gopsutil/v4/cpu"
 	"github.com/shirou/gopsutil/v4/mem"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"io"
-	"log"
 	"logger/conf"
-	"math/rand"
+	"logger/internal/apperr"
+	"logger/internal/breaker"
+	"logger/internal/collector"
+	"logger/internal/compress"
+	"logger/internal/idempotency"
+	"logger/internal/logging"
+	"logger/internal/retry"
+	"logger/internal/selfmetrics"
+	"logger/internal/storage"
+	"logger/internal/tlsconf"
+	"logger/internal/tracing"
+	"logger/internal/wire"
+	mathrand "math/rand"
 	"net/http"
 	"reflect"
 	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// MetricsStorage метрики агента. counterMap содержит приращения counter-ов с момента последней успешной отсылки,
+// pendingMap -- приращения из batch-а pendingID, отосланного на сервер, но еще не подтвержденного им
 type MetricsStorage struct {
 	gaugeMap   map[string]float64
 	counterMap map[string]int64
+	pendingMap map[string]int64
+	pendingID  string
 }
 
-// Набор из 3-х таймаутов для повтора операции в случае retriable-ошибки
-var timeoutsRetryConst = [3]int{1, 3, 5}
+// sendPolicy политика повтора отсылки запроса на сервер
+var sendPolicy = retry.DefaultPolicy.Named("agent.send")
 
+// sendBreaker circuit breaker отсылки запросов на сервер. Параметры задаются через InitBreaker
+var sendBreaker = newSendBreaker(breaker.Settings{})
+
+// client HTTP клиент отсылки запросов на сервер. TLS настраивается через InitClient
 var client = &http.Client{}
 
+// InitClient настройка TLS клиента отсылки запросов согласно конфигурации агента.
+// Вызывается до запуска горутин отсылки метрик
+func InitClient(config *conf.AgentConfig) error {
+	if !config.TLS {
+		return nil
+	}
+	tlsConfig, err := tlsconf.Client(config.TLSCAFile, config.TLSCertFile, config.TLSKeyFile)
+	if err != nil {
+		return err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	client = &http.Client{Transport: transport}
+	return nil
+}
+
+// ServerURL URL запроса к серверу по пути path: https, если включен TLS, иначе http
+func ServerURL(config *conf.AgentConfig, path string) string {
+	scheme := "http://"
+	if config.TLS {
+		scheme = "https://"
+	}
+	return scheme + config.Address + path
+}
+
 func NewMetricsStorageObj() MetricsStorage {
 	return MetricsStorage{
 		gaugeMap:   make(map[string]float64),
@@ -37,9 +88,23 @@ func NewMetricsStorageObj() MetricsStorage {
 	}
 }
 
+// SetGauge, SetCounter, AddCounter -- реализация collector.Sink. Блокировку обеспечивает вызывающий код
+
+func (metrics *MetricsStorage) SetGauge(name string, value float64) {
+	metrics.gaugeMap[name] = value
+}
+
+func (metrics *MetricsStorage) SetCounter(name string, value int64) {
+	metrics.counterMap[name] = value
+}
+
+func (metrics *MetricsStorage) AddCounter(name string, delta int64) {
+	metrics.counterMap[name] += delta
+}
+
 // MetricsPolling -- заполнение словаря метрик перебором всех полей структуры MemStats через reflect
 // с выбором метрик необходимых типов
-func MetricsPolling(metrics *MetricsStorage) error {
+func MetricsPolling(metrics collector.Sink) error {
 	var memStats runtime.MemStats
 	runtime.ReadMemStats(&memStats)
 	val := reflect.ValueOf(memStats)
@@ -49,174 +114,233 @@ func MetricsPolling(metrics *MetricsStorage) error {
 		field := val.Field(x)
 		switch field.Kind() {
 		case reflect.Uint64:
-			metrics.gaugeMap[val.Type().Field(x).Name] = float64(field.Uint())
+			metrics.SetGauge(val.Type().Field(x).Name, float64(field.Uint()))
 		case reflect.Uint32:
-			metrics.gaugeMap[val.Type().Field(x).Name] = float64(field.Uint())
+			metrics.SetGauge(val.Type().Field(x).Name, float64(field.Uint()))
 		case reflect.Float64:
-			metrics.gaugeMap[val.Type().Field(x).Name] = field.Float()
+			metrics.SetGauge(val.Type().Field(x).Name, field.Float())
 		default:
 			//fmt.Printf("Unsupported type: %v\n", field.Kind())
 		}
 	}
-	metrics.counterMap["PollCount"] = 1
-	metrics.gaugeMap["RandomValue"] = rand.Float64()
+	metrics.AddCounter("PollCount", 1)
+	metrics.SetGauge("RandomValue", mathrand.Float64())
 
 	return nil
 }
 
-func GopsMetricPolling(metrics *MetricsStorage) error {
+func GopsMetricPolling(metrics collector.Sink) error {
 	v, err := mem.VirtualMemory()
 	if err != nil {
-		log.Println("GopsMetricPolling error in mem.VirtualMemory()")
-		return err
+		return fmt.Errorf("GopsMetricPolling: mem.VirtualMemory: %w", err)
 	}
-	metrics.gaugeMap["TotalMemory"] = float64(v.Total)
-	metrics.gaugeMap["FreeMemory"] = float64(v.Free)
+	metrics.SetGauge("TotalMemory", float64(v.Total))
+	metrics.SetGauge("FreeMemory", float64(v.Free))
 
-	c, err := cpu.Percent(0, false)
+	// Загрузка каждого ядра: CPUutilization1 ... CPUutilizationN
+	c, err := cpu.Percent(0, true)
 	if err != nil {
-		log.Println("GopsMetricPolling error in cpu.Percent(0, false)")
-		return err
+		return fmt.Errorf("GopsMetricPolling: cpu.Percent: %w", err)
+	}
+	for i, percent := range c {
+		metrics.SetGauge("CPUutilization"+strconv.Itoa(i+1), percent)
 	}
-	metrics.gaugeMap["CPUutilization1"] = c[0]
 
 	return nil
 }
 
-// hashBody функция подписи body отсылаемого сообщения
-// Если ключ задан (не равен "" в AgentConfig) -- возвращаем hash, true
-// Если ключ не задан -- возвращаем nil, false
-func hashBody(body []byte, config *conf.AgentConfig) ([]byte, bool) {
-	if config.Key == "" {
-		log.Println("config.Key is empty")
-		return nil, false
-	}
-	h := hmac.New(sha256.New, []byte(config.Key))
-	h.Write(body)
-	dst := h.Sum(nil)
-	fmt.Printf("%x", dst)
-	return dst, true
+// newSendBreaker создание circuit breaker-а отсылки запросов. Отказом сервера считаются только retriable ошибки
+// (нет связи с сервером, 5xx, 429), ответы 4xx breaker не открывают
+func newSendBreaker(s breaker.Settings) *breaker.Breaker {
+	s.Name = "agent.send"
+	s.IsFailure = retry.IsRetriable
+	s.OnStateChange = func(name string, from, to breaker.State) {
+		logging.L().Warnw("breaker state changed", "breaker", name, "from", from.String(), "to", to.String())
+	}
+	return breaker.New(s)
 }
 
-func SendRequest(client *http.Client, url string, body io.Reader, contentType string, config *conf.AgentConfig) (*http.Response, error) {
-
-	var hash []byte
-	var keyBool bool
+// InitBreaker настройка circuit breaker-а отсылки запросов согласно конфигурации агента.
+// Вызывается до запуска горутин отсылки метрик
+func InitBreaker(config *conf.AgentConfig) {
+	sendBreaker = newSendBreaker(breaker.Settings{
+		FailureThreshold: config.BreakerFailureThreshold,
+		OpenTimeout:      time.Duration(config.BreakerOpenTimeout) * time.Second,
+		HalfOpenMaxCalls: config.BreakerHalfOpenMaxCalls,
+	})
+}
 
-	if body != nil {
+// sendRetriable повтор отсылки после retriable ошибок, кроме отказа открытого breaker-а:
+// повтор в этом случае бессмысленен до истечения OpenTimeout
+func sendRetriable(err error) bool {
+	return retry.IsRetriable(err) && !errors.Is(err, breaker.ErrOpen)
+}
 
-		b, err := io.ReadAll(body)
-		if err != nil {
-			log.Println("SendRequest. Error reading body:", err)
-			return nil, err
-		}
+// BreakerMetricsPolling заполнение метрик состояния circuit breaker-а отсылки запросов:
+// AgentBreakerState (0 -- closed, 1 -- open, 2 -- half-open), количество открытий и отклоненных запросов
+func BreakerMetricsPolling(metrics collector.Sink) {
+	c := sendBreaker.Counts()
+	metrics.SetGauge("AgentBreakerState", float64(c.State))
+	metrics.SetGauge("AgentBreakerOpens", float64(c.Opens))
+	metrics.SetGauge("AgentBreakerRejected", float64(c.Rejected))
+}
 
-		var buf bytes.Buffer
-		zb := gzip.NewWriter(&buf)
+// verifyResponse проверка подписи тела ответа сервера body. Ответы без тела сервер не подписывает.
+// Неверная или отсутствующая подпись -- non-retriable ошибка: повтор запроса с тем же ключом не поможет
+func verifyResponse(response *http.Response, body []byte, config *conf.AgentConfig) error {
+	if config == nil || !config.KeyRing.Enabled() || len(body) == 0 {
+		return nil
+	}
+	if err := config.KeyRing.VerifyHeader(response.Header, body); err != nil {
+		return apperr.Unauthorized("SendRequest: response signature", err)
+	}
+	return nil
+}
 
-		if _, err := zb.Write(b); err != nil {
-			log.Println("SendRequest. Error gzip body:", err)
-			return nil, err
-		}
+// sendNotBefore время в UnixNano, до которого запросы на сервер не отсылаются: сервер ответил 429 или 503
+// с Retry-After, а повторы в SendRequest исчерпаны раньше
+var sendNotBefore atomic.Int64
 
-		err = zb.Close()
-		if err != nil {
-			log.Println("SendRequest. Error closing compress writer:", err)
-		}
+// errRetryAfter отказ от отсылки до истечения Retry-After последнего ответа сервера
+var errRetryAfter = errors.New("server asked to retry later")
 
-		rawBody := buf.Bytes()
-		body = bytes.NewReader(rawBody)
-		// Считаем hash256 body ПОСЛЕ gzip-упаковки
-		hash, keyBool = hashBody(rawBody, config)
-		log.Println("hash is:", hash, "keyBool is :", keyBool)
-		if err != nil {
-			log.Println("SendRequest. Error hashing body:", err)
-		}
-		log.Printf("HashSHA256 is : %x", hash)
+func SendRequest(ctx context.Context, client *http.Client, url string, body io.Reader, contentType string, config *conf.AgentConfig) (*http.Response, error) {
+	logger := logging.FromContext(ctx)
+	if wait := time.Until(time.Unix(0, sendNotBefore.Load())); wait > 0 {
+		return nil, apperr.WithRetryAfter(apperr.Retriable("SendRequest", errRetryAfter), wait)
 	}
 
-	req, err := http.NewRequest(http.MethodPost, url, body)
-
-	if err != nil {
-		log.Println("SendRequest. Error creating request:", err)
-		return nil, fmt.Errorf("%s %v", "SendRequest: http.NewRequest error.", err)
+	// Кодек тела запроса. Без конфигурации -- gzip
+	encoding := compress.Gzip
+	if config != nil && config.Compression != "" {
+		encoding = config.Compression
 	}
+	// Тело запроса после сжатия сохраняется целиком, чтобы при повторе отправлять его заново
+	var payload []byte
+	var rawSize int
+
 	if body != nil {
-		defer req.Body.Close()
-	}
 
-	req.Close = true
+		b, err := io.ReadAll(body)
+		if err != nil {
+			return nil, fmt.Errorf("SendRequest: read body: %w", err)
+		}
 
-	// Устанавливаем Header key HashSHA256, если key определен
-	if keyBool {
-		req.Header.Set("HashSHA256", hex.EncodeToString(hash))
+		payload, err = compress.Encode(encoding, b)
+		if err != nil {
+			return nil, fmt.Errorf("SendRequest: %s body: %w", encoding, err)
+		}
+		rawSize = len(b)
 	}
-	req.Header.Set("Content-Type", contentType)
-	req.Header.Set("Content-Encoding", "compress")
 
-	log.Println("req.Header is:", req.Header)
+	// Отсылка сформированного запроса. При retriable ошибке (нет связи с сервером, 5xx) запрос повторяется согласно sendPolicy.
+	// Каждая попытка проходит через sendBreaker: при открытом breaker-е запрос на сервер не отсылается
+	var response *http.Response
+	// Span отсылки охватывает все попытки. Контекст трассировки передается серверу в заголовке traceparent
+	ctx, span := tracing.Start(ctx, "agent.SendRequest", trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("url.full", url), attribute.Int("http.request.body.size", len(payload))))
+	defer span.End()
+	start := time.Now()
+	attempts := 0
+	err := retry.Do(ctx, sendPolicy, sendRetriable, func(ctx context.Context) error {
+		attempts++
+		return sendBreaker.Execute(func() error {
+			var reqBody io.Reader
+			if body != nil {
+				reqBody = bytes.NewReader(payload)
+			}
+			req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, reqBody)
+			if err != nil {
+				return fmt.Errorf("SendRequest: http.NewRequest error: %w", err)
+			}
 
-	// Отсылка сформированного запроса req. Если сервер не отвечает -- работа агента завершается
-	response, err := client.Do(req)
+			req.Close = true
 
-	if err != nil {
-		log.Println("SendRequest error in 1 attempt. Error is:", err)
-		for i, t := range timeoutsRetryConst {
-			log.Println("SendRequest. Trying to recover after ", t, "seconds, attempt number ", i+1)
-			time.Sleep(time.Duration(t) * time.Second)
+			// Подпись метода, пути и body ПОСЛЕ сжатия самым новым ключом, если ключи заданы.
+			// Запросы без body (обновление метрики через URL) тоже подписываются
+			if config != nil {
+				config.KeyRing.SignRequest(req, payload)
+				if config.Token != "" {
+					req.Header.Set("Authorization", "Bearer "+config.Token)
+				}
+			}
+			req.Header.Set("Content-Type", contentType)
+			if body != nil && encoding != compress.Identity {
+				req.Header.Set("Content-Encoding", encoding)
+			}
+			// Ответ запрашивается в том же кодеке. Заданный явно Accept-Encoding отключает распаковку
+			// ответа http.Client-ом, поэтому ответ распаковывается ниже
+			if accept, err := compress.Normalize(encoding); err == nil {
+				req.Header.Set("Accept-Encoding", accept)
+			}
+			if id, ok := ctx.Value(batchIDKey{}).(string); ok {
+				req.Header.Set(idempotency.Header, id)
+			}
+			tracing.Inject(ctx, req.Header)
+
+			selfmetrics.Default.AddCounter(selfmetrics.SendBytesRaw, int64(rawSize))
+			selfmetrics.Default.AddCounter(selfmetrics.SendBytesCompressed, int64(len(payload)))
 			response, err = client.Do(req)
 			if err != nil {
-				log.Println("SendRequest: attempt ", i+1, " error is", err)
-				if i == 2 {
-					//panic(fmt.Errorf("%s %v", "SendRequest: PANIC in SendRequest.", err))
-					return nil, fmt.Errorf("%s %v", "SendRequest: client.Do error", err)
+				logger.Warnw("SendRequest: request failed", "url", url, "error", err)
+				return apperr.Retriable("SendRequest: client.Do", err)
+			}
+			logger.Debugw("SendRequest: response received", "url", url, "status", response.StatusCode)
+			defer response.Body.Close()
+			if ce := response.Header.Get("Content-Encoding"); ce != "" {
+				dec, err := compress.NewReader(ce, response.Body)
+				if err != nil {
+					return apperr.InvalidValue("SendRequest: response encoding", err)
 				}
-				continue
+				defer dec.Close()
+				response.Body = dec
 			}
-			return response, nil
-		}
+			// Ответ сервера с кодом не 2xx преобразуется в типизированную ошибку apperr
+			if err := apperr.FromResponse("SendRequest", response); err != nil {
+				return err
+			}
+			respBody, err := io.ReadAll(response.Body)
+			if err != nil {
+				return apperr.Retriable("SendRequest: read response", err)
+			}
+			return verifyResponse(response, respBody, config)
+		})
+	})
+	selfmetrics.Default.ObserveDuration(selfmetrics.SendLatency, time.Since(start))
+	if attempts > 1 {
+		selfmetrics.Default.AddCounter(selfmetrics.SendRetries, int64(attempts-1))
 	}
-
-	if response != nil {
-		log.Println("SendRequest: response is:", response)
-		defer response.Body.Close()
+	span.SetAttributes(attribute.Int("agent.send.attempts", attempts))
+	if err != nil {
+		selfmetrics.Default.AddCounter(selfmetrics.SendFailures, 1)
+		tracing.RecordError(span, err)
+		if after, ok := apperr.RetryAfter(err); ok {
+			sendNotBefore.Store(time.Now().Add(after).UnixNano())
+		}
 	}
-	return response, nil
+	return response, err
 }
 
 // SendMetrics отсылка метрик на сервер
-func SendMetrics(metrics *MetricsStorage, c string, config *conf.AgentConfig) error {
-	count := 0
-
+func SendMetrics(ctx context.Context, metrics *MetricsStorage, c string, config *conf.AgentConfig) error {
 	// Цикл для отсылки метрик типа gaugeMap
 	for m := range metrics.gaugeMap {
-		count++
 		reqURL := c + "/gauge/" + m + "/" + fmt.Sprintf("%v", metrics.gaugeMap[m])
-		log.Println(m, "=>", metrics.gaugeMap[m], "url:", reqURL, "count:", count)
-
-		response, err := SendRequest(client, reqURL, nil, "text/plain", config)
+		response, err := SendRequest(ctx, client, reqURL, nil, "text/plain", config)
 		if err != nil {
 			return err
 		}
 		defer response.Body.Close()
-
-		log.Println("response status:", response.Status)
 	}
 
 	// Цикл для отсылки метрик типа counterMap
 	for m := range metrics.counterMap {
-		count++
 		reqURL := c + "/counter/" + m + "/" + fmt.Sprintf("%v", metrics.counterMap[m])
-		log.Println(m, "=>", metrics.counterMap[m], "url:", reqURL, "count:", count)
-
-		response, err := SendRequest(client, reqURL, nil, "text/plain", config)
+		response, err := SendRequest(ctx, client, reqURL, nil, "text/plain", config)
 		if err != nil {
-			log.Println("Error Send Metrics in SendRequest call:", err)
 			return err
 		}
 		defer response.Body.Close()
-
-		log.Println("response status:", response.Status)
 	}
 	return nil
 }
@@ -228,23 +352,18 @@ type Metrics struct {
 	Value *float64 `json:"value,omitempty"` // Значение метрики в случае передачи gauge
 }
 
-func SendMetricsJSON(metrics *MetricsStorage, reqURL string, config *conf.AgentConfig) error {
-	count := 0
+func SendMetricsJSON(ctx context.Context, metrics *MetricsStorage, reqURL string, config *conf.AgentConfig) error {
 	// Цикл для отсылки метрик типа gaugeMap
 	for m := range metrics.gaugeMap {
-		count++
-		log.Println(m, "=>", metrics.gaugeMap[m], "url:", reqURL, "JSON count:", count)
 		valGauge := metrics.gaugeMap[m]
 		var tmpMetric = Metrics{m, "gauge", nil, &valGauge}
 
 		payload, err := json.Marshal(tmpMetric)
-		log.Println("payload in SendMetrics is:", string(payload))
 		if err != nil {
 			return err
 		}
-		response, err := SendRequest(client, reqURL, bytes.NewReader(payload), "application/json", config)
+		response, err := SendRequest(ctx, client, reqURL, bytes.NewReader(payload), "application/json", config)
 		if err != nil {
-			log.Println("Error Send Metrics in SendRequest call:", err)
 			return err
 		}
 		defer response.Body.Close()
@@ -252,8 +371,6 @@ func SendMetricsJSON(metrics *MetricsStorage, reqURL string, config *conf.AgentC
 
 	// Цикл для отсылки метрик типа counterMap
 	for m := range metrics.counterMap {
-		count++
-		log.Println(m, "=>", metrics.counterMap[m], "url:", reqURL, "JSON count:", count)
 		valCounter := metrics.counterMap[m]
 		var tmpMetric = Metrics{m, "counter", &valCounter, nil}
 
@@ -262,10 +379,9 @@ func SendMetricsJSON(metrics *MetricsStorage, reqURL string, config *conf.AgentC
 			return err
 		}
 
-		response, err := SendRequest(client, reqURL, bytes.NewReader(payload), "application/json", config)
+		response, err := SendRequest(ctx, client, reqURL, bytes.NewReader(payload), "application/json", config)
 
 		if err != nil {
-			log.Println("Error in SendMetricsJSON from SendRequest", err)
 			return err
 		}
 		defer response.Body.Close()
@@ -288,27 +404,130 @@ func MemstorageToMetrics(store MetricsStorage) ([]Metrics, error) {
 		tmpMetric.Delta = &v
 		metrics = append(metrics, tmpMetric)
 	}
-	//log.Println("MetricsToMemstorage: []Metrics :", metrics, " -> store :", store)
 	return metrics, nil
 }
 
-func SendMetricsJSONBatch(metrics *MetricsStorage, reqURL string, config *conf.AgentConfig) error {
-	tmpMetrics, err := MemstorageToMetrics(*metrics)
-	if err != nil {
-		log.Println("Error in SendMetricsJSONBatch:", err)
-		return err
+// PrepareReport формирование batch-а для отсылки: идентификатор batch-а, текущие значения gauge-ей и приращения counter-ов.
+// Пока batch не подтвержден сервером, повторно отсылаются те же приращения с тем же идентификатором,
+// а новые приращения накапливаются в counterMap до следующего batch-а. Поэтому batch, примененный сервером,
+// но не подтвержденный из-за потери ответа, сервер распознает по идентификатору и не применяет повторно.
+// Вызывается под блокировкой MetricsStorage
+func (metrics *MetricsStorage) PrepareReport() (string, []Metrics) {
+	if metrics.pendingID == "" {
+		metrics.pendingID = newBatchID()
+		metrics.pendingMap = metrics.counterMap
+		metrics.counterMap = make(map[string]int64)
 	}
-	payload, err := json.Marshal(tmpMetrics)
-	if err != nil {
-		log.Println("SendMetricsJSONBatch error in json.Marshal: ", err)
+
+	batch := make([]Metrics, 0, len(metrics.gaugeMap)+len(metrics.pendingMap))
+	for k, v := range metrics.gaugeMap {
+		batch = append(batch, Metrics{ID: k, MType: "gauge", Value: &v})
+	}
+	for k, v := range metrics.pendingMap {
+		batch = append(batch, Metrics{ID: k, MType: "counter", Delta: &v})
 	}
-	//log.Println("payload in SendMetricsJSONBatch is:", string(payload))
+	return metrics.pendingID, batch
+}
 
-	response, err := SendRequest(client, reqURL, bytes.NewReader(payload), "application/json", config)
-	if err != nil {
-		log.Println("SendMetricsJSONBatch: Error from SendRequest call:", err)
+// AckReport подтверждение успешной отсылки batch-а, сформированного PrepareReport: отосланные приращения сбрасываются.
+// Вызывается под блокировкой MetricsStorage
+func (metrics *MetricsStorage) AckReport() {
+	metrics.pendingMap = nil
+	metrics.pendingID = ""
+}
+
+// newBatchID уникальный идентификатор batch-а
+func newBatchID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		// crypto/rand на поддерживаемых платформах не возвращает ошибок
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+type batchIDKey struct{}
+
+// ContextWithBatchID контекст запроса с идентификатором batch-а. SendRequest передает его в заголовке X-Batch-ID
+// во всех попытках отсылки, чтобы сервер не применял batch повторно
+func ContextWithBatchID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, batchIDKey{}, id)
+}
+
+// SendMetricsJSONBatch отсылка метрик на сервер одним batch-ем. Блокировка m удерживается только на время
+// формирования batch-а и подтверждения отсылки, сбор метрик во время отсылки не блокируется
+func SendMetricsJSONBatch(ctx context.Context, m sync.Locker, metrics *MetricsStorage, reqURL string, config *conf.AgentConfig) error {
+	m.Lock()
+	batchID, tmpMetrics := metrics.PrepareReport()
+	m.Unlock()
+	selfmetrics.Default.SetGauge(selfmetrics.QueueDepth, float64(len(tmpMetrics)))
+
+	// Формат batch-а задается конфигурацией агента, по умолчанию JSON
+	format := wire.JSON
+	if config != nil && config.WireFormat != "" {
+		format = config.WireFormat
+	}
+	batch := make([]storage.Metrics, len(tmpMetrics))
+	for i, m := range tmpMetrics {
+		batch[i] = storage.Metrics(m)
+	}
+	// Counter-ы в начале batch-а и в постоянном порядке: от этого зависит деление batch-а в sendBatch
+	slices.SortFunc(batch, func(a, b storage.Metrics) int {
+		if a.MType != b.MType {
+			return strings.Compare(a.MType, b.MType)
+		}
+		return strings.Compare(a.ID, b.ID)
+	})
+
+	if err := sendBatch(ctx, batchID, batch, format, reqURL, config); err != nil {
+		// Сервер отверг batch как некорректный или метрику, которая не помещается в лимит размера даже одна:
+		// повторная отсылка не поможет, приращения отбрасываются, чтобы не блокировать отсылку следующих метрик
+		if errors.Is(err, apperr.ErrInvalidValue) || errors.Is(err, apperr.ErrWrongType) || errors.Is(err, apperr.ErrTooLarge) {
+			logging.FromContext(ctx).Errorw("SendMetricsJSONBatch: batch rejected by server, drop pending counters", "batch_id", batchID, "error", err)
+			m.Lock()
+			metrics.AckReport()
+			m.Unlock()
+		}
 		return err
 	}
-	defer response.Body.Close()
+
+	m.Lock()
+	metrics.AckReport()
+	m.Unlock()
+	selfmetrics.Default.SetGauge(selfmetrics.QueueDepth, 0)
+	selfmetrics.Default.SetGauge(selfmetrics.LastReportSuccess, float64(time.Now().Unix()))
 	return nil
 }
+
+// sendBatch отсылка batch-а с идентификатором batchID. Batch, превышающий лимит размера сервера (413),
+// делится пополам, половины отсылаются с идентификаторами batchID.1 и batchID.2. Batch начинается с counter-ов,
+// и делятся в первую очередь они: состав counter-ов каждой части не зависит от gauge-ей, значения и количество
+// которых меняются между отсылками. Поэтому при повторной отсылке того же batch-а уже примененные сервером
+// части распознаются по идентификатору, и приращения не применяются дважды
+func sendBatch(ctx context.Context, batchID string, batch []storage.Metrics, format string, reqURL string, config *conf.AgentConfig) error {
+	payload, err := wire.MarshalMetrics(format, batch)
+	if err != nil {
+		return fmt.Errorf("SendMetricsJSONBatch: marshal %s: %w", format, err)
+	}
+	response, err := SendRequest(ContextWithBatchID(ctx, batchID), client, reqURL, bytes.NewReader(payload), format, config)
+	if err == nil {
+		return response.Body.Close()
+	}
+	if !errors.Is(err, apperr.ErrTooLarge) || len(batch) < 2 {
+		return err
+	}
+	counters := 0
+	for counters < len(batch) && batch[counters].MType == "counter" {
+		counters++
+	}
+	half := len(batch) / 2
+	if counters >= 2 {
+		half = counters / 2
+	}
+	logging.FromContext(ctx).Warnw("SendMetricsJSONBatch: batch is too large, split in halves", "batch_id", batchID,
+		"metrics", len(batch))
+	if err := sendBatch(ctx, batchID+".1", batch[:half], format, reqURL, config); err != nil {
+		return err
+	}
+	return sendBatch(ctx, batchID+".2", batch[half:], format, reqURL, config)
+}
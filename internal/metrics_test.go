@@ -1,12 +1,18 @@
 package internal
 
 import (
+	"context"
 	"github.com/stretchr/testify/assert"
 	"logger/conf"
+	"logger/internal/apperr"
+	"logger/internal/breaker"
+	"logger/internal/retry"
 	"net/http"
 	"net/http/httptest"
 	"reflect"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestMetricsPolling(t *testing.T) {
@@ -98,7 +104,7 @@ func TestSendMetrics(t *testing.T) {
 			}))
 			defer server.Close()
 
-			if err := SendMetrics(tt.args.metrics, server.URL+tt.args.c, tt.args.config); (err != nil) != tt.wantErr {
+			if err := SendMetrics(context.Background(), tt.args.metrics, server.URL+tt.args.c, tt.args.config); (err != nil) != tt.wantErr {
 				t.Errorf("SendMetrics() error = %v, wantErr %v", err, tt.wantErr)
 			}
 		})
@@ -149,7 +155,7 @@ func TestSendRequest(t *testing.T) {
 			}))
 
 			defer server.Close()
-			res, err := SendRequest(tt.args.client, server.URL+tt.args.url, nil, "text/plain", tt.args.config)
+			res, err := SendRequest(context.Background(), tt.args.client, server.URL+tt.args.url, nil, "text/plain", tt.args.config)
 			assert.Equal(t, tt.want.code, res.StatusCode)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("SendRequest() error = %v, wantErr %v", err, tt.wantErr)
@@ -158,3 +164,33 @@ func TestSendRequest(t *testing.T) {
 		})
 	}
 }
+
+func TestSendRequest_BreakerOpens(t *testing.T) {
+	// Быстрые повторы и breaker, открывающийся после 2-х ошибок подряд
+	defer func(p retry.Policy, b *breaker.Breaker) { sendPolicy, sendBreaker = p, b }(sendPolicy, sendBreaker)
+	sendPolicy = retry.Policy{Name: "test.send", InitialInterval: time.Millisecond, MaxAttempts: 5}
+	sendBreaker = newSendBreaker(breaker.Settings{FailureThreshold: 2, OpenTimeout: time.Hour})
+
+	var hits atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	_, err := SendRequest(context.Background(), &http.Client{}, server.URL+"/updates", nil, "application/json", nil)
+	assert.ErrorIs(t, err, breaker.ErrOpen)
+	assert.ErrorIs(t, err, apperr.ErrRetriable)
+	assert.Equal(t, int32(2), hits.Load())
+	assert.Equal(t, breaker.StateOpen, sendBreaker.State())
+
+	// При открытом breaker-е запрос на сервер не отсылается
+	_, err = SendRequest(context.Background(), &http.Client{}, server.URL+"/updates", nil, "application/json", nil)
+	assert.ErrorIs(t, err, breaker.ErrOpen)
+	assert.Equal(t, int32(2), hits.Load())
+
+	metrics := NewMetricsStorageObj()
+	BreakerMetricsPolling(&metrics)
+	assert.Equal(t, float64(breaker.StateOpen), metrics.gaugeMap["AgentBreakerState"])
+	assert.Equal(t, float64(1), metrics.gaugeMap["AgentBreakerOpens"])
+}
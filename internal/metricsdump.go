@@ -4,51 +4,50 @@ import (
 	"context"
 	"fmt"
 	"github.com/gin-gonic/gin"
-	"log"
 	"logger/cmd/server/initconf"
 	"logger/internal/handlers"
+	"logger/internal/logging"
+	"logger/internal/retry"
+	"logger/internal/servermetrics"
 	"logger/internal/storage/memstorage"
 	"os"
 	"time"
 )
 
+// savePolicy политика повтора записи дампа метрик в файл
+var savePolicy = retry.DefaultPolicy.Named("dump.save")
+
 type Storager interface {
 	GetAllMetrics(ctx context.Context) (any, error)
 }
 
-// Save функция сохранения дампа метрик в файл.
-func Save(ctx context.Context, store Storager, fname string) error {
+// Save функция сохранения дампа метрик в файл. Длительность и результат дампа учитываются в метриках сервера
+func Save(ctx context.Context, store Storager, fname string) (err error) {
+	start := time.Now()
+	defer func() {
+		servermetrics.Default.ObserveDump(time.Since(start), err)
+	}()
+
 	// сериализуем структуру в JSON формат
 	metrics, err := store.GetAllMetrics(ctx)
 	if err != nil {
-		log.Println("error store serialisation in Save", err)
+		logging.FromContext(ctx).Errorw("Save: get metrics failed", "error", err)
 		return err
 	}
 
 	// Использование метода Marshal пакета memstorage из-за не-публичности полей, аналог вызова data, err := json.Marshal(metrics)
 	data, err := memstorage.Marshal(metrics)
 	if err != nil {
-		log.Println("Save. Error marshalling store")
+		logging.FromContext(ctx).Errorw("Save: marshal metrics failed", "error", err)
 		return err
 	}
 
-	err = os.WriteFile(fname, data, 0666)
-
+	err = retry.Do(ctx, savePolicy, retry.Always, func(_ context.Context) error {
+		return os.WriteFile(fname, data, 0666)
+	})
 	if err != nil {
-		log.Println("Save. Error os.WriteFile")
-		// константа timeoutsRetryConst = [3]int{1, 3, 5} определена в metrics.go
-		for i, t := range timeoutsRetryConst {
-			log.Println("Save: Trying to recover after ", t, "seconds, attempt number ", i+1)
-			time.Sleep(time.Duration(t) * time.Second)
-			err := os.WriteFile(fname, data, 0666)
-			if err != nil {
-				log.Println("Save: attempt ", i+1, " error")
-				if i == 2 {
-					return fmt.Errorf("%s %v", "Save: os.WriteFile error:", err)
-				}
-				continue
-			}
-		}
+		logging.FromContext(ctx).Errorw("Save: write dump failed", "file", fname, "error", err)
+		return fmt.Errorf("Save: os.WriteFile error: %w", err)
 	}
 	return nil
 }
@@ -60,30 +59,29 @@ func Load(fname string) (handlers.Storager, error) {
 	var memStore memstorage.MemStorage
 	data, err := os.ReadFile(fname)
 	if err != nil {
-		log.Println("Save. Error read store dump file", fname)
+		logging.L().Warnw("Load: read dump failed", "file", fname, "error", err)
 		return nil, err
 	}
 	// Использование метода Unmarshal пакета memstorage из-за не-публичности полей, аналог вызова err = json.Unmarshal(data, &memStore)
 	err = memstorage.Unmarshal(data, &memStore)
 	if err != nil {
-		log.Println("Load. Error unmarshalling from file")
+		logging.L().Warnw("Load: unmarshal dump failed", "file", fname, "error", err)
 		return nil, err
 	}
 	store = memStore
-	log.Println("storage from Load:", store)
+	logging.L().Infow("metrics dump loaded", "file", fname)
 	return store, nil
 }
 
 // SyncDumpUpdate middleware для апдейта файла дампа метрик каждый раз при приходе новой метрики
 // Для случая ключа STORE_INTERVAL = 0
 func SyncDumpUpdate(ctx context.Context, store handlers.Storager, conf *initconf.Config) gin.HandlerFunc {
+	logger := logging.FromContext(ctx)
 	return func(c *gin.Context) {
 		c.Next()
-		log.Println("SyncDumpUpdate StoreMetricInterval :", conf.StoreMetricInterval)
 		if conf.StoreMetricInterval == 0 {
-			log.Println("sync flush metric into dump")
 			if err := Save(ctx, store, conf.FileStoragePath); err != nil {
-				log.Println("SyncDumpUpdate error:", err)
+				logger.Errorw("SyncDumpUpdate: save dump failed", "error", err)
 			}
 		}
 	}
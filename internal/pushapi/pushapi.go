@@ -0,0 +1,149 @@
+// Package pushapi локальный HTTP API агента для приложений на том же хосте.
+// Приложение отсылает метрики в формате JSON []Metrics, как на /updates сервера, по TCP или через Unix socket.
+// Агент переносит их в MetricsStorage и отсылает на сервер при очередной отсылке,
+// поэтому приложению не нужны адрес сервера и ключ подписи.
+//
+//	POST /updates -- массив метрик
+//	POST /update  -- одна метрика
+//
+// Значение gauge заменяет текущее, значение counter добавляется к накопленному приращению.
+package pushapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"logger/internal/apperr"
+	"logger/internal/collector"
+	"logger/internal/logging"
+	"logger/internal/selfmetrics"
+	"logger/internal/storage"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxBodySize максимальный размер тела запроса
+const maxBodySize = 1 << 20
+
+// unixPrefix префикс адреса Unix socket-а
+const unixPrefix = "unix:"
+
+type handler struct {
+	sink   collector.Sink
+	locker sync.Locker // Блокировка, под которой пишется sink
+}
+
+// NewHandler handler push API. Метрики пишутся в sink под блокировкой locker
+func NewHandler(sink collector.Sink, locker sync.Locker) http.Handler {
+	h := handler{sink: sink, locker: locker}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /updates", h.updates)
+	mux.HandleFunc("POST /update", h.update)
+	return mux
+}
+
+func (h handler) updates(w http.ResponseWriter, r *http.Request) {
+	var metrics []storage.Metrics
+	if err := decode(w, r, &metrics); err != nil {
+		apperr.WriteHTTPProblem(w, err)
+		return
+	}
+	h.write(w, metrics)
+}
+
+func (h handler) update(w http.ResponseWriter, r *http.Request) {
+	var metric storage.Metrics
+	if err := decode(w, r, &metric); err != nil {
+		apperr.WriteHTTPProblem(w, err)
+		return
+	}
+	h.write(w, []storage.Metrics{metric})
+}
+
+// decode разбор JSON тела запроса с ограничением размера
+func decode(w http.ResponseWriter, r *http.Request, v any) error {
+	r.Body = http.MaxBytesReader(w, r.Body, maxBodySize)
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		if errors.As(err, new(*http.MaxBytesError)) {
+			return apperr.TooLarge("pushapi.decode", err)
+		}
+		return apperr.InvalidValue("pushapi.decode", err)
+	}
+	return nil
+}
+
+// write проверка и перенос метрик в sink. Метрики переносятся либо все, либо ни одной.
+// Имена с зарезервированным префиксом метрик агента не принимаются
+func (h handler) write(w http.ResponseWriter, metrics []storage.Metrics) {
+	if err := storage.ValidateBatch(metrics); err != nil {
+		apperr.WriteHTTPProblem(w, err)
+		return
+	}
+	for _, m := range metrics {
+		if selfmetrics.Reserved(m.ID) {
+			apperr.WriteHTTPProblem(w, apperr.InvalidValue("pushapi.write",
+				fmt.Errorf("metric %s: prefix %s is reserved for agent metrics", m.ID, selfmetrics.Prefix)))
+			return
+		}
+	}
+	h.locker.Lock()
+	for _, m := range metrics {
+		switch m.MType {
+		case "gauge":
+			h.sink.SetGauge(m.ID, *m.Value)
+		case "counter":
+			h.sink.AddCounter(m.ID, *m.Delta)
+		}
+	}
+	h.locker.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]int{"accepted": len(metrics)})
+}
+
+// Listen открытие listener-а. Адрес вида unix:/path/to/socket открывает Unix socket,
+// оставшийся от предыдущего запуска файл socket-а удаляется. Остальные адреса -- TCP
+func Listen(address string) (net.Listener, error) {
+	if path, ok := strings.CutPrefix(address, unixPrefix); ok {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("pushapi: remove stale socket: %w", err)
+		}
+		return net.Listen("unix", path)
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, fmt.Errorf("pushapi: %w", err)
+	}
+	// API не требует подписи, поэтому доступ к нему снаружи хоста нежелателен
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		logging.L().Warnw("pushapi: listening on non-loopback address", "address", address)
+	}
+	return net.Listen("tcp", address)
+}
+
+// Serve обработка запросов на ln до отмены ctx
+func Serve(ctx context.Context, ln net.Listener, h http.Handler) error {
+	logger := logging.FromContext(ctx)
+	srv := &http.Server{Handler: h, ReadHeaderTimeout: 5 * time.Second}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			logger.Warnw("pushapi: shutdown failed", "error", err)
+		}
+	}()
+	logger.Infow("pushapi: listening", "address", ln.Addr().String())
+	if err := srv.Serve(ln); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	logger.Infow("pushapi: stop server")
+	return nil
+}
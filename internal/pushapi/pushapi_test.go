@@ -0,0 +1,140 @@
+package pushapi
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"logger/internal/apperr"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testSink struct {
+	gauges   map[string]float64
+	counters map[string]int64
+}
+
+func newTestSink() *testSink {
+	return &testSink{gauges: make(map[string]float64), counters: make(map[string]int64)}
+}
+
+func (s *testSink) SetGauge(name string, value float64) { s.gauges[name] = value }
+func (s *testSink) SetCounter(name string, value int64) { s.counters[name] = value }
+func (s *testSink) AddCounter(name string, delta int64) { s.counters[name] += delta }
+
+func TestHandler(t *testing.T) {
+	tests := []struct {
+		name         string
+		path         string
+		body         string
+		wantStatus   int
+		wantGauges   map[string]float64
+		wantCounters map[string]int64
+	}{
+		{
+			name:         "batch",
+			path:         "/updates",
+			body:         `[{"id":"g1","type":"gauge","value":1.5},{"id":"c1","type":"counter","delta":2},{"id":"c1","type":"counter","delta":3}]`,
+			wantStatus:   http.StatusOK,
+			wantGauges:   map[string]float64{"g1": 1.5},
+			wantCounters: map[string]int64{"c1": 15},
+		},
+		{
+			name:         "single metric",
+			path:         "/update",
+			body:         `{"id":"g1","type":"gauge","value":7}`,
+			wantStatus:   http.StatusOK,
+			wantGauges:   map[string]float64{"g1": 7},
+			wantCounters: map[string]int64{"c1": 10},
+		},
+		{
+			name:         "invalid metric rejects whole batch",
+			path:         "/updates",
+			body:         `[{"id":"g1","type":"gauge","value":1.5},{"id":"c1","type":"counter"}]`,
+			wantStatus:   http.StatusBadRequest,
+			wantGauges:   map[string]float64{},
+			wantCounters: map[string]int64{"c1": 10},
+		},
+		{
+			name:         "reserved agent prefix",
+			path:         "/updates",
+			body:         `[{"id":"g1","type":"gauge","value":1.5},{"id":"agent.send.failures","type":"counter","delta":1}]`,
+			wantStatus:   http.StatusBadRequest,
+			wantGauges:   map[string]float64{},
+			wantCounters: map[string]int64{"c1": 10},
+		},
+		{
+			name:         "malformed json",
+			path:         "/updates",
+			body:         `[{"id":`,
+			wantStatus:   http.StatusBadRequest,
+			wantGauges:   map[string]float64{},
+			wantCounters: map[string]int64{"c1": 10},
+		},
+		{
+			name:         "oversized body",
+			path:         "/updates",
+			body:         `[{"id":"` + strings.Repeat("g", maxBodySize) + `","type":"gauge","value":1}]`,
+			wantStatus:   http.StatusRequestEntityTooLarge,
+			wantGauges:   map[string]float64{},
+			wantCounters: map[string]int64{"c1": 10},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sink := newTestSink()
+			sink.counters["c1"] = 10
+			h := NewHandler(sink, &sync.Mutex{})
+
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, tt.path, strings.NewReader(tt.body)))
+
+			assert.Equal(t, tt.wantStatus, w.Code)
+			if tt.wantStatus != http.StatusOK {
+				assert.Equal(t, apperr.ProblemContentType, w.Header().Get("Content-Type"))
+			}
+			assert.Equal(t, tt.wantGauges, sink.gauges)
+			assert.Equal(t, tt.wantCounters, sink.counters)
+		})
+	}
+}
+
+func TestServe_UnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "agent.sock")
+	ln, err := Listen(unixPrefix + path)
+	require.NoError(t, err)
+
+	var mu sync.Mutex
+	sink := newTestSink()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- Serve(ctx, ln, NewHandler(sink, &mu)) }()
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", path)
+		},
+	}}
+	resp, err := client.Post("http://agent/updates", "application/json", strings.NewReader(`[{"id":"g1","type":"gauge","value":3}]`))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	mu.Lock()
+	assert.Equal(t, 3.0, sink.gauges["g1"])
+	mu.Unlock()
+
+	cancel()
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve did not stop after context cancel")
+	}
+}
@@ -0,0 +1,451 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"io"
+	"logger/conf"
+	"logger/internal/apperr"
+	"logger/internal/breaker"
+	"logger/internal/compress"
+	"logger/internal/idempotency"
+	"logger/internal/keyring"
+	"logger/internal/retry"
+	"logger/internal/selfmetrics"
+	"logger/internal/storage"
+	"logger/internal/wire"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// counterServer тестовый сервер, суммирующий приращения counter-ов из batch-ей, как это делает сервер метрик.
+// Запросы с номерами из fail отклоняются с кодом 503 без учета приращений. Запросы с номерами из lost
+// применяются, но агент получает код 503, как при потере ответа. Batch с уже примененным X-Batch-ID не применяется
+type counterServer struct {
+	mu       sync.Mutex
+	requests int
+	fail     map[int]bool
+	lost     map[int]bool
+	applied  map[string]bool
+	totals   map[string]int64
+	// tooLarge batch-и, для которых возвращается 413. nil -- без ограничения
+	tooLarge func(batch []storage.Metrics) bool
+}
+
+func (s *counterServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests++
+	if s.fail[s.requests] {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	id := r.Header.Get(idempotency.Header)
+	if id == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if s.applied[id] {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	zr, err := compress.NewReader(r.Header.Get("Content-Encoding"), r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	body, err := io.ReadAll(zr)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	format, err := wire.Parse(r.Header.Get("Content-Type"))
+	if err != nil {
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		return
+	}
+	batch, err := wire.UnmarshalMetrics(format, body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if s.tooLarge != nil && s.tooLarge(batch) {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		return
+	}
+	for _, m := range batch {
+		if m.MType == "counter" {
+			s.totals[m.ID] += *m.Delta
+		}
+	}
+	s.applied[id] = true
+	if s.lost[s.requests] {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func TestSendMetricsJSONBatch_CounterTotals(t *testing.T) {
+	defer func(p retry.Policy, b *breaker.Breaker) { sendPolicy, sendBreaker = p, b }(sendPolicy, sendBreaker)
+	sendBreaker = newSendBreaker(breaker.Settings{FailureThreshold: 100})
+
+	tests := []struct {
+		name        string
+		maxAttempts int
+		fail        map[int]bool
+		lost        map[int]bool
+		format      string
+	}{
+		{name: "all reports succeed", maxAttempts: 1},
+		{name: "protobuf batches", maxAttempts: 1, format: wire.Protobuf},
+		{name: "msgpack batches with retries", maxAttempts: 3, fail: map[int]bool{1: true, 4: true}, format: wire.MsgPack},
+		{name: "failed reports are resent later", maxAttempts: 1, fail: map[int]bool{2: true, 3: true}},
+		{name: "retries inside one report", maxAttempts: 3, fail: map[int]bool{1: true, 4: true, 5: true}},
+		{name: "lost responses are not applied twice", maxAttempts: 1, lost: map[int]bool{1: true, 3: true}},
+		{name: "lost responses with retries", maxAttempts: 3, lost: map[int]bool{1: true, 2: true}, fail: map[int]bool{5: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sendPolicy = retry.Policy{Name: "test.report", InitialInterval: time.Millisecond, MaxAttempts: tt.maxAttempts}
+			srv := &counterServer{fail: tt.fail, lost: tt.lost, applied: make(map[string]bool), totals: make(map[string]int64)}
+			server := httptest.NewServer(srv)
+			defer server.Close()
+
+			var m sync.RWMutex
+			metrics := NewMetricsStorageObj()
+			const polls = 12
+			for i := 1; i <= polls; i++ {
+				m.Lock()
+				require.NoError(t, MetricsPolling(&metrics))
+				metrics.AddCounter("Pushed", 2)
+				m.Unlock()
+				if i%3 == 0 {
+					_ = SendMetricsJSONBatch(context.Background(), &m, &metrics, server.URL+"/updates", &conf.AgentConfig{WireFormat: tt.format})
+				}
+			}
+			// Заключительная отсылка гарантированно успешна
+			srv.mu.Lock()
+			srv.fail, srv.lost = nil, nil
+			srv.mu.Unlock()
+			require.NoError(t, SendMetricsJSONBatch(context.Background(), &m, &metrics, server.URL+"/updates", &conf.AgentConfig{WireFormat: tt.format}))
+
+			srv.mu.Lock()
+			defer srv.mu.Unlock()
+			assert.Equal(t, int64(polls), srv.totals["PollCount"])
+			assert.Equal(t, int64(2*polls), srv.totals["Pushed"])
+			assert.Empty(t, metrics.counterMap)
+			assert.Empty(t, metrics.pendingMap)
+		})
+	}
+}
+
+func TestSendMetricsJSONBatch_TooLarge(t *testing.T) {
+	defer func(p retry.Policy, b *breaker.Breaker) { sendPolicy, sendBreaker = p, b }(sendPolicy, sendBreaker)
+	sendBreaker = newSendBreaker(breaker.Settings{FailureThreshold: 100})
+	sendPolicy = retry.Policy{Name: "test.too_large", InitialInterval: time.Millisecond, MaxAttempts: 1}
+
+	t.Run("large batches are split", func(t *testing.T) {
+		// Ответ на одну из частей теряется: при повторной отсылке примененные части не применяются дважды
+		srv := &counterServer{
+			lost:     map[int]bool{4: true},
+			applied:  make(map[string]bool),
+			totals:   make(map[string]int64),
+			tooLarge: func(batch []storage.Metrics) bool { return len(batch) > 5 },
+		}
+		server := httptest.NewServer(srv)
+		defer server.Close()
+
+		var m sync.RWMutex
+		metrics := NewMetricsStorageObj()
+		require.NoError(t, MetricsPolling(&metrics))
+		for i := 0; i < 8; i++ {
+			metrics.AddCounter(fmt.Sprintf("Counter%d", i), int64(i+1))
+		}
+		assert.Error(t, SendMetricsJSONBatch(context.Background(), &m, &metrics, server.URL+"/updates", &conf.AgentConfig{}))
+		assert.NotEmpty(t, metrics.pendingMap)
+
+		// Новая gauge не меняет деление counter-ов между частями
+		metrics.SetGauge("Extra", 1)
+		require.NoError(t, SendMetricsJSONBatch(context.Background(), &m, &metrics, server.URL+"/updates", &conf.AgentConfig{}))
+
+		srv.mu.Lock()
+		defer srv.mu.Unlock()
+		for i := 0; i < 8; i++ {
+			assert.Equal(t, int64(i+1), srv.totals[fmt.Sprintf("Counter%d", i)])
+		}
+		assert.Equal(t, int64(1), srv.totals["PollCount"])
+		assert.Empty(t, metrics.pendingMap)
+	})
+
+	t.Run("metric that never fits is dropped", func(t *testing.T) {
+		srv := &counterServer{
+			applied:  make(map[string]bool),
+			totals:   make(map[string]int64),
+			tooLarge: func(batch []storage.Metrics) bool { return len(batch) > 0 },
+		}
+		server := httptest.NewServer(srv)
+		defer server.Close()
+
+		var m sync.RWMutex
+		metrics := NewMetricsStorageObj()
+		metrics.AddCounter("Huge", 1)
+		err := SendMetricsJSONBatch(context.Background(), &m, &metrics, server.URL+"/updates", &conf.AgentConfig{})
+		assert.ErrorIs(t, err, apperr.ErrTooLarge)
+		assert.Empty(t, metrics.pendingMap)
+		assert.Empty(t, metrics.counterMap)
+
+		// Следующая отсылка не блокируется отброшенными приращениями
+		srv.mu.Lock()
+		srv.tooLarge = nil
+		srv.mu.Unlock()
+		metrics.AddCounter("Huge", 2)
+		require.NoError(t, SendMetricsJSONBatch(context.Background(), &m, &metrics, server.URL+"/updates", &conf.AgentConfig{}))
+		srv.mu.Lock()
+		defer srv.mu.Unlock()
+		assert.Equal(t, int64(2), srv.totals["Huge"])
+	})
+}
+
+func TestSendMetricsJSONBatch_SelfMetrics(t *testing.T) {
+	defer func(p retry.Policy, b *breaker.Breaker, s *selfmetrics.Set) {
+		sendPolicy, sendBreaker, selfmetrics.Default = p, b, s
+	}(sendPolicy, sendBreaker, selfmetrics.Default)
+	sendBreaker = newSendBreaker(breaker.Settings{FailureThreshold: 100})
+	sendPolicy = retry.Policy{Name: "test.self", InitialInterval: time.Millisecond, MaxAttempts: 2}
+	selfmetrics.Default = selfmetrics.New()
+
+	// Первая попытка первой отсылки и обе попытки второй завершаются ошибкой сервера
+	srv := &counterServer{fail: map[int]bool{1: true, 3: true, 4: true}, applied: make(map[string]bool), totals: make(map[string]int64)}
+	server := httptest.NewServer(srv)
+	defer server.Close()
+
+	var m sync.RWMutex
+	metrics := NewMetricsStorageObj()
+	metrics.SetGauge("Alloc", 1)
+	require.NoError(t, SendMetricsJSONBatch(context.Background(), &m, &metrics, server.URL+"/updates", &conf.AgentConfig{}))
+	assert.Error(t, SendMetricsJSONBatch(context.Background(), &m, &metrics, server.URL+"/updates", &conf.AgentConfig{}))
+
+	s := selfmetrics.Default.Snapshot()
+	assert.Equal(t, int64(2), s.Counters["agent.send.retries"])
+	assert.Equal(t, int64(1), s.Counters["agent.send.failures"])
+	assert.Greater(t, s.Counters["agent.send.bytes_raw"], int64(0))
+	assert.Greater(t, s.Counters["agent.send.bytes_compressed"], int64(0))
+	assert.Equal(t, 1.0, s.Gauges["agent.queue.depth"])
+	assert.Greater(t, s.Gauges["agent.report.last_success"], 0.0)
+}
+
+func TestSendRequest_Traceparent(t *testing.T) {
+	defer func(p retry.Policy, b *breaker.Breaker) { sendPolicy, sendBreaker = p, b }(sendPolicy, sendBreaker)
+	sendBreaker = newSendBreaker(breaker.Settings{FailureThreshold: 100})
+	sendPolicy = retry.Policy{Name: "test.trace", InitialInterval: time.Millisecond, MaxAttempts: 2}
+	defer func(tp trace.TracerProvider, p propagation.TextMapPropagator) {
+		otel.SetTracerProvider(tp)
+		otel.SetTextMapPropagator(p)
+	}(otel.GetTracerProvider(), otel.GetTextMapPropagator())
+	sr := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	// Первая попытка завершается ошибкой сервера, обе попытки передают контекст одного span-а
+	var headers []string
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		headers = append(headers, r.Header.Get("traceparent"))
+		if requests == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	resp, err := SendRequest(context.Background(), server.Client(), server.URL+"/updates", nil, "application/json", &conf.AgentConfig{})
+	require.NoError(t, err)
+	require.NotNil(t, resp)
+
+	spans := sr.Ended()
+	require.Len(t, spans, 1)
+	assert.Equal(t, "agent.SendRequest", spans[0].Name())
+	sc := spans[0].SpanContext()
+	want := "00-" + sc.TraceID().String() + "-" + sc.SpanID().String() + "-01"
+	assert.Equal(t, []string{want, want}, headers)
+}
+
+func TestSendRequest_ResponseSignature(t *testing.T) {
+	defer func(p retry.Policy, b *breaker.Breaker) { sendPolicy, sendBreaker = p, b }(sendPolicy, sendBreaker)
+	sendBreaker = newSendBreaker(breaker.Settings{FailureThreshold: 100})
+	sendPolicy = retry.Policy{Name: "test.sign", InitialInterval: time.Millisecond, MaxAttempts: 2}
+
+	tests := []struct {
+		name       string
+		serverKeys string // Набор ключей сервера. Пустая строка -- сервер ответ не подписывает
+		agentKeys  string
+		wantErr    bool
+	}{
+		{name: "same key", serverKeys: "a:s1", agentKeys: "a:s1"},
+		{name: "server signs with old key during rotation", serverKeys: "old:s1,new:s2", agentKeys: "new:s2,old:s1"},
+		{name: "server signs with new key during rotation", serverKeys: "new:s2,old:s1", agentKeys: "old:s1,new:s2"},
+		{name: "unknown key", serverKeys: "b:s1", agentKeys: "a:s1", wantErr: true},
+		{name: "wrong secret", serverKeys: "a:s2", agentKeys: "a:s1", wantErr: true},
+		{name: "unsigned response", agentKeys: "a:s1", wantErr: true},
+		{name: "agent without keys", serverKeys: "a:s1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			serverRing, err := keyring.New("", tt.serverKeys)
+			require.NoError(t, err)
+			agentRing, err := keyring.New("", tt.agentKeys)
+			require.NoError(t, err)
+
+			requests := 0
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests++
+				body := []byte(`{"id":"Alloc","type":"gauge","value":1}`)
+				serverRing.SignHeader(w.Header(), body)
+				w.WriteHeader(http.StatusOK)
+				_, _ = w.Write(body)
+			}))
+			defer server.Close()
+
+			_, err = SendRequest(context.Background(), server.Client(), server.URL+"/update/", nil, "application/json", &conf.AgentConfig{KeyRing: agentRing})
+			if tt.wantErr {
+				assert.ErrorIs(t, err, apperr.ErrUnauthorized)
+				// Ошибка подписи не повторяется
+				assert.Equal(t, 1, requests)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestSendRequest_RequestSignature(t *testing.T) {
+	defer func(p retry.Policy, b *breaker.Breaker) { sendPolicy, sendBreaker = p, b }(sendPolicy, sendBreaker)
+	sendBreaker = newSendBreaker(breaker.Settings{FailureThreshold: 100})
+	sendPolicy = retry.Policy{Name: "test.sign", InitialInterval: time.Millisecond, MaxAttempts: 1}
+	ring, err := keyring.New("", "a:s1")
+	require.NoError(t, err)
+
+	// Сервер проверяет подпись метода, пути и тела запроса в том виде, в котором оно передано
+	var verifyErr error
+	var authorization string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		verifyErr = ring.VerifyHeader(r.Header, keyring.RequestPayload(r.Method, r.URL.RequestURI(), r.Header.Get(keyring.TimestampHeader), r.Header.Get(keyring.NonceHeader), body))
+		authorization = r.Header.Get("Authorization")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	config := &conf.AgentConfig{KeyRing: ring, Token: "t1"}
+	// Обновление метрики через URL без body
+	_, err = SendRequest(context.Background(), server.Client(), server.URL+"/update/gauge/Alloc/1", nil, "text/plain", config)
+	require.NoError(t, err)
+	assert.NoError(t, verifyErr)
+
+	_, err = SendRequest(context.Background(), server.Client(), server.URL+"/updates", strings.NewReader(`[]`), "application/json", config)
+	require.NoError(t, err)
+	assert.NoError(t, verifyErr)
+	assert.Equal(t, "Bearer t1", authorization)
+}
+
+func TestSendRequest_RetryAfter(t *testing.T) {
+	defer func(p retry.Policy, b *breaker.Breaker) { sendPolicy, sendBreaker = p, b }(sendPolicy, sendBreaker)
+	defer sendNotBefore.Store(0)
+	sendBreaker = newSendBreaker(breaker.Settings{FailureThreshold: 100})
+	sendPolicy = retry.Policy{Name: "test.retryafter", InitialInterval: time.Millisecond, MaxAttempts: 2}
+
+	// Сервер ограничивает частоту запросов: первый запрос отклоняется с Retry-After: 1
+	var times []time.Time
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		times = append(times, time.Now())
+		if len(times) == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	_, err := SendRequest(context.Background(), server.Client(), server.URL+"/updates", nil, "application/json", &conf.AgentConfig{})
+	require.NoError(t, err)
+	require.Len(t, times, 2)
+	assert.GreaterOrEqual(t, times[1].Sub(times[0]), time.Second, "retry must wait for Retry-After instead of backoff")
+
+	// Повторы исчерпаны до истечения Retry-After: следующие запросы не отсылаются до его истечения
+	sendPolicy.MaxAttempts = 1
+	times = nil
+	sendNotBefore.Store(0)
+	_, err = SendRequest(context.Background(), server.Client(), server.URL+"/updates", nil, "application/json", &conf.AgentConfig{})
+	assert.ErrorIs(t, err, apperr.ErrRetriable)
+	_, err = SendRequest(context.Background(), server.Client(), server.URL+"/updates", nil, "application/json", &conf.AgentConfig{})
+	assert.ErrorIs(t, err, errRetryAfter)
+	assert.Len(t, times, 1)
+}
+
+func TestSendRequest_Compression(t *testing.T) {
+	defer func(p retry.Policy, b *breaker.Breaker) { sendPolicy, sendBreaker = p, b }(sendPolicy, sendBreaker)
+	sendBreaker = newSendBreaker(breaker.Settings{FailureThreshold: 100})
+	sendPolicy = retry.Policy{Name: "test.compression", InitialInterval: time.Millisecond, MaxAttempts: 1}
+	ring, err := keyring.New("", "a:s1")
+	require.NoError(t, err)
+
+	tests := []struct {
+		name         string
+		compression  string
+		wantEncoding string
+		wantAccept   string
+	}{
+		{name: "default", wantEncoding: "gzip", wantAccept: "gzip"},
+		{name: "zstd", compression: "zstd", wantEncoding: "zstd", wantAccept: "zstd"},
+		{name: "deflate", compression: "deflate", wantEncoding: "deflate", wantAccept: "deflate"},
+		{name: "legacy server", compression: "compress", wantEncoding: "compress", wantAccept: "gzip"},
+		{name: "identity", compression: "identity", wantAccept: "identity"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var encoding, accept string
+			var received []byte
+			// Сервер распаковывает запрос и отвечает подписанным телом в кодеке из Accept-Encoding
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				encoding, accept = r.Header.Get("Content-Encoding"), r.Header.Get("Accept-Encoding")
+				dec, err := compress.NewReader(encoding, r.Body)
+				require.NoError(t, err)
+				received, err = io.ReadAll(dec)
+				require.NoError(t, err)
+				body := []byte(`{"id":"Alloc","type":"gauge","value":1}`)
+				ring.SignHeader(w.Header(), body)
+				respEncoding := compress.Negotiate(accept)
+				encoded, err := compress.Encode(respEncoding, body)
+				require.NoError(t, err)
+				if respEncoding != compress.Identity {
+					w.Header().Set("Content-Encoding", respEncoding)
+				}
+				_, _ = w.Write(encoded)
+			}))
+			defer server.Close()
+
+			config := &conf.AgentConfig{KeyRing: ring, Compression: tt.compression}
+			response, err := SendRequest(context.Background(), server.Client(), server.URL+"/updates", strings.NewReader(`[]`), "application/json", config)
+			require.NoError(t, err, "response must be decoded before signature check")
+			assert.NoError(t, response.Body.Close())
+			assert.Equal(t, tt.wantEncoding, encoding)
+			assert.Equal(t, tt.wantAccept, accept)
+			assert.Equal(t, "[]", string(received))
+		})
+	}
+}
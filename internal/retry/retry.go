@@ -0,0 +1,216 @@
+// Package retry повтор операций с экспоненциальной задержкой (backoff), jitter-ом, ограничением общего времени
+// и количества попыток. Ожидание между попытками прерывается отменой контекста.
+// По каждой именованной политике собирается статистика попыток (Snapshot).
+package retry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"logger/internal/apperr"
+	"logger/internal/logging"
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Policy параметры повтора операции
+type Policy struct {
+	Name            string        // Имя операции, под которым собирается статистика
+	InitialInterval time.Duration // Задержка перед первым повтором
+	Multiplier      float64       // Множитель задержки для каждого следующего повтора
+	MaxInterval     time.Duration // Максимальная задержка между попытками
+	MaxElapsedTime  time.Duration // Максимальное общее время выполнения с учетом повторов. 0 -- без ограничения
+	MaxAttempts     int           // Максимальное количество попыток, включая первую. 0 -- без ограничения
+	Jitter          float64       // Доля случайного разброса задержки, от 0 до 1
+}
+
+// DefaultPolicy политика по умолчанию: 3 повтора с задержками около 1, 2, 4 секунд
+var DefaultPolicy = Policy{
+	Name:            "default",
+	InitialInterval: 1 * time.Second,
+	Multiplier:      2,
+	MaxInterval:     5 * time.Second,
+	MaxElapsedTime:  15 * time.Second,
+	MaxAttempts:     4,
+	Jitter:          0.2,
+}
+
+// Named копия политики с другим именем для сбора статистики
+func (p Policy) Named(name string) Policy {
+	p.Name = name
+	return p
+}
+
+// Backoff задержка перед повтором номер retry (начиная с 1) без учета jitter
+func (p Policy) Backoff(retry int) time.Duration {
+	if retry < 1 {
+		return 0
+	}
+	mult := p.Multiplier
+	if mult < 1 {
+		mult = 1
+	}
+	d := float64(p.InitialInterval) * math.Pow(mult, float64(retry-1))
+	if p.MaxInterval > 0 && d > float64(p.MaxInterval) {
+		d = float64(p.MaxInterval)
+	}
+	return time.Duration(d)
+}
+
+// withJitter случайный разброс задержки d в пределах +-jitter*d
+func withJitter(d time.Duration, jitter float64) time.Duration {
+	if jitter <= 0 || d <= 0 {
+		return d
+	}
+	if jitter > 1 {
+		jitter = 1
+	}
+	delta := jitter * float64(d)
+	return time.Duration(float64(d) - delta + rand.Float64()*2*delta)
+}
+
+// Classifier функция определения, имеет ли смысл повторять операцию после ошибки err
+type Classifier func(err error) bool
+
+// Always повтор после любой ошибки
+func Always(err error) bool {
+	return err != nil
+}
+
+// IsRetriable повтор только после ошибок класса apperr.ErrRetriable
+func IsRetriable(err error) bool {
+	return errors.Is(err, apperr.ErrRetriable)
+}
+
+// Any повтор, если хотя бы один из классификаторов считает ошибку retriable
+func Any(classifiers ...Classifier) Classifier {
+	return func(err error) bool {
+		for _, c := range classifiers {
+			if c(err) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// Wait ожидание в течение d с прерыванием по отмене контекста
+func Wait(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// Do выполнение fn с повторами согласно политике p, пока retryable считает ошибку retriable.
+// Если ошибка содержит задержку apperr.RetryAfter, повтор выполняется не раньше нее.
+// Возвращает последнюю ошибку fn. При отмене контекста во время ожидания возвращается ошибка,
+// содержащая и ctx.Err(), и последнюю ошибку fn
+func Do(ctx context.Context, p Policy, retryable Classifier, fn func(ctx context.Context) error) error {
+	s := statsFor(p.Name)
+	start := time.Now()
+	for attempt := 1; ; attempt++ {
+		s.attempts.Add(1)
+		err := fn(ctx)
+		if err == nil {
+			s.successes.Add(1)
+			return nil
+		}
+		if !retryable(err) {
+			s.failures.Add(1)
+			return err
+		}
+		if p.MaxAttempts > 0 && attempt >= p.MaxAttempts {
+			s.exhausted.Add(1)
+			return err
+		}
+		delay := withJitter(p.Backoff(attempt), p.Jitter)
+		// Задержка из Retry-After ответа сервера имеет приоритет, если она больше backoff
+		if after, ok := apperr.RetryAfter(err); ok && after > delay {
+			delay = after
+		}
+		if p.MaxElapsedTime > 0 && time.Since(start)+delay > p.MaxElapsedTime {
+			s.exhausted.Add(1)
+			return err
+		}
+		logging.FromContext(ctx).Warnw("retry after error", "policy", p.Name, "attempt", attempt, "delay", delay, "error", err)
+		s.retries.Add(1)
+		if waitErr := Wait(ctx, delay); waitErr != nil {
+			s.canceled.Add(1)
+			return fmt.Errorf("retry %s canceled: %w", p.Name, errors.Join(waitErr, err))
+		}
+	}
+}
+
+// DoValue аналог Do для функций, возвращающих значение
+func DoValue[T any](ctx context.Context, p Policy, retryable Classifier, fn func(ctx context.Context) (T, error)) (T, error) {
+	var result T
+	err := Do(ctx, p, retryable, func(ctx context.Context) error {
+		var err error
+		result, err = fn(ctx)
+		return err
+	})
+	return result, err
+}
+
+// Статистика повторов
+type stats struct {
+	attempts  atomic.Int64
+	retries   atomic.Int64
+	successes atomic.Int64
+	failures  atomic.Int64
+	exhausted atomic.Int64
+	canceled  atomic.Int64
+}
+
+var registry sync.Map // map[string]*stats
+
+func statsFor(name string) *stats {
+	if name == "" {
+		name = "default"
+	}
+	s, _ := registry.LoadOrStore(name, &stats{})
+	return s.(*stats)
+}
+
+// Stats снимок статистики повторов одной политики
+type Stats struct {
+	Name      string `json:"name"`
+	Attempts  int64  `json:"attempts"`  // Всего вызовов fn
+	Retries   int64  `json:"retries"`   // Повторных вызовов fn
+	Successes int64  `json:"successes"` // Завершений без ошибки
+	Failures  int64  `json:"failures"`  // Завершений с non-retriable ошибкой
+	Exhausted int64  `json:"exhausted"` // Завершений из-за исчерпания попыток или времени
+	Canceled  int64  `json:"canceled"`  // Завершений из-за отмены контекста во время ожидания
+}
+
+// Snapshot статистика повторов по всем политикам, отсортированная по имени
+func Snapshot() []Stats {
+	var res []Stats
+	registry.Range(func(k, v any) bool {
+		s := v.(*stats)
+		res = append(res, Stats{
+			Name:      k.(string),
+			Attempts:  s.attempts.Load(),
+			Retries:   s.retries.Load(),
+			Successes: s.successes.Load(),
+			Failures:  s.failures.Load(),
+			Exhausted: s.exhausted.Load(),
+			Canceled:  s.canceled.Load(),
+		})
+		return true
+	})
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+	return res
+}
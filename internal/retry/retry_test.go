@@ -0,0 +1,151 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"logger/internal/apperr"
+	"testing"
+	"time"
+)
+
+func testPolicy(name string) Policy {
+	return Policy{
+		Name:            name,
+		InitialInterval: time.Millisecond,
+		Multiplier:      2,
+		MaxInterval:     4 * time.Millisecond,
+		MaxAttempts:     4,
+	}
+}
+
+func TestPolicy_Backoff(t *testing.T) {
+	p := Policy{InitialInterval: time.Second, Multiplier: 2, MaxInterval: 5 * time.Second}
+	tests := []struct {
+		retry int
+		want  time.Duration
+	}{
+		{retry: 0, want: 0},
+		{retry: 1, want: time.Second},
+		{retry: 2, want: 2 * time.Second},
+		{retry: 3, want: 4 * time.Second},
+		{retry: 4, want: 5 * time.Second},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, p.Backoff(tt.retry), "retry %d", tt.retry)
+	}
+}
+
+func TestDo(t *testing.T) {
+	errRetriable := apperr.Retriable("test", errors.New("connection refused"))
+	errPermanent := errors.New("bad request")
+	tests := []struct {
+		name      string
+		errs      []error // ошибки, возвращаемые fn на каждой попытке
+		wantErr   error
+		wantCalls int
+	}{
+		{name: "success first attempt", errs: []error{nil}, wantErr: nil, wantCalls: 1},
+		{name: "success after retries", errs: []error{errRetriable, errRetriable, nil}, wantErr: nil, wantCalls: 3},
+		{name: "non-retriable stops immediately", errs: []error{errPermanent, nil}, wantErr: errPermanent, wantCalls: 1},
+		{name: "attempts exhausted", errs: []error{errRetriable, errRetriable, errRetriable, errRetriable, nil}, wantErr: apperr.ErrRetriable, wantCalls: 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			err := Do(context.Background(), testPolicy("test."+tt.name), IsRetriable, func(ctx context.Context) error {
+				err := tt.errs[calls]
+				calls++
+				return err
+			})
+			if tt.wantErr == nil {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorIs(t, err, tt.wantErr)
+			}
+			assert.Equal(t, tt.wantCalls, calls)
+		})
+	}
+}
+
+func TestDo_MaxElapsedTime(t *testing.T) {
+	p := testPolicy("test.elapsed")
+	p.MaxAttempts = 0
+	p.MaxElapsedTime = 20 * time.Millisecond
+	start := time.Now()
+	err := Do(context.Background(), p, Always, func(ctx context.Context) error {
+		return errors.New("always fails")
+	})
+	assert.Error(t, err)
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func TestDo_RetryAfter(t *testing.T) {
+	p := testPolicy("test.retryafter")
+	p.MaxAttempts = 2
+	start := time.Now()
+	calls := 0
+	err := Do(context.Background(), p, IsRetriable, func(ctx context.Context) error {
+		calls++
+		if calls == 1 {
+			return apperr.WithRetryAfter(apperr.Retriable("test", errors.New("rate limited")), 50*time.Millisecond)
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, calls)
+	assert.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+}
+
+func TestDo_ContextCanceled(t *testing.T) {
+	p := testPolicy("test.canceled")
+	p.InitialInterval = time.Hour
+	p.MaxInterval = time.Hour
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	cause := errors.New("connection refused")
+	start := time.Now()
+	err := Do(ctx, p, Always, func(ctx context.Context) error {
+		return cause
+	})
+	assert.Less(t, time.Since(start), time.Second)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.ErrorIs(t, err, cause)
+}
+
+func TestDoValue(t *testing.T) {
+	calls := 0
+	v, err := DoValue(context.Background(), testPolicy("test.value"), Always, func(ctx context.Context) (int, error) {
+		calls++
+		if calls < 2 {
+			return 0, errors.New("not yet")
+		}
+		return 42, nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 42, v)
+}
+
+func TestSnapshot(t *testing.T) {
+	p := testPolicy("test.snapshot")
+	calls := 0
+	_ = Do(context.Background(), p, Always, func(ctx context.Context) error {
+		calls++
+		if calls < 3 {
+			return errors.New("fail")
+		}
+		return nil
+	})
+	_ = Do(context.Background(), p, IsRetriable, func(ctx context.Context) error {
+		return errors.New("permanent")
+	})
+
+	var got Stats
+	for _, s := range Snapshot() {
+		if s.Name == p.Name {
+			got = s
+		}
+	}
+	assert.Equal(t, Stats{Name: p.Name, Attempts: 4, Retries: 2, Successes: 1, Failures: 1}, got)
+}
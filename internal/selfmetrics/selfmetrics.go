@@ -0,0 +1,159 @@
+// Package selfmetrics метрики работы самого агента: длительность сбора коллекторами, задержка и объем отсылки,
+// повторы и ошибки отсылки, повторы операций по политикам пакета retry, размер очереди и время последней успешной отсылки.
+// Метрики отсылаются на сервер вместе с остальными под зарезервированным префиксом "agent."
+// и при необходимости отдаются в JSON на HTTP сервере pprof.
+package selfmetrics
+
+import (
+	"context"
+	"encoding/json"
+	"logger/internal/collector"
+	"logger/internal/retry"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Prefix зарезервированный префикс имен метрик агента. Метрики с таким префиксом от приложений
+// (StatsD, push API) не принимаются, чтобы не смешивать их с метриками агента
+const Prefix = "agent."
+
+// Path путь, по которому метрики агента отдаются на HTTP сервере pprof
+const Path = "/debug/agent/metrics"
+
+// Имена метрик агента без префикса
+const (
+	SendLatency         = "send.latency_ms"       // Длительность последней отсылки batch-а с учетом повторов
+	SendBytesRaw        = "send.bytes_raw"        // Объем отосланных данных до сжатия
+	SendBytesCompressed = "send.bytes_compressed" // Объем отосланных данных после сжатия
+	SendRetries         = "send.retries"          // Количество повторов отсылки
+	SendFailures        = "send.failures"         // Количество неудачных отсылок после всех повторов
+	QueueDepth          = "queue.depth"           // Количество метрик в batch-е, ожидающем подтверждения сервером
+	LastReportSuccess   = "report.last_success"   // Unix время последней успешной отсылки
+)
+
+// CollectDuration имя метрики длительности последнего сбора коллектором name
+func CollectDuration(name string) string {
+	return "collector." + name + ".duration_ms"
+}
+
+// CollectErrors имя метрики количества неудачных сборов коллектором name
+func CollectErrors(name string) string {
+	return "collector." + name + ".errors"
+}
+
+// RetryAttempts имя метрики количества вызовов операции с политикой повторов name
+func RetryAttempts(name string) string {
+	return "retry." + name + ".attempts"
+}
+
+// RetryRetries имя метрики количества повторных вызовов операции с политикой повторов name
+func RetryRetries(name string) string {
+	return "retry." + name + ".retries"
+}
+
+// RetryExhausted имя метрики количества отказов от повторов операции с политикой name
+// после исчерпания попыток или времени
+func RetryExhausted(name string) string {
+	return "retry." + name + ".exhausted"
+}
+
+// Reserved имя метрики использует зарезервированный префикс агента
+func Reserved(name string) bool {
+	return strings.HasPrefix(name, Prefix)
+}
+
+// Set набор метрик агента. Counter-ы накапливаются с момента запуска агента
+type Set struct {
+	mu       sync.Mutex
+	gauges   map[string]float64
+	counters map[string]int64
+	reported map[string]int64 // Значения counter-ов на момент последнего Collect
+}
+
+// Default набор метрик агента, в который пишут коллекторы и отсылка метрик
+var Default = New()
+
+func New() *Set {
+	return &Set{
+		gauges:   make(map[string]float64),
+		counters: make(map[string]int64),
+		reported: make(map[string]int64),
+	}
+}
+
+func (s *Set) SetGauge(name string, value float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.gauges[name] = value
+}
+
+func (s *Set) AddCounter(name string, delta int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.counters[name] += delta
+}
+
+// ObserveDuration запись длительности d в миллисекундах в gauge name
+func (s *Set) ObserveDuration(name string, d time.Duration) {
+	s.SetGauge(name, float64(d.Microseconds())/1000)
+}
+
+// syncRetry перенос статистики пакета retry в counter-ы. Вызывается под s.mu
+func (s *Set) syncRetry() {
+	for _, st := range retry.Snapshot() {
+		s.counters[RetryAttempts(st.Name)] = st.Attempts
+		s.counters[RetryRetries(st.Name)] = st.Retries
+		s.counters[RetryExhausted(st.Name)] = st.Exhausted
+	}
+}
+
+// Collect перенос метрик в sink под префиксом Prefix. Counter-ы переносятся приращениями с момента
+// предыдущего вызова, так как sink агента накапливает приращения до отсылки на сервер
+func (s *Set) Collect(_ context.Context, sink collector.Sink) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.syncRetry()
+	for k, v := range s.gauges {
+		sink.SetGauge(Prefix+k, v)
+	}
+	for k, v := range s.counters {
+		if delta := v - s.reported[k]; delta != 0 {
+			sink.AddCounter(Prefix+k, delta)
+		}
+		s.reported[k] = v
+	}
+	return nil
+}
+
+// Snapshot текущие значения метрик с префиксом Prefix. Counter-ы -- накопленные с момента запуска агента
+type Snapshot struct {
+	Gauges   map[string]float64 `json:"gauges"`
+	Counters map[string]int64   `json:"counters"`
+}
+
+func (s *Set) Snapshot() Snapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.syncRetry()
+	res := Snapshot{
+		Gauges:   make(map[string]float64, len(s.gauges)),
+		Counters: make(map[string]int64, len(s.counters)),
+	}
+	for k, v := range s.gauges {
+		res.Gauges[Prefix+k] = v
+	}
+	for k, v := range s.counters {
+		res.Counters[Prefix+k] = v
+	}
+	return res
+}
+
+// Handler отдача Snapshot в JSON
+func (s *Set) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(s.Snapshot())
+	})
+}
@@ -0,0 +1,84 @@
+package selfmetrics
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"logger/internal/retry"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// testSink collector.Sink для проверки перенесенных значений
+type testSink struct {
+	gauges   map[string]float64
+	counters map[string]int64
+}
+
+func newTestSink() *testSink {
+	return &testSink{gauges: make(map[string]float64), counters: make(map[string]int64)}
+}
+
+func (s *testSink) SetGauge(name string, value float64) { s.gauges[name] = value }
+func (s *testSink) SetCounter(name string, value int64) { s.counters[name] = value }
+func (s *testSink) AddCounter(name string, delta int64) { s.counters[name] += delta }
+
+func TestSet_Collect(t *testing.T) {
+	s := New()
+	sink := newTestSink()
+
+	s.AddCounter(SendFailures, 2)
+	s.ObserveDuration(SendLatency, 1500*time.Microsecond)
+	s.SetGauge(QueueDepth, 10)
+	assert.NoError(t, s.Collect(context.Background(), sink))
+	assert.Equal(t, int64(2), sink.counters["agent.send.failures"])
+	assert.Equal(t, 1.5, sink.gauges["agent.send.latency_ms"])
+	assert.Equal(t, 10.0, sink.gauges["agent.queue.depth"])
+
+	// Sink накапливает приращения: повторный Collect переносит только новые
+	s.AddCounter(SendFailures, 1)
+	assert.NoError(t, s.Collect(context.Background(), sink))
+	assert.Equal(t, int64(3), sink.counters["agent.send.failures"])
+	assert.NoError(t, s.Collect(context.Background(), sink))
+	assert.Equal(t, int64(3), sink.counters["agent.send.failures"])
+}
+
+func TestSet_Handler(t *testing.T) {
+	s := New()
+	s.AddCounter(SendRetries, 4)
+	s.AddCounter(SendRetries, 1)
+	s.SetGauge(CollectDuration("runtime"), 0.5)
+
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, Path, nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+
+	var got Snapshot
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &got))
+	assert.Equal(t, map[string]int64{"agent.send.retries": 5}, got.Counters)
+	assert.Equal(t, map[string]float64{"agent.collector.runtime.duration_ms": 0.5}, got.Gauges)
+}
+
+func TestReserved(t *testing.T) {
+	assert.True(t, Reserved("agent.send.retries"))
+	assert.False(t, Reserved("agentCount"))
+	assert.False(t, Reserved("PollCount"))
+}
+
+func TestSet_Retry(t *testing.T) {
+	p := retry.Policy{Name: "selfmetrics.test", MaxAttempts: 3}
+	err := retry.Do(context.Background(), p, retry.Always, func(context.Context) error { return assert.AnError })
+	require.Error(t, err)
+
+	s := New()
+	sink := newTestSink()
+	assert.NoError(t, s.Collect(context.Background(), sink))
+	assert.Equal(t, int64(3), sink.counters["agent.retry.selfmetrics.test.attempts"])
+	assert.Equal(t, int64(2), sink.counters["agent.retry.selfmetrics.test.retries"])
+	assert.Equal(t, int64(1), sink.counters["agent.retry.selfmetrics.test.exhausted"])
+	assert.Equal(t, int64(3), s.Snapshot().Counters["agent.retry.selfmetrics.test.attempts"])
+}
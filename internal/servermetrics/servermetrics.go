@@ -0,0 +1,232 @@
+// Package servermetrics метрики работы самого сервера: количество и длительность запросов по route-ам и статусам,
+// длительность операций хранилища по backend-ам и методам, длительность дампа метрик в файл
+// и количество запросов с неверной HMAC-подписью. Метрики отдаются в JSON на служебном endpoint-е.
+package servermetrics
+
+import (
+	"github.com/gin-gonic/gin"
+	"logger/internal/retry"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Path служебный endpoint метрик сервера
+const Path = "/internal/metrics"
+
+// bucketBounds верхние границы интервалов гистограмм длительности в миллисекундах
+var bucketBounds = []float64{1, 5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000}
+
+// histogram гистограмма длительностей
+type histogram struct {
+	counts []int64 // counts[i] -- количество значений в интервале (bucketBounds[i-1], bucketBounds[i]], последний -- больше всех границ
+	count  int64
+	sum    float64 // Сумма длительностей в миллисекундах
+}
+
+func newHistogram() *histogram {
+	return &histogram{counts: make([]int64, len(bucketBounds)+1)}
+}
+
+func (h *histogram) observe(d time.Duration) {
+	ms := float64(d.Microseconds()) / 1000
+	i := sort.SearchFloat64s(bucketBounds, ms)
+	h.counts[i]++
+	h.count++
+	h.sum += ms
+}
+
+// Bucket количество значений не больше LE миллисекунд
+type Bucket struct {
+	LE    string `json:"le"`
+	Count int64  `json:"count"`
+}
+
+// Histogram снимок гистограммы. Buckets накопительные, как в Prometheus: последний с LE "+Inf" равен Count
+type Histogram struct {
+	Count   int64    `json:"count"`
+	SumMs   float64  `json:"sum_ms"`
+	Buckets []Bucket `json:"buckets"`
+}
+
+func (h *histogram) snapshot() Histogram {
+	res := Histogram{Count: h.count, SumMs: h.sum, Buckets: make([]Bucket, 0, len(h.counts))}
+	var total int64
+	for i, c := range h.counts {
+		total += c
+		le := "+Inf"
+		if i < len(bucketBounds) {
+			le = strconv.FormatFloat(bucketBounds[i], 'f', -1, 64)
+		}
+		res.Buckets = append(res.Buckets, Bucket{LE: le, Count: total})
+	}
+	return res
+}
+
+type requestKey struct {
+	method string
+	route  string
+	status int
+}
+
+type operationKey struct {
+	backend string
+	method  string
+}
+
+// operation длительность и количество ошибок операции
+type operation struct {
+	latency *histogram
+	errors  int64
+}
+
+// Registry метрики сервера
+type Registry struct {
+	mu           sync.Mutex
+	requests     map[requestKey]*histogram
+	storage      map[operationKey]*operation
+	dump         operation
+	hmacFailures int64
+}
+
+// Default метрики сервера, в которые пишут middleware, хранилище, дамп и проверка подписи
+var Default = New()
+
+func New() *Registry {
+	return &Registry{
+		requests: make(map[requestKey]*histogram),
+		storage:  make(map[operationKey]*operation),
+		dump:     operation{latency: newHistogram()},
+	}
+}
+
+// ObserveRequest запись длительности обработки запроса
+func (r *Registry) ObserveRequest(method, route string, status int, d time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	k := requestKey{method: method, route: route, status: status}
+	h, ok := r.requests[k]
+	if !ok {
+		h = newHistogram()
+		r.requests[k] = h
+	}
+	h.observe(d)
+}
+
+// ObserveStorage запись длительности и результата операции method хранилища backend
+func (r *Registry) ObserveStorage(backend, method string, d time.Duration, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	k := operationKey{backend: backend, method: method}
+	op, ok := r.storage[k]
+	if !ok {
+		op = &operation{latency: newHistogram()}
+		r.storage[k] = op
+	}
+	op.latency.observe(d)
+	if err != nil {
+		op.errors++
+	}
+}
+
+// ObserveDump запись длительности и результата дампа метрик в файл
+func (r *Registry) ObserveDump(d time.Duration, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.dump.latency.observe(d)
+	if err != nil {
+		r.dump.errors++
+	}
+}
+
+// HMACFailure учет запроса с неверной HMAC-подписью
+func (r *Registry) HMACFailure() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.hmacFailures++
+}
+
+// RequestStats метрики запросов одного route-а с одним статусом
+type RequestStats struct {
+	Method  string    `json:"method"`
+	Route   string    `json:"route"`
+	Status  int       `json:"status"`
+	Latency Histogram `json:"latency"`
+}
+
+// OperationStats метрики операции
+type OperationStats struct {
+	Backend string    `json:"backend,omitempty"`
+	Method  string    `json:"method,omitempty"`
+	Errors  int64     `json:"errors"`
+	Latency Histogram `json:"latency"`
+}
+
+// Snapshot снимок метрик сервера
+type Snapshot struct {
+	Requests     []RequestStats   `json:"requests"`
+	Storage      []OperationStats `json:"storage"`
+	Dump         OperationStats   `json:"dump"`
+	HMACFailures int64            `json:"hmac_failures"`
+	Retry        []retry.Stats    `json:"retry"` // Повторы операций сервера (БД, дамп) по политикам retry
+}
+
+// Snapshot снимок метрик, отсортированный по route-ам и методам
+func (r *Registry) Snapshot() Snapshot {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	res := Snapshot{
+		Requests:     make([]RequestStats, 0, len(r.requests)),
+		Storage:      make([]OperationStats, 0, len(r.storage)),
+		Dump:         OperationStats{Errors: r.dump.errors, Latency: r.dump.latency.snapshot()},
+		HMACFailures: r.hmacFailures,
+		Retry:        retry.Snapshot(),
+	}
+	for k, h := range r.requests {
+		res.Requests = append(res.Requests, RequestStats{Method: k.method, Route: k.route, Status: k.status, Latency: h.snapshot()})
+	}
+	sort.Slice(res.Requests, func(i, j int) bool {
+		a, b := res.Requests[i], res.Requests[j]
+		if a.Route != b.Route {
+			return a.Route < b.Route
+		}
+		if a.Method != b.Method {
+			return a.Method < b.Method
+		}
+		return a.Status < b.Status
+	})
+	for k, op := range r.storage {
+		res.Storage = append(res.Storage, OperationStats{Backend: k.backend, Method: k.method, Errors: op.errors, Latency: op.latency.snapshot()})
+	}
+	sort.Slice(res.Storage, func(i, j int) bool {
+		a, b := res.Storage[i], res.Storage[j]
+		if a.Backend != b.Backend {
+			return a.Backend < b.Backend
+		}
+		return a.Method < b.Method
+	})
+	return res
+}
+
+// Middleware учет количества и длительности запросов. Запрос учитывается по шаблону route-а,
+// а не по URL, чтобы имена метрик в URL не порождали неограниченное количество записей
+func Middleware(r *Registry) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+		route := c.FullPath()
+		if route == "" {
+			route = "NoRoute"
+		}
+		r.ObserveRequest(c.Request.Method, route, c.Writer.Status(), time.Since(start))
+	}
+}
+
+// Handler отдача Snapshot в JSON
+func Handler(r *Registry) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, r.Snapshot())
+	}
+}
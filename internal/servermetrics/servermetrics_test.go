@@ -0,0 +1,123 @@
+package servermetrics
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"logger/internal/retry"
+	"logger/internal/storage/memstorage"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHistogram(t *testing.T) {
+	h := newHistogram()
+	for _, d := range []time.Duration{500 * time.Microsecond, time.Millisecond, 7 * time.Millisecond, 10 * time.Second} {
+		h.observe(d)
+	}
+	s := h.snapshot()
+	assert.Equal(t, int64(4), s.Count)
+	assert.InDelta(t, 10008.5, s.SumMs, 0.001)
+	assert.Len(t, s.Buckets, len(bucketBounds)+1)
+	assert.Equal(t, Bucket{LE: "1", Count: 2}, s.Buckets[0])
+	assert.Equal(t, Bucket{LE: "5", Count: 2}, s.Buckets[1])
+	assert.Equal(t, Bucket{LE: "10", Count: 3}, s.Buckets[2])
+	assert.Equal(t, Bucket{LE: "5000", Count: 3}, s.Buckets[len(bucketBounds)-1])
+	assert.Equal(t, Bucket{LE: "+Inf", Count: 4}, s.Buckets[len(bucketBounds)])
+}
+
+func TestMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := New()
+	router := gin.New()
+	router.Use(Middleware(r))
+	router.GET("/value/:metricType/:metricName", func(c *gin.Context) {
+		if c.Param("metricName") == "missing" {
+			c.Status(http.StatusNotFound)
+			return
+		}
+		c.String(http.StatusOK, "1")
+	})
+	router.GET(Path, Handler(r))
+
+	for _, url := range []string{"/value/gauge/a", "/value/gauge/b", "/value/gauge/missing", "/unknown"} {
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, url, nil))
+	}
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, Path, nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	var got Snapshot
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &got))
+
+	// Запросы учитываются по шаблону route-а, а не по URL
+	type key struct {
+		route  string
+		status int
+		count  int64
+	}
+	var keys []key
+	for _, rs := range got.Requests {
+		keys = append(keys, key{rs.Route, rs.Status, rs.Latency.Count})
+	}
+	assert.Equal(t, []key{
+		{"/value/:metricType/:metricName", http.StatusOK, 2},
+		{"/value/:metricType/:metricName", http.StatusNotFound, 1},
+		{"NoRoute", http.StatusNotFound, 1},
+	}, keys)
+}
+
+func TestInstrumentStorage(t *testing.T) {
+	ctx := context.Background()
+	ms, err := memstorage.New(ctx)
+	require.NoError(t, err)
+	r := New()
+	store := InstrumentStorage(ms, "memstorage", r)
+
+	require.NoError(t, store.UpdateGauge(ctx, "g", 1.5))
+	require.NoError(t, store.UpdateGauge(ctx, "g", 2.5))
+	v, err := store.GetGauge(ctx, "g")
+	require.NoError(t, err)
+	assert.Equal(t, 2.5, v)
+	_, err = store.GetCounter(ctx, "missing")
+	assert.Error(t, err)
+
+	s := r.Snapshot()
+	require.Len(t, s.Storage, 3)
+	assert.Equal(t, "GetCounter", s.Storage[0].Method)
+	assert.Equal(t, int64(1), s.Storage[0].Errors)
+	assert.Equal(t, "GetGauge", s.Storage[1].Method)
+	assert.Equal(t, int64(0), s.Storage[1].Errors)
+	assert.Equal(t, "UpdateGauge", s.Storage[2].Method)
+	assert.Equal(t, "memstorage", s.Storage[2].Backend)
+	assert.Equal(t, int64(2), s.Storage[2].Latency.Count)
+}
+
+func TestRegistry_DumpAndHMAC(t *testing.T) {
+	r := New()
+	r.ObserveDump(time.Millisecond, nil)
+	r.ObserveDump(time.Millisecond, assert.AnError)
+	r.HMACFailure()
+
+	s := r.Snapshot()
+	assert.Equal(t, int64(2), s.Dump.Latency.Count)
+	assert.Equal(t, int64(1), s.Dump.Errors)
+	assert.Equal(t, int64(1), s.HMACFailures)
+}
+
+func TestHandler_Retry(t *testing.T) {
+	p := retry.Policy{Name: "servermetrics.test", MaxAttempts: 2}
+	err := retry.Do(context.Background(), p, retry.Always, func(context.Context) error { return assert.AnError })
+	require.Error(t, err)
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	Handler(New())(c)
+	var got Snapshot
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &got))
+	assert.Contains(t, got.Retry, retry.Stats{Name: "servermetrics.test", Attempts: 2, Retries: 1, Exhausted: 1})
+}
@@ -0,0 +1,77 @@
+package servermetrics
+
+import (
+	"context"
+	"logger/internal/handlers"
+	"logger/internal/storage"
+	"time"
+)
+
+// instrumentedStorage handlers.Storager с учетом длительности и ошибок каждой операции
+type instrumentedStorage struct {
+	store    handlers.Storager
+	backend  string
+	registry *Registry
+}
+
+// InstrumentStorage обертка над хранилищем store для учета длительности его операций под именем backend
+func InstrumentStorage(store handlers.Storager, backend string, r *Registry) handlers.Storager {
+	return instrumentedStorage{store: store, backend: backend, registry: r}
+}
+
+func (s instrumentedStorage) observe(method string, start time.Time, err error) {
+	s.registry.ObserveStorage(s.backend, method, time.Since(start), err)
+}
+
+func (s instrumentedStorage) UpdateGauge(ctx context.Context, key string, value float64) error {
+	start := time.Now()
+	err := s.store.UpdateGauge(ctx, key, value)
+	s.observe("UpdateGauge", start, err)
+	return err
+}
+
+func (s instrumentedStorage) UpdateCounter(ctx context.Context, key string, value int64) error {
+	start := time.Now()
+	err := s.store.UpdateCounter(ctx, key, value)
+	s.observe("UpdateCounter", start, err)
+	return err
+}
+
+func (s instrumentedStorage) UpdateBatch(ctx context.Context, metrics []storage.Metrics) error {
+	start := time.Now()
+	err := s.store.UpdateBatch(ctx, metrics)
+	s.observe("UpdateBatch", start, err)
+	return err
+}
+
+func (s instrumentedStorage) GetGauge(ctx context.Context, key string) (float64, error) {
+	start := time.Now()
+	v, err := s.store.GetGauge(ctx, key)
+	s.observe("GetGauge", start, err)
+	return v, err
+}
+
+func (s instrumentedStorage) GetCounter(ctx context.Context, key string) (int64, error) {
+	start := time.Now()
+	v, err := s.store.GetCounter(ctx, key)
+	s.observe("GetCounter", start, err)
+	return v, err
+}
+
+func (s instrumentedStorage) GetValue(ctx context.Context, t string, key string) (any, error) {
+	start := time.Now()
+	v, err := s.store.GetValue(ctx, t, key)
+	s.observe("GetValue", start, err)
+	return v, err
+}
+
+func (s instrumentedStorage) GetAllMetrics(ctx context.Context) (any, error) {
+	start := time.Now()
+	v, err := s.store.GetAllMetrics(ctx)
+	s.observe("GetAllMetrics", start, err)
+	return v, err
+}
+
+func (s instrumentedStorage) Close() error {
+	return s.store.Close()
+}
@@ -0,0 +1,57 @@
+package statsd
+
+import (
+	"context"
+	"errors"
+	"logger/internal/logging"
+	"net"
+)
+
+// maxPacketSize максимальный размер UDP пакета StatsD
+const maxPacketSize = 65535
+
+// Server UDP listener StatsD
+type Server struct {
+	conn net.PacketConn
+	agg  *Aggregator
+}
+
+// Listen открытие UDP порта addr. Принятые метрики учитываются в agg
+func Listen(addr string, agg *Aggregator) (*Server, error) {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &Server{conn: conn, agg: agg}, nil
+}
+
+// Addr адрес, на котором принимаются метрики
+func (s *Server) Addr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+// Serve прием пакетов до отмены ctx. Некорректные строки пропускаются
+func (s *Server) Serve(ctx context.Context) error {
+	logger := logging.FromContext(ctx)
+	logger.Infow("statsd: listening", "address", s.Addr().String())
+	go func() {
+		<-ctx.Done()
+		s.conn.Close()
+	}()
+
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, _, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				logger.Infow("statsd: stop listener")
+				return nil
+			}
+			logger.Warnw("statsd: read failed", "error", err)
+			continue
+		}
+		if err := s.agg.AddPacket(buf[:n]); err != nil {
+			logger.Debugw("statsd: skip invalid lines", "error", err)
+		}
+	}
+}
@@ -0,0 +1,242 @@
+// Package statsd прием метрик в формате StatsD/DogStatsD по UDP и их агрегация за интервал отсылки.
+// Поддерживаются типы c (counter), g (gauge, в том числе относительные +N/-N), ms, h, d (timer) и s (set),
+// частота выборки @rate для counter-ов и timer-ов. Теги DogStatsD (#tag:value) разбираются, но не учитываются.
+//
+// При сбросе в collector.Sink:
+//   - counter -- сумма приращений за интервал с учетом частоты выборки;
+//   - gauge -- последнее значение;
+//   - timer -- gauge-и <name>.count, .min, .max, .mean и <name>.pNN для заданных перцентилей;
+//   - set -- gauge с количеством уникальных значений за интервал.
+package statsd
+
+import (
+	"errors"
+	"fmt"
+	"logger/internal/collector"
+	"logger/internal/selfmetrics"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Metric одна разобранная строка StatsD
+type Metric struct {
+	Name       string
+	Type       string  // c, g, ms, s. Типы h и d приводятся к ms
+	Value      float64 // Значение для c, g, ms
+	SetValue   string  // Значение для s
+	Relative   bool    // Относительное изменение gauge (+N/-N)
+	SampleRate float64 // Частота выборки, 1 по умолчанию
+	Tags       []string
+}
+
+// ErrInvalidLine строка не соответствует формату StatsD
+var ErrInvalidLine = errors.New("invalid statsd line")
+
+// ParseLine разбор строки вида name:value|type[|@rate][|#tag1:v1,tag2]
+func ParseLine(line string) (Metric, error) {
+	m := Metric{SampleRate: 1}
+	name, rest, ok := strings.Cut(line, ":")
+	if !ok || name == "" {
+		return m, fmt.Errorf("%w: %q: no name", ErrInvalidLine, line)
+	}
+	m.Name = sanitizeName(name)
+	if selfmetrics.Reserved(m.Name) {
+		return m, fmt.Errorf("%w: %q: prefix %s is reserved for agent metrics", ErrInvalidLine, line, selfmetrics.Prefix)
+	}
+
+	parts := strings.Split(rest, "|")
+	if len(parts) < 2 {
+		return m, fmt.Errorf("%w: %q: no type", ErrInvalidLine, line)
+	}
+	value, typ := parts[0], parts[1]
+	switch typ {
+	case "h", "d":
+		typ = "ms"
+	case "c", "g", "ms", "s":
+	default:
+		return m, fmt.Errorf("%w: %q: unknown type %s", ErrInvalidLine, line, typ)
+	}
+	m.Type = typ
+
+	for _, p := range parts[2:] {
+		switch {
+		case strings.HasPrefix(p, "@"):
+			rate, err := strconv.ParseFloat(p[1:], 64)
+			if err != nil || rate <= 0 || rate > 1 {
+				return m, fmt.Errorf("%w: %q: bad sample rate", ErrInvalidLine, line)
+			}
+			m.SampleRate = rate
+		case strings.HasPrefix(p, "#"):
+			m.Tags = strings.Split(p[1:], ",")
+		}
+	}
+
+	if typ == "s" {
+		m.SetValue = value
+		return m, nil
+	}
+	if typ == "g" && (strings.HasPrefix(value, "+") || strings.HasPrefix(value, "-")) {
+		m.Relative = true
+	}
+	v, err := strconv.ParseFloat(value, 64)
+	if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+		return m, fmt.Errorf("%w: %q: bad value", ErrInvalidLine, line)
+	}
+	m.Value = v
+	return m, nil
+}
+
+// sanitizeName замена пробелов и символов '/' в имени метрики
+func sanitizeName(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ' ', '/', '\t':
+			return '_'
+		}
+		return r
+	}, name)
+}
+
+// DefaultPercentiles перцентили timer-ов по умолчанию
+var DefaultPercentiles = []float64{50, 90, 99}
+
+// sample значение timer-а с весом 1/rate, где rate -- частота выборки
+type sample struct {
+	value  float64
+	weight float64
+}
+
+// Aggregator агрегация метрик StatsD между сбросами
+type Aggregator struct {
+	mu          sync.Mutex
+	percentiles []float64
+	counters    map[string]float64 // Дробный остаток приращения counter-а переносится в следующий интервал
+	gauges      map[string]float64
+	timers      map[string][]sample
+	sets        map[string]map[string]struct{}
+	invalid     int64 // Количество отброшенных строк
+}
+
+// NewAggregator создание Aggregator. Пустой список перцентилей заменяется DefaultPercentiles
+func NewAggregator(percentiles []float64) *Aggregator {
+	if len(percentiles) == 0 {
+		percentiles = DefaultPercentiles
+	}
+	return &Aggregator{
+		percentiles: percentiles,
+		counters:    make(map[string]float64),
+		gauges:      make(map[string]float64),
+		timers:      make(map[string][]sample),
+		sets:        make(map[string]map[string]struct{}),
+	}
+}
+
+// Add учет одной метрики
+func (a *Aggregator) Add(m Metric) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	switch m.Type {
+	case "c":
+		a.counters[m.Name] += m.Value / m.SampleRate
+	case "g":
+		if m.Relative {
+			a.gauges[m.Name] += m.Value
+		} else {
+			a.gauges[m.Name] = m.Value
+		}
+	case "ms":
+		// Значение с частотой выборки rate учитывается с весом 1/rate
+		a.timers[m.Name] = append(a.timers[m.Name], sample{value: m.Value, weight: 1 / m.SampleRate})
+	case "s":
+		if a.sets[m.Name] == nil {
+			a.sets[m.Name] = make(map[string]struct{})
+		}
+		a.sets[m.Name][m.SetValue] = struct{}{}
+	}
+}
+
+// AddPacket разбор и учет UDP пакета, содержащего одну или несколько строк. Возвращает ошибки разбора строк
+func (a *Aggregator) AddPacket(packet []byte) error {
+	var errs []error
+	for _, line := range strings.Split(string(packet), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		m, err := ParseLine(line)
+		if err != nil {
+			a.mu.Lock()
+			a.invalid++
+			a.mu.Unlock()
+			errs = append(errs, err)
+			continue
+		}
+		a.Add(m)
+	}
+	return errors.Join(errs...)
+}
+
+// Flush перенос агрегированных за интервал значений в s и начало нового интервала.
+// Приращения counter-ов добавляются к накопленным в s, дробный остаток приращения (при частоте выборки < 1)
+// учитывается в следующем интервале. Значения gauge-ей сохраняются между интервалами для относительных изменений
+func (a *Aggregator) Flush(s collector.Sink) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for name, v := range a.counters {
+		delta := int64(math.Trunc(v))
+		if delta != 0 {
+			s.AddCounter(name, delta)
+		}
+		if rest := v - float64(delta); rest != 0 {
+			a.counters[name] = rest
+		} else {
+			delete(a.counters, name)
+		}
+	}
+	for name, v := range a.gauges {
+		s.SetGauge(name, v)
+	}
+	for name, samples := range a.timers {
+		sort.Slice(samples, func(i, j int) bool { return samples[i].value < samples[j].value })
+		sum, count := 0.0, 0.0
+		for _, smp := range samples {
+			sum += smp.value * smp.weight
+			count += smp.weight
+		}
+		s.SetGauge(name+".count", count)
+		s.SetGauge(name+".min", samples[0].value)
+		s.SetGauge(name+".max", samples[len(samples)-1].value)
+		s.SetGauge(name+".mean", sum/count)
+		for _, p := range a.percentiles {
+			s.SetGauge(name+".p"+strconv.FormatFloat(p, 'f', -1, 64), weightedPercentile(samples, count, p))
+		}
+	}
+	for name, set := range a.sets {
+		s.SetGauge(name, float64(len(set)))
+	}
+	s.SetGauge("StatsdInvalidLines", float64(a.invalid))
+
+	a.timers = make(map[string][]sample)
+	a.sets = make(map[string]map[string]struct{})
+}
+
+// weightedPercentile перцентиль p (0..100) отсортированных по значению выборок с суммарным весом total
+// методом ближайшего ранга: первое значение, накопленный вес которого достигает p% от total
+func weightedPercentile(sorted []sample, total float64, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	target := p / 100 * total
+	cum := 0.0
+	for _, smp := range sorted {
+		cum += smp.weight
+		// Допуск на погрешность суммирования дробных весов
+		if cum >= target-1e-9*total {
+			return smp.value
+		}
+	}
+	return sorted[len(sorted)-1].value
+}
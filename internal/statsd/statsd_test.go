@@ -0,0 +1,139 @@
+package statsd
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"logger/internal/collector"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestParseLine(t *testing.T) {
+	tests := []struct {
+		name    string
+		line    string
+		want    Metric
+		wantErr bool
+	}{
+		{name: "counter", line: "requests:1|c", want: Metric{Name: "requests", Type: "c", Value: 1, SampleRate: 1}},
+		{name: "counter with rate", line: "requests:2|c|@0.5", want: Metric{Name: "requests", Type: "c", Value: 2, SampleRate: 0.5}},
+		{name: "gauge", line: "queue.size:42.5|g", want: Metric{Name: "queue.size", Type: "g", Value: 42.5, SampleRate: 1}},
+		{name: "relative gauge", line: "queue.size:-3|g", want: Metric{Name: "queue.size", Type: "g", Value: -3, Relative: true, SampleRate: 1}},
+		{name: "timer", line: "api latency:320|ms", want: Metric{Name: "api_latency", Type: "ms", Value: 320, SampleRate: 1}},
+		{name: "histogram as timer", line: "api:10|h", want: Metric{Name: "api", Type: "ms", Value: 10, SampleRate: 1}},
+		{name: "set", line: "users:alice|s", want: Metric{Name: "users", Type: "s", SetValue: "alice", SampleRate: 1}},
+		{name: "dogstatsd tags", line: "requests:1|c|#env:prod,region", want: Metric{Name: "requests", Type: "c", Value: 1, SampleRate: 1, Tags: []string{"env:prod", "region"}}},
+		{name: "no value", line: "requests", wantErr: true},
+		{name: "no type", line: "requests:1", wantErr: true},
+		{name: "unknown type", line: "requests:1|x", wantErr: true},
+		{name: "bad value", line: "requests:abc|c", wantErr: true},
+		{name: "bad rate", line: "requests:1|c|@2", wantErr: true},
+		{name: "reserved prefix", line: "agent.send.failures:1|c", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseLine(tt.line)
+			if tt.wantErr {
+				assert.ErrorIs(t, err, ErrInvalidLine)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestAggregator_Flush(t *testing.T) {
+	agg := NewAggregator([]float64{50, 99})
+	err := agg.AddPacket([]byte("hits:1|c\nhits:2|c|@0.5\ntemp:20|g\ntemp:+5|g\nlat:10|ms\nlat:30|ms\nlat:20|ms\nusers:a|s\nusers:b|s\nusers:a|s\nbroken"))
+	assert.Error(t, err)
+
+	b := collector.NewBatch()
+	agg.Flush(b)
+	sink := newTestSink()
+	b.MergeInto(sink)
+
+	assert.Equal(t, int64(5), sink.counters["hits"])
+	assert.Equal(t, 25.0, sink.gauges["temp"])
+	assert.Equal(t, 3.0, sink.gauges["lat.count"])
+	assert.Equal(t, 10.0, sink.gauges["lat.min"])
+	assert.Equal(t, 30.0, sink.gauges["lat.max"])
+	assert.Equal(t, 20.0, sink.gauges["lat.mean"])
+	assert.Equal(t, 20.0, sink.gauges["lat.p50"])
+	assert.Equal(t, 30.0, sink.gauges["lat.p99"])
+	assert.Equal(t, 2.0, sink.gauges["users"])
+	assert.Equal(t, 1.0, sink.gauges["StatsdInvalidLines"])
+
+	// Следующий интервал: приращения counter-а добавляются к накопленным, gauge сохраняется
+	assert.NoError(t, agg.AddPacket([]byte("hits:2|c")))
+	agg.Flush(sink)
+	assert.Equal(t, int64(7), sink.counters["hits"])
+	assert.Equal(t, 25.0, sink.gauges["temp"])
+	// Без новых значений timer-а его gauge-и не обновляются
+	assert.Equal(t, 3.0, sink.gauges["lat.count"])
+}
+
+func TestAggregator_SampleRate(t *testing.T) {
+	agg := NewAggregator([]float64{50, 90})
+	// Значение с малой частотой выборки хранится одной выборкой с весом 1/rate
+	assert.NoError(t, agg.AddPacket([]byte("lat:1|ms|@0.000000001\nlat:100|ms\nhits:1|c|@0.4")))
+	assert.Len(t, agg.timers["lat"], 2)
+
+	sink := newTestSink()
+	agg.Flush(sink)
+	assert.InDelta(t, 1e9+1, sink.gauges["lat.count"], 1e-3)
+	assert.Equal(t, 1.0, sink.gauges["lat.p90"])
+	assert.InDelta(t, 1.0, sink.gauges["lat.mean"], 1e-6)
+	// 2.5 приращения: 2 отсылаются, остаток 0.5 переносится в следующий интервал
+	assert.Equal(t, int64(2), sink.counters["hits"])
+
+	assert.NoError(t, agg.AddPacket([]byte("hits:1|c|@0.4")))
+	agg.Flush(sink)
+	assert.Equal(t, int64(5), sink.counters["hits"])
+	assert.Empty(t, agg.counters)
+}
+
+func TestServer(t *testing.T) {
+	agg := NewAggregator(nil)
+	server, err := Listen("127.0.0.1:0", agg)
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- server.Serve(ctx) }()
+
+	conn, err := net.Dial("udp", server.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("hits:3|c"))
+	require.NoError(t, err)
+
+	sink := newTestSink()
+	assert.Eventually(t, func() bool {
+		agg.Flush(sink)
+		return sink.counters["hits"] == 3
+	}, time.Second, 10*time.Millisecond)
+
+	cancel()
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("Serve did not stop after context cancel")
+	}
+}
+
+// testSink collector.Sink для проверки результата сброса
+type testSink struct {
+	gauges   map[string]float64
+	counters map[string]int64
+}
+
+func newTestSink() *testSink {
+	return &testSink{gauges: make(map[string]float64), counters: make(map[string]int64)}
+}
+
+func (s *testSink) SetGauge(name string, value float64) { s.gauges[name] = value }
+func (s *testSink) SetCounter(name string, value int64) { s.counters[name] = value }
+func (s *testSink) AddCounter(name string, delta int64) { s.counters[name] += delta }
@@ -0,0 +1,212 @@
+package boltstorage
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	bolt "go.etcd.io/bbolt"
+	"logger/cmd/server/initconf"
+	"logger/internal/apperr"
+	"logger/internal/logging"
+	"logger/internal/storage"
+	"math"
+	"time"
+)
+
+// Имена bucket-ов для хранения метрик разных типов
+var (
+	gaugeBucket   = []byte("gauge")
+	counterBucket = []byte("counter")
+)
+
+// Таймаут ожидания блокировки файла БД другим процессом
+const openTimeout = 1 * time.Second
+
+// BoltStorage хранилище метрик на основе встраиваемой key-value БД bbolt.
+// Каждое изменение метрики выполняется в отдельной транзакции и сбрасывается на диск (fsync) при commit-е,
+// поэтому периодический дамп на диск для этого хранилища не требуется.
+type BoltStorage struct {
+	db *bolt.DB
+}
+
+// Временная структура для выдачи всех метрик в GetAllMetrics
+type tmpStor struct {
+	GaugeMap   map[string]float64
+	CounterMap map[string]int64
+}
+
+// New функция открытия (или создания) файла БД bbolt по пути conf.BoltStoragePath и инициализации bucket-ов
+func New(ctx context.Context, conf *initconf.Config) (BoltStorage, error) {
+	logging.FromContext(ctx).Infow("opening bolt storage", "path", conf.BoltStoragePath)
+	db, err := bolt.Open(conf.BoltStoragePath, 0600, &bolt.Options{Timeout: openTimeout})
+	if err != nil {
+		return BoltStorage{}, fmt.Errorf("%s %v", "boltstorage New: error opening bolt file:", err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(gaugeBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(counterBucket)
+		return err
+	})
+	if err != nil {
+		_ = db.Close()
+		return BoltStorage{}, fmt.Errorf("%s %v", "boltstorage New: error creating buckets:", err)
+	}
+	return BoltStorage{db: db}, nil
+}
+
+// encodeGauge, decodeGauge, encodeCounter, decodeCounter -- функции сериализации значений метрик в 8 байт (big endian)
+func encodeGauge(v float64) []byte {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, math.Float64bits(v))
+	return buf
+}
+
+func decodeGauge(b []byte) float64 {
+	return math.Float64frombits(binary.BigEndian.Uint64(b))
+}
+
+func encodeCounter(v int64) []byte {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, uint64(v))
+	return buf
+}
+
+func decodeCounter(b []byte) int64 {
+	return int64(binary.BigEndian.Uint64(b))
+}
+
+// putGauge, addCounter -- изменение метрик в рамках уже открытой транзакции
+func putGauge(tx *bolt.Tx, key string, value float64) error {
+	return tx.Bucket(gaugeBucket).Put([]byte(key), encodeGauge(value))
+}
+
+func addCounter(tx *bolt.Tx, key string, delta int64) error {
+	b := tx.Bucket(counterBucket)
+	var current int64
+	if v := b.Get([]byte(key)); v != nil {
+		current = decodeCounter(v)
+	}
+	return b.Put([]byte(key), encodeCounter(current+delta))
+}
+
+func (bs BoltStorage) UpdateGauge(_ context.Context, key string, value float64) error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		return putGauge(tx, key, value)
+	})
+}
+
+func (bs BoltStorage) UpdateCounter(_ context.Context, key string, value int64) error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		return addCounter(tx, key, value)
+	})
+}
+
+// UpdateBatch изменение batch-а метрик в одной транзакции. При ошибке в любой из метрик транзакция откатывается целиком
+func (bs BoltStorage) UpdateBatch(_ context.Context, metrics []storage.Metrics) error {
+	if len(metrics) == 0 {
+		return nil
+	}
+	if err := storage.ValidateBatch(metrics); err != nil {
+		return err
+	}
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		for _, metric := range metrics {
+			switch metric.MType {
+			case "gauge":
+				if err := putGauge(tx, metric.ID, *metric.Value); err != nil {
+					return err
+				}
+			case "counter":
+				if err := addCounter(tx, metric.ID, *metric.Delta); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+func (bs BoltStorage) GetGauge(_ context.Context, key string) (float64, error) {
+	var val float64
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(gaugeBucket).Get([]byte(key))
+		if v == nil {
+			return apperr.NotFound("boltstorage.GetGauge", key)
+		}
+		val = decodeGauge(v)
+		return nil
+	})
+	return val, err
+}
+
+func (bs BoltStorage) GetCounter(_ context.Context, key string) (int64, error) {
+	var val int64
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(counterBucket).Get([]byte(key))
+		if v == nil {
+			return apperr.NotFound("boltstorage.GetCounter", key)
+		}
+		val = decodeCounter(v)
+		return nil
+	})
+	return val, err
+}
+
+func (bs BoltStorage) GetValue(ctx context.Context, t string, key string) (any, error) {
+	switch t {
+	case "gauge":
+		val, err := bs.GetGauge(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		return val, nil
+	case "counter":
+		val, err := bs.GetCounter(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		return val, nil
+	default:
+		return nil, apperr.WrongType("boltstorage.GetValue", t)
+	}
+}
+
+func (bs BoltStorage) GetAllGaugesMap(_ context.Context) (map[string]float64, error) {
+	gauges := make(map[string]float64)
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(gaugeBucket).ForEach(func(k, v []byte) error {
+			gauges[string(k)] = decodeGauge(v)
+			return nil
+		})
+	})
+	return gauges, err
+}
+
+func (bs BoltStorage) GetAllCountersMap(_ context.Context) (map[string]int64, error) {
+	counters := make(map[string]int64)
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(counterBucket).ForEach(func(k, v []byte) error {
+			counters[string(k)] = decodeCounter(v)
+			return nil
+		})
+	})
+	return counters, err
+}
+
+func (bs BoltStorage) GetAllMetrics(ctx context.Context) (any, error) {
+	stor := tmpStor{}
+	var err error
+	if stor.GaugeMap, err = bs.GetAllGaugesMap(ctx); err != nil {
+		return nil, err
+	}
+	if stor.CounterMap, err = bs.GetAllCountersMap(ctx); err != nil {
+		return nil, err
+	}
+	return stor, nil
+}
+
+func (bs BoltStorage) Close() error {
+	return bs.db.Close()
+}
@@ -0,0 +1,408 @@
+package boltstorage
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"logger/cmd/server/initconf"
+	"logger/internal/storage"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// createTestStor вспомогательная функция создания BoltStorage во временной директории теста с набором тестовых метрик
+func createTestStor(t *testing.T) BoltStorage {
+	ctx := context.Background()
+	conf := initconf.Config{BoltStoragePath: filepath.Join(t.TempDir(), "metrics.db")}
+	stor, err := New(ctx, &conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = stor.Close() })
+	for k, v := range map[string]float64{"Gauge1": 1.1, "Gauge2": 2.2, "Gauge3": 3.3} {
+		if err := stor.UpdateGauge(ctx, k, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for k, v := range map[string]int64{"Counter1": 1, "Counter2": 2, "Counter3": 3} {
+		if err := stor.UpdateCounter(ctx, k, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return stor
+}
+
+func TestBoltStorage_UpdateCounter(t *testing.T) {
+	type args struct {
+		key   string
+		value int64
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tests := []struct {
+		name    string
+		args    args
+		want    int64
+		wantErr bool
+	}{
+		{
+			name: "Test TestBoltStorage_UpdateCounter new key positive",
+			args: args{
+				key:   "metric1",
+				value: 1,
+			},
+			want:    1,
+			wantErr: false,
+		},
+		{
+			name: "Test TestBoltStorage_UpdateCounter existing key positive",
+			args: args{
+				key:   "Counter2",
+				value: 5,
+			},
+			want:    7,
+			wantErr: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bs := createTestStor(t)
+			if err := bs.UpdateCounter(ctx, tt.args.key, tt.args.value); (err != nil) != tt.wantErr {
+				t.Errorf("UpdateCounter() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			got, _ := bs.GetCounter(ctx, tt.args.key)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestBoltStorage_UpdateGauge(t *testing.T) {
+	type args struct {
+		key   string
+		value float64
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tests := []struct {
+		name    string
+		args    args
+		wantErr bool
+	}{
+		{
+			name: "Test TestBoltStorage_UpdateGauge new key positive",
+			args: args{
+				key:   "metric1",
+				value: 1.0,
+			},
+			wantErr: false,
+		},
+		{
+			name: "Test TestBoltStorage_UpdateGauge existing key positive",
+			args: args{
+				key:   "Gauge1",
+				value: 10.5,
+			},
+			wantErr: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bs := createTestStor(t)
+			if err := bs.UpdateGauge(ctx, tt.args.key, tt.args.value); (err != nil) != tt.wantErr {
+				t.Errorf("UpdateGauge() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			got, _ := bs.GetGauge(ctx, tt.args.key)
+			assert.Equal(t, tt.args.value, got)
+		})
+	}
+}
+
+func TestNew(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tests := []struct {
+		name    string
+		path    string
+		wantErr bool
+	}{
+		{
+			name:    "Test positive New()",
+			path:    filepath.Join(t.TempDir(), "metrics.db"),
+			wantErr: false,
+		},
+		{
+			name:    "Test negative New(), directory does not exist",
+			path:    filepath.Join(t.TempDir(), "nodir", "metrics.db"),
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := New(ctx, &initconf.Config{BoltStoragePath: tt.path})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("New() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if err == nil {
+				_ = got.Close()
+			}
+		})
+	}
+}
+
+// TestBoltStorage_Persistence проверка сохранности метрик после закрытия и повторного открытия файла БД
+func TestBoltStorage_Persistence(t *testing.T) {
+	ctx := context.Background()
+	conf := initconf.Config{BoltStoragePath: filepath.Join(t.TempDir(), "metrics.db")}
+	var g = 100.1
+	var c int64 = 100
+
+	bs, err := New(ctx, &conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bs.UpdateBatch(ctx, []storage.Metrics{{ID: "Gauge100", MType: "gauge", Value: &g}, {ID: "Counter100", MType: "counter", Delta: &c}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := bs.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	bs, err = New(ctx, &conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.Close()
+	gotGauge, err := bs.GetGauge(ctx, "Gauge100")
+	assert.NoError(t, err)
+	assert.Equal(t, g, gotGauge)
+	gotCounter, err := bs.GetCounter(ctx, "Counter100")
+	assert.NoError(t, err)
+	assert.Equal(t, c, gotCounter)
+}
+
+func TestBoltStorage_GetAllCountersMap(t *testing.T) {
+	tests := []struct {
+		name    string
+		want    map[string]int64
+		wantErr bool
+	}{
+		{
+			name:    "Test GetAllCountersMap positive",
+			want:    map[string]int64{"Counter1": 1, "Counter2": 2, "Counter3": 3},
+			wantErr: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := createTestStor(t).GetAllCountersMap(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Errorf("GetAllCountersMap() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestBoltStorage_GetAllGaugesMap(t *testing.T) {
+	tests := []struct {
+		name    string
+		want    map[string]float64
+		wantErr bool
+	}{
+		{
+			name:    "Test GetAllGaugesMap positive",
+			want:    map[string]float64{"Gauge1": 1.1, "Gauge2": 2.2, "Gauge3": 3.3},
+			wantErr: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := createTestStor(t).GetAllGaugesMap(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Errorf("GetAllGaugesMap() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestBoltStorage_GetAllMetrics(t *testing.T) {
+	tests := []struct {
+		name    string
+		want    tmpStor
+		wantErr bool
+	}{
+		{
+			name:    "Test GetAllMetrics positive",
+			wantErr: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := createTestStor(t).GetAllMetrics(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Errorf("GetAllMetrics() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !assert.Equal(t, reflect.TypeOf(got), reflect.TypeOf(tt.want)) {
+				t.Errorf("GetAllMetrics() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBoltStorage_GetCounter(t *testing.T) {
+	tests := []struct {
+		name    string
+		key     string
+		want    int64
+		wantErr bool
+	}{
+		{
+			name:    "Test GetCounter positive",
+			key:     "Counter2",
+			want:    2,
+			wantErr: false,
+		},
+		{
+			name:    "Test GetCounter negative, no key",
+			key:     "Counter200",
+			want:    0,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := createTestStor(t).GetCounter(context.Background(), tt.key)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("GetCounter() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestBoltStorage_GetGauge(t *testing.T) {
+	tests := []struct {
+		name    string
+		key     string
+		want    float64
+		wantErr bool
+	}{
+		{
+			name:    "Test GetGauge positive",
+			key:     "Gauge2",
+			want:    2.2,
+			wantErr: false,
+		},
+		{
+			name:    "Test GetGauge negative, no key",
+			key:     "Gauge200",
+			want:    0,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := createTestStor(t).GetGauge(context.Background(), tt.key)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("GetGauge() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestBoltStorage_GetValue(t *testing.T) {
+	type args struct {
+		t   string
+		key string
+	}
+	tests := []struct {
+		name    string
+		args    args
+		want    any
+		wantErr bool
+	}{
+		{
+			name:    "Test GetValue Gauge positive",
+			args:    args{t: "gauge", key: "Gauge2"},
+			want:    2.2,
+			wantErr: false,
+		},
+		{
+			name:    "Test GetValue Counter positive",
+			args:    args{t: "counter", key: "Counter2"},
+			want:    int64(2), // из-за типа any в tests необходимо явно кастовать в int64
+			wantErr: false,
+		},
+		{
+			name:    "Test GetValue negative, wrong type",
+			args:    args{t: "bool", key: "Counter2"},
+			want:    nil,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := createTestStor(t).GetValue(context.Background(), tt.args.t, tt.args.key)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("GetValue() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestBoltStorage_UpdateBatch(t *testing.T) {
+	type args struct {
+		metrics []storage.Metrics
+		key     string
+	}
+	var g = 100.1
+	var c int64 = 100
+	tests := []struct {
+		name    string
+		args    args
+		want    float64
+		wantErr bool
+	}{
+		{
+			name: "Test TestBoltStorage_UpdateBatch positive",
+			args: args{
+				metrics: []storage.Metrics{{ID: "Gauge100", MType: "gauge", Value: &g}, {ID: "Counter100", MType: "counter", Delta: &c}},
+				key:     "Gauge100",
+			},
+			want:    100.1,
+			wantErr: false,
+		},
+		{
+			name: "Test TestBoltStorage_UpdateBatch negative, batch without value is rolled back",
+			args: args{
+				metrics: []storage.Metrics{{ID: "Gauge100", MType: "gauge", Value: &g}, {ID: "Counter100", MType: "counter"}},
+				key:     "Gauge100",
+			},
+			want:    0,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bs := createTestStor(t)
+			err := bs.UpdateBatch(context.Background(), tt.args.metrics)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("UpdateBatch() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			got, _ := bs.GetGauge(context.Background(), tt.args.key)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
@@ -0,0 +1,23 @@
+package boltstorage_test
+
+import (
+	"context"
+	"logger/cmd/server/initconf"
+	"logger/internal/handlers"
+	"logger/internal/storage/boltstorage"
+	"logger/internal/storage/storagetest"
+	"path/filepath"
+	"testing"
+)
+
+func TestBoltStorage_Conformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) handlers.Storager {
+		conf := initconf.Config{BoltStoragePath: filepath.Join(t.TempDir(), "metrics.db")}
+		store, err := boltstorage.New(context.Background(), &conf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { _ = store.Close() })
+		return store
+	})
+}
@@ -0,0 +1,19 @@
+package memstorage_test
+
+import (
+	"context"
+	"logger/internal/handlers"
+	"logger/internal/storage/memstorage"
+	"logger/internal/storage/storagetest"
+	"testing"
+)
+
+func TestMemStorage_Conformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) handlers.Storager {
+		store, err := memstorage.New(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return store
+	})
+}
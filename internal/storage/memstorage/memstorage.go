@@ -3,98 +3,127 @@ package memstorage
 import (
 	"context"
 	"encoding/json"
-	"errors"
-	"log"
+	"logger/internal/apperr"
+	"logger/internal/logging"
 	"logger/internal/storage"
+	"maps"
+	"sync"
 )
 
 // MemStorage inmemory хранилище для метрик. Разные map-ы для разных типов метрик.
+// MemStorage передается по значению, поэтому мьютекс хранится по указателю и общий для копий одного хранилища
 type MemStorage struct {
+	mu         *sync.RWMutex
 	gaugeMap   map[string]float64
 	counterMap map[string]int64
 }
 
 func New(_ context.Context) (MemStorage, error) {
 	return MemStorage{
+		mu:         &sync.RWMutex{},
 		gaugeMap:   make(map[string]float64),
 		counterMap: make(map[string]int64),
 	}, nil
 }
 
 func (ms MemStorage) UpdateGauge(_ context.Context, key string, value float64) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
 	ms.gaugeMap[key] = value
 	return nil
 }
 
 func (ms MemStorage) UpdateCounter(_ context.Context, key string, value int64) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
 	ms.counterMap[key] += value
 	return nil
 }
 
-func (ms MemStorage) UpdateBatch(_ context.Context, metrics []storage.Metrics) error {
-	log.Println("UpdateBatch. Start Update batch, storage now is :", ms)
+func (ms MemStorage) UpdateBatch(ctx context.Context, metrics []storage.Metrics) error {
 	if len(metrics) == 0 {
-		log.Println("UpdateBatch. No metrics to update im []Metrics")
 		return nil
 	}
+	if err := storage.ValidateBatch(metrics); err != nil {
+		logging.FromContext(ctx).Debugw("memstorage UpdateBatch: invalid batch", "error", err)
+		return err
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
 	for _, metric := range metrics {
 		switch metric.MType {
 		case "gauge":
 			ms.gaugeMap[metric.ID] = *metric.Value
 		case "counter":
-			log.Println("UpdateBatch: memstorage update counter ", metric.ID, "value, before:", ms.counterMap[metric.ID], "updating with delta :", *metric.Delta)
 			ms.counterMap[metric.ID] += *metric.Delta
-			log.Println("UpdateBatch: memstorage update counter value, after:", ms.counterMap[metric.ID])
 		}
 	}
-	log.Println("UpdateBatch. End Update batch")
 	return nil
 }
 
 func (ms MemStorage) GetGauge(_ context.Context, key string) (float64, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
 	val, ok := ms.gaugeMap[key]
 	if !ok {
-		return 0, errors.New("no value for key " + key)
+		return 0, apperr.NotFound("memstorage.GetGauge", key)
 	}
 	return val, nil
 }
 
 func (ms MemStorage) GetCounter(_ context.Context, key string) (int64, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
 	val, ok := ms.counterMap[key]
 	if !ok {
-		return 0, errors.New("no value for key " + key)
+		return 0, apperr.NotFound("memstorage.GetCounter", key)
 	}
 	return val, nil
 }
 
 func (ms MemStorage) GetValue(_ context.Context, t string, key string) (any, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
 	if t == "counter" {
 		val, ok := ms.counterMap[key]
 		if !ok {
-			return nil, errors.New("no value for key " + key)
+			return nil, apperr.NotFound("memstorage.GetValue", key)
 		}
 		return val, nil
 	} else if t == "gauge" {
 		val, ok := ms.gaugeMap[key]
 		if !ok {
-			return nil, errors.New("no value for key " + key)
+			return nil, apperr.NotFound("memstorage.GetValue", key)
 		}
 		return val, nil
 	} else {
-		return nil, errors.New("wrong metric type")
+		return nil, apperr.WrongType("memstorage.GetValue", t)
 	}
 }
 
+// GetAllGaugesMap копия значений gauge-ей
 func (ms MemStorage) GetAllGaugesMap(_ context.Context) (map[string]float64, error) {
-	return ms.gaugeMap, nil
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	return maps.Clone(ms.gaugeMap), nil
 }
 
+// GetAllCountersMap копия значений counter-ов
 func (ms MemStorage) GetAllCountersMap(_ context.Context) (map[string]int64, error) {
-	return ms.counterMap, nil
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	return maps.Clone(ms.counterMap), nil
 }
 
+// GetAllMetrics копия хранилища: вызывающий может читать ее без блокировки, пока хранилище изменяется
 func (ms MemStorage) GetAllMetrics(_ context.Context) (any, error) {
-	return ms, nil
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	return MemStorage{
+		mu:         &sync.RWMutex{},
+		gaugeMap:   maps.Clone(ms.gaugeMap),
+		counterMap: maps.Clone(ms.counterMap),
+	}, nil
 }
 
 func (ms MemStorage) Close() error {
@@ -117,6 +146,11 @@ func Unmarshal(data []byte, stor *MemStorage) error {
 	if err != nil {
 		return err
 	}
+	if stor.mu == nil {
+		stor.mu = &sync.RWMutex{}
+	}
+	stor.mu.Lock()
+	defer stor.mu.Unlock()
 	stor.gaugeMap = tmp.GaugeMap
 	stor.counterMap = tmp.CounterMap
 	return nil
@@ -124,12 +158,12 @@ func Unmarshal(data []byte, stor *MemStorage) error {
 
 // Marshal функция для Marshal private полей структуры MemStorage
 func Marshal(stor any) ([]byte, error) {
+	ms := stor.(MemStorage)
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
 	tmp := tmpMemStorage{
-		GaugeMap:   make(map[string]float64),
-		CounterMap: make(map[string]int64),
+		GaugeMap:   ms.gaugeMap,
+		CounterMap: ms.counterMap,
 	}
-	stor = stor.(MemStorage)
-	tmp.GaugeMap = stor.(MemStorage).gaugeMap
-	tmp.CounterMap = stor.(MemStorage).counterMap
 	return json.Marshal(tmp)
 }
@@ -6,11 +6,13 @@ import (
 	"log"
 	"logger/internal/storage"
 	"reflect"
+	"sync"
 	"testing"
 )
 
 func createTestStor() MemStorage {
 	return MemStorage{
+		mu:         &sync.RWMutex{},
 		gaugeMap:   map[string]float64{"Gauge1": 1.1, "Gauge2": 2.2, "Gauge3": 3.3},
 		counterMap: map[string]int64{"Counter1": 1, "Counter2": 2, "Counter3": 3},
 	}
@@ -48,6 +50,7 @@ func TestMemStorage_UpdateCounter(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			ms := &MemStorage{
+				mu:         &sync.RWMutex{},
 				gaugeMap:   tt.fields.gaugeMap,
 				counterMap: tt.fields.counterMap,
 			}
@@ -90,6 +93,7 @@ func TestMemStorage_UpdateGauge(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			ms := &MemStorage{
+				mu:         &sync.RWMutex{},
 				gaugeMap:   tt.fields.gaugeMap,
 				counterMap: tt.fields.counterMap,
 			}
@@ -110,6 +114,7 @@ func TestNew(t *testing.T) {
 		{
 			name: "Test positive New()",
 			want: MemStorage{
+				mu:         &sync.RWMutex{},
 				gaugeMap:   make(map[string]float64),
 				counterMap: make(map[string]int64),
 			},
@@ -464,3 +469,36 @@ func TestMemStorage_UpdateBatch(t *testing.T) {
 		})
 	}
 }
+
+func TestMemStorage_ConcurrentSnapshots(t *testing.T) {
+	ctx := context.Background()
+	ms, err := New(ctx)
+	assert.NoError(t, err)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			_ = ms.UpdateGauge(ctx, "g", float64(i))
+			_ = ms.UpdateCounter(ctx, "c", 1)
+		}
+	}()
+	// Снимки читаются без блокировки одновременно с изменением хранилища
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			all, _ := ms.GetAllMetrics(ctx)
+			_, _ = Marshal(all)
+			gauges, _ := ms.GetAllGaugesMap(ctx)
+			for range gauges {
+			}
+		}
+	}()
+	wg.Wait()
+
+	// Снимок не изменяется последующими изменениями хранилища
+	counters, _ := ms.GetAllCountersMap(ctx)
+	assert.NoError(t, ms.UpdateCounter(ctx, "c", 1))
+	assert.Equal(t, int64(1000), counters["c"])
+}
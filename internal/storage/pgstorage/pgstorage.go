@@ -8,12 +8,16 @@ import (
 	"github.com/jackc/pgerrcode"
 	"github.com/jackc/pgx/v5/pgconn"
 	_ "github.com/jackc/pgx/v5/stdlib"
-	"log"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"logger/cmd/server/initconf"
 	"logger/conf"
+	"logger/internal/apperr"
 	"logger/internal/database"
+	"logger/internal/logging"
+	"logger/internal/retry"
 	"logger/internal/storage"
-	"time"
+	"logger/internal/tracing"
 )
 
 // PgStorage postgresql хранилище для метрик. Разные map-ы для разных типов метрик
@@ -29,110 +33,130 @@ type Metrics struct {
 	Value *float64 `json:"value,omitempty"` // Значение метрики в случае передачи gauge
 }
 
-// Набор из 3-х таймаутов для повтора операции в случае retriable-ошибки
-var timeoutsRetryConst = [3]int{1, 3, 5}
+// pgPolicy политика повтора SQL запросов в случае retriable-ошибки
+var pgPolicy = retry.DefaultPolicy.Named("pg")
 
 // pgErrorRetriable функция определения принадлежности PostgreSQL ошибки к классу retriable.
 func pgErrorRetriable(err error) bool {
 	var pgErr *pgconn.PgError
 	if errors.As(err, &pgErr) {
-		log.Println("PostgreSQL error pgErr.Message :", pgErr.Message, "error code :", pgErr.Code)
 		if pgerrcode.IsConnectionException(pgErr.Code) {
-			log.Println("PostgreSQL error : IsConnectionException is true.")
 			return true
 		}
 	}
 	return false
 }
 
+// pgScanError классификация ошибки чтения строки результата: отсутствие строки -- apperr.ErrNotFound,
+// ошибка подключения -- apperr.ErrRetriable
+func pgScanError(op string, key string, err error) error {
+	if errors.Is(err, sql.ErrNoRows) {
+		return apperr.NotFound(op, key)
+	}
+	if pgErrorRetriable(err) {
+		return apperr.Retriable(op, err)
+	}
+	return fmt.Errorf("%s: %w", op, err)
+}
+
+// startSpan span SQL-запроса sqlQuery. В span пишется только текст запроса с placeholder-ами, без значений метрик
+func startSpan(ctx context.Context, name string, sqlQuery string) (context.Context, trace.Span) {
+	return tracing.Start(ctx, name, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+		attribute.String("db.system", "postgresql"),
+		attribute.String("db.statement", sqlQuery),
+	))
+}
+
 // ExecContext раздел
 // pgExecWrapper -- wrapper для запросов типа ExecContext
-func pgExecWrapper(f func(ctx context.Context, query string, args ...any) (sql.Result, error), ctx context.Context, sqlQuery string, args ...any) error {
-	_, err := f(ctx, sqlQuery, args...)
-	// Если ошибка retriable
+func pgExecWrapper(f func(ctx context.Context, query string, args ...any) (sql.Result, error), ctx context.Context, sqlQuery string, args ...any) (err error) {
+	ctx, span := startSpan(ctx, "pg.exec", sqlQuery)
+	defer func() {
+		tracing.RecordError(span, err)
+		span.End()
+	}()
+	err = retry.Do(ctx, pgPolicy, pgErrorRetriable, func(ctx context.Context) error {
+		_, err := f(ctx, sqlQuery, args...)
+		return err
+	})
+	// Если ошибка retriable и попытки исчерпаны
 	if pgErrorRetriable(err) {
-		for i, t := range timeoutsRetryConst {
-			log.Println("pg.Wrapper, RetriableError: Trying to recover after ", t, "seconds, attempt number ", i+1)
-			time.Sleep(time.Duration(t) * time.Second)
-			_, err := f(ctx, sqlQuery, args...)
-			if err != nil {
-				if i == 2 {
-					return fmt.Errorf("%s %v", "pg.Wrapper RetriableError: Panic in wrapped function:", err)
-				}
-				continue
-			}
-			log.Println("pg.Wrapper RetriableError: attempt ", i+1, "success")
-			return nil
-		}
+		return apperr.Retriable("pg.Wrapper", err)
 	}
 	// Если ошибка non-retriable
 	if err != nil {
-		return fmt.Errorf("%s %v", "pg.Wrapper Non-RetriableError: Panic in wrapped function:", err)
+		return fmt.Errorf("pg.Wrapper Non-RetriableError: %w", err)
 	}
 	// Если ошибки нет
 	return nil
 }
 
 func New(ctx context.Context, conf *initconf.Config) (PgStorage, error) {
+	logger := logging.FromContext(ctx)
 	pg := database.Postgresql{}
-	log.Println("Connecting to database ...", pg)
 	_ = pg.Connect(conf.DatabaseDSN)
 
-	log.Println("creating gauge table")
+	logger.Debugw("creating gauge table")
 	sqlQuery := `CREATE TABLE IF NOT EXISTS gauge (
     	"metric_name" TEXT PRIMARY KEY, 
     	"metric_value" double precision
     	)`
 	err := pgExecWrapper(pg.ExecContext, ctx, sqlQuery)
 	if err != nil {
-		log.Fatal("Error creating table gauge:", err)
+		logger.Fatalw("create table gauge failed", "error", err)
 	}
 
-	log.Println("creating counter table")
+	logger.Debugw("creating counter table")
 	sqlQuery = `CREATE TABLE IF NOT EXISTS counter (
         "metric_name" TEXT PRIMARY KEY,
         "metric_value" BIGINT
       )`
 	err = pgExecWrapper(pg.ExecContext, ctx, sqlQuery)
 	if err != nil {
-		log.Fatal("Error creating table counter:", err)
+		logger.Fatalw("create table counter failed", "error", err)
 	}
 
 	return PgStorage{pg.Cfg, &pg}, nil
 }
 
+// DB подключение к БД хранилища для вспомогательных таблиц сервера
+func (pg PgStorage) DB() database.Database {
+	return pg.pgDB
+}
+
 func (pg PgStorage) UpdateGauge(ctx context.Context, key string, value float64) error {
-	log.Println("UpdateGauge PG")
 	sqlQuery := "INSERT INTO gauge (metric_name, metric_value) VALUES($1,$2) ON CONFLICT(metric_name) DO UPDATE SET metric_name = $1, metric_value = $2"
 	err := pgExecWrapper(pg.pgDB.ExecContext, ctx, sqlQuery, key, value)
 	if err != nil {
-		return fmt.Errorf("%s %v", "error PG update gauge", err)
+		return fmt.Errorf("error PG update gauge: %w", err)
 	}
 	return nil
 }
 
 func (pg PgStorage) UpdateCounter(ctx context.Context, key string, value int64) error {
-	log.Println("UpdateCounter PG")
 	sqlQuery := "INSERT INTO counter (metric_name, metric_value) VALUES($1,$2)" +
 		" ON CONFLICT(metric_name)" +
 		" DO UPDATE SET " +
-		"metric_value = (SELECT metric_value FROM counter WHERE metric_name = $1) + $2"
+		"metric_value = counter.metric_value + EXCLUDED.metric_value"
 	err := pgExecWrapper(pg.pgDB.ExecContext, ctx, sqlQuery, key, value)
 	if err != nil {
-		return fmt.Errorf("%s %v", "error PG update counter", err)
+		return fmt.Errorf("error PG update counter: %w", err)
 	}
 	return nil
 }
 
 func (pg PgStorage) UpdateBatch(ctx context.Context, metrics []storage.Metrics) error {
-	log.Println("UpdatePGBatch: Start Update batch")
+	logger := logging.FromContext(ctx)
 	if len(metrics) == 0 {
-		log.Println("UpdatePGBatch: No metrics to update im []Metrics")
 		return nil
 	}
+	if err := storage.ValidateBatch(metrics); err != nil {
+		logger.Debugw("pgstorage UpdateBatch: invalid batch", "error", err)
+		return err
+	}
 	tx, err := pg.pgDB.BeginTx(ctx, nil)
 	if err != nil {
-		log.Println("UpdatePGBatch: Error begin transaction:", err)
+		logger.Errorw("pgstorage UpdateBatch: begin transaction failed", "error", err)
 		return err
 	}
 	for _, metric := range metrics {
@@ -142,87 +166,69 @@ func (pg PgStorage) UpdateBatch(ctx context.Context, metrics []storage.Metrics)
 				" DO UPDATE SET metric_name = $1, metric_value = $2"
 			err := pgExecWrapper(tx.ExecContext, ctx, sqlQuery, metric.ID, metric.Value)
 			if err != nil {
-				log.Println("UpdatePGBatch Error update gauge:", err)
+				logger.Errorw("pgstorage UpdateBatch: update gauge failed", "metric", metric.ID, "error", err)
 				if err := tx.Rollback(); err != nil {
-					log.Println("UpdatePGBatch. Error rollback:", err)
+					logger.Errorw("pgstorage UpdateBatch: rollback failed", "error", err)
 				}
 				return err
 			}
 		}
 		if metric.MType == "counter" {
-			log.Println("UpdateBatch: PG update counter metric.ID", metric.ID, " by value :", *metric.Delta)
 			sqlQuery := "INSERT INTO counter (metric_name, metric_value) VALUES($1,$2)" +
 				" ON CONFLICT(metric_name)" +
 				" DO UPDATE SET " +
-				"metric_value = (SELECT metric_value FROM counter WHERE metric_name = $1) + $2"
+				"metric_value = counter.metric_value + EXCLUDED.metric_value"
 			err = pgExecWrapper(tx.ExecContext, ctx, sqlQuery, metric.ID, metric.Delta)
 			if err != nil {
-				log.Println("UpdatePGBatch: Error update counter:", err)
+				logger.Errorw("pgstorage UpdateBatch: update counter failed", "metric", metric.ID, "error", err)
 				if err := tx.Rollback(); err != nil {
-					log.Println("UpdatePGBatch: Error rollback:", err)
+					logger.Errorw("pgstorage UpdateBatch: rollback failed", "error", err)
 				}
 				return err
 			}
 		}
 	}
-	log.Println("UpdatePGBatch: End Update batch")
 	return tx.Commit()
 }
 
 // QueryContext раздел
 // pgQueryRowWrapper -- wrapper для SQL запросов типа QueryRowContext
 func pgQueryRowWrapper(f func(ctx context.Context, query string, args ...any) *sql.Row, ctx context.Context, sqlQuery string, args ...any) *sql.Row {
-	row := f(ctx, sqlQuery, args...)
-	// Если ошибка retriable
-	if pgErrorRetriable(row.Err()) {
-		for i, t := range timeoutsRetryConst {
-			log.Println("pg.Wrapper, RetriableError: Trying to recover after ", t, "seconds, attempt number ", i+1)
-			time.Sleep(time.Duration(t) * time.Second)
-			row := f(ctx, sqlQuery, args...)
-			if row.Err() != nil {
-				if i == 2 {
-					log.Println("pgQueryWrapper RetriableError: Panic in wrapped function:", row.Err())
-				}
-				continue
-			}
-			log.Println("pgQueryWrapper RetriableError: attempt ", i+1, "success")
-			return row
-		}
-	}
-	// Если ошибка non-retriable
-	if row.Err() != nil {
-		log.Println("pg.Wrapper Non-RetriableError: Panic in wrapped function:", row.Err())
+	ctx, span := startSpan(ctx, "pg.query", sqlQuery)
+	defer span.End()
+	// Ошибка *sql.Row возвращается через Scan, поэтому при исчерпании попыток возвращается последний row
+	row, err := retry.DoValue(ctx, pgPolicy, pgErrorRetriable, func(ctx context.Context) (*sql.Row, error) {
+		row := f(ctx, sqlQuery, args...)
+		return row, row.Err()
+	})
+	if err != nil {
+		logging.FromContext(ctx).Warnw("pgstorage query failed", "error", err)
+		tracing.RecordError(span, err)
 	}
-	// Если ошибки нет
 	return row
 }
 
 func (pg PgStorage) GetGauge(ctx context.Context, key string) (float64, error) {
-	log.Println("GetGauge PG")
 	sqlQuery := "SELECT metric_value FROM gauge WHERE metric_name = $1"
 	row := pgQueryRowWrapper(pg.pgDB.QueryRowContext, ctx, sqlQuery, key)
 	var metricValue float64
 	if err := row.Scan(&metricValue); err != nil {
-		log.Println("Error PG get gauge:", err)
-		return -1, fmt.Errorf("%s %v", "Error PG get gauge:", err)
+		return 0, pgScanError("pgstorage.GetGauge", key, err)
 	}
 	return metricValue, nil
 }
 
 func (pg PgStorage) GetCounter(ctx context.Context, key string) (int64, error) {
-	log.Println("GetCounter PG for key ", key)
 	sqlQuery := "SELECT metric_value FROM counter WHERE metric_name = $1"
 	row := pgQueryRowWrapper(pg.pgDB.QueryRowContext, ctx, sqlQuery, key)
 	var metricValue int64
 	if err := row.Scan(&metricValue); err != nil {
-		log.Println("Error PG get counter:", err)
-		return -1, fmt.Errorf("%s %v", "Error PG get counter:", err)
+		return 0, pgScanError("pgstorage.GetCounter", key, err)
 	}
 	return metricValue, nil
 }
 
 func (pg PgStorage) GetValue(ctx context.Context, t string, key string) (any, error) {
-	log.Println("GetValue PG")
 	var row *sql.Row
 	if t == "gauge" {
 		sqlQuery := "SELECT metric_value FROM gauge WHERE metric_name = $1"
@@ -231,12 +237,11 @@ func (pg PgStorage) GetValue(ctx context.Context, t string, key string) (any, er
 		sqlQuery := "SELECT metric_value FROM counter WHERE metric_name = $1"
 		row = pgQueryRowWrapper(pg.pgDB.QueryRowContext, ctx, sqlQuery, key)
 	} else {
-		return nil, errors.New("wrong metric type")
+		return nil, apperr.WrongType("pgstorage.GetValue", t)
 	}
 	var metricValue any
 	if err := row.Scan(&metricValue); err != nil {
-		log.Println("Error PG GetValue:", err)
-		return -1, fmt.Errorf("%s %v", "Error PG GetValue:", err)
+		return nil, pgScanError("pgstorage.GetValue", key, err)
 	}
 	return metricValue, nil
 }
@@ -249,33 +254,25 @@ type tmpStor struct {
 // QueryContext раздел
 // pgQueryWrapper -- wrapper для SQL запросов типа QueryContext
 func pgQueryWrapper(f func(ctx context.Context, query string, args ...any) (*sql.Rows, error), ctx context.Context, sqlQuery string, args ...any) (*sql.Rows, error) {
-	rows, err := f(ctx, sqlQuery, args...)
-	// Если ошибка retriable
+	ctx, span := startSpan(ctx, "pg.query", sqlQuery)
+	defer span.End()
+	rows, err := retry.DoValue(ctx, pgPolicy, pgErrorRetriable, func(ctx context.Context) (*sql.Rows, error) {
+		return f(ctx, sqlQuery, args...)
+	})
+	tracing.RecordError(span, err)
+	// Если ошибка retriable и попытки исчерпаны
 	if pgErrorRetriable(err) {
-		for i, t := range timeoutsRetryConst {
-			log.Println("pg.Wrapper, RetriableError: Trying to recover after ", t, "seconds, attempt number ", i+1)
-			time.Sleep(time.Duration(t) * time.Second)
-			rows, err := f(ctx, sqlQuery, args...)
-			if err != nil {
-				if i == 2 {
-					return nil, fmt.Errorf("%s %v", "pgQueryWrapper RetriableError: Panic in wrapped function:", err)
-				}
-				continue
-			}
-			log.Println("pgQueryWrapper RetriableError: attempt ", i+1, "success")
-			return rows, nil
-		}
+		return nil, apperr.Retriable("pgQueryWrapper", err)
 	}
 	// Если ошибка non-retriable
 	if err != nil {
-		return nil, fmt.Errorf("%s %v", "pg.Wrapper Non-RetriableError: Panic in wrapped function:", err)
+		return nil, fmt.Errorf("pgQueryWrapper Non-RetriableError: %w", err)
 	}
 	// Если ошибки нет
 	return rows, nil
 }
 
 func (pg PgStorage) GetAllMetrics(ctx context.Context) (any, error) {
-	log.Println("GetAllMetrics PG")
 	var rows *sql.Rows
 
 	stor := tmpStor{
@@ -287,7 +284,7 @@ func (pg PgStorage) GetAllMetrics(ctx context.Context) (any, error) {
 	sqlQuery := "SELECT metric_name, metric_value FROM gauge"
 	rows, err := pgQueryWrapper(pg.pgDB.QueryContext, ctx, sqlQuery)
 	if err != nil {
-		return -1, err
+		return nil, err
 	}
 	for rows.Next() {
 		var gauge struct {
@@ -297,7 +294,7 @@ func (pg PgStorage) GetAllMetrics(ctx context.Context) (any, error) {
 
 		err = rows.Scan(&gauge.key, &gauge.value)
 		if err != nil {
-			return -1, err
+			return nil, err
 		}
 		stor.GaugeMap[gauge.key] = gauge.value
 	}
@@ -309,7 +306,7 @@ func (pg PgStorage) GetAllMetrics(ctx context.Context) (any, error) {
 	sqlQuery = "SELECT metric_name, metric_value FROM counter"
 	rows, err = pgQueryWrapper(pg.pgDB.QueryContext, ctx, sqlQuery)
 	if err != nil {
-		return -1, err
+		return nil, err
 	}
 	for rows.Next() {
 		var counter struct {
@@ -319,7 +316,7 @@ func (pg PgStorage) GetAllMetrics(ctx context.Context) (any, error) {
 
 		err = rows.Scan(&counter.key, &counter.value)
 		if err != nil {
-			return -1, err
+			return nil, err
 		}
 		stor.CounterMap[counter.key] = counter.value
 	}
@@ -333,3 +330,8 @@ func (pg PgStorage) GetAllMetrics(ctx context.Context) (any, error) {
 func (pg PgStorage) Close() error {
 	return pg.pgDB.Close()
 }
+
+// Truncate удаление всех метрик из таблиц gauge и counter
+func (pg PgStorage) Truncate(ctx context.Context) error {
+	return pgExecWrapper(pg.pgDB.ExecContext, ctx, "TRUNCATE TABLE gauge, counter")
+}
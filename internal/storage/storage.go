@@ -1,8 +1,40 @@
 package storage
 
+import (
+	"errors"
+	"logger/internal/apperr"
+)
+
 type Metrics struct {
 	ID    string   `json:"id"`              // Имя метрики.
 	MType string   `json:"type"`            // Параметр, принимающий значение gauge или counter.
 	Delta *int64   `json:"delta,omitempty"` // Значение метрики в случае передачи counter.
 	Value *float64 `json:"value,omitempty"` // Значение метрики в случае передачи gauge.
 }
+
+// Validate проверка корректности метрики для записи в хранилище: известный тип и наличие значения этого типа
+func (m Metrics) Validate() error {
+	switch m.MType {
+	case "gauge":
+		if m.Value == nil {
+			return apperr.InvalidValue("storage.Validate", errors.New("no value for gauge "+m.ID))
+		}
+	case "counter":
+		if m.Delta == nil {
+			return apperr.InvalidValue("storage.Validate", errors.New("no delta for counter "+m.ID))
+		}
+	default:
+		return apperr.WrongType("storage.Validate", m.MType)
+	}
+	return nil
+}
+
+// ValidateBatch проверка всех метрик batch-а до начала записи, чтобы batch применялся либо целиком, либо никак
+func ValidateBatch(metrics []Metrics) error {
+	for _, m := range metrics {
+		if err := m.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
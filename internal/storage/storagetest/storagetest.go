@@ -0,0 +1,213 @@
+// Package storagetest общий набор тестов на соответствие поведению интерфейса handlers.Storager.
+// Каждый backend хранилища метрик запускает его из своих тестов через Run, передавая фабрику пустого хранилища.
+package storagetest
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"logger/internal/handlers"
+	"logger/internal/storage"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// Factory функция создания нового пустого хранилища для отдельного теста.
+// Освобождение ресурсов хранилища регистрируется фабрикой через t.Cleanup
+type Factory func(t *testing.T) handlers.Storager
+
+// Параметры теста конкурентного доступа
+const (
+	workers    = 8
+	iterations = 50
+)
+
+// Run запуск всего набора тестов соответствия для хранилища, создаваемого newStore
+func Run(t *testing.T, newStore Factory) {
+	t.Run("GaugeUpsert", func(t *testing.T) { testGaugeUpsert(t, newStore(t)) })
+	t.Run("CounterAccumulation", func(t *testing.T) { testCounterAccumulation(t, newStore(t)) })
+	t.Run("SeparateNamespaces", func(t *testing.T) { testSeparateNamespaces(t, newStore(t)) })
+	t.Run("Batch", func(t *testing.T) { testBatch(t, newStore(t)) })
+	t.Run("EmptyBatch", func(t *testing.T) { testEmptyBatch(t, newStore(t)) })
+	t.Run("BatchAtomicity", func(t *testing.T) { testBatchAtomicity(t, newStore(t)) })
+	t.Run("MissingKey", func(t *testing.T) { testMissingKey(t, newStore(t)) })
+	t.Run("GetValueDispatch", func(t *testing.T) { testGetValueDispatch(t, newStore(t)) })
+	t.Run("GetAllMetrics", func(t *testing.T) { testGetAllMetrics(t, newStore(t)) })
+	t.Run("Concurrency", func(t *testing.T) { testConcurrency(t, newStore(t)) })
+}
+
+func gauge(id string, v float64) storage.Metrics {
+	return storage.Metrics{ID: id, MType: "gauge", Value: &v}
+}
+
+func counter(id string, d int64) storage.Metrics {
+	return storage.Metrics{ID: id, MType: "counter", Delta: &d}
+}
+
+// testGaugeUpsert повторное обновление gauge заменяет значение
+func testGaugeUpsert(t *testing.T, store handlers.Storager) {
+	ctx := context.Background()
+	require.NoError(t, store.UpdateGauge(ctx, "g1", 1.5))
+	require.NoError(t, store.UpdateGauge(ctx, "g1", -2.25))
+	got, err := store.GetGauge(ctx, "g1")
+	require.NoError(t, err)
+	assert.Equal(t, -2.25, got)
+}
+
+// testCounterAccumulation обновление counter прибавляет delta к текущему значению
+func testCounterAccumulation(t *testing.T, store handlers.Storager) {
+	ctx := context.Background()
+	for _, d := range []int64{1, 2, 3, -1} {
+		require.NoError(t, store.UpdateCounter(ctx, "c1", d))
+	}
+	got, err := store.GetCounter(ctx, "c1")
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), got)
+}
+
+// testSeparateNamespaces метрики разных типов с одинаковым именем не пересекаются
+func testSeparateNamespaces(t *testing.T, store handlers.Storager) {
+	ctx := context.Background()
+	require.NoError(t, store.UpdateGauge(ctx, "m", 7.7))
+	require.NoError(t, store.UpdateCounter(ctx, "m", 7))
+	g, err := store.GetGauge(ctx, "m")
+	require.NoError(t, err)
+	assert.Equal(t, 7.7, g)
+	c, err := store.GetCounter(ctx, "m")
+	require.NoError(t, err)
+	assert.Equal(t, int64(7), c)
+}
+
+// testBatch повторы метрик в одном batch-е: gauge -- последнее значение, counter -- сумма delta
+func testBatch(t *testing.T, store handlers.Storager) {
+	ctx := context.Background()
+	require.NoError(t, store.UpdateCounter(ctx, "c1", 10))
+	batch := []storage.Metrics{
+		gauge("g1", 1.1),
+		counter("c1", 1),
+		gauge("g1", 2.2),
+		counter("c1", 2),
+		counter("c2", 5),
+	}
+	require.NoError(t, store.UpdateBatch(ctx, batch))
+
+	g, err := store.GetGauge(ctx, "g1")
+	require.NoError(t, err)
+	assert.Equal(t, 2.2, g)
+	c, err := store.GetCounter(ctx, "c1")
+	require.NoError(t, err)
+	assert.Equal(t, int64(13), c)
+	c, err = store.GetCounter(ctx, "c2")
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), c)
+}
+
+func testEmptyBatch(t *testing.T, store handlers.Storager) {
+	assert.NoError(t, store.UpdateBatch(context.Background(), nil))
+	assert.NoError(t, store.UpdateBatch(context.Background(), []storage.Metrics{}))
+}
+
+// testBatchAtomicity batch с некорректной метрикой не применяется целиком
+func testBatchAtomicity(t *testing.T, store handlers.Storager) {
+	ctx := context.Background()
+	require.NoError(t, store.UpdateCounter(ctx, "c1", 1))
+
+	invalid := [][]storage.Metrics{
+		{counter("c1", 1), gauge("g1", 1), {ID: "c2", MType: "counter"}},
+		{counter("c1", 1), gauge("g1", 1), {ID: "g2", MType: "gauge"}},
+		{counter("c1", 1), gauge("g1", 1), {ID: "b1", MType: "bool", Value: new(float64)}},
+	}
+	for i, batch := range invalid {
+		assert.Error(t, store.UpdateBatch(ctx, batch), "invalid batch %d must be rejected", i)
+	}
+
+	c, err := store.GetCounter(ctx, "c1")
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), c, "counter must not be changed by rejected batch")
+	_, err = store.GetGauge(ctx, "g1")
+	assert.Error(t, err, "gauge from rejected batch must not be stored")
+}
+
+// testMissingKey запрос отсутствующей метрики возвращает ошибку и нулевое значение
+func testMissingKey(t *testing.T, store handlers.Storager) {
+	ctx := context.Background()
+	g, err := store.GetGauge(ctx, "absent")
+	assert.Error(t, err)
+	assert.Equal(t, float64(0), g)
+
+	c, err := store.GetCounter(ctx, "absent")
+	assert.Error(t, err)
+	assert.Equal(t, int64(0), c)
+
+	for _, mType := range []string{"gauge", "counter"} {
+		v, err := store.GetValue(ctx, mType, "absent")
+		assert.Error(t, err)
+		assert.Nil(t, v, "GetValue must return nil value for missing %s", mType)
+	}
+}
+
+// testGetValueDispatch GetValue возвращает значение типа, соответствующего типу метрики
+func testGetValueDispatch(t *testing.T, store handlers.Storager) {
+	ctx := context.Background()
+	require.NoError(t, store.UpdateGauge(ctx, "g1", 3.5))
+	require.NoError(t, store.UpdateCounter(ctx, "c1", 4))
+
+	v, err := store.GetValue(ctx, "gauge", "g1")
+	require.NoError(t, err)
+	assert.IsType(t, float64(0), v)
+	assert.Equal(t, 3.5, v)
+
+	v, err = store.GetValue(ctx, "counter", "c1")
+	require.NoError(t, err)
+	assert.IsType(t, int64(0), v)
+	assert.Equal(t, int64(4), v)
+
+	v, err = store.GetValue(ctx, "counter", "g1")
+	assert.Error(t, err)
+	assert.Nil(t, v)
+
+	v, err = store.GetValue(ctx, "bool", "g1")
+	assert.Error(t, err)
+	assert.Nil(t, v)
+}
+
+func testGetAllMetrics(t *testing.T, store handlers.Storager) {
+	ctx := context.Background()
+	require.NoError(t, store.UpdateGauge(ctx, "g1", 1))
+	require.NoError(t, store.UpdateCounter(ctx, "c1", 1))
+	all, err := store.GetAllMetrics(ctx)
+	require.NoError(t, err)
+	assert.NotNil(t, all)
+}
+
+// testConcurrency конкурентные обновления и чтения не теряют изменений counter-ов
+func testConcurrency(t *testing.T, store handlers.Storager) {
+	ctx := context.Background()
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			name := "g" + strconv.Itoa(w)
+			for i := 0; i < iterations; i++ {
+				assert.NoError(t, store.UpdateCounter(ctx, "c", 1))
+				assert.NoError(t, store.UpdateGauge(ctx, name, float64(i)))
+				assert.NoError(t, store.UpdateBatch(ctx, []storage.Metrics{counter("c", 1), gauge(name, float64(i))}))
+				_, _ = store.GetCounter(ctx, "c")
+				_, _ = store.GetValue(ctx, "gauge", name)
+				_, _ = store.GetAllMetrics(ctx)
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	c, err := store.GetCounter(ctx, "c")
+	require.NoError(t, err)
+	assert.Equal(t, int64(2*workers*iterations), c)
+	for w := 0; w < workers; w++ {
+		g, err := store.GetGauge(ctx, "g"+strconv.Itoa(w))
+		require.NoError(t, err)
+		assert.Equal(t, float64(iterations-1), g)
+	}
+}
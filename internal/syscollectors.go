@@ -0,0 +1,220 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/shirou/gopsutil/v4/disk"
+	"github.com/shirou/gopsutil/v4/load"
+	"github.com/shirou/gopsutil/v4/mem"
+	"github.com/shirou/gopsutil/v4/net"
+	"github.com/shirou/gopsutil/v4/process"
+	"logger/internal/collector"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Коллекторы системных метрик через gopsutil. На Linux все значения читаются из /proc
+// (или из каталога, заданного переменной окружения HOST_PROC, при запуске агента в контейнере).
+// Накопительные счетчики ОС (байты и операции ввода-вывода) отсылаются как gauge:
+// сервер суммирует counter-ы, а значение счетчика ОС уже является итоговым
+
+// metricSuffix преобразование имени точки монтирования, устройства или процесса в суффикс имени метрики
+func metricSuffix(s string) string {
+	s = strings.Trim(s, "/")
+	if s == "" {
+		return "root"
+	}
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == '-' {
+			return r
+		}
+		return '_'
+	}, s)
+}
+
+// hostProc путь к файлу в /proc с учетом HOST_PROC
+func hostProc(elem ...string) string {
+	root := os.Getenv("HOST_PROC")
+	if root == "" {
+		root = "/proc"
+	}
+	return filepath.Join(append([]string{root}, elem...)...)
+}
+
+// LoadMetricPolling средняя загрузка системы за 1, 5 и 15 минут
+func LoadMetricPolling(ctx context.Context, metrics collector.Sink) error {
+	avg, err := load.AvgWithContext(ctx)
+	if err != nil {
+		return fmt.Errorf("LoadMetricPolling: %w", err)
+	}
+	metrics.SetGauge("Load1", avg.Load1)
+	metrics.SetGauge("Load5", avg.Load5)
+	metrics.SetGauge("Load15", avg.Load15)
+	return nil
+}
+
+// SwapMetricPolling использование swap
+func SwapMetricPolling(ctx context.Context, metrics collector.Sink) error {
+	s, err := mem.SwapMemoryWithContext(ctx)
+	if err != nil {
+		return fmt.Errorf("SwapMetricPolling: %w", err)
+	}
+	metrics.SetGauge("SwapTotal", float64(s.Total))
+	metrics.SetGauge("SwapUsed", float64(s.Used))
+	metrics.SetGauge("SwapFree", float64(s.Free))
+	return nil
+}
+
+// DiskMetricPolling заполненность каждой физической точки монтирования и ввод-вывод каждого блочного устройства
+func DiskMetricPolling(ctx context.Context, metrics collector.Sink) error {
+	partitions, err := disk.PartitionsWithContext(ctx, false)
+	if err != nil {
+		return fmt.Errorf("DiskMetricPolling: partitions: %w", err)
+	}
+	var errs []error
+	for _, p := range partitions {
+		u, err := disk.UsageWithContext(ctx, p.Mountpoint)
+		if err != nil {
+			// Недоступная точка монтирования не мешает сбору остальных
+			errs = append(errs, fmt.Errorf("usage of %s: %w", p.Mountpoint, err))
+			continue
+		}
+		suffix := metricSuffix(p.Mountpoint)
+		metrics.SetGauge("DiskTotal_"+suffix, float64(u.Total))
+		metrics.SetGauge("DiskUsed_"+suffix, float64(u.Used))
+		metrics.SetGauge("DiskUsedPercent_"+suffix, u.UsedPercent)
+	}
+
+	counters, err := disk.IOCountersWithContext(ctx)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("io counters: %w", err))
+	}
+	for name, c := range counters {
+		suffix := metricSuffix(name)
+		metrics.SetGauge("DiskReadBytes_"+suffix, float64(c.ReadBytes))
+		metrics.SetGauge("DiskWriteBytes_"+suffix, float64(c.WriteBytes))
+		metrics.SetGauge("DiskReadCount_"+suffix, float64(c.ReadCount))
+		metrics.SetGauge("DiskWriteCount_"+suffix, float64(c.WriteCount))
+	}
+	if err := errors.Join(errs...); err != nil {
+		return fmt.Errorf("DiskMetricPolling: %w", err)
+	}
+	return nil
+}
+
+// NetMetricPolling переданные и принятые байты и пакеты каждого сетевого интерфейса
+func NetMetricPolling(ctx context.Context, metrics collector.Sink) error {
+	counters, err := net.IOCountersWithContext(ctx, true)
+	if err != nil {
+		return fmt.Errorf("NetMetricPolling: %w", err)
+	}
+	for _, c := range counters {
+		suffix := metricSuffix(c.Name)
+		metrics.SetGauge("NetBytesSent_"+suffix, float64(c.BytesSent))
+		metrics.SetGauge("NetBytesRecv_"+suffix, float64(c.BytesRecv))
+		metrics.SetGauge("NetPacketsSent_"+suffix, float64(c.PacketsSent))
+		metrics.SetGauge("NetPacketsRecv_"+suffix, float64(c.PacketsRecv))
+	}
+	return nil
+}
+
+// parseFileNr разбор /proc/sys/fs/file-nr: выделенные дескрипторы, свободные выделенные дескрипторы, максимум
+func parseFileNr(data string) (allocated, free, maxFiles uint64, err error) {
+	fields := strings.Fields(data)
+	if len(fields) != 3 {
+		return 0, 0, 0, fmt.Errorf("unexpected file-nr format: %q", data)
+	}
+	values := make([]uint64, 3)
+	for i, f := range fields {
+		if values[i], err = strconv.ParseUint(f, 10, 64); err != nil {
+			return 0, 0, 0, fmt.Errorf("unexpected file-nr value %q: %w", f, err)
+		}
+	}
+	return values[0], values[1], values[2], nil
+}
+
+// FDMetricPolling количество открытых файловых дескрипторов в системе и их максимум
+func FDMetricPolling(_ context.Context, metrics collector.Sink) error {
+	data, err := os.ReadFile(hostProc("sys", "fs", "file-nr"))
+	if err != nil {
+		return fmt.Errorf("FDMetricPolling: %w", err)
+	}
+	allocated, free, maxFiles, err := parseFileNr(string(data))
+	if err != nil {
+		return fmt.Errorf("FDMetricPolling: %w", err)
+	}
+	metrics.SetGauge("FileDescriptorsUsed", float64(allocated-free))
+	metrics.SetGauge("FileDescriptorsMax", float64(maxFiles))
+	return nil
+}
+
+// processCollector коллектор потребления памяти и CPU процессами с заданными именами.
+// Значения процессов с одинаковым именем суммируются
+type processCollector struct {
+	names []string
+	// mu защищает procs: сбор, прерванный по таймауту, продолжает работу в своей горутине
+	// одновременно со сбором следующего интервала
+	mu sync.Mutex
+	// Процессы с прошлого сбора: загрузка CPU считается как разница времени CPU между сборами
+	procs map[int32]*process.Process
+}
+
+// errCollectInProgress предыдущий сбор еще не завершился
+var errCollectInProgress = errors.New("previous collection is still running")
+
+func newProcessCollector(names []string) *processCollector {
+	return &processCollector{names: names, procs: make(map[int32]*process.Process)}
+}
+
+func (pc *processCollector) Name() string { return "process" }
+
+func (pc *processCollector) Collect(ctx context.Context, metrics collector.Sink) error {
+	// Сбор пропускается, пока не завершился предыдущий: ожидание блокировки копило бы зависшие горутины
+	if !pc.mu.TryLock() {
+		return fmt.Errorf("ProcessMetricPolling: %w", errCollectInProgress)
+	}
+	defer pc.mu.Unlock()
+	list, err := process.ProcessesWithContext(ctx)
+	if err != nil {
+		return fmt.Errorf("ProcessMetricPolling: %w", err)
+	}
+	rss := make(map[string]uint64, len(pc.names))
+	cpuPercent := make(map[string]float64, len(pc.names))
+	count := make(map[string]int, len(pc.names))
+	seen := make(map[int32]*process.Process)
+	for _, p := range list {
+		name, err := p.NameWithContext(ctx)
+		// Процесс мог завершиться после получения списка
+		if err != nil || !slices.Contains(pc.names, name) {
+			continue
+		}
+		if prev, ok := pc.procs[p.Pid]; ok {
+			p = prev
+		}
+		m, err := p.MemoryInfoWithContext(ctx)
+		if err != nil {
+			continue
+		}
+		seen[p.Pid] = p
+		count[name]++
+		rss[name] += m.RSS
+		// При первом сборе процесса Percent возвращает 0, загрузка считается со следующего сбора
+		if c, err := p.PercentWithContext(ctx, 0); err == nil {
+			cpuPercent[name] += c
+		}
+	}
+	pc.procs = seen
+
+	for _, name := range pc.names {
+		suffix := metricSuffix(name)
+		metrics.SetGauge("ProcessCount_"+suffix, float64(count[name]))
+		metrics.SetGauge("ProcessRSS_"+suffix, float64(rss[name]))
+		metrics.SetGauge("ProcessCPU_"+suffix, cpuPercent[name])
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package internal
+
+import (
+	"context"
+	"github.com/shirou/gopsutil/v4/process"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"runtime"
+	"testing"
+)
+
+func Test_metricSuffix(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{name: "/", want: "root"},
+		{name: "/var/lib/docker", want: "var_lib_docker"},
+		{name: "sda1", want: "sda1"},
+		{name: "br-1a2b.100", want: "br-1a2b_100"},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, metricSuffix(tt.name))
+	}
+}
+
+func Test_parseFileNr(t *testing.T) {
+	allocated, free, maxFiles, err := parseFileNr("1472\t0\t9223372036854775807\n")
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1472), allocated)
+	assert.Equal(t, uint64(0), free)
+	assert.Equal(t, uint64(9223372036854775807), maxFiles)
+
+	_, _, _, err = parseFileNr("1472 0")
+	assert.Error(t, err)
+	_, _, _, err = parseFileNr("a b c")
+	assert.Error(t, err)
+}
+
+func TestSystemCollectors(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("system collectors are tested on Linux only")
+	}
+	tests := []struct {
+		name     string
+		poll     func(ctx context.Context, metrics *MetricsStorage) error
+		wantKeys []string
+	}{
+		{
+			name:     "gops",
+			poll:     func(_ context.Context, m *MetricsStorage) error { return GopsMetricPolling(m) },
+			wantKeys: []string{"TotalMemory", "FreeMemory", "CPUutilization1"},
+		},
+		{
+			name:     "load",
+			poll:     func(ctx context.Context, m *MetricsStorage) error { return LoadMetricPolling(ctx, m) },
+			wantKeys: []string{"Load1", "Load5", "Load15"},
+		},
+		{
+			name:     "swap",
+			poll:     func(ctx context.Context, m *MetricsStorage) error { return SwapMetricPolling(ctx, m) },
+			wantKeys: []string{"SwapTotal", "SwapUsed", "SwapFree"},
+		},
+		{
+			name:     "net",
+			poll:     func(ctx context.Context, m *MetricsStorage) error { return NetMetricPolling(ctx, m) },
+			wantKeys: []string{"NetBytesRecv_lo", "NetPacketsSent_lo"},
+		},
+		{
+			name:     "fd",
+			poll:     func(ctx context.Context, m *MetricsStorage) error { return FDMetricPolling(ctx, m) },
+			wantKeys: []string{"FileDescriptorsUsed", "FileDescriptorsMax"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			metrics := NewMetricsStorageObj()
+			require.NoError(t, tt.poll(context.Background(), &metrics))
+			for _, key := range tt.wantKeys {
+				assert.Contains(t, metrics.gaugeMap, key)
+			}
+		})
+	}
+}
+
+func TestProcessCollector(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("process collector is tested on Linux only")
+	}
+	self, err := process.NewProcess(int32(os.Getpid()))
+	require.NoError(t, err)
+	name, err := self.Name()
+	require.NoError(t, err)
+
+	pc := newProcessCollector([]string{name, "no-such-process"})
+	metrics := NewMetricsStorageObj()
+	for i := 0; i < 2; i++ {
+		require.NoError(t, pc.Collect(context.Background(), &metrics))
+	}
+	suffix := metricSuffix(name)
+	assert.GreaterOrEqual(t, metrics.gaugeMap["ProcessCount_"+suffix], float64(1))
+	assert.Greater(t, metrics.gaugeMap["ProcessRSS_"+suffix], float64(0))
+	assert.Contains(t, metrics.gaugeMap, "ProcessCPU_"+suffix)
+	assert.Equal(t, float64(0), metrics.gaugeMap["ProcessCount_no-such-process"])
+
+	// Сбор, начатый до завершения предыдущего, пропускается
+	pc.mu.Lock()
+	assert.ErrorIs(t, pc.Collect(context.Background(), &metrics), errCollectInProgress)
+	pc.mu.Unlock()
+}
@@ -0,0 +1,180 @@
+// Package tlsconf TLS конфигурация сервера и агента. Сертификат и ключ читаются из файлов и перечитываются
+// при их изменении, поэтому обновленный сертификат применяется без перезапуска. Если задан CA клиентов,
+// сервер требует клиентский сертификат (mTLS), и CN сертификата становится идентификатором агента.
+package tlsconf
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"logger/internal/logging"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// identityKey ключ идентификатора агента в gin.Context
+const identityKey = "tlsconf.identity"
+
+// reloadCheckInterval интервал, чаще которого файлы сертификата не проверяются на изменение
+const reloadCheckInterval = 10 * time.Second
+
+// CertReloader сертификат из файлов certFile и keyFile, перечитываемых при изменении
+type CertReloader struct {
+	certFile string
+	keyFile  string
+
+	mu        sync.Mutex
+	cert      *tls.Certificate
+	certMod   time.Time
+	keyMod    time.Time
+	checkedAt time.Time
+	now       func() time.Time
+}
+
+// NewCertReloader загрузка сертификата. Ошибка, если файлы не читаются или сертификат не соответствует ключу
+func NewCertReloader(certFile string, keyFile string) (*CertReloader, error) {
+	r := &CertReloader{certFile: certFile, keyFile: keyFile, now: time.Now}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// reload чтение сертификата, если файлы изменились. Вызывается под r.mu
+func (r *CertReloader) reload() error {
+	r.checkedAt = r.now()
+	certInfo, err := os.Stat(r.certFile)
+	if err != nil {
+		return fmt.Errorf("tlsconf: stat certificate: %w", err)
+	}
+	keyInfo, err := os.Stat(r.keyFile)
+	if err != nil {
+		return fmt.Errorf("tlsconf: stat key: %w", err)
+	}
+	if r.cert != nil && certInfo.ModTime().Equal(r.certMod) && keyInfo.ModTime().Equal(r.keyMod) {
+		return nil
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("tlsconf: load certificate: %w", err)
+	}
+	r.cert, r.certMod, r.keyMod = &cert, certInfo.ModTime(), keyInfo.ModTime()
+	return nil
+}
+
+// Certificate текущий сертификат. Ошибка чтения измененных файлов (например, сертификат записан, а ключ еще нет)
+// пишется в лог, и используется ранее загруженный сертификат
+func (r *CertReloader) Certificate() *tls.Certificate {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.now().Sub(r.checkedAt) >= reloadCheckInterval {
+		if err := r.reload(); err != nil {
+			logging.L().Warnw("tlsconf: certificate reload failed, keep previous certificate", "cert", r.certFile, "error", err)
+		}
+	}
+	return r.cert
+}
+
+// GetCertificate реализация tls.Config.GetCertificate
+func (r *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return r.Certificate(), nil
+}
+
+// GetClientCertificate реализация tls.Config.GetClientCertificate
+func (r *CertReloader) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return r.Certificate(), nil
+}
+
+// loadPool пул сертификатов CA из PEM файла file
+func loadPool(file string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("tlsconf: read CA bundle: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("tlsconf: no certificates found in %s", file)
+	}
+	return pool, nil
+}
+
+// Server TLS конфигурация сервера с сертификатом certFile и ключом keyFile. Если clientCAFile не пуст,
+// клиенты должны предъявить сертификат, подписанный одним из CA из этого файла
+func Server(certFile string, keyFile string, clientCAFile string) (*tls.Config, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("tlsconf: both certificate and key files are required")
+	}
+	reloader, err := NewCertReloader(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.GetCertificate,
+	}
+	if clientCAFile != "" {
+		pool, err := loadPool(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, nil
+}
+
+// Client TLS конфигурация агента. caFile -- CA bundle для проверки сертификата сервера, пустая строка --
+// системные CA. certFile и keyFile -- клиентский сертификат для mTLS, пустые строки -- без сертификата
+func Client(caFile string, certFile string, keyFile string) (*tls.Config, error) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		pool, err := loadPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = pool
+	}
+	if certFile != "" || keyFile != "" {
+		if certFile == "" || keyFile == "" {
+			return nil, errors.New("tlsconf: both client certificate and key files are required")
+		}
+		reloader, err := NewCertReloader(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.GetClientCertificate = reloader.GetClientCertificate
+	}
+	return cfg, nil
+}
+
+// PeerIdentity CN проверенного клиентского сертификата запроса r. Пустая строка, если запрос без mTLS
+func PeerIdentity(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	return r.TLS.VerifiedChains[0][0].Subject.CommonName
+}
+
+// Middleware сохранение идентификатора агента из клиентского сертификата в gin.Context
+// и добавление его в логгер контекста запроса
+func Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if id := PeerIdentity(c.Request); id != "" {
+			c.Set(identityKey, id)
+			ctx := c.Request.Context()
+			c.Request = c.Request.WithContext(logging.WithLogger(ctx, logging.FromContext(ctx).With("agent", id)))
+		}
+		c.Next()
+	}
+}
+
+// Identity идентификатор агента запроса, сохраненный Middleware. Пустая строка, если запрос без mTLS
+func Identity(c *gin.Context) string {
+	return c.GetString(identityKey)
+}
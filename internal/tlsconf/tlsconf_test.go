@@ -0,0 +1,172 @@
+package tlsconf
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCA самоподписанный CA, выпускающий сертификаты в тестах
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	file string
+}
+
+func newTestCA(t *testing.T, dir string, name string) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	file := filepath.Join(dir, name+".pem")
+	require.NoError(t, os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	return &testCA{cert: cert, key: key, file: file}
+}
+
+// issue выпуск сертификата с CN cn в файлы dir/name.crt и dir/name.key
+func (ca *testCA) issue(t *testing.T, dir string, name string, cn string, serial int64) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	certFile, keyFile := filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+	return certFile, keyFile
+}
+
+// newServer https сервер, отвечающий идентификатором агента из клиентского сертификата. Возвращает URL сервера
+func newServer(t *testing.T, certFile, keyFile, clientCA string) string {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(Middleware())
+	router.GET("/", func(c *gin.Context) { c.String(http.StatusOK, Identity(c)) })
+	cfg, err := Server(certFile, keyFile, clientCA)
+	require.NoError(t, err)
+	// httptest.Server подставляет собственный сертификат, поэтому сервер запускается так же, как в cmd/server
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	srv := &http.Server{Handler: router, TLSConfig: cfg, ErrorLog: log.New(io.Discard, "", 0)}
+	go func() { _ = srv.ServeTLS(ln, "", "") }()
+	t.Cleanup(func() { _ = srv.Close() })
+	return "https://" + ln.Addr().String()
+}
+
+func get(t *testing.T, url string, caFile, certFile, keyFile string) (string, error) {
+	cfg, err := Client(caFile, certFile, keyFile)
+	require.NoError(t, err)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: cfg}}
+	resp, err := client.Get(url)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body := make([]byte, 64)
+	n, _ := resp.Body.Read(body)
+	return string(body[:n]), nil
+}
+
+func TestTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t, dir, "ca")
+	certFile, keyFile := ca.issue(t, dir, "server", "server", 2)
+	url := newServer(t, certFile, keyFile, "")
+
+	body, err := get(t, url, ca.file, "", "")
+	require.NoError(t, err)
+	assert.Empty(t, body, "no identity without client certificate")
+
+	// Сертификат сервера не подписан системными CA
+	_, err = get(t, url, "", "", "")
+	assert.Error(t, err)
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t, dir, "ca")
+	certFile, keyFile := ca.issue(t, dir, "server", "server", 2)
+	clientCert, clientKey := ca.issue(t, dir, "agent", "agent-01", 3)
+	url := newServer(t, certFile, keyFile, ca.file)
+
+	body, err := get(t, url, ca.file, clientCert, clientKey)
+	require.NoError(t, err)
+	assert.Equal(t, "agent-01", body)
+
+	_, err = get(t, url, ca.file, "", "")
+	assert.Error(t, err, "client certificate is required")
+
+	// Сертификат, выпущенный другим CA, не принимается
+	other := newTestCA(t, dir, "other")
+	otherCert, otherKey := other.issue(t, dir, "intruder", "intruder", 4)
+	_, err = get(t, url, ca.file, otherCert, otherKey)
+	assert.Error(t, err)
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t, dir, "ca")
+	certFile, keyFile := ca.issue(t, dir, "server", "first", 2)
+	r, err := NewCertReloader(certFile, keyFile)
+	require.NoError(t, err)
+	now := time.Now()
+	r.now = func() time.Time { return now }
+	leaf := func() string {
+		cert, err := x509.ParseCertificate(r.Certificate().Certificate[0])
+		require.NoError(t, err)
+		return cert.Subject.CommonName
+	}
+	assert.Equal(t, "first", leaf())
+
+	// Новый сертификат подхватывается после интервала проверки
+	ca.issue(t, dir, "server", "second", 3)
+	future := now.Add(time.Minute)
+	require.NoError(t, os.Chtimes(certFile, future, future))
+	require.NoError(t, os.Chtimes(keyFile, future, future))
+	assert.Equal(t, "first", leaf())
+	now = now.Add(reloadCheckInterval)
+	assert.Equal(t, "second", leaf())
+
+	// Битый файл не заменяет загруженный сертификат
+	require.NoError(t, os.WriteFile(certFile, []byte("broken"), 0600))
+	future = future.Add(time.Minute)
+	require.NoError(t, os.Chtimes(certFile, future, future))
+	now = now.Add(reloadCheckInterval)
+	assert.Equal(t, "second", leaf())
+}
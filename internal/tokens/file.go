@@ -0,0 +1,141 @@
+package tokens
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// FileStore хранилище описаний токенов в JSON файле. Файл перечитывается при изменении, поэтому токены,
+// созданные и отозванные командой "token", применяются работающим сервером без перезапуска
+type FileStore struct {
+	mu      sync.Mutex
+	path    string
+	modTime time.Time
+	size    int64
+	tokens  []Token
+}
+
+// NewFileStore хранилище в файле path. Отсутствующий файл считается пустым списком токенов
+func NewFileStore(path string) (*FileStore, error) {
+	s := &FileStore{path: path}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// reload чтение файла, если он изменился с последнего чтения. Вызывается под s.mu
+func (s *FileStore) reload() error {
+	info, err := os.Stat(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		s.tokens, s.modTime, s.size = nil, time.Time{}, 0
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("tokens: stat %s: %w", s.path, err)
+	}
+	if info.ModTime().Equal(s.modTime) && info.Size() == s.size {
+		return nil
+	}
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return fmt.Errorf("tokens: read %s: %w", s.path, err)
+	}
+	var tokens []Token
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &tokens); err != nil {
+			return fmt.Errorf("tokens: parse %s: %w", s.path, err)
+		}
+	}
+	s.tokens, s.modTime, s.size = tokens, info.ModTime(), info.Size()
+	return nil
+}
+
+// save запись токенов во временный файл с последующим переименованием. Вызывается под s.mu
+func (s *FileStore) save(tokens []Token) error {
+	data, err := json.MarshalIndent(tokens, "", "  ")
+	if err != nil {
+		return fmt.Errorf("tokens: marshal: %w", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return fmt.Errorf("tokens: create temp file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("tokens: write %s: %w", tmp.Name(), err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("tokens: write %s: %w", tmp.Name(), err)
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return fmt.Errorf("tokens: rename to %s: %w", s.path, err)
+	}
+	// Следующий вызов reload перечитает файл
+	s.modTime = time.Time{}
+	return s.reload()
+}
+
+func (s *FileStore) Lookup(_ context.Context, hash string) (Token, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.reload(); err != nil {
+		return Token{}, false, err
+	}
+	for _, t := range s.tokens {
+		if t.Hash == hash {
+			return t, true, nil
+		}
+	}
+	return Token{}, false, nil
+}
+
+func (s *FileStore) List(_ context.Context) ([]Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+	return append([]Token(nil), s.tokens...), nil
+}
+
+func (s *FileStore) Add(_ context.Context, t Token) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.reload(); err != nil {
+		return err
+	}
+	for _, old := range s.tokens {
+		if old.ID == t.ID {
+			return fmt.Errorf("tokens: duplicate token id %q", t.ID)
+		}
+	}
+	return s.save(append(append([]Token(nil), s.tokens...), t))
+}
+
+func (s *FileStore) Revoke(_ context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.reload(); err != nil {
+		return err
+	}
+	tokens := make([]Token, 0, len(s.tokens))
+	for _, t := range s.tokens {
+		if t.ID != id {
+			tokens = append(tokens, t)
+		}
+	}
+	if len(tokens) == len(s.tokens) {
+		return fmt.Errorf("%w: %s", ErrNotFound, id)
+	}
+	return s.save(tokens)
+}
@@ -0,0 +1,90 @@
+package tokens
+
+import (
+	"github.com/gin-gonic/gin"
+	"logger/internal/apperr"
+	"logger/internal/logging"
+	"strings"
+)
+
+// contextKey ключ описания токена запроса в gin.Context
+const contextKey = "tokens.token"
+
+// metricNameParam параметр route-а с именем метрики, например "/value/:metricType/:metricName"
+const metricNameParam = "metricName"
+
+// Middleware проверка bearer-токена запросов к route-ам routes (шаблон gin -> требуемая роль).
+// Запросы к остальным route-ам пропускаются без проверки. Если route содержит имя метрики, оно проверяется
+// по префиксам токена здесь же, имена метрик из тела запроса проверяет handler через AllowsMetric.
+// Неизвестный токен -- 401, недостаточная роль или метрика вне префиксов -- 403
+func Middleware(store Store, routes map[string]Role) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		need, ok := routes[c.FullPath()]
+		if !ok {
+			c.Next()
+			return
+		}
+		logger := logging.FromContext(c.Request.Context())
+
+		t, err := authenticate(c, store)
+		if err == nil && !t.Allows(need) {
+			err = apperr.Forbidden("tokens.Middleware", ErrRole)
+		}
+		if name := c.Param(metricNameParam); err == nil && name != "" && !t.AllowsMetric(name) {
+			err = apperr.Forbidden("tokens.Middleware", ErrScope)
+		}
+		if err != nil {
+			// Токен в лог не пишется
+			logger.Warnw("tokens.Middleware: access denied", "remote", c.ClientIP(), "route", c.FullPath(),
+				"token_id", t.ID, "need_role", need, "error", err)
+			apperr.WriteProblem(c, err)
+			return
+		}
+		SetContext(c, t)
+		c.Next()
+	}
+}
+
+// authenticate поиск описания токена из заголовка Authorization
+func authenticate(c *gin.Context, store Store) (Token, error) {
+	token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+	token = strings.TrimSpace(token)
+	if !ok || token == "" {
+		return Token{}, apperr.Unauthorized("tokens.Middleware", ErrNoToken)
+	}
+	t, ok, err := store.Lookup(c.Request.Context(), Hash(token))
+	if err != nil {
+		return Token{}, err
+	}
+	if !ok {
+		return Token{}, apperr.Unauthorized("tokens.Middleware", ErrUnknownToken)
+	}
+	return t, nil
+}
+
+// SetContext сохранение описания токена запроса в gin.Context
+func SetContext(c *gin.Context, t Token) {
+	c.Set(contextKey, t)
+}
+
+// FromContext описание токена запроса. ok == false, если проверка токенов отключена
+func FromContext(c *gin.Context) (Token, bool) {
+	v, ok := c.Get(contextKey)
+	if !ok {
+		return Token{}, false
+	}
+	t, ok := v.(Token)
+	return t, ok
+}
+
+// AllowsMetric true, если токен запроса разрешает доступ к метрике name или проверка токенов отключена
+func AllowsMetric(c *gin.Context, name string) bool {
+	t, ok := FromContext(c)
+	return !ok || t.AllowsMetric(name)
+}
+
+// Scoped true, если токен запроса ограничивает доступ префиксами имен метрик
+func Scoped(c *gin.Context) bool {
+	t, ok := FromContext(c)
+	return ok && len(t.Prefixes) > 0
+}
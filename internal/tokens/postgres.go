@@ -0,0 +1,100 @@
+package tokens
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"logger/internal/database"
+	"strings"
+)
+
+// PgStore хранилище описаний токенов в таблице PostgreSQL api_tokens. Токены общие для всех экземпляров
+// сервера с общей БД
+type PgStore struct {
+	db database.Database
+}
+
+// NewPgStore создание таблицы api_tokens при необходимости
+func NewPgStore(ctx context.Context, db database.Database) (*PgStore, error) {
+	sqlQuery := `CREATE TABLE IF NOT EXISTS api_tokens (
+		"id" TEXT PRIMARY KEY,
+		"hash" TEXT NOT NULL UNIQUE,
+		"role" TEXT NOT NULL,
+		"prefixes" TEXT NOT NULL DEFAULT '',
+		"comment" TEXT NOT NULL DEFAULT '',
+		"created_at" TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`
+	if _, err := db.ExecContext(ctx, sqlQuery); err != nil {
+		return nil, fmt.Errorf("tokens: create table api_tokens: %w", err)
+	}
+	return &PgStore{db: db}, nil
+}
+
+// Префиксы хранятся одной строкой через запятую
+func joinPrefixes(prefixes []string) string {
+	return strings.Join(prefixes, ",")
+}
+
+func splitPrefixes(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
+
+func (s *PgStore) Lookup(ctx context.Context, hash string) (Token, bool, error) {
+	sqlQuery := "SELECT id, hash, role, prefixes, comment, created_at FROM api_tokens WHERE hash = $1"
+	var t Token
+	var prefixes string
+	err := s.db.QueryRowContext(ctx, sqlQuery, hash).Scan(&t.ID, &t.Hash, &t.Role, &prefixes, &t.Comment, &t.Created)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Token{}, false, nil
+	}
+	if err != nil {
+		return Token{}, false, fmt.Errorf("tokens: lookup token: %w", err)
+	}
+	t.Prefixes = splitPrefixes(prefixes)
+	return t, true, nil
+}
+
+func (s *PgStore) List(ctx context.Context) ([]Token, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT id, hash, role, prefixes, comment, created_at FROM api_tokens ORDER BY created_at")
+	if err != nil {
+		return nil, fmt.Errorf("tokens: list tokens: %w", err)
+	}
+	defer rows.Close()
+	var tokens []Token
+	for rows.Next() {
+		var t Token
+		var prefixes string
+		if err := rows.Scan(&t.ID, &t.Hash, &t.Role, &prefixes, &t.Comment, &t.Created); err != nil {
+			return nil, fmt.Errorf("tokens: list tokens: %w", err)
+		}
+		t.Prefixes = splitPrefixes(prefixes)
+		tokens = append(tokens, t)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("tokens: list tokens: %w", err)
+	}
+	return tokens, nil
+}
+
+func (s *PgStore) Add(ctx context.Context, t Token) error {
+	sqlQuery := "INSERT INTO api_tokens (id, hash, role, prefixes, comment, created_at) VALUES($1,$2,$3,$4,$5,$6)"
+	if _, err := s.db.ExecContext(ctx, sqlQuery, t.ID, t.Hash, string(t.Role), joinPrefixes(t.Prefixes), t.Comment, t.Created); err != nil {
+		return fmt.Errorf("tokens: add token: %w", err)
+	}
+	return nil
+}
+
+func (s *PgStore) Revoke(ctx context.Context, id string) error {
+	res, err := s.db.ExecContext(ctx, "DELETE FROM api_tokens WHERE id = $1", id)
+	if err != nil {
+		return fmt.Errorf("tokens: revoke token: %w", err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("%w: %s", ErrNotFound, id)
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+// Package tokens bearer-токены клиентов сервера с ролями и ограничением доступа по префиксам имен метрик.
+// Клиент передает токен в заголовке "Authorization: Bearer <token>". Сервер хранит только SHA-256 хэш токена
+// в файле или в таблице PostgreSQL, поэтому утечка хранилища не раскрывает сами токены.
+// Токены создаются и отзываются командой сервера "token", см. cmd/server.
+package tokens
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Role роль токена
+type Role string
+
+const (
+	RoleReader Role = "reader" // Чтение метрик
+	RoleWriter Role = "writer" // Изменение метрик, выдается агентам
+	RoleAdmin  Role = "admin"  // Чтение и изменение метрик
+)
+
+var (
+	ErrNoToken      = errors.New("bearer token is missing")
+	ErrUnknownToken = errors.New("bearer token is unknown or revoked")
+	ErrRole         = errors.New("token role does not allow this request")
+	ErrScope        = errors.New("token scope does not allow this metric")
+	ErrNotFound     = errors.New("token not found")
+)
+
+// ParseRole разбор имени роли
+func ParseRole(s string) (Role, error) {
+	switch r := Role(s); r {
+	case RoleReader, RoleWriter, RoleAdmin:
+		return r, nil
+	default:
+		return "", fmt.Errorf("tokens: unknown role %q, must be reader, writer or admin", s)
+	}
+}
+
+// Token описание токена. Сам токен не хранится
+type Token struct {
+	ID       string    `json:"id"`                 // Идентификатор для просмотра и отзыва токена
+	Hash     string    `json:"hash"`               // SHA-256 токена в hex
+	Role     Role      `json:"role"`               // Роль
+	Prefixes []string  `json:"prefixes,omitempty"` // Разрешенные префиксы имен метрик. Пустой список -- все метрики
+	Comment  string    `json:"comment,omitempty"`  // Описание владельца токена, например имя агента
+	Created  time.Time `json:"created"`
+}
+
+// Allows true, если роль токена разрешает запрос, требующий роли need. Роль admin разрешает любой запрос
+func (t Token) Allows(need Role) bool {
+	return t.Role == RoleAdmin || t.Role == need
+}
+
+// AllowsMetric true, если имя метрики name входит в разрешенные префиксы токена
+func (t Token) AllowsMetric(name string) bool {
+	if len(t.Prefixes) == 0 {
+		return true
+	}
+	for _, p := range t.Prefixes {
+		if strings.HasPrefix(name, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// Store хранилище описаний токенов
+type Store interface {
+	// Lookup описание токена по хэшу hash. ok == false, если токен неизвестен или отозван
+	Lookup(ctx context.Context, hash string) (t Token, ok bool, err error)
+	List(ctx context.Context) ([]Token, error)
+	Add(ctx context.Context, t Token) error
+	// Revoke удаление токена по идентификатору. ErrNotFound, если токена нет
+	Revoke(ctx context.Context, id string) error
+}
+
+// Hash SHA-256 токена в hex
+func Hash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Generate создание нового токена с ролью role и префиксами prefixes. Возвращается сам токен,
+// который показывается один раз, и его описание для сохранения в Store
+func Generate(role Role, prefixes []string, comment string) (string, Token, error) {
+	id, err := randomHex(8)
+	if err != nil {
+		return "", Token{}, fmt.Errorf("tokens: generate id: %w", err)
+	}
+	secret, err := randomHex(32)
+	if err != nil {
+		return "", Token{}, fmt.Errorf("tokens: generate token: %w", err)
+	}
+	return secret, Token{
+		ID:       id,
+		Hash:     Hash(secret),
+		Role:     role,
+		Prefixes: prefixes,
+		Comment:  comment,
+		Created:  time.Now().UTC().Truncate(time.Second),
+	}, nil
+}
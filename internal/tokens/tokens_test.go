@@ -0,0 +1,114 @@
+package tokens
+
+import (
+	"context"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func TestToken_Allows(t *testing.T) {
+	writer := Token{Role: RoleWriter, Prefixes: []string{"app.", "Alloc"}}
+	assert.True(t, writer.Allows(RoleWriter))
+	assert.False(t, writer.Allows(RoleReader))
+	assert.True(t, Token{Role: RoleAdmin}.Allows(RoleReader))
+	assert.True(t, writer.AllowsMetric("app.requests"))
+	assert.True(t, writer.AllowsMetric("Alloc"))
+	assert.False(t, writer.AllowsMetric("HeapAlloc"))
+	assert.True(t, Token{Role: RoleReader}.AllowsMetric("anything"))
+
+	_, err := ParseRole("root")
+	assert.Error(t, err)
+}
+
+func TestFileStore(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "tokens.json")
+	s, err := NewFileStore(path)
+	require.NoError(t, err)
+
+	secret, tok, err := Generate(RoleWriter, []string{"app."}, "agent1")
+	require.NoError(t, err)
+	require.NoError(t, s.Add(ctx, tok))
+
+	// Второй экземпляр видит токен, добавленный первым -- как сервер после команды "token create"
+	other, err := NewFileStore(path)
+	require.NoError(t, err)
+	got, ok, err := other.Lookup(ctx, Hash(secret))
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, tok.ID, got.ID)
+	assert.Equal(t, []string{"app."}, got.Prefixes)
+	_, ok, err = other.Lookup(ctx, secret)
+	require.NoError(t, err)
+	assert.False(t, ok, "token must be looked up by hash only")
+
+	require.NoError(t, s.Revoke(ctx, tok.ID))
+	assert.ErrorIs(t, s.Revoke(ctx, tok.ID), ErrNotFound)
+	_, ok, err = other.Lookup(ctx, Hash(secret))
+	require.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func TestMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	ctx := context.Background()
+	s, err := NewFileStore(filepath.Join(t.TempDir(), "tokens.json"))
+	require.NoError(t, err)
+	add := func(role Role, prefixes ...string) string {
+		secret, tok, err := Generate(role, prefixes, "")
+		require.NoError(t, err)
+		require.NoError(t, s.Add(ctx, tok))
+		return secret
+	}
+	writer, reader, admin, scoped := add(RoleWriter), add(RoleReader), add(RoleAdmin), add(RoleReader, "app.")
+
+	router := gin.New()
+	router.Use(Middleware(s, map[string]Role{
+		"/update/:metricType/:metricName/:metricValue": RoleWriter,
+		"/value/:metricType/:metricName":               RoleReader,
+		"/internal/metrics":                            RoleAdmin,
+	}))
+	router.POST("/update/:metricType/:metricName/:metricValue", func(c *gin.Context) { c.Status(http.StatusOK) })
+	router.GET("/value/:metricType/:metricName", func(c *gin.Context) { c.Status(http.StatusOK) })
+	router.GET("/ping", func(c *gin.Context) { c.Status(http.StatusOK) })
+	router.GET("/internal/metrics", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	tests := []struct {
+		name     string
+		method   string
+		target   string
+		token    string
+		wantCode int
+	}{
+		{name: "unprotected route", method: http.MethodGet, target: "/ping", wantCode: http.StatusOK},
+		{name: "no token", method: http.MethodPost, target: "/update/gauge/Alloc/1", wantCode: http.StatusUnauthorized},
+		{name: "unknown token", method: http.MethodPost, target: "/update/gauge/Alloc/1", token: "bad", wantCode: http.StatusUnauthorized},
+		{name: "writer writes", method: http.MethodPost, target: "/update/gauge/Alloc/1", token: writer, wantCode: http.StatusOK},
+		{name: "writer reads", method: http.MethodGet, target: "/value/gauge/Alloc", token: writer, wantCode: http.StatusForbidden},
+		{name: "reader reads", method: http.MethodGet, target: "/value/gauge/Alloc", token: reader, wantCode: http.StatusOK},
+		{name: "reader writes", method: http.MethodPost, target: "/update/gauge/Alloc/1", token: reader, wantCode: http.StatusForbidden},
+		{name: "admin writes", method: http.MethodPost, target: "/update/gauge/Alloc/1", token: admin, wantCode: http.StatusOK},
+		{name: "scoped allowed", method: http.MethodGet, target: "/value/gauge/app.requests", token: scoped, wantCode: http.StatusOK},
+		{name: "admin route no token", method: http.MethodGet, target: "/internal/metrics", wantCode: http.StatusUnauthorized},
+		{name: "admin route reader", method: http.MethodGet, target: "/internal/metrics", token: reader, wantCode: http.StatusForbidden},
+		{name: "admin route writer", method: http.MethodGet, target: "/internal/metrics", token: writer, wantCode: http.StatusForbidden},
+		{name: "admin route admin", method: http.MethodGet, target: "/internal/metrics", token: admin, wantCode: http.StatusOK},
+		{name: "scoped denied", method: http.MethodGet, target: "/value/gauge/Alloc", token: scoped, wantCode: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.target, nil)
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			assert.Equal(t, tt.wantCode, w.Code)
+		})
+	}
+}
@@ -0,0 +1,85 @@
+package tracing
+
+import (
+	"context"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"logger/internal/handlers"
+	"logger/internal/storage"
+)
+
+// tracedStorage handlers.Storager со span-ом на каждую операцию
+type tracedStorage struct {
+	store   handlers.Storager
+	backend string
+}
+
+// InstrumentStorage обертка над хранилищем store, создающая span на каждую операцию под именем backend
+func InstrumentStorage(store handlers.Storager, backend string) handlers.Storager {
+	return tracedStorage{store: store, backend: backend}
+}
+
+func (s tracedStorage) start(ctx context.Context, method string) (context.Context, trace.Span) {
+	return Start(ctx, "storage."+method, trace.WithAttributes(attribute.String("storage.backend", s.backend)))
+}
+
+func (s tracedStorage) UpdateGauge(ctx context.Context, key string, value float64) error {
+	ctx, span := s.start(ctx, "UpdateGauge")
+	defer span.End()
+	err := s.store.UpdateGauge(ctx, key, value)
+	RecordError(span, err)
+	return err
+}
+
+func (s tracedStorage) UpdateCounter(ctx context.Context, key string, value int64) error {
+	ctx, span := s.start(ctx, "UpdateCounter")
+	defer span.End()
+	err := s.store.UpdateCounter(ctx, key, value)
+	RecordError(span, err)
+	return err
+}
+
+func (s tracedStorage) UpdateBatch(ctx context.Context, metrics []storage.Metrics) error {
+	ctx, span := s.start(ctx, "UpdateBatch")
+	defer span.End()
+	span.SetAttributes(attribute.Int("storage.batch_size", len(metrics)))
+	err := s.store.UpdateBatch(ctx, metrics)
+	RecordError(span, err)
+	return err
+}
+
+func (s tracedStorage) GetGauge(ctx context.Context, key string) (float64, error) {
+	ctx, span := s.start(ctx, "GetGauge")
+	defer span.End()
+	v, err := s.store.GetGauge(ctx, key)
+	RecordError(span, err)
+	return v, err
+}
+
+func (s tracedStorage) GetCounter(ctx context.Context, key string) (int64, error) {
+	ctx, span := s.start(ctx, "GetCounter")
+	defer span.End()
+	v, err := s.store.GetCounter(ctx, key)
+	RecordError(span, err)
+	return v, err
+}
+
+func (s tracedStorage) GetValue(ctx context.Context, t string, key string) (any, error) {
+	ctx, span := s.start(ctx, "GetValue")
+	defer span.End()
+	v, err := s.store.GetValue(ctx, t, key)
+	RecordError(span, err)
+	return v, err
+}
+
+func (s tracedStorage) GetAllMetrics(ctx context.Context) (any, error) {
+	ctx, span := s.start(ctx, "GetAllMetrics")
+	defer span.End()
+	v, err := s.store.GetAllMetrics(ctx)
+	RecordError(span, err)
+	return v, err
+}
+
+func (s tracedStorage) Close() error {
+	return s.store.Close()
+}
@@ -0,0 +1,136 @@
+// Package tracing трассировка OpenTelemetry агента и сервера. Контекст трассировки передается
+// от агента серверу в заголовке traceparent (W3C Trace Context). На сервере span-ы создаются для запроса,
+// middleware, обработчика, операции хранилища и SQL-запроса к PostgreSQL.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"net/http"
+	"strings"
+)
+
+// Name имя tracer-а
+const Name = "logger"
+
+// Exporter-ы span-ов
+const (
+	ExporterNone   = "none"
+	ExporterStdout = "stdout"
+	ExporterOTLP   = "otlp"
+)
+
+// Config параметры трассировки
+type Config struct {
+	Exporter    string // none, stdout или otlp. По умолчанию none -- span-ы не экспортируются
+	Endpoint    string // URL OTLP/HTTP collector-а, например http://localhost:4318. Пустая строка -- значение по умолчанию OTLP
+	ServiceName string // Имя сервиса в span-ах
+}
+
+// Init установка глобальных TracerProvider и propagator-а согласно cfg.
+// Возвращаемая функция выгружает накопленные span-ы и должна быть вызвана при остановке процесса
+func Init(ctx context.Context, cfg Config) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	var exp sdktrace.SpanExporter
+	var err error
+	switch strings.ToLower(cfg.Exporter) {
+	case "", ExporterNone:
+		return func(context.Context) error { return nil }, nil
+	case ExporterStdout:
+		exp, err = stdouttrace.New()
+	case ExporterOTLP:
+		var opts []otlptracehttp.Option
+		if cfg.Endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpointURL(cfg.Endpoint))
+		}
+		exp, err = otlptracehttp.New(ctx, opts...)
+	default:
+		return nil, fmt.Errorf("tracing: unknown exporter %q, must be none, stdout or otlp", cfg.Exporter)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("tracing: create %s exporter: %w", cfg.Exporter, err)
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", cfg.ServiceName))),
+	)
+	otel.SetTracerProvider(tp)
+	return tp.Shutdown, nil
+}
+
+// Start создание дочернего span-а name глобального TracerProvider-а
+func Start(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	return otel.Tracer(Name).Start(ctx, name, opts...)
+}
+
+// RecordError отметка span-а как завершившегося ошибкой err. При err == nil ничего не делает
+func RecordError(span trace.Span, err error) {
+	if err == nil {
+		return
+	}
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
+
+// Inject запись контекста трассировки ctx в заголовки запроса h
+func Inject(ctx context.Context, h http.Header) {
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(h))
+}
+
+// recordStatus отметка span-а как завершившегося ошибкой при ответе 5xx
+func recordStatus(span trace.Span, status int) {
+	if status >= http.StatusInternalServerError {
+		span.SetStatus(codes.Error, http.StatusText(status))
+	}
+}
+
+// Middleware span запроса. Контекст трассировки агента берется из заголовка traceparent,
+// span называется по шаблону route-а, а не по URL
+func Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := otel.GetTextMapPropagator().Extract(c.Request.Context(), propagation.HeaderCarrier(c.Request.Header))
+		route := c.FullPath()
+		if route == "" {
+			route = "NoRoute"
+		}
+		ctx, span := Start(ctx, c.Request.Method+" "+route,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.request.method", c.Request.Method),
+				attribute.String("http.route", route),
+			))
+		defer span.End()
+		c.Request = c.Request.WithContext(ctx)
+
+		c.Next()
+
+		status := c.Writer.Status()
+		span.SetAttributes(attribute.Int("http.response.status_code", status))
+		recordStatus(span, status)
+	}
+}
+
+// Handler обертка над обработчиком h, создающая span name. Span передается обработчику в контексте c.Request
+func Handler(name string, h gin.HandlerFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx, span := Start(c.Request.Context(), name)
+		defer span.End()
+		c.Request = c.Request.WithContext(ctx)
+
+		h(c)
+
+		recordStatus(span, c.Writer.Status())
+	}
+}
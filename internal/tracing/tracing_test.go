@@ -0,0 +1,125 @@
+package tracing
+
+import (
+	"context"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"logger/internal/storage/memstorage"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// useRecorder установка TracerProvider-а, сохраняющего span-ы в памяти, на время теста
+func useRecorder(t *testing.T) *tracetest.SpanRecorder {
+	sr := tracetest.NewSpanRecorder()
+	tp, prop := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() {
+		otel.SetTracerProvider(tp)
+		otel.SetTextMapPropagator(prop)
+	})
+	return sr
+}
+
+func TestInit(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     Config
+		wantErr bool
+	}{
+		{name: "default is none", cfg: Config{}},
+		{name: "none", cfg: Config{Exporter: ExporterNone}},
+		{name: "stdout", cfg: Config{Exporter: ExporterStdout, ServiceName: "test"}},
+		{name: "unknown exporter", cfg: Config{Exporter: "jaeger"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tp := otel.GetTracerProvider()
+			defer otel.SetTracerProvider(tp)
+			shutdown, err := Init(context.Background(), tt.cfg)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.NoError(t, shutdown(context.Background()))
+		})
+	}
+}
+
+func TestMiddleware_SpanChain(t *testing.T) {
+	sr := useRecorder(t)
+	gin.SetMode(gin.TestMode)
+	ms, err := memstorage.New(context.Background())
+	require.NoError(t, err)
+	store := InstrumentStorage(ms, "memstorage")
+
+	router := gin.New()
+	router.Use(Middleware())
+	router.POST("/update/:metricName", Handler("handlers.Update", func(c *gin.Context) {
+		if err := store.UpdateGauge(c.Request.Context(), c.Param("metricName"), 1); err != nil {
+			c.Status(http.StatusInternalServerError)
+			return
+		}
+		c.Status(http.StatusOK)
+	}))
+
+	// Контекст трассировки агента
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	req := httptest.NewRequest(http.MethodPost, "/update/Alloc", nil)
+	req.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	// Span-ы завершаются в порядке storage, handler, запрос
+	spans := sr.Ended()
+	require.Len(t, spans, 3)
+	storageSpan, handlerSpan, serverSpan := spans[0], spans[1], spans[2]
+	assert.Equal(t, "storage.UpdateGauge", storageSpan.Name())
+	assert.Equal(t, "handlers.Update", handlerSpan.Name())
+	assert.Equal(t, "POST /update/:metricName", serverSpan.Name())
+	for _, s := range spans {
+		assert.Equal(t, traceID, s.SpanContext().TraceID().String())
+	}
+	assert.Equal(t, "00f067aa0ba902b7", serverSpan.Parent().SpanID().String())
+	assert.True(t, serverSpan.Parent().IsRemote())
+	assert.Equal(t, serverSpan.SpanContext().SpanID(), handlerSpan.Parent().SpanID())
+	assert.Equal(t, handlerSpan.SpanContext().SpanID(), storageSpan.Parent().SpanID())
+}
+
+func TestStorage_RecordError(t *testing.T) {
+	sr := useRecorder(t)
+	ms, err := memstorage.New(context.Background())
+	require.NoError(t, err)
+	store := InstrumentStorage(ms, "memstorage")
+
+	_, err = store.GetGauge(context.Background(), "missing")
+	require.Error(t, err)
+
+	spans := sr.Ended()
+	require.Len(t, spans, 1)
+	assert.Equal(t, "storage.GetGauge", spans[0].Name())
+	assert.Equal(t, codes.Error, spans[0].Status().Code)
+	assert.Len(t, spans[0].Events(), 1)
+}
+
+func TestInject(t *testing.T) {
+	useRecorder(t)
+	h := http.Header{}
+	Inject(context.Background(), h)
+	assert.Empty(t, h.Get("traceparent"))
+
+	ctx, span := Start(context.Background(), "agent.SendRequest")
+	defer span.End()
+	Inject(ctx, h)
+	assert.Contains(t, h.Get("traceparent"), span.SpanContext().TraceID().String())
+}
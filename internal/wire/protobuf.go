@@ -0,0 +1,123 @@
+package wire
+
+import (
+	"errors"
+	"fmt"
+	"google.golang.org/protobuf/encoding/protowire"
+	"logger/internal/storage"
+	"math"
+)
+
+// Номера полей из metrics.proto
+const (
+	fieldID      protowire.Number = 1
+	fieldType    protowire.Number = 2
+	fieldDelta   protowire.Number = 3
+	fieldValue   protowire.Number = 4
+	fieldMetrics protowire.Number = 1
+)
+
+// errWireType тип поля не соответствует схеме
+var errWireType = errors.New("unexpected wire type")
+
+// appendMetric кодирование сообщения Metric
+func appendMetric(b []byte, m storage.Metrics) []byte {
+	if m.ID != "" {
+		b = protowire.AppendTag(b, fieldID, protowire.BytesType)
+		b = protowire.AppendString(b, m.ID)
+	}
+	if m.MType != "" {
+		b = protowire.AppendTag(b, fieldType, protowire.BytesType)
+		b = protowire.AppendString(b, m.MType)
+	}
+	if m.Delta != nil {
+		b = protowire.AppendTag(b, fieldDelta, protowire.VarintType)
+		b = protowire.AppendVarint(b, protowire.EncodeZigZag(*m.Delta))
+	}
+	if m.Value != nil {
+		b = protowire.AppendTag(b, fieldValue, protowire.Fixed64Type)
+		b = protowire.AppendFixed64(b, math.Float64bits(*m.Value))
+	}
+	return b
+}
+
+// consumeMetric разбор сообщения Metric. Неизвестные поля пропускаются
+func consumeMetric(b []byte) (storage.Metrics, error) {
+	var m storage.Metrics
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return m, protowire.ParseError(n)
+		}
+		b = b[n:]
+		switch {
+		case num == fieldID && typ == protowire.BytesType:
+			m.ID, n = protowire.ConsumeString(b)
+		case num == fieldType && typ == protowire.BytesType:
+			m.MType, n = protowire.ConsumeString(b)
+		case num == fieldDelta && typ == protowire.VarintType:
+			var v uint64
+			v, n = protowire.ConsumeVarint(b)
+			delta := protowire.DecodeZigZag(v)
+			m.Delta = &delta
+		case num == fieldValue && typ == protowire.Fixed64Type:
+			var v uint64
+			v, n = protowire.ConsumeFixed64(b)
+			value := math.Float64frombits(v)
+			m.Value = &value
+		case num >= fieldID && num <= fieldValue:
+			return m, fmt.Errorf("field %d: %w %d", num, errWireType, typ)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return m, protowire.ParseError(n)
+		}
+		b = b[n:]
+	}
+	return m, nil
+}
+
+// appendMetricList кодирование сообщения MetricList
+func appendMetricList(b []byte, metrics []storage.Metrics) []byte {
+	var item []byte
+	for _, m := range metrics {
+		item = appendMetric(item[:0], m)
+		b = protowire.AppendTag(b, fieldMetrics, protowire.BytesType)
+		b = protowire.AppendBytes(b, item)
+	}
+	return b
+}
+
+// consumeMetricList разбор сообщения MetricList. Неизвестные поля пропускаются
+func consumeMetricList(b []byte) ([]storage.Metrics, error) {
+	metrics := []storage.Metrics{}
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		b = b[n:]
+		if num != fieldMetrics {
+			if n = protowire.ConsumeFieldValue(num, typ, b); n < 0 {
+				return nil, protowire.ParseError(n)
+			}
+			b = b[n:]
+			continue
+		}
+		if typ != protowire.BytesType {
+			return nil, fmt.Errorf("field %d: %w %d", num, errWireType, typ)
+		}
+		item, n := protowire.ConsumeBytes(b)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		m, err := consumeMetric(item)
+		if err != nil {
+			return nil, fmt.Errorf("metric %d: %w", len(metrics), err)
+		}
+		metrics = append(metrics, m)
+		b = b[n:]
+	}
+	return metrics, nil
+}
@@ -0,0 +1,165 @@
+// Package wire форматы тел запросов и ответов с метриками: JSON, Protobuf (схема в metrics.proto) и MessagePack.
+// Формат тела запроса задается Content-Type, формат ответа -- Accept, а если клиент его не указал --
+// совпадает с форматом запроса. JSON -- формат по умолчанию.
+package wire
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/ugorji/go/codec"
+	"logger/internal/storage"
+	"mime"
+	"strconv"
+	"strings"
+)
+
+// Content-Type поддерживаемых форматов
+const (
+	JSON     = "application/json"
+	Protobuf = "application/x-protobuf"
+	MsgPack  = "application/msgpack"
+)
+
+// ErrUnsupportedFormat неизвестный формат тела
+var ErrUnsupportedFormat = errors.New("unsupported format")
+
+// aliases альтернативные Content-Type форматов
+var aliases = map[string]string{
+	JSON:                              JSON,
+	Protobuf:                          Protobuf,
+	"application/protobuf":            Protobuf,
+	"application/vnd.google.protobuf": Protobuf,
+	MsgPack:                           MsgPack,
+	"application/x-msgpack":           MsgPack,
+	"application/vnd.msgpack":         MsgPack,
+}
+
+// names короткие имена форматов для настройки агента
+var names = map[string]string{
+	"json":     JSON,
+	"protobuf": Protobuf,
+	"proto":    Protobuf,
+	"msgpack":  MsgPack,
+}
+
+// msgpackHandle настройки MessagePack: имена полей берутся из json тегов storage.Metrics
+var msgpackHandle codec.MsgpackHandle
+
+// Parse формат по заголовку Content-Type. Пустой заголовок -- JSON
+func Parse(contentType string) (string, error) {
+	if strings.TrimSpace(contentType) == "" {
+		return JSON, nil
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return "", fmt.Errorf("%w %q: %v", ErrUnsupportedFormat, contentType, err)
+	}
+	if f, ok := aliases[mediaType]; ok {
+		return f, nil
+	}
+	return "", fmt.Errorf("%w %q", ErrUnsupportedFormat, contentType)
+}
+
+// ByName формат по короткому имени json, protobuf или msgpack либо по Content-Type
+func ByName(name string) (string, error) {
+	if f, ok := names[strings.ToLower(strings.TrimSpace(name))]; ok {
+		return f, nil
+	}
+	return Parse(name)
+}
+
+// Negotiate формат ответа по заголовку Accept: поддерживаемый формат с наибольшим q-value.
+// Если Accept пуст, допускает любой формат или не содержит поддерживаемых -- fallback
+func Negotiate(accept string, fallback string) string {
+	best, bestQ := fallback, 0.0
+	for _, item := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(item))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		f, ok := aliases[mediaType]
+		if !ok {
+			if mediaType != "*/*" && mediaType != "application/*" {
+				continue
+			}
+			f = fallback
+		}
+		if q > bestQ {
+			best, bestQ = f, q
+		}
+	}
+	return best
+}
+
+// MarshalMetric кодирование метрики в формате format
+func MarshalMetric(format string, m storage.Metrics) ([]byte, error) {
+	switch format {
+	case JSON:
+		return json.Marshal(m)
+	case Protobuf:
+		return appendMetric(nil, m), nil
+	case MsgPack:
+		var b []byte
+		err := codec.NewEncoderBytes(&b, &msgpackHandle).Encode(m)
+		return b, err
+	default:
+		return nil, fmt.Errorf("%w %q", ErrUnsupportedFormat, format)
+	}
+}
+
+// UnmarshalMetric разбор метрики в формате format
+func UnmarshalMetric(format string, data []byte) (storage.Metrics, error) {
+	var m storage.Metrics
+	switch format {
+	case JSON:
+		err := json.Unmarshal(data, &m)
+		return m, err
+	case Protobuf:
+		return consumeMetric(data)
+	case MsgPack:
+		err := codec.NewDecoderBytes(data, &msgpackHandle).Decode(&m)
+		return m, err
+	default:
+		return m, fmt.Errorf("%w %q", ErrUnsupportedFormat, format)
+	}
+}
+
+// MarshalMetrics кодирование списка метрик в формате format
+func MarshalMetrics(format string, metrics []storage.Metrics) ([]byte, error) {
+	switch format {
+	case JSON:
+		return json.Marshal(metrics)
+	case Protobuf:
+		return appendMetricList(nil, metrics), nil
+	case MsgPack:
+		var b []byte
+		err := codec.NewEncoderBytes(&b, &msgpackHandle).Encode(metrics)
+		return b, err
+	default:
+		return nil, fmt.Errorf("%w %q", ErrUnsupportedFormat, format)
+	}
+}
+
+// UnmarshalMetrics разбор списка метрик в формате format
+func UnmarshalMetrics(format string, data []byte) ([]storage.Metrics, error) {
+	var metrics []storage.Metrics
+	switch format {
+	case JSON:
+		err := json.Unmarshal(data, &metrics)
+		return metrics, err
+	case Protobuf:
+		return consumeMetricList(data)
+	case MsgPack:
+		err := codec.NewDecoderBytes(data, &msgpackHandle).Decode(&metrics)
+		return metrics, err
+	default:
+		return nil, fmt.Errorf("%w %q", ErrUnsupportedFormat, format)
+	}
+}
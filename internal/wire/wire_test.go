@@ -0,0 +1,97 @@
+package wire
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"logger/internal/storage"
+	"testing"
+)
+
+func ptr[T any](v T) *T { return &v }
+
+func TestMarshalMetrics(t *testing.T) {
+	metrics := []storage.Metrics{
+		{ID: "Alloc", MType: "gauge", Value: ptr(1.5)},
+		{ID: "PollCount", MType: "counter", Delta: ptr(int64(-3))},
+		{ID: "Zero", MType: "gauge", Value: ptr(0.0)},
+	}
+	for _, format := range []string{JSON, Protobuf, MsgPack} {
+		t.Run(format, func(t *testing.T) {
+			data, err := MarshalMetrics(format, metrics)
+			require.NoError(t, err)
+			got, err := UnmarshalMetrics(format, data)
+			require.NoError(t, err)
+			assert.Equal(t, metrics, got)
+
+			one, err := MarshalMetric(format, metrics[1])
+			require.NoError(t, err)
+			m, err := UnmarshalMetric(format, one)
+			require.NoError(t, err)
+			assert.Equal(t, metrics[1], m)
+		})
+	}
+
+	_, err := MarshalMetrics("text/plain", metrics)
+	assert.ErrorIs(t, err, ErrUnsupportedFormat)
+}
+
+func TestMsgPack_FieldNames(t *testing.T) {
+	data, err := MarshalMetric(MsgPack, storage.Metrics{ID: "Alloc", MType: "gauge", Value: ptr(1.0)})
+	require.NoError(t, err)
+	// Имена полей совпадают с JSON, пустой delta не кодируется
+	assert.True(t, bytes.Contains(data, []byte("type")))
+	assert.False(t, bytes.Contains(data, []byte("delta")))
+	assert.False(t, bytes.Contains(data, []byte("MType")))
+}
+
+func TestProtobuf(t *testing.T) {
+	// Unknown поле 9 пропускается
+	data := append(appendMetric(nil, storage.Metrics{ID: "a", MType: "counter", Delta: ptr(int64(7))}), 0x48, 0x01)
+	m, err := UnmarshalMetric(Protobuf, data)
+	require.NoError(t, err)
+	assert.Equal(t, int64(7), *m.Delta)
+	assert.Nil(t, m.Value)
+
+	_, err = UnmarshalMetrics(Protobuf, []byte{0x0a, 0x05, 0x0a})
+	assert.Error(t, err, "truncated message")
+
+	metrics, err := UnmarshalMetrics(Protobuf, nil)
+	require.NoError(t, err)
+	assert.Empty(t, metrics)
+}
+
+func TestNegotiate(t *testing.T) {
+	tests := []struct {
+		accept   string
+		fallback string
+		want     string
+	}{
+		{accept: "", fallback: JSON, want: JSON},
+		{accept: "", fallback: Protobuf, want: Protobuf},
+		{accept: "*/*", fallback: MsgPack, want: MsgPack},
+		{accept: "application/x-protobuf", fallback: JSON, want: Protobuf},
+		{accept: "application/json;q=0.5, application/msgpack", fallback: JSON, want: MsgPack},
+		{accept: "text/html", fallback: JSON, want: JSON},
+		{accept: "application/x-msgpack, */*;q=0.1", fallback: JSON, want: MsgPack},
+	}
+	for _, tt := range tests {
+		t.Run(tt.accept, func(t *testing.T) {
+			assert.Equal(t, tt.want, Negotiate(tt.accept, tt.fallback))
+		})
+	}
+}
+
+func TestParse(t *testing.T) {
+	f, err := Parse("application/json; charset=utf-8")
+	require.NoError(t, err)
+	assert.Equal(t, JSON, f)
+	f, err = Parse("")
+	require.NoError(t, err)
+	assert.Equal(t, JSON, f)
+	f, err = ByName("msgpack")
+	require.NoError(t, err)
+	assert.Equal(t, MsgPack, f)
+	_, err = Parse("text/plain")
+	assert.ErrorIs(t, err, ErrUnsupportedFormat)
+}